@@ -0,0 +1,348 @@
+// Package agents hands queued runs out to the agents that run them.
+// Agents register with labels describing what they can run, then keep
+// sending heartbeats. Idle agents are leased the oldest queued run they
+// have the labels for on their next heartbeat, and runs whose agents stop
+// sending heartbeats go back to the queue once their lease runs out.
+//
+// Cancelled runs are left for their agent to stop, and are cancelled
+// without it if it takes too long. Runs that go on for longer than their
+// timeout are failed.
+package agents
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/run-ci/run-server/metrics"
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/store"
+	"github.com/sirupsen/logrus"
+)
+
+var logger *logrus.Entry
+
+var leased = metrics.NewCounterVec("run_agent_leases_total",
+	"Runs leased to agents.")
+
+func init() {
+	logger = logrus.WithField("package", "agents")
+}
+
+// DefaultLeaseTimeout is how long agents can go without a heartbeat before
+// the run they hold goes back to the queue.
+const DefaultLeaseTimeout = time.Minute
+
+// DefaultCancelTimeout is how long agents have to stop a cancelled run
+// before it's cancelled without them.
+const DefaultCancelTimeout = time.Minute
+
+// Group is the queue group servers consume registrations and heartbeats
+// in, so that each one is only handled once.
+const Group = "run-server"
+
+// ErrLeaseLost is returned for heartbeats about a run the agent no longer
+// holds the lease of, because it ran out and the run went to someone else.
+var ErrLeaseLost = errors.New("agent doesn't hold the lease of that run")
+
+var idRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,254}$`)
+
+// JobSubject is the subject jobs leased to the agent with the given ID are
+// published on.
+func JobSubject(agentID string) string {
+	return queue.SubjectJobs + "." + agentID
+}
+
+// CancelSubject is the subject the agent with the given ID is told to stop
+// runs on.
+func CancelSubject(agentID string) string {
+	return JobSubject(agentID) + ".cancel"
+}
+
+// Cancel tells an agent to stop a run. Agents should stop it gracefully
+// and report it cancelled in their next heartbeat. If Force is set, the
+// run is already over as far as the server is concerned, because the
+// agent took too long to stop it or it ran out of time, and should be
+// killed outright.
+type Cancel struct {
+	RunID int  `json:"run_id"`
+	Force bool `json:"force"`
+}
+
+// Job tells an agent about a run it should run. Jobs never carry task
+// definitions, however the run was started or however many times it's
+// been leased. Agents read them from the task files in ConfigPath once
+// they have the commit checked out, which for runs of a single task is
+// the commit the server read the task from.
+//
+// Jobs without a Task are runs of the whole pipeline, like the ones
+// pushes trigger. Agents run every task in ConfigPath for them, in order
+// of their names, each as a step of its own.
+type Job struct {
+	RunID      int               `json:"run_id"`
+	Remote     string            `json:"remote"`
+	Branch     string            `json:"branch"`
+	Commit     string            `json:"commit"`
+	ConfigPath string            `json:"config_path"`
+	Task       string            `json:"task"`
+	Arguments  map[string]string `json:"arguments"`
+	Labels     []string          `json:"labels,omitempty"`
+
+	// Cancel is set once the run has been cancelled, so agents that
+	// missed the Cancel message hear about it in their next heartbeat.
+	Cancel bool `json:"cancel,omitempty"`
+}
+
+// Heartbeat is what agents send to say they're still around. Busy agents
+// say which run they're running and how it's going, and report the final
+// status of the run in their first heartbeat after it's done.
+type Heartbeat struct {
+	AgentID string          `json:"agent_id"`
+	RunID   int             `json:"run_id"`
+	Status  store.RunStatus `json:"status"`
+}
+
+// Validate returns an error if the heartbeat doesn't make sense.
+func (hb Heartbeat) Validate() error {
+	if !ValidID(hb.AgentID) {
+		return fmt.Errorf("invalid agent ID %q", hb.AgentID)
+	}
+
+	if hb.RunID == 0 {
+		if hb.Status != "" {
+			return errors.New("status given without a run")
+		}
+		return nil
+	}
+
+	if hb.Status != store.RunRunning && !hb.Status.Done() {
+		return fmt.Errorf("invalid run status %q", hb.Status)
+	}
+
+	return nil
+}
+
+// ValidID returns whether `id` can be the ID of an agent. IDs end up in
+// subjects on the queue, so they're kept to a single token.
+func ValidID(id string) bool {
+	return idRE.MatchString(id)
+}
+
+// NormalizeLabels returns `labels` sorted and without repeats. It returns
+// an error for labels that are empty or have whitespace in them.
+func NormalizeLabels(labels []string) ([]string, error) {
+	seen := map[string]bool{}
+	normalized := []string{}
+
+	for _, label := range labels {
+		if label == "" || strings.IndexFunc(label, isSpace) >= 0 {
+			return nil, fmt.Errorf("invalid label %q", label)
+		}
+
+		if seen[label] {
+			continue
+		}
+		seen[label] = true
+
+		normalized = append(normalized, label)
+	}
+
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+// Dispatcher registers agents, records their heartbeats and leases them
+// runs.
+type Dispatcher struct {
+	st  store.Repo
+	bus queue.Bus
+
+	// LeaseTimeout is how long a lease lasts after the heartbeat that
+	// last extended it.
+	LeaseTimeout time.Duration
+}
+
+// NewDispatcher returns a Dispatcher leasing the runs in `st` and
+// publishing jobs on `bus`.
+func NewDispatcher(st store.Repo, bus queue.Bus) *Dispatcher {
+	return &Dispatcher{
+		st:  st,
+		bus: bus,
+
+		LeaseTimeout: DefaultLeaseTimeout,
+	}
+}
+
+// Register saves `agent`, or updates it if it has registered before.
+func (d *Dispatcher) Register(agent store.Agent) (store.Agent, error) {
+	if !ValidID(agent.ID) {
+		return agent, fmt.Errorf("invalid agent ID %q", agent.ID)
+	}
+
+	labels, err := NormalizeLabels(agent.Labels)
+	if err != nil {
+		return agent, err
+	}
+	agent.Labels = labels
+
+	agent, err = d.st.RegisterAgent(agent)
+	if err != nil {
+		return agent, err
+	}
+
+	logger.WithFields(logrus.Fields{
+		"agent_id": agent.ID,
+		"labels":   agent.Labels,
+	}).Info("registered agent")
+
+	return agent, nil
+}
+
+// Heartbeat records `hb` and returns the agent along with the job it
+// should be running, if any. Agents that just finished a run have its
+// status saved, and idle agents are leased a run if there's one they can
+// run. Newly leased jobs are also published on the agent's JobSubject.
+func (d *Dispatcher) Heartbeat(hb Heartbeat) (store.Agent, *Job, error) {
+	logger := logger.WithField("agent_id", hb.AgentID)
+
+	if err := hb.Validate(); err != nil {
+		return store.Agent{}, nil, err
+	}
+
+	agent, err := d.st.HeartbeatAgent(hb.AgentID, d.LeaseTimeout)
+	if err != nil {
+		return agent, nil, err
+	}
+
+	if hb.RunID != 0 {
+		logger = logger.WithField("run_id", hb.RunID)
+
+		if agent.RunID != hb.RunID {
+			logger.Warn("agent reported on a run it doesn't hold")
+			return agent, nil, ErrLeaseLost
+		}
+
+		if hb.Status.Done() {
+			if _, err := d.st.UpdateRunStatus(hb.RunID, hb.Status); err != nil {
+				logger.WithField("error", err).Error("unable to save run status")
+				return agent, nil, err
+			}
+
+			logger.Infof("run %v", hb.Status)
+			agent.RunID = 0
+		}
+	}
+
+	// Agents that are busy already have their job, so it isn't published
+	// again. It's still returned for agents that lost track of it.
+	if agent.RunID != 0 {
+		run, err := d.st.GetRun(agent.RunID)
+		if err != nil {
+			return agent, nil, err
+		}
+
+		job := NewJob(d.st, run)
+		return agent, &job, nil
+	}
+
+	run, err := d.st.LeaseRun(agent.ID, d.LeaseTimeout)
+	if err == store.ErrNotFound {
+		return agent, nil, nil
+	}
+	if err != nil {
+		logger.WithField("error", err).Error("unable to lease run")
+		return agent, nil, err
+	}
+
+	leased.Inc()
+	logger.WithField("run_id", run.ID).Info("leased run")
+
+	agent.RunID = run.ID
+	job := NewJob(d.st, run)
+
+	// The lease is saved whether or not the agent hears about it here,
+	// since it gets the job in the response to its heartbeat too.
+	if err := publish(d.bus, JobSubject(agent.ID), job); err != nil {
+		logger.WithField("error", err).Warn("unable to publish job")
+	}
+
+	return agent, &job, nil
+}
+
+// Cancel cancels the run with the given ID and returns it. Queued runs
+// are cancelled straight away. Running runs are left cancelling, and the
+// agent running them is told to stop them on its CancelSubject.
+func (d *Dispatcher) Cancel(runID int) (store.Run, error) {
+	logger := logger.WithField("run_id", runID)
+
+	run, err := d.st.CancelRun(runID)
+	if err != nil {
+		return run, err
+	}
+
+	if run.Status != store.RunCancelling {
+		logger.Info("cancelled queued run")
+		return run, nil
+	}
+
+	logger = logger.WithField("agent_id", run.AgentID)
+	logger.Info("asking agent to stop run")
+
+	// The run stays cancelling either way, and agents find out from
+	// their next heartbeat if they miss this.
+	if err := publishCancel(d.bus, run.AgentID, Cancel{RunID: run.ID}); err != nil {
+		logger.WithField("error", err).Warn("unable to publish cancellation")
+	}
+
+	return run, nil
+}
+
+// NewJob returns the Job for `run`, which is cloned from its project's URL
+// and has its tasks in the project's config path if the project is still
+// around.
+func NewJob(st store.Repo, run store.Run) Job {
+	job := Job{
+		RunID:      run.ID,
+		Remote:     run.Remote,
+		Branch:     run.Branch,
+		Commit:     run.Commit,
+		ConfigPath: store.DefaultConfigPath,
+		Task:       run.Task,
+		Arguments:  run.Args,
+		Labels:     run.Labels,
+		Cancel:     run.Status == store.RunCancelling,
+	}
+
+	if p, err := st.GetProjectByRemote(run.Remote); err == nil {
+		job.Remote = p.CloneURL()
+		job.ConfigPath = p.ConfigPath
+	}
+
+	return job
+}
+
+func publish(bus queue.Bus, subj string, job Job) error {
+	buf, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	return bus.Publish(subj, buf)
+}
+
+func publishCancel(bus queue.Bus, agentID string, cancel Cancel) error {
+	buf, err := json.Marshal(cancel)
+	if err != nil {
+		return err
+	}
+
+	return bus.Publish(CancelSubject(agentID), buf)
+}
@@ -0,0 +1,356 @@
+package agents
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/store"
+)
+
+func newDispatcher(t *testing.T) (*Dispatcher, *store.Memory, *queue.Memory) {
+	st := store.NewMemory()
+	bus := queue.NewMemory()
+
+	for _, labels := range [][]string{{"os=darwin"}, nil} {
+		_, err := st.CreateRun(store.Run{
+			Remote:  "example.com/a",
+			Branch:  "master",
+			Commit:  "abc123",
+			Trigger: "push",
+			Labels:  labels,
+		})
+		if err != nil {
+			t.Fatalf("got error creating run: %v", err)
+		}
+	}
+
+	return NewDispatcher(st, bus), st, bus
+}
+
+func TestNormalizeLabels(t *testing.T) {
+	labels, err := NormalizeLabels([]string{"os=linux", "docker", "os=linux"})
+	if err != nil {
+		t.Fatalf("got error normalizing labels: %v", err)
+	}
+
+	if len(labels) != 2 || labels[0] != "docker" || labels[1] != "os=linux" {
+		t.Fatalf("expected sorted labels without repeats, got %v", labels)
+	}
+
+	for _, bad := range []string{"", "os linux", "os\tlinux"} {
+		if _, err := NormalizeLabels([]string{bad}); err == nil {
+			t.Fatalf("expected error for label %q", bad)
+		}
+	}
+}
+
+func TestHeartbeatLeasesByLabel(t *testing.T) {
+	d, _, bus := newDispatcher(t)
+
+	jobs, err := bus.Subscribe(JobSubject("linux"))
+	if err != nil {
+		t.Fatalf("got error subscribing: %v", err)
+	}
+
+	if _, err := d.Register(store.Agent{ID: "linux", Labels: []string{"os=linux"}}); err != nil {
+		t.Fatalf("got error registering agent: %v", err)
+	}
+
+	// The first run needs darwin, so the linux agent gets the second.
+	agent, job, err := d.Heartbeat(Heartbeat{AgentID: "linux"})
+	if err != nil {
+		t.Fatalf("got error sending heartbeat: %v", err)
+	}
+
+	if job == nil || job.RunID != 2 || agent.RunID != 2 {
+		t.Fatalf("expected run 2 leased, got %+v and %+v", agent, job)
+	}
+
+	published := Job{}
+	if err := json.Unmarshal((<-jobs).Data, &published); err != nil {
+		t.Fatalf("got error unmarshalling job: %v", err)
+	}
+	if published.RunID != 2 {
+		t.Fatalf("expected run 2 published, got %+v", published)
+	}
+
+	// Busy agents are told about their run again without it being
+	// published again.
+	_, job, err = d.Heartbeat(Heartbeat{AgentID: "linux", RunID: 2, Status: store.RunRunning})
+	if err != nil {
+		t.Fatalf("got error sending heartbeat: %v", err)
+	}
+
+	if job == nil || job.RunID != 2 {
+		t.Fatalf("expected run 2 again, got %+v", job)
+	}
+
+	select {
+	case msg := <-jobs:
+		t.Fatalf("expected no job published, got %s", msg.Data)
+	default:
+	}
+
+	_, job, err = d.Heartbeat(Heartbeat{AgentID: "linux", RunID: 2, Status: store.RunFailed})
+	if err != nil {
+		t.Fatalf("got error sending heartbeat: %v", err)
+	}
+
+	if job != nil {
+		t.Fatalf("expected nothing left for linux, got %+v", job)
+	}
+}
+
+func TestReap(t *testing.T) {
+	d, st, bus := newDispatcher(t)
+
+	announced, err := bus.Subscribe(queue.SubjectJobs)
+	if err != nil {
+		t.Fatalf("got error subscribing: %v", err)
+	}
+
+	if _, err := d.Register(store.Agent{ID: "lost"}); err != nil {
+		t.Fatalf("got error registering agent: %v", err)
+	}
+
+	// The lease runs out as soon as it's taken, like it would for an
+	// agent that went away without another heartbeat.
+	d.LeaseTimeout = -time.Second
+	if _, _, err := d.Heartbeat(Heartbeat{AgentID: "lost"}); err != nil {
+		t.Fatalf("got error sending heartbeat: %v", err)
+	}
+
+	runs, err := NewReaper(st, bus).Reap()
+	if err != nil {
+		t.Fatalf("got error reaping: %v", err)
+	}
+
+	if len(runs) != 1 || runs[0].ID != 2 || runs[0].Status != store.RunQueued {
+		t.Fatalf("expected run 2 requeued, got %+v", runs)
+	}
+
+	job := Job{}
+	if err := json.Unmarshal((<-announced).Data, &job); err != nil {
+		t.Fatalf("got error unmarshalling job: %v", err)
+	}
+	if job.RunID != 2 {
+		t.Fatalf("expected run 2 announced, got %+v", job)
+	}
+
+	// The agent lost the run, so it can't report on it anymore.
+	d.LeaseTimeout = time.Minute
+	if _, _, err := d.Heartbeat(Heartbeat{AgentID: "lost", RunID: 2, Status: store.RunSucceeded}); err != ErrLeaseLost {
+		t.Fatalf("expected %v, got %v", ErrLeaseLost, err)
+	}
+}
+
+func readCancel(t *testing.T, recv <-chan queue.Message) Cancel {
+	select {
+	case msg := <-recv:
+		cancel := Cancel{}
+		if err := json.Unmarshal(msg.Data, &cancel); err != nil {
+			t.Fatalf("got error unmarshalling cancellation: %v", err)
+		}
+		return cancel
+	default:
+		t.Fatal("expected a cancellation to be published")
+	}
+
+	return Cancel{}
+}
+
+func TestCancel(t *testing.T) {
+	d, st, bus := newDispatcher(t)
+
+	cancels, err := bus.Subscribe(CancelSubject("a"))
+	if err != nil {
+		t.Fatalf("got error subscribing: %v", err)
+	}
+
+	if _, err := d.Register(store.Agent{ID: "a"}); err != nil {
+		t.Fatalf("got error registering agent: %v", err)
+	}
+	if _, _, err := d.Heartbeat(Heartbeat{AgentID: "a"}); err != nil {
+		t.Fatalf("got error sending heartbeat: %v", err)
+	}
+
+	run, err := d.Cancel(2)
+	if err != nil {
+		t.Fatalf("got error cancelling run: %v", err)
+	}
+	if run.Status != store.RunCancelling {
+		t.Fatalf("expected run 2 to be cancelling, got %v", run.Status)
+	}
+
+	if cancel := readCancel(t, cancels); cancel.RunID != 2 || cancel.Force {
+		t.Fatalf("expected agent asked to stop run 2, got %+v", cancel)
+	}
+
+	// Agents that missed the message hear about it from their heartbeat.
+	_, job, err := d.Heartbeat(Heartbeat{AgentID: "a", RunID: 2, Status: store.RunRunning})
+	if err != nil {
+		t.Fatalf("got error sending heartbeat: %v", err)
+	}
+	if job == nil || job.RunID != 2 || !job.Cancel {
+		t.Fatalf("expected run 2 to be cancelled, got %+v", job)
+	}
+
+	if _, _, err := d.Heartbeat(Heartbeat{AgentID: "a", RunID: 2, Status: store.RunCancelled}); err != nil {
+		t.Fatalf("got error acknowledging cancellation: %v", err)
+	}
+
+	// Queued runs don't need anyone to stop them.
+	run, err = d.Cancel(1)
+	if err != nil {
+		t.Fatalf("got error cancelling run: %v", err)
+	}
+	if run.Status != store.RunCancelled {
+		t.Fatalf("expected run 1 to be cancelled, got %v", run.Status)
+	}
+
+	for _, id := range []int{1, 2} {
+		run, err := st.GetRun(id)
+		if err != nil {
+			t.Fatalf("got error getting run: %v", err)
+		}
+		if run.Status != store.RunCancelled {
+			t.Fatalf("expected run %v to be cancelled, got %v", id, run.Status)
+		}
+	}
+
+	select {
+	case msg := <-cancels:
+		t.Fatalf("expected nothing more published, got %s", msg.Data)
+	default:
+	}
+
+	if _, err := d.Cancel(1); err != store.ErrIllegalTransition {
+		t.Fatalf("expected %v cancelling a finished run, got %v", store.ErrIllegalTransition, err)
+	}
+}
+
+func TestTimeOut(t *testing.T) {
+	d, _, bus := newDispatcher(t)
+
+	cancels := map[string]<-chan queue.Message{}
+	for _, agent := range []store.Agent{{ID: "mac", Labels: []string{"os=darwin"}}, {ID: "slow"}} {
+		recv, err := bus.Subscribe(CancelSubject(agent.ID))
+		if err != nil {
+			t.Fatalf("got error subscribing: %v", err)
+		}
+		cancels[agent.ID] = recv
+
+		if _, err := d.Register(agent); err != nil {
+			t.Fatalf("got error registering agent: %v", err)
+		}
+		if _, _, err := d.Heartbeat(Heartbeat{AgentID: agent.ID}); err != nil {
+			t.Fatalf("got error sending heartbeat: %v", err)
+		}
+	}
+
+	if _, err := d.Cancel(2); err != nil {
+		t.Fatalf("got error cancelling run: %v", err)
+	}
+	readCancel(t, cancels["slow"])
+
+	r := NewReaper(d.st, bus)
+
+	// Without timeouts, nothing gets stopped.
+	r.Timeout = 0
+	if runs, err := r.TimeOut(); err != nil || len(runs) != 0 {
+		t.Fatalf("expected nothing timed out, got %+v and %v", runs, err)
+	}
+
+	// slow doesn't stop its run in time.
+	r.CancelTimeout = -time.Second
+	runs, err := r.TimeOut()
+	if err != nil {
+		t.Fatalf("got error timing out runs: %v", err)
+	}
+	if len(runs) != 1 || runs[0].ID != 2 || runs[0].Status != store.RunCancelled {
+		t.Fatalf("expected run 2 cancelled, got %+v", runs)
+	}
+
+	if cancel := readCancel(t, cancels["slow"]); cancel.RunID != 2 || !cancel.Force {
+		t.Fatalf("expected slow told to kill run 2, got %+v", cancel)
+	}
+
+	if _, _, err := d.Heartbeat(Heartbeat{AgentID: "slow", RunID: 2, Status: store.RunCancelled}); err != ErrLeaseLost {
+		t.Fatalf("expected %v acknowledging too late, got %v", ErrLeaseLost, err)
+	}
+
+	// mac's run goes on for longer than runs can.
+	r.Timeout = time.Nanosecond
+	runs, err = r.TimeOut()
+	if err != nil {
+		t.Fatalf("got error timing out runs: %v", err)
+	}
+	if len(runs) != 1 || runs[0].ID != 1 || runs[0].Status != store.RunFailed {
+		t.Fatalf("expected run 1 failed, got %+v", runs)
+	}
+
+	if cancel := readCancel(t, cancels["mac"]); cancel.RunID != 1 || !cancel.Force {
+		t.Fatalf("expected mac told to kill run 1, got %+v", cancel)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	d, st, _ := newDispatcher(t)
+
+	msgs := []queue.Message{
+		{Subject: queue.SubjectAgentRegister, Data: []byte(`{"id": "mac", "labels": ["os=darwin"]}`)},
+		{Subject: queue.SubjectAgentHeartbeat, Data: []byte(`{"agent_id": "mac"}`)},
+	}
+	for _, msg := range msgs {
+		if err := Handle(msg, d); err != nil {
+			t.Fatalf("got error handling %s: %v", msg.Data, err)
+		}
+	}
+
+	agent, err := st.GetAgent("mac")
+	if err != nil {
+		t.Fatalf("got error getting agent: %v", err)
+	}
+
+	if agent.RunID != 1 {
+		t.Fatalf("expected mac to be running run 1, got %+v", agent)
+	}
+
+	bad := queue.Message{Subject: queue.SubjectAgentHeartbeat, Data: []byte(`{"agent_id": "nope"}`)}
+	if err := Handle(bad, d); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+}
+
+func TestNewJobPipeline(t *testing.T) {
+	_, st, _ := newDispatcher(t)
+
+	run, err := st.GetRun(2)
+	if err != nil {
+		t.Fatalf("got error getting run: %v", err)
+	}
+
+	// Pushes run the whole pipeline, so agents only get where its tasks
+	// are.
+	job := NewJob(st, run)
+	if job.Task != "" || job.ConfigPath != store.DefaultConfigPath {
+		t.Fatalf("expected pipeline job for %v, got %+v", store.DefaultConfigPath, job)
+	}
+
+	_, err = st.CreateProject(store.Project{
+		Name:          "a",
+		Remote:        "example.com/a",
+		DefaultBranch: "master",
+		ConfigPath:    "ci/tasks",
+		Enabled:       true,
+	})
+	if err != nil {
+		t.Fatalf("got error creating project: %v", err)
+	}
+
+	if job := NewJob(st, run); job.ConfigPath != "ci/tasks" {
+		t.Fatalf("expected the project's config path, got %+v", job)
+	}
+}
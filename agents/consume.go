@@ -0,0 +1,64 @@
+package agents
+
+import (
+	"encoding/json"
+
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/store"
+)
+
+// Registration is what agents publish on queue.SubjectAgentRegister to
+// register without going through the API.
+type Registration struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Labels []string `json:"labels"`
+}
+
+// Consume handles every registration and heartbeat received on `recv`
+// with `d`. It returns when `recv` is closed.
+func Consume(recv <-chan queue.Message, d *Dispatcher) {
+	logger.Info("consuming agent messages")
+
+	for msg := range recv {
+		Handle(msg, d)
+	}
+
+	logger.Info("agent channel closed, done consuming")
+}
+
+// Handle handles a single registration or heartbeat. Agents that send
+// heartbeats this way get their jobs on their JobSubject, so nothing is
+// returned. Messages that can't be handled are logged and dropped, since
+// agents keep sending heartbeats anyway.
+func Handle(msg queue.Message, d *Dispatcher) error {
+	logger := logger.WithField("subject", msg.Subject)
+
+	var err error
+	switch msg.Subject {
+	case queue.SubjectAgentRegister:
+		var reg Registration
+		if err = json.Unmarshal(msg.Data, &reg); err == nil {
+			_, err = d.Register(store.Agent{
+				ID:     reg.ID,
+				Name:   reg.Name,
+				Labels: reg.Labels,
+			})
+		}
+	case queue.SubjectAgentHeartbeat:
+		var hb Heartbeat
+		if err = json.Unmarshal(msg.Data, &hb); err == nil {
+			_, _, err = d.Heartbeat(hb)
+		}
+	default:
+		logger.Warnf("dropping message on unexpected subject: %s", msg.Data)
+		return nil
+	}
+
+	if err != nil {
+		logger.WithField("error", err).
+			Errorf("dropping agent message: %s", msg.Data)
+	}
+
+	return err
+}
@@ -0,0 +1,130 @@
+package agents
+
+import (
+	"context"
+	"time"
+
+	"github.com/run-ci/run-server/metrics"
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/store"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	requeued = metrics.NewCounterVec("run_agent_leases_expired_total",
+		"Runs put back in the queue because their agent stopped sending heartbeats.")
+	timedOut = metrics.NewCounterVec("run_timeouts_total",
+		"Runs stopped for taking too long, by the status they were stopped with.",
+		"status")
+)
+
+// Reaper puts runs back in the queue when the agents running them stop
+// sending heartbeats, and stops runs that take too long.
+type Reaper struct {
+	st  store.Repo
+	bus queue.Bus
+
+	// Interval is how often leases and timeouts are checked.
+	Interval time.Duration
+
+	// Timeout is how long runs without a timeout of their own can go on
+	// for before they're failed. Zero lets them go on forever.
+	Timeout time.Duration
+
+	// CancelTimeout is how long agents have to stop a cancelled run
+	// before it's cancelled without them.
+	CancelTimeout time.Duration
+}
+
+// NewReaper returns a Reaper requeueing the runs in `st` and announcing
+// them on `bus`.
+func NewReaper(st store.Repo, bus queue.Bus) *Reaper {
+	return &Reaper{
+		st:  st,
+		bus: bus,
+
+		Interval:      10 * time.Second,
+		CancelTimeout: DefaultCancelTimeout,
+	}
+}
+
+// Run reaps expired leases and runs that took too long every Interval
+// until `ctx` is done.
+func (r *Reaper) Run(ctx context.Context) {
+	logger.Info("starting lease reaper")
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := r.Reap(); err != nil {
+			logger.WithField("error", err).Error("unable to expire leases")
+		}
+
+		if _, err := r.TimeOut(); err != nil {
+			logger.WithField("error", err).Error("unable to time out runs")
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Info("stopping lease reaper")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reap puts every run whose lease has run out back in the queue and
+// returns them. Each one is announced on queue.SubjectJobs again, but
+// runs are requeued whether or not that works since agents are leased
+// runs from the store, not the queue.
+func (r *Reaper) Reap() ([]store.Run, error) {
+	runs, err := r.st.ExpireLeases()
+	if err != nil {
+		return runs, err
+	}
+
+	for _, run := range runs {
+		logger := logger.WithField("run_id", run.ID)
+		logger.Warn("lease ran out, requeued run")
+		requeued.Inc()
+
+		if err := publish(r.bus, queue.SubjectJobs, NewJob(r.st, run)); err != nil {
+			logger.WithField("error", err).Warn("unable to announce requeued run")
+		}
+	}
+
+	return runs, nil
+}
+
+// TimeOut fails every run that has gone on for longer than its timeout,
+// and cancels every run whose agent hasn't stopped it within
+// CancelTimeout of it being cancelled. It returns the runs it stopped.
+// The agents running them are told to kill them on their CancelSubject,
+// but the runs are over either way.
+func (r *Reaper) TimeOut() ([]store.Run, error) {
+	runs, err := r.st.TimeoutRuns(r.Timeout, r.CancelTimeout)
+	if err != nil {
+		return runs, err
+	}
+
+	for _, run := range runs {
+		logger := logger.WithFields(logrus.Fields{
+			"run_id":   run.ID,
+			"agent_id": run.AgentID,
+		})
+		timedOut.Inc(string(run.Status))
+
+		if run.Status == store.RunCancelled {
+			logger.Warn("agent didn't stop cancelled run in time, cancelled it without it")
+		} else {
+			logger.Warn("run took too long, failed it")
+		}
+
+		if err := publishCancel(r.bus, run.AgentID, Cancel{RunID: run.ID, Force: true}); err != nil {
+			logger.WithField("error", err).Warn("unable to tell agent to kill run")
+		}
+	}
+
+	return runs, nil
+}
@@ -0,0 +1,133 @@
+// Package branches matches branch names against the patterns projects
+// track them with.
+//
+// A pattern is either a glob or, between slashes, a regular expression.
+// In globs, `*` matches anything but a slash, `**` matches anything at all
+// and `?` matches a single character other than a slash. Regular
+// expressions have to match the whole branch name. Patterns starting with
+// `!` are exclusions: branches matching them never match the set, even if
+// they match another pattern.
+package branches
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Error is returned for patterns that can't be parsed.
+type Error struct {
+	Pattern string
+	Reason  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("invalid branch pattern %q: %v", e.Pattern, e.Reason)
+}
+
+// Set is a parsed set of branch patterns.
+type Set struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// Parse parses every pattern in `patterns` into a Set.
+func Parse(patterns []string) (Set, error) {
+	set := Set{}
+
+	for _, pattern := range patterns {
+		exclude := strings.HasPrefix(pattern, "!")
+
+		re, err := compile(strings.TrimPrefix(pattern, "!"))
+		if err != nil {
+			return Set{}, &Error{pattern, err.Error()}
+		}
+
+		if exclude {
+			set.exclude = append(set.exclude, re)
+		} else {
+			set.include = append(set.include, re)
+		}
+	}
+
+	return set, nil
+}
+
+// Validate returns an error if `pattern` can't be parsed.
+func Validate(pattern string) error {
+	_, err := Parse([]string{pattern})
+	return err
+}
+
+// IsExclusion returns whether `pattern` is an exclusion.
+func IsExclusion(pattern string) bool {
+	return strings.HasPrefix(pattern, "!")
+}
+
+// Match returns whether `branch` matches one of the set's patterns and
+// none of its exclusions.
+func (s Set) Match(branch string) bool {
+	for _, re := range s.exclude {
+		if re.MatchString(branch) {
+			return false
+		}
+	}
+
+	for _, re := range s.include {
+		if re.MatchString(branch) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func compile(pattern string) (*regexp.Regexp, error) {
+	if strings.TrimSpace(pattern) == "" {
+		return nil, fmt.Errorf("pattern is empty")
+	}
+
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile("^(?:" + pattern[1:len(pattern)-1] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("bad regular expression: %v", err)
+		}
+
+		return re, nil
+	}
+
+	if strings.ContainsAny(pattern, " ~^:\\") || strings.Contains(pattern, "..") {
+		return nil, fmt.Errorf("not a valid branch name or glob")
+	}
+
+	return regexp.Compile(GlobRegexp(pattern))
+}
+
+// GlobRegexp turns the glob `glob` into an anchored regular expression.
+// It only uses syntax that Go and Postgres read the same way, so that
+// globs can be matched in either.
+func GlobRegexp(glob string) string {
+	var expr strings.Builder
+	expr.WriteString("^")
+
+	runes := []rune(glob)
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; r {
+		case '*':
+			if i+1 < len(runes) && runes[i+1] == '*' {
+				expr.WriteString(".*")
+				i++
+				continue
+			}
+
+			expr.WriteString("[^/]*")
+		case '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	expr.WriteString("$")
+	return expr.String()
+}
@@ -0,0 +1,69 @@
+package branches
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		branch   string
+		want     bool
+	}{
+		{[]string{"master"}, "master", true},
+		{[]string{"master"}, "main", false},
+		{[]string{"release/*"}, "release/1.0", true},
+		{[]string{"release/*"}, "release/1.0/hotfix", false},
+		{[]string{"release/*"}, "release", false},
+		{[]string{"feature/**"}, "feature/a/b", true},
+		{[]string{"v?"}, "v1", true},
+		{[]string{"v?"}, "v/", false},
+		{[]string{"/release-[0-9]+/"}, "release-12", true},
+		{[]string{"/release-[0-9]+/"}, "my-release-12", false},
+		{[]string{"feature/**", "!feature/wip-*"}, "feature/wip-x", false},
+		{[]string{"feature/**", "!feature/wip-*"}, "feature/done", true},
+		{[]string{"!master"}, "develop", false},
+		{[]string{"release.1"}, "releasex1", false},
+		{nil, "master", false},
+	}
+
+	for _, test := range tests {
+		set, err := Parse(test.patterns)
+		if err != nil {
+			t.Fatalf("got error parsing %v: %v", test.patterns, err)
+		}
+
+		if got := set.Match(test.branch); got != test.want {
+			t.Fatalf("expected %v to match %q: %v, got %v", test.patterns, test.branch, test.want, got)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, pattern := range []string{"", "!", "/release-(/", "a b", "a..b", "a:b"} {
+		err := Validate(pattern)
+		if err == nil {
+			t.Fatalf("expected an error parsing %q", pattern)
+		}
+
+		if _, ok := err.(*Error); !ok {
+			t.Fatalf("expected *Error parsing %q, got %T", pattern, err)
+		}
+	}
+}
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		glob string
+		want string
+	}{
+		{"master", `^master$`},
+		{"release/*", `^release/[^/]*$`},
+		{"feature/**", `^feature/.*$`},
+		{"v?.x", `^v[^/]\.x$`},
+	}
+
+	for _, test := range tests {
+		if got := GlobRegexp(test.glob); got != test.want {
+			t.Fatalf("expected %q for %q, got %q", test.want, test.glob, got)
+		}
+	}
+}
@@ -1,3 +1,6 @@
+-- The schema is managed by `run-server migrate`. This only exists so that
+-- local databases start out with something to poll.
+
 CREATE TABLE git_repos (
     remote varchar(255) NOT NULL,
     branch varchar(255) NOT NULL,
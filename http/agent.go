@@ -0,0 +1,242 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/run-ci/run-server/agents"
+	"github.com/run-ci/run-server/store"
+)
+
+type agentRequest struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Labels []string `json:"labels"`
+}
+
+type agentResponse struct {
+	ID            string           `json:"id"`
+	Name          string           `json:"name"`
+	Labels        []string         `json:"labels"`
+	State         store.AgentState `json:"state"`
+	RunID         int              `json:"run_id,omitempty"`
+	RegisteredAt  time.Time        `json:"registered_at"`
+	LastHeartbeat time.Time        `json:"last_heartbeat"`
+}
+
+func (srv *Server) newAgentResponse(agent store.Agent) agentResponse {
+	labels := agent.Labels
+	if labels == nil {
+		labels = []string{}
+	}
+
+	return agentResponse{
+		ID:            agent.ID,
+		Name:          agent.Name,
+		Labels:        labels,
+		State:         agent.State(time.Now(), srv.dispatcher.LeaseTimeout),
+		RunID:         agent.RunID,
+		RegisteredAt:  agent.RegisteredAt,
+		LastHeartbeat: agent.LastHeartbeat,
+	}
+}
+
+type heartbeatRequest struct {
+	RunID  int             `json:"run_id"`
+	Status store.RunStatus `json:"status"`
+}
+
+type heartbeatResponse struct {
+	Agent agentResponse `json:"agent"`
+	Job   *agents.Job   `json:"job"`
+}
+
+// SetDispatcher replaces the dispatcher agents are registered and leased
+// runs with, so that it can be shared with agents talking over the queue.
+func (srv *Server) SetDispatcher(d *agents.Dispatcher) {
+	srv.dispatcher = d
+}
+
+// postAgent registers an agent, or updates the name and labels of one
+// that has registered before.
+func (srv *Server) postAgent(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	logger.Debug("reading request body")
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to read request body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	logger.Debug("unmarshaling request body")
+	var agentreq agentRequest
+	err = json.Unmarshal(buf, &agentreq)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to unmarshal request body")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	errs := fieldErrors{}
+	if !agents.ValidID(agentreq.ID) {
+		errs["id"] = "invalid agent ID"
+	}
+	if _, err := agents.NormalizeLabels(agentreq.Labels); err != nil {
+		errs["labels"] = err.Error()
+	}
+	if len(errs) > 0 {
+		logger.WithField("error", errs).Error("invalid agent")
+
+		writeErrResp(rw, errs, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("agent_id", agentreq.ID)
+
+	agent, err := srv.dispatcher.Register(store.Agent{
+		ID:     agentreq.ID,
+		Name:   agentreq.Name,
+		Labels: agentreq.Labels,
+	})
+	if err != nil {
+		logger.WithField("error", err).Error("unable to register agent")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	buf, err = json.Marshal(srv.newAgentResponse(agent))
+	if err != nil {
+		logger.WithField("error", err).Error("unable to marshal response body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.Write(buf)
+	return
+}
+
+// postAgentHeartbeat records a heartbeat from an agent and responds with
+// the job it should be running, which is null if there's nothing for it
+// to do.
+func (srv *Server) postAgentHeartbeat(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	id := mux.Vars(req)["id"]
+	logger = logger.WithField("agent_id", id)
+
+	logger.Debug("reading request body")
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to read request body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	// Idle agents don't have anything to say, so they can leave the body
+	// out altogether.
+	var hbreq heartbeatRequest
+	if len(buf) > 0 {
+		logger.Debug("unmarshaling request body")
+		err = json.Unmarshal(buf, &hbreq)
+		if err != nil {
+			logger.WithField("error", err).
+				Error("unable to unmarshal request body")
+
+			writeErrResp(rw, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	hb := agents.Heartbeat{
+		AgentID: id,
+		RunID:   hbreq.RunID,
+		Status:  hbreq.Status,
+	}
+
+	if err := hb.Validate(); err != nil {
+		logger.WithField("error", err).Error("invalid heartbeat")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	agent, job, err := srv.dispatcher.Heartbeat(hb)
+	switch err {
+	case nil:
+	case store.ErrNotFound:
+		logger.WithField("error", err).Error("agent not found in database")
+
+		writeErrResp(rw, errors.New("agent not registered"), http.StatusNotFound)
+		return
+	case agents.ErrLeaseLost, store.ErrIllegalTransition:
+		logger.WithField("error", err).Error("agent can't report on run")
+
+		writeErrResp(rw, err, http.StatusConflict)
+		return
+	default:
+		logger.WithField("error", err).Error("unable to record heartbeat")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	buf, err = json.Marshal(heartbeatResponse{
+		Agent: srv.newAgentResponse(agent),
+		Job:   job,
+	})
+	if err != nil {
+		logger.WithField("error", err).Error("unable to marshal response body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.Write(buf)
+	return
+}
+
+// getAgents lists every agent along with what it's up to.
+func (srv *Server) getAgents(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	agents, err := srv.st.GetAgents()
+	if err != nil {
+		logger.WithField("error", err).Error("unable to fetch agents from database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]agentResponse, len(agents))
+	for i, agent := range agents {
+		resp[i] = srv.newAgentResponse(agent)
+	}
+
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		logger.WithField("error", err).Error("unable to marshal response body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.Write(buf)
+	return
+}
@@ -0,0 +1,168 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/run-ci/run-server/agents"
+	"github.com/run-ci/run-server/store"
+)
+
+// heartbeat sends a heartbeat for the agent with the given ID and decodes
+// the response.
+func heartbeat(t *testing.T, srv *Server, id string, body interface{}) (int, heartbeatResponse) {
+	resp := do(t, srv, http.MethodPost, "/agents/"+id+"/heartbeat", body)
+
+	hbresp := heartbeatResponse{}
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&hbresp); err != nil {
+			t.Fatalf("got error decoding response body: %v", err)
+		}
+	}
+
+	return resp.StatusCode, hbresp
+}
+
+func TestAgentLifecycle(t *testing.T) {
+	srv, st := newRunServer(t)
+	jobs := subscribe(t, srv.bus, agents.JobSubject("builder"))
+
+	resp := do(t, srv, http.MethodPost, "/agents", agentRequest{
+		ID:     "builder",
+		Labels: []string{"os=linux", "docker", "os=linux"},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	registered := agentResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&registered); err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	if registered.State != store.AgentIdle || !reflect.DeepEqual(registered.Labels, []string{"docker", "os=linux"}) {
+		t.Fatalf("expected idle agent with sorted labels, got %+v", registered)
+	}
+
+	// An idle agent is leased the oldest queued run.
+	status, hbresp := heartbeat(t, srv, "builder", nil)
+	if status != http.StatusOK {
+		t.Fatalf("expected status %v, got %v", http.StatusOK, status)
+	}
+
+	if hbresp.Job == nil || hbresp.Job.RunID != 1 || hbresp.Agent.State != store.AgentBusy {
+		t.Fatalf("expected busy agent with run 1, got %+v", hbresp)
+	}
+
+	// The project's registered URL is what gets cloned.
+	if hbresp.Job.Remote != "https://example.com/test.git" {
+		t.Fatalf("expected job cloned from the registered URL, got %v", hbresp.Job.Remote)
+	}
+
+	job := agents.Job{}
+	if err := json.Unmarshal((<-jobs).Data, &job); err != nil {
+		t.Fatalf("got error unmarshalling job message: %v", err)
+	}
+	if job.RunID != 1 {
+		t.Fatalf("expected job for run 1, got %+v", job)
+	}
+
+	resp = do(t, srv, http.MethodGet, "/agents", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	list := []agentResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	if len(list) != 1 || list[0].RunID != 1 || list[0].State != store.AgentBusy {
+		t.Fatalf("expected builder running run 1, got %+v", list)
+	}
+
+	// Reporting the run done frees the agent up for the next one.
+	status, hbresp = heartbeat(t, srv, "builder", heartbeatRequest{RunID: 1, Status: store.RunSucceeded})
+	if status != http.StatusOK {
+		t.Fatalf("expected status %v, got %v", http.StatusOK, status)
+	}
+
+	if hbresp.Job == nil || hbresp.Job.RunID != 2 {
+		t.Fatalf("expected run 2 next, got %+v", hbresp)
+	}
+
+	run, err := st.GetRun(1)
+	if err != nil {
+		t.Fatalf("got error getting run: %v", err)
+	}
+
+	if run.Status != store.RunSucceeded || run.AgentID != "builder" {
+		t.Fatalf("expected run 1 succeeded on builder, got %+v", run)
+	}
+}
+
+func TestPostAgentHeartbeatErrors(t *testing.T) {
+	srv, _ := newRunServer(t)
+
+	for _, id := range []string{"a", "b"} {
+		resp := do(t, srv, http.MethodPost, "/agents", agentRequest{ID: id})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %v registering %v, got %v", http.StatusOK, id, resp.StatusCode)
+		}
+	}
+
+	if status, _ := heartbeat(t, srv, "a", nil); status != http.StatusOK {
+		t.Fatalf("expected status %v, got %v", http.StatusOK, status)
+	}
+
+	tests := []struct {
+		id     string
+		body   interface{}
+		status int
+	}{
+		{"unknown", nil, http.StatusNotFound},
+		{"a", heartbeatRequest{RunID: 1, Status: "bogus"}, http.StatusBadRequest},
+		{"a", heartbeatRequest{Status: store.RunSucceeded}, http.StatusBadRequest},
+		{"b", heartbeatRequest{RunID: 1, Status: store.RunSucceeded}, http.StatusConflict},
+	}
+
+	for _, test := range tests {
+		if status, _ := heartbeat(t, srv, test.id, test.body); status != test.status {
+			t.Fatalf("expected status %v for %v with %+v, got %v", test.status, test.id, test.body, status)
+		}
+	}
+}
+
+func TestPostAgentInvalid(t *testing.T) {
+	srv, _ := newRunServer(t)
+
+	tests := []struct {
+		req   agentRequest
+		field string
+	}{
+		{agentRequest{}, "id"},
+		{agentRequest{ID: "a.b"}, "id"},
+		{agentRequest{ID: "a", Labels: []string{"os linux"}}, "labels"},
+		{agentRequest{ID: "a", Labels: []string{""}}, "labels"},
+	}
+
+	for _, test := range tests {
+		resp := do(t, srv, http.MethodPost, "/agents", test.req)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status %v for %+v, got %v", http.StatusBadRequest, test.req, resp.StatusCode)
+		}
+
+		body := struct {
+			Fields map[string]string `json:"fields"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("got error decoding response body: %v", err)
+		}
+
+		if body.Fields[test.field] == "" {
+			t.Fatalf("expected an error for %v, got %v", test.field, body.Fields)
+		}
+	}
+}
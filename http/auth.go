@@ -0,0 +1,118 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/run-ci/run-server/store"
+)
+
+// tokenPrefix makes API tokens easy to spot, e.g. by secret scanners.
+const tokenPrefix = "run_"
+
+var (
+	errNoToken      = errors.New("missing bearer token")
+	errBadToken     = errors.New("invalid bearer token")
+	errMissingScope = errors.New("token doesn't have the required scope")
+)
+
+// SetAdminToken lets `token` be used as an admin token without it being
+// in the store. It's how the first real tokens get minted.
+func (srv *Server) SetAdminToken(token string) {
+	srv.adminHash = hashToken(token)
+}
+
+// newToken returns a new random API token.
+func newToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashToken returns the hash of `token` that's kept in the store. Tokens
+// are long and random, so a plain SHA-256 is enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerToken returns the token in the request's Authorization header.
+func bearerToken(req *http.Request) (string, bool) {
+	header := req.Header.Get("Authorization")
+	if len(header) < len("Bearer ") || !strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+
+	token := strings.TrimSpace(header[len("Bearer "):])
+	return token, token != ""
+}
+
+// lookupToken returns the token whose hash is `hash`, checking the admin
+// token first.
+func (srv *Server) lookupToken(hash string) (store.Token, error) {
+	if srv.adminHash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(srv.adminHash)) == 1 {
+		return store.Token{Name: "admin", Scopes: []string{store.ScopeAdmin}}, nil
+	}
+
+	return srv.st.GetTokenByHash(hash)
+}
+
+// Authorize returns a middleware that only lets requests through if they
+// carry a bearer token with `scope`. It must have a "request_id" set on
+// the request context.
+func (srv *Server) authorize(scope string) middleware {
+	return func(f http.HandlerFunc) http.HandlerFunc {
+		return func(rw http.ResponseWriter, req *http.Request) {
+			reqID := req.Context().Value(keyReqID).(string)
+			logger := logger.WithField("request_id", reqID)
+
+			raw, ok := bearerToken(req)
+			if !ok {
+				logger.Debug("request has no bearer token")
+
+				rw.Header().Set("WWW-Authenticate", `Bearer realm="run-server"`)
+				writeErrResp(rw, errNoToken, http.StatusUnauthorized)
+				return
+			}
+
+			token, err := srv.lookupToken(hashToken(raw))
+			if err == store.ErrNotFound {
+				logger.Warn("request has an unknown bearer token")
+
+				rw.Header().Set("WWW-Authenticate", `Bearer realm="run-server", error="invalid_token"`)
+				writeErrResp(rw, errBadToken, http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				logger.WithField("error", err).Error("unable to look up token")
+
+				writeErrResp(rw, err, http.StatusInternalServerError)
+				return
+			}
+
+			logger = logger.WithField("token", token.Name)
+
+			if !token.HasScope(scope) {
+				logger.Warnf("token is missing scope %v", scope)
+
+				writeErrResp(rw, errMissingScope, http.StatusForbidden)
+				return
+			}
+
+			logger.Debug("request authorized")
+
+			ctx := context.WithValue(req.Context(), keyToken, token)
+			f(rw, req.WithContext(ctx))
+		}
+	}
+}
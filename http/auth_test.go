@@ -0,0 +1,181 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/store"
+)
+
+const testAdminToken = "run_test-admin-token"
+
+// setToken makes `req` carry `token` as its bearer token.
+func setToken(req *http.Request, token string) {
+	req.Header.Set("Authorization", "Bearer "+token)
+}
+
+// newAuthServer returns a server with the test admin token set and a
+// token that can only read repos.
+func newAuthServer(t *testing.T) (*Server, string) {
+	st := newSeededStore(t)
+
+	srv := NewServer(":9001", queue.NewMemory(), st)
+	srv.SetAdminToken(testAdminToken)
+
+	reader := "run_test-reader-token"
+	_, err := st.CreateToken(store.Token{
+		Name:   "reader",
+		Hash:   hashToken(reader),
+		Scopes: []string{store.ScopeReposRead},
+	})
+	if err != nil {
+		t.Fatalf("got error creating token: %v", err)
+	}
+
+	return srv, reader
+}
+
+func TestAuthorize(t *testing.T) {
+	srv, reader := newAuthServer(t)
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		status int
+	}{
+		{"NoToken", http.MethodGet, "", http.StatusUnauthorized},
+		{"UnknownToken", http.MethodGet, "run_nope", http.StatusUnauthorized},
+		{"Scoped", http.MethodGet, reader, http.StatusOK},
+		{"MissingScope", http.MethodDelete, reader, http.StatusForbidden},
+		{"Admin", http.MethodDelete, testAdminToken, http.StatusAccepted},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "http://test/repos/git?remote=https://example.com/test.git", nil)
+			if test.token != "" {
+				setToken(req, test.token)
+			}
+			rw := httptest.NewRecorder()
+
+			srv.Handler.ServeHTTP(rw, req)
+
+			resp := rw.Result()
+			if resp.StatusCode != test.status {
+				t.Fatalf("expected status %v, got %v", test.status, resp.StatusCode)
+			}
+
+			if resp.StatusCode == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+				t.Fatal("expected a WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestTokenLifecycle(t *testing.T) {
+	srv, _ := newAuthServer(t)
+
+	payload, err := json.Marshal(tokenRequest{
+		Name:   "poller",
+		Scopes: []string{store.ScopeReposRead, store.ScopeReposWrite},
+	})
+	if err != nil {
+		t.Fatalf("got error when marshaling request payload: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://test/tokens", bytes.NewBuffer(payload))
+	setToken(req, testAdminToken)
+	rw := httptest.NewRecorder()
+
+	srv.Handler.ServeHTTP(rw, req)
+
+	resp := rw.Result()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %v, got %v", http.StatusCreated, resp.StatusCode)
+	}
+
+	minted := tokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&minted); err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	if minted.Token == "" || minted.ID == 0 {
+		t.Fatalf("expected minted token to have a value and an ID, got %+v", minted)
+	}
+
+	// The new token works straight away, and isn't shown when listing.
+	req = httptest.NewRequest(http.MethodGet, "http://test/tokens", nil)
+	setToken(req, testAdminToken)
+	rw = httptest.NewRecorder()
+
+	srv.Handler.ServeHTTP(rw, req)
+
+	listed := []tokenResponse{}
+	if err := json.NewDecoder(rw.Result().Body).Decode(&listed); err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	if len(listed) != 2 {
+		t.Fatalf("expected 2 tokens, got %v", len(listed))
+	}
+
+	for _, token := range listed {
+		if token.Token != "" {
+			t.Fatalf("expected listed tokens to hide their value, got %+v", token)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://test/repos/git", nil)
+	setToken(req, minted.Token)
+	rw = httptest.NewRecorder()
+
+	srv.Handler.ServeHTTP(rw, req)
+
+	if status := rw.Result().StatusCode; status != http.StatusOK {
+		t.Fatalf("expected minted token to be accepted, got status %v", status)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "http://test/tokens/2", nil)
+	setToken(req, testAdminToken)
+	rw = httptest.NewRecorder()
+
+	srv.Handler.ServeHTTP(rw, req)
+
+	if status := rw.Result().StatusCode; status != http.StatusNoContent {
+		t.Fatalf("expected status %v revoking token, got %v", http.StatusNoContent, status)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://test/repos/git", nil)
+	setToken(req, minted.Token)
+	rw = httptest.NewRecorder()
+
+	srv.Handler.ServeHTTP(rw, req)
+
+	if status := rw.Result().StatusCode; status != http.StatusUnauthorized {
+		t.Fatalf("expected revoked token to be rejected, got status %v", status)
+	}
+}
+
+func TestPostTokenBadScope(t *testing.T) {
+	srv, _ := newAuthServer(t)
+
+	payload, err := json.Marshal(tokenRequest{Name: "bad", Scopes: []string{"everything"}})
+	if err != nil {
+		t.Fatalf("got error when marshaling request payload: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://test/tokens", bytes.NewBuffer(payload))
+	setToken(req, testAdminToken)
+	rw := httptest.NewRecorder()
+
+	srv.Handler.ServeHTTP(rw, req)
+
+	if status := rw.Result().StatusCode; status != http.StatusBadRequest {
+		t.Fatalf("expected status %v, got %v", http.StatusBadRequest, status)
+	}
+}
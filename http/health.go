@@ -1,7 +1,12 @@
 package http
 
 import (
+	"encoding/json"
 	"net/http"
+	"sort"
+
+	"github.com/run-ci/run-server/leader"
+	"github.com/sirupsen/logrus"
 )
 
 // GetRoot is just a basic handler that signals to clients that
@@ -10,3 +15,121 @@ func getRoot(rw http.ResponseWriter, req *http.Request) {
 	rw.WriteHeader(http.StatusOK)
 	return
 }
+
+// Check reports whether a dependency of the server is usable, returning
+// an error explaining why if it isn't.
+type check func() error
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+	Leader *leaderResult          `json:"leader,omitempty"`
+}
+
+// leaderResult says which instance is leader, as far as this one can
+// tell, and whether that's this one.
+type leaderResult struct {
+	Instance string `json:"instance"`
+	Leader   string `json:"leader"`
+	IsLeader bool   `json:"is_leader"`
+	Error    string `json:"error,omitempty"`
+}
+
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+const (
+	statusOK   = "ok"
+	statusDown = "down"
+)
+
+// AddCheck makes readiness depend on `c`, reported under `name`. Checks
+// for the store and the bus are added by NewServer.
+func (srv *Server) AddCheck(name string, c func() error) {
+	srv.checks[name] = c
+}
+
+// SetElector shows the leadership of `e` on /readyz. Servers are ready
+// whether or not they're leader, so it doesn't count as a check.
+func (srv *Server) SetElector(e *leader.Elector) {
+	srv.elector = e
+}
+
+// GetHealthz signals that the process is alive. It doesn't look at any
+// dependencies, since restarting the server won't fix those.
+func getHealthz(rw http.ResponseWriter, req *http.Request) {
+	writeHealth(rw, http.StatusOK, healthResponse{Status: statusOK})
+}
+
+// GetReadyz runs every check and reports each dependency's status. The
+// server is only ready to take traffic if all of them pass.
+func (srv *Server) getReadyz(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	names := make([]string, 0, len(srv.checks))
+	for name := range srv.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	resp := healthResponse{
+		Status: statusOK,
+		Checks: map[string]checkResult{},
+	}
+	status := http.StatusOK
+
+	for _, name := range names {
+		if err := srv.checks[name](); err != nil {
+			logger.WithField("error", err).Warnf("%v is down", name)
+
+			resp.Checks[name] = checkResult{Status: statusDown, Error: err.Error()}
+			resp.Status = statusDown
+			status = http.StatusServiceUnavailable
+			continue
+		}
+
+		resp.Checks[name] = checkResult{Status: statusOK}
+	}
+
+	if srv.elector != nil {
+		resp.Leader = srv.leaderResult(logger)
+	}
+
+	writeHealth(rw, status, resp)
+}
+
+func (srv *Server) leaderResult(logger *logrus.Entry) *leaderResult {
+	res := &leaderResult{
+		Instance: srv.elector.ID,
+		IsLeader: srv.elector.IsLeader(),
+	}
+
+	id, err := srv.elector.Leader()
+	if err != nil {
+		logger.WithField("error", err).Warn("unable to find out who the leader is")
+
+		res.Error = err.Error()
+		if res.IsLeader {
+			id = res.Instance
+		}
+	}
+	res.Leader = id
+
+	return res
+}
+
+func writeHealth(rw http.ResponseWriter, status int, resp healthResponse) {
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		logger.WithField("error", err).Error("unable to marshal health response")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(buf)
+}
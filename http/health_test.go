@@ -1,9 +1,16 @@
 package http
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/run-ci/run-server/leader"
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/store"
 )
 
 func TestGetRoot(t *testing.T) {
@@ -15,3 +22,121 @@ func TestGetRoot(t *testing.T) {
 		t.Fatalf("expected status %v, got %v", http.StatusOK, resp.StatusCode)
 	}
 }
+
+func TestGetHealthz(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://test/healthz", nil)
+	rw := httptest.NewRecorder()
+	getHealthz(rw, req)
+	resp := rw.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+}
+
+// getReadyz requests /readyz from `srv` and returns the status code and
+// decoded body.
+func getReadyz(t *testing.T, srv *Server) (int, healthResponse) {
+	req := httptest.NewRequest("GET", "http://test/readyz", nil)
+	req = req.WithContext(context.WithValue(context.Background(), keyReqID, "test"))
+	rw := httptest.NewRecorder()
+
+	srv.getReadyz(rw, req)
+
+	resp := rw.Result()
+	defer resp.Body.Close()
+
+	body := healthResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	return resp.StatusCode, body
+}
+
+func TestGetReadyz(t *testing.T) {
+	srv := NewServer(":9001", queue.NewMemory(), store.NewMemory())
+
+	status, body := getReadyz(t, srv)
+	if status != http.StatusOK {
+		t.Fatalf("expected status %v, got %v", http.StatusOK, status)
+	}
+
+	for _, name := range []string{"store", "queue"} {
+		if res := body.Checks[name]; res.Status != statusOK {
+			t.Fatalf("expected %v to be %v, got %+v", name, statusOK, res)
+		}
+	}
+}
+
+func TestGetReadyzDown(t *testing.T) {
+	bus := queue.NewMemory()
+	srv := NewServer(":9001", bus, store.NewMemory())
+	srv.AddCheck("extra", func() error { return errors.New("broken") })
+
+	bus.Close()
+
+	status, body := getReadyz(t, srv)
+	if status != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %v, got %v", http.StatusServiceUnavailable, status)
+	}
+
+	if body.Status != statusDown {
+		t.Fatalf("expected overall status %v, got %v", statusDown, body.Status)
+	}
+
+	if res := body.Checks["store"]; res.Status != statusOK {
+		t.Fatalf("expected store to be %v, got %+v", statusOK, res)
+	}
+
+	if res := body.Checks["queue"]; res.Status != statusDown || res.Error != queue.ErrClosed.Error() {
+		t.Fatalf("expected queue to be down with %q, got %+v", queue.ErrClosed, res)
+	}
+
+	if res := body.Checks["extra"]; res.Error != "broken" {
+		t.Fatalf(`expected extra to fail with "broken", got %+v`, res)
+	}
+}
+
+func TestGetReadyzLeader(t *testing.T) {
+	srv := NewServer(":9001", queue.NewMemory(), store.NewMemory())
+
+	if _, body := getReadyz(t, srv); body.Leader != nil {
+		t.Fatalf("expected no leader without an elector, got %+v", body.Leader)
+	}
+
+	lock := leader.NewMemory()
+	other := leader.New(lock, "other")
+	if _, err := other.Check(); err != nil {
+		t.Fatalf("got error checking leadership: %v", err)
+	}
+
+	e := leader.New(lock, "this")
+	if _, err := e.Check(); err != nil {
+		t.Fatalf("got error checking leadership: %v", err)
+	}
+	srv.SetElector(e)
+
+	// Not being leader doesn't make a server any less ready.
+	status, body := getReadyz(t, srv)
+	if status != http.StatusOK {
+		t.Fatalf("expected status %v, got %v", http.StatusOK, status)
+	}
+
+	want := leaderResult{Instance: "this", Leader: "other"}
+	if body.Leader == nil || *body.Leader != want {
+		t.Fatalf("expected %+v, got %+v", want, body.Leader)
+	}
+
+	if err := other.Resign(); err != nil {
+		t.Fatalf("got error resigning: %v", err)
+	}
+	if _, err := e.Check(); err != nil {
+		t.Fatalf("got error checking leadership: %v", err)
+	}
+
+	_, body = getReadyz(t, srv)
+	want = leaderResult{Instance: "this", Leader: "this", IsLeader: true}
+	if body.Leader == nil || *body.Leader != want {
+		t.Fatalf("expected %+v, got %+v", want, body.Leader)
+	}
+}
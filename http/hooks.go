@@ -0,0 +1,360 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/remote"
+	"github.com/run-ci/run-server/store"
+	"github.com/sirupsen/logrus"
+)
+
+// errIgnoredEvent is returned by webhook parsers for events that don't
+// need to trigger anything.
+var errIgnoredEvent = errors.New("event ignored")
+
+// pushEvent is what's left of a provider's push payload once it has been
+// normalized.
+type pushEvent struct {
+	// Remotes are all the URLs the repository is known by, since it could
+	// have been registered using any of them.
+	Remotes []string
+	Ref     string
+	Commit  string
+}
+
+// hookProvider knows how to authenticate and parse webhooks from a single
+// Git hosting provider.
+type hookProvider struct {
+	verify func(secret string, req *http.Request, body []byte) bool
+	parse  func(req *http.Request, body []byte) (pushEvent, error)
+}
+
+var hookProviders = map[string]hookProvider{
+	"github": {
+		verify: verifyGitHub,
+		parse:  parseGitHub,
+	},
+	"gitlab": {
+		verify: verifyGitLab,
+		parse:  parseGitLab,
+	},
+	"gitea": {
+		verify: verifyGitea,
+		parse:  parseGitea,
+	},
+}
+
+// SetHookSecret sets the secret used to authenticate webhooks coming from
+// `provider`. Webhooks from providers without a secret are rejected.
+func (srv *Server) SetHookSecret(provider, secret string) {
+	srv.hookSecrets[provider] = secret
+}
+
+func (srv *Server) postHook(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	name := mux.Vars(req)["provider"]
+	logger = logger.WithField("provider", name)
+
+	provider, ok := hookProviders[name]
+	if !ok {
+		logger.Error("unknown webhook provider")
+
+		writeErrResp(rw, errors.New("unknown webhook provider"), http.StatusNotFound)
+		return
+	}
+
+	logger.Debug("reading request body")
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to read request body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	secret := srv.hookSecrets[name]
+	if secret == "" || !provider.verify(secret, req, buf) {
+		logger.Error("unable to verify webhook signature")
+
+		writeErrResp(rw, errors.New("invalid webhook signature"), http.StatusUnauthorized)
+		return
+	}
+
+	ev, err := provider.parse(req, buf)
+	if err == errIgnoredEvent {
+		logger.Info("ignoring webhook event")
+
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to parse webhook payload")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	msg := map[string]string{
+		"op":       "trigger",
+		"provider": name,
+		"commit":   ev.Commit,
+	}
+
+	switch {
+	case strings.HasPrefix(ev.Ref, "refs/heads/"):
+		msg["trigger"] = "push"
+		msg["branch"] = strings.TrimPrefix(ev.Ref, "refs/heads/")
+		msg["remote"], err = srv.matchBranch(ev.Remotes, msg["branch"])
+	case strings.HasPrefix(ev.Ref, "refs/tags/"):
+		msg["trigger"] = "tag"
+		msg["tag"] = strings.TrimPrefix(ev.Ref, "refs/tags/")
+		msg["remote"], err = srv.matchRemote(ev.Remotes)
+	default:
+		logger.Infof("ignoring push to %v", ev.Ref)
+
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err == store.ErrNotFound {
+		logger.WithField("ref", ev.Ref).Error("repo not found in database")
+
+		writeErrResp(rw, errors.New("repo not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.WithField("error", err).Error("unable to fetch repo from database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	logger = logger.WithFields(logrus.Fields{
+		"remote": msg["remote"],
+		"ref":    ev.Ref,
+		"commit": ev.Commit,
+	})
+
+	rawmsg, err := json.Marshal(msg)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to marshal trigger message")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("triggering build from webhook")
+	srv.send(logger, queue.SubjectTriggers, rawmsg)
+
+	rw.WriteHeader(http.StatusAccepted)
+	rw.Write(rawmsg)
+	return
+}
+
+// canonicalRemotes returns the canonical forms of `remotes`, leaving out
+// any that can't be parsed.
+func canonicalRemotes(remotes []string) []string {
+	canonical := []string{}
+	for _, raw := range remotes {
+		if c, err := remote.Canonical(raw); err == nil {
+			canonical = append(canonical, c)
+		}
+	}
+
+	return canonical
+}
+
+// matchBranch returns the URL of the first of `remotes` whose project
+// tracks `branch`, whichever way it was spelled when it was registered.
+// It returns store.ErrNotFound if there isn't one.
+func (srv *Server) matchBranch(remotes []string, branch string) (string, error) {
+	return srv.matchProject(remotes, func(p store.Project) bool {
+		return p.Tracks(branch)
+	})
+}
+
+// matchRemote returns the URL of the first of `remotes` with an enabled
+// project. It returns store.ErrNotFound if there isn't one.
+func (srv *Server) matchRemote(remotes []string) (string, error) {
+	return srv.matchProject(remotes, func(p store.Project) bool {
+		return p.Enabled
+	})
+}
+
+// matchProject returns the URL of the first of `remotes` with a project
+// that `match` accepts. It returns store.ErrNotFound if there isn't one.
+func (srv *Server) matchProject(remotes []string, match func(store.Project) bool) (string, error) {
+	for _, remote := range canonicalRemotes(remotes) {
+		p, err := srv.st.GetProjectByRemote(remote)
+		if err == store.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if match(p) {
+			return p.CloneURL(), nil
+		}
+	}
+
+	return "", store.ErrNotFound
+}
+
+// verifyHMAC checks that `sig` is the hex encoded HMAC of `body`.
+func verifyHMAC(h func() hash.Hash, secret, sig string, body []byte) bool {
+	want, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(body)
+
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+func verifyGitHub(secret string, req *http.Request, body []byte) bool {
+	if sig := req.Header.Get("X-Hub-Signature-256"); sig != "" {
+		return verifyHMAC(sha256.New, secret, strings.TrimPrefix(sig, "sha256="), body)
+	}
+
+	sig := req.Header.Get("X-Hub-Signature")
+	return verifyHMAC(sha1.New, secret, strings.TrimPrefix(sig, "sha1="), body)
+}
+
+func verifyGitLab(secret string, req *http.Request, body []byte) bool {
+	token := req.Header.Get("X-Gitlab-Token")
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+func verifyGitea(secret string, req *http.Request, body []byte) bool {
+	return verifyHMAC(sha256.New, secret, req.Header.Get("X-Gitea-Signature"), body)
+}
+
+// githubPush is a push payload as sent by GitHub. Gitea sends the same
+// shape.
+type githubPush struct {
+	Ref     string `json:"ref"`
+	After   string `json:"after"`
+	Deleted bool   `json:"deleted"`
+
+	Repository struct {
+		CloneURL string `json:"clone_url"`
+		SSHURL   string `json:"ssh_url"`
+		GitURL   string `json:"git_url"`
+		HTMLURL  string `json:"html_url"`
+	} `json:"repository"`
+}
+
+func (p githubPush) event() (pushEvent, error) {
+	if p.Deleted || strings.Trim(p.After, "0") == "" {
+		return pushEvent{}, errIgnoredEvent
+	}
+
+	return pushEvent{
+		Remotes: nonEmpty(
+			p.Repository.CloneURL,
+			p.Repository.SSHURL,
+			p.Repository.GitURL,
+			p.Repository.HTMLURL,
+		),
+		Ref:    p.Ref,
+		Commit: p.After,
+	}, nil
+}
+
+func parseGitHub(req *http.Request, body []byte) (pushEvent, error) {
+	if req.Header.Get("X-GitHub-Event") != "push" {
+		return pushEvent{}, errIgnoredEvent
+	}
+
+	var p githubPush
+	if err := json.Unmarshal(body, &p); err != nil {
+		return pushEvent{}, err
+	}
+
+	return p.event()
+}
+
+func parseGitea(req *http.Request, body []byte) (pushEvent, error) {
+	if req.Header.Get("X-Gitea-Event") != "push" {
+		return pushEvent{}, errIgnoredEvent
+	}
+
+	var p githubPush
+	if err := json.Unmarshal(body, &p); err != nil {
+		return pushEvent{}, err
+	}
+
+	return p.event()
+}
+
+// gitlabPush is a push or tag push payload as sent by GitLab.
+type gitlabPush struct {
+	Ref         string `json:"ref"`
+	After       string `json:"after"`
+	CheckoutSHA string `json:"checkout_sha"`
+
+	Project struct {
+		GitHTTPURL string `json:"git_http_url"`
+		GitSSHURL  string `json:"git_ssh_url"`
+		WebURL     string `json:"web_url"`
+	} `json:"project"`
+}
+
+func parseGitLab(req *http.Request, body []byte) (pushEvent, error) {
+	switch req.Header.Get("X-Gitlab-Event") {
+	case "Push Hook", "Tag Push Hook":
+	default:
+		return pushEvent{}, errIgnoredEvent
+	}
+
+	var p gitlabPush
+	if err := json.Unmarshal(body, &p); err != nil {
+		return pushEvent{}, err
+	}
+
+	// GitLab leaves checkout_sha empty when a ref is deleted.
+	if p.CheckoutSHA == "" {
+		return pushEvent{}, errIgnoredEvent
+	}
+
+	return pushEvent{
+		Remotes: nonEmpty(
+			p.Project.GitHTTPURL,
+			p.Project.GitSSHURL,
+			p.Project.WebURL,
+		),
+		Ref:    p.Ref,
+		Commit: p.CheckoutSHA,
+	}, nil
+}
+
+func nonEmpty(strs ...string) []string {
+	ret := []string{}
+	for _, s := range strs {
+		if s != "" {
+			ret = append(ret, s)
+		}
+	}
+
+	return ret
+}
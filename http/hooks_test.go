@@ -0,0 +1,220 @@
+package http
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/store"
+)
+
+const githubPushPayload = `{
+	"ref": "refs/heads/master",
+	"after": "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
+	"repository": {
+		"clone_url": "https://github.com/run-ci/run-server.git",
+		"ssh_url": "git@github.com:run-ci/run-server.git"
+	}
+}`
+
+const gitlabTagPayload = `{
+	"ref": "refs/tags/v1.0.0",
+	"checkout_sha": "82b3d5ae55f7080f1e6022629cdb57bfae7cccc7",
+	"project": {
+		"git_http_url": "http://EXAMPLE.com/test.git"
+	}
+}`
+
+func newHookServer(t *testing.T) (*Server, <-chan queue.Message) {
+	bus := queue.NewMemory()
+	trig := subscribe(t, bus, queue.SubjectTriggers)
+	st := newSeededStore(t)
+
+	srv := NewServer(":9001", bus, st)
+	srv.SetHookSecret("github", "s3cr3t")
+	srv.SetHookSecret("gitlab", "t0k3n")
+
+	return srv, trig
+}
+
+func githubSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestPostHookGitHubPush(t *testing.T) {
+	srv, trig := newHookServer(t)
+
+	body := []byte(githubPushPayload)
+	req := httptest.NewRequest(http.MethodPost, "http://test/hooks/github", bytes.NewBuffer(body))
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-Hub-Signature-256", githubSignature("s3cr3t", body))
+	rw := httptest.NewRecorder()
+
+	srv.Handler.ServeHTTP(rw, req)
+
+	resp := rw.Result()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status %v, got %v", http.StatusAccepted, resp.StatusCode)
+	}
+
+	rawmsg := (<-trig).Data
+	msg := map[string]string{}
+	err := json.Unmarshal(rawmsg, &msg)
+	if err != nil {
+		t.Fatalf("got error unmarshalling trigger message: %v", err)
+	}
+
+	if remote := msg["remote"]; remote != "https://github.com/run-ci/run-server.git" {
+		t.Fatalf(`expected "remote" to be the clone URL, got %v`, remote)
+	}
+
+	if branch := msg["branch"]; branch != "master" {
+		t.Fatalf(`expected "branch" to be set to "master", got %v`, branch)
+	}
+
+	if commit := msg["commit"]; commit != "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c" {
+		t.Fatalf(`expected "commit" to be set to the pushed commit, got %v`, commit)
+	}
+}
+
+func TestPostHookGitHubBadSignature(t *testing.T) {
+	srv, _ := newHookServer(t)
+
+	body := []byte(githubPushPayload)
+	req := httptest.NewRequest(http.MethodPost, "http://test/hooks/github", bytes.NewBuffer(body))
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-Hub-Signature-256", githubSignature("wrong", body))
+	rw := httptest.NewRecorder()
+
+	srv.Handler.ServeHTTP(rw, req)
+
+	resp := rw.Result()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected status %v, got %v", http.StatusUnauthorized, resp.StatusCode)
+	}
+}
+
+func TestPostHookUnknownRepo(t *testing.T) {
+	srv, _ := newHookServer(t)
+
+	body := []byte(`{
+		"ref": "refs/heads/master",
+		"after": "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
+		"repository": {"clone_url": "https://github.com/run-ci/unknown.git"}
+	}`)
+	req := httptest.NewRequest(http.MethodPost, "http://test/hooks/github", bytes.NewBuffer(body))
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-Hub-Signature-256", githubSignature("s3cr3t", body))
+	rw := httptest.NewRecorder()
+
+	srv.Handler.ServeHTTP(rw, req)
+
+	resp := rw.Result()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %v, got %v", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestPostHookBranchPatterns(t *testing.T) {
+	srv, _ := newHookServer(t)
+
+	_, err := srv.st.CreateProject(store.Project{
+		Name:     "patterns",
+		Remote:   "github.com/run-ci/patterns",
+		Branches: []string{"release/*", "!release/old"},
+		Enabled:  true,
+	})
+	if err != nil {
+		t.Fatalf("got error creating project: %v", err)
+	}
+
+	tests := []struct {
+		branch string
+		status int
+	}{
+		{"release/1.0", http.StatusAccepted},
+		{"release/old", http.StatusNotFound},
+		{"release/1.0/hotfix", http.StatusNotFound},
+		{"master", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		body := []byte(fmt.Sprintf(`{
+			"ref": "refs/heads/%v",
+			"after": "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
+			"repository": {"clone_url": "https://github.com/run-ci/patterns.git"}
+		}`, test.branch))
+		req := httptest.NewRequest(http.MethodPost, "http://test/hooks/github", bytes.NewBuffer(body))
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-Hub-Signature-256", githubSignature("s3cr3t", body))
+		rw := httptest.NewRecorder()
+
+		srv.Handler.ServeHTTP(rw, req)
+
+		if status := rw.Result().StatusCode; status != test.status {
+			t.Fatalf("expected status %v pushing to %v, got %v", test.status, test.branch, status)
+		}
+	}
+}
+
+func TestPostHookGitLabTag(t *testing.T) {
+	srv, trig := newHookServer(t)
+
+	body := []byte(gitlabTagPayload)
+	req := httptest.NewRequest(http.MethodPost, "http://test/hooks/gitlab", bytes.NewBuffer(body))
+	req.Header.Set("X-Gitlab-Event", "Tag Push Hook")
+	req.Header.Set("X-Gitlab-Token", "t0k3n")
+	rw := httptest.NewRecorder()
+
+	srv.Handler.ServeHTTP(rw, req)
+
+	resp := rw.Result()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status %v, got %v", http.StatusAccepted, resp.StatusCode)
+	}
+
+	rawmsg := (<-trig).Data
+	msg := map[string]string{}
+	err := json.Unmarshal(rawmsg, &msg)
+	if err != nil {
+		t.Fatalf("got error unmarshalling trigger message: %v", err)
+	}
+
+	if trigger := msg["trigger"]; trigger != "tag" {
+		t.Fatalf(`expected "trigger" to be set to "tag", got %v`, trigger)
+	}
+
+	if tag := msg["tag"]; tag != "v1.0.0" {
+		t.Fatalf(`expected "tag" to be set to "v1.0.0", got %v`, tag)
+	}
+
+	// The pushed remote is spelled differently from the registered one,
+	// so the trigger carries the registered one.
+	if remote := msg["remote"]; remote != "https://example.com/test.git" {
+		t.Fatalf(`expected "remote" to be the registered URL, got %v`, remote)
+	}
+}
+
+func TestPostHookUnknownProvider(t *testing.T) {
+	srv, _ := newHookServer(t)
+
+	req := httptest.NewRequest(http.MethodPost, "http://test/hooks/bitbucket", bytes.NewBufferString("{}"))
+	rw := httptest.NewRecorder()
+
+	srv.Handler.ServeHTTP(rw, req)
+
+	resp := rw.Result()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %v, got %v", http.StatusNotFound, resp.StatusCode)
+	}
+}
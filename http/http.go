@@ -3,8 +3,16 @@ package http
 import (
 	"context"
 	"net/http"
+	"sync"
 
+	"github.com/run-ci/run-server/agents"
+	"github.com/run-ci/run-server/leader"
+	"github.com/run-ci/run-server/logs"
+	"github.com/run-ci/run-server/logstream"
+	"github.com/run-ci/run-server/metrics"
+	"github.com/run-ci/run-server/queue"
 	"github.com/run-ci/run-server/store"
+	"github.com/run-ci/run-server/tasks"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -17,6 +25,7 @@ type ctxkey int
 
 const (
 	keyReqID ctxkey = iota
+	keyToken
 )
 
 func init() {
@@ -26,41 +35,213 @@ func init() {
 // Server is a net/http.Server with dependencies like
 // the database connection.
 type Server struct {
-	st     store.Repo
-	pollch chan<- []byte
+	st  store.Repo
+	bus queue.Bus
+
+	// pending tracks messages that are still being sent in the background.
+	pending sync.WaitGroup
+
+	hookSecrets map[string]string
+
+	// adminHash is the hash of the bootstrap admin token, if there is one.
+	adminHash string
+
+	// checks are run by /readyz, keyed by the dependency they check.
+	checks map[string]check
+
+	// elector is shown by /readyz, if there is one.
+	elector *leader.Elector
+
+	// fetcher gets the task files of runs started by hand.
+	fetcher tasks.Fetcher
+
+	dispatcher *agents.Dispatcher
+
+	logs *logstream.Hub
+
+	// logstore keeps the output of steps once it's been streamed.
+	logstore logs.LogStore
+
+	// closing is closed when the server starts shutting down, to end the
+	// streams that would otherwise keep it waiting.
+	closing   chan struct{}
+	closeOnce sync.Once
 
 	*http.Server
 }
 
 // NewServer returns a Server with a reference to `st`, listening
-// on `addr`.
-func NewServer(addr string, pollch chan<- []byte, st store.Repo) *Server {
+// on `addr`. Messages for pollers and build triggers are published
+// on `bus`.
+func NewServer(addr string, bus queue.Bus, st store.Repo) *Server {
 	srv := &Server{
 		Server: &http.Server{
 			Addr: addr,
 		},
 
-		st:     st,
-		pollch: pollch,
+		st:  st,
+		bus: bus,
+
+		hookSecrets: map[string]string{},
+
+		fetcher: tasks.Git{Timeout: taskFetchTimeout},
+
+		dispatcher: agents.NewDispatcher(st, bus),
+
+		logs:    logstream.NewHub(),
+		closing: make(chan struct{}),
+	}
+
+	srv.checks = map[string]check{
+		"store": st.Ping,
+		"queue": bus.Ping,
 	}
 
 	r := mux.NewRouter()
 	srv.Handler = r
 
-	r.Handle("/", chain(getRoot, setRequestID, logRequest)).
+	r.Handle("/", chain(getRoot, instrument, setRequestID, logRequest)).
+		Methods(http.MethodGet)
+
+	r.Handle("/healthz", chain(getHealthz, instrument, setRequestID, logRequest)).
+		Methods(http.MethodGet)
+
+	r.Handle("/readyz", chain(srv.getReadyz, instrument, setRequestID, logRequest)).
+		Methods(http.MethodGet)
+
+	r.Handle("/metrics", metrics.Handler()).
+		Methods(http.MethodGet)
+
+	r.Handle("/repos/git", chain(srv.postGitRepo, instrument, setRequestID, logRequest, srv.authorize(store.ScopeReposWrite))).
+		Methods(http.MethodPost)
+
+	r.Handle("/repos/git", chain(srv.getGitRepo, instrument, setRequestID, logRequest, srv.authorize(store.ScopeReposRead))).
 		Methods(http.MethodGet)
 
-	r.Handle("/repos/git", chain(srv.postGitRepo, setRequestID, logRequest)).
+	r.Handle("/repos/git", chain(srv.patchGitRepo, instrument, setRequestID, logRequest, srv.authorize(store.ScopeReposWrite))).
+		Methods(http.MethodPatch)
+
+	r.Handle("/repos/git", chain(srv.deleteGitRepo, instrument, setRequestID, logRequest, srv.authorize(store.ScopeReposWrite))).
+		Methods(http.MethodDelete)
+
+	r.Handle("/projects", chain(srv.postProject, instrument, setRequestID, logRequest, srv.authorize(store.ScopeReposWrite))).
 		Methods(http.MethodPost)
 
-	r.Handle("/repos/git", chain(srv.getGitRepo, setRequestID, logRequest)).
+	r.Handle("/projects", chain(srv.getProjects, instrument, setRequestID, logRequest, srv.authorize(store.ScopeReposRead))).
 		Methods(http.MethodGet)
 
-	// TODO: delete git repos
+	r.Handle("/projects/{id}", chain(srv.getProject, instrument, setRequestID, logRequest, srv.authorize(store.ScopeReposRead))).
+		Methods(http.MethodGet)
+
+	r.Handle("/projects/{id}", chain(srv.patchProject, instrument, setRequestID, logRequest, srv.authorize(store.ScopeReposWrite))).
+		Methods(http.MethodPatch)
+
+	r.Handle("/projects/{id}", chain(srv.deleteProject, instrument, setRequestID, logRequest, srv.authorize(store.ScopeReposWrite))).
+		Methods(http.MethodDelete)
+
+	r.Handle("/repos/git/runs", chain(srv.postGitRepoRun, instrument, setRequestID, logRequest, srv.authorize(store.ScopeRunsTrigger))).
+		Methods(http.MethodPost)
+
+	r.Handle("/repos/git/runs", chain(srv.getGitRepoRuns, instrument, setRequestID, logRequest, srv.authorize(store.ScopeReposRead))).
+		Methods(http.MethodGet)
+
+	r.Handle("/repos/git/schedules", chain(srv.postSchedule, instrument, setRequestID, logRequest, srv.authorize(store.ScopeReposWrite))).
+		Methods(http.MethodPost)
+
+	r.Handle("/repos/git/schedules", chain(srv.getSchedules, instrument, setRequestID, logRequest, srv.authorize(store.ScopeReposRead))).
+		Methods(http.MethodGet)
+
+	r.Handle("/repos/git/schedules/{id}", chain(srv.getSchedule, instrument, setRequestID, logRequest, srv.authorize(store.ScopeReposRead))).
+		Methods(http.MethodGet)
+
+	r.Handle("/repos/git/schedules/{id}", chain(srv.patchSchedule, instrument, setRequestID, logRequest, srv.authorize(store.ScopeReposWrite))).
+		Methods(http.MethodPatch)
+
+	r.Handle("/repos/git/schedules/{id}", chain(srv.deleteSchedule, instrument, setRequestID, logRequest, srv.authorize(store.ScopeReposWrite))).
+		Methods(http.MethodDelete)
+
+	r.Handle("/runs/{id}", chain(srv.getRun, instrument, setRequestID, logRequest, srv.authorize(store.ScopeReposRead))).
+		Methods(http.MethodGet)
+
+	// Anyone who can start runs can stop them too.
+	r.Handle("/runs/{id}/cancel", chain(srv.postRunCancel, instrument, setRequestID, logRequest, srv.authorize(store.ScopeRunsTrigger))).
+		Methods(http.MethodPost)
+
+	r.Handle("/runs/{id}/logs", chain(srv.getRunLogs, instrument, setRequestID, logRequest, srv.authorize(store.ScopeReposRead))).
+		Methods(http.MethodGet)
+
+	r.Handle("/runs/{id}/steps/{step}/log", chain(srv.getStepLog, instrument, setRequestID, logRequest, srv.authorize(store.ScopeReposRead))).
+		Methods(http.MethodGet)
+
+	// Validating a task doesn't touch anything, so any token will do.
+	r.Handle("/tasks/validate", chain(srv.postTaskValidate, instrument, setRequestID, logRequest, srv.authorize(store.ScopeReposRead))).
+		Methods(http.MethodPost)
+
+	r.Handle("/agents", chain(srv.postAgent, instrument, setRequestID, logRequest, srv.authorize(store.ScopeAgentsRun))).
+		Methods(http.MethodPost)
+
+	r.Handle("/agents", chain(srv.getAgents, instrument, setRequestID, logRequest, srv.authorize(store.ScopeReposRead))).
+		Methods(http.MethodGet)
+
+	r.Handle("/agents/{id}/heartbeat", chain(srv.postAgentHeartbeat, instrument, setRequestID, logRequest, srv.authorize(store.ScopeAgentsRun))).
+		Methods(http.MethodPost)
+
+	r.Handle("/tokens", chain(srv.postToken, instrument, setRequestID, logRequest, srv.authorize(store.ScopeAdmin))).
+		Methods(http.MethodPost)
+
+	r.Handle("/tokens", chain(srv.getTokens, instrument, setRequestID, logRequest, srv.authorize(store.ScopeAdmin))).
+		Methods(http.MethodGet)
+
+	r.Handle("/tokens/{id}", chain(srv.deleteToken, instrument, setRequestID, logRequest, srv.authorize(store.ScopeAdmin))).
+		Methods(http.MethodDelete)
+
+	// Webhooks are authenticated by their signatures, not by tokens.
+	r.Handle("/hooks/{provider}", chain(srv.postHook, instrument, setRequestID, logRequest)).
+		Methods(http.MethodPost)
 
 	return srv
 }
 
+// Shutdown stops the server from accepting new requests and waits for
+// in-flight requests and background sends to finish. If `ctx` expires
+// first, whatever is left is abandoned and the context's error is returned.
+// It's safe to call more than once.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	logger.Info("draining in-flight requests")
+	srv.closeOnce.Do(func() {
+		close(srv.closing)
+	})
+	if err := srv.Server.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		srv.pending.Wait()
+		close(done)
+	}()
+
+	logger.Info("waiting for pending messages to be sent")
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		logger.Warn("gave up waiting for pending messages")
+		return ctx.Err()
+	}
+}
+
+// Send publishes `msg` on `subj` in the background, retrying with backoff.
+// Shutdown waits for it to finish.
+func (srv *Server) send(logger *logrus.Entry, subj string, msg []byte) {
+	srv.pending.Add(1)
+	go func() {
+		defer srv.pending.Done()
+
+		sendWithBackoff(logger, srv.bus, subj, msg)
+	}()
+}
+
 // Middleware is a function that can intercept the handling of an HTTP request
 // to do something useful.
 type middleware func(http.HandlerFunc) http.HandlerFunc
@@ -0,0 +1,104 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/store"
+	"github.com/sirupsen/logrus"
+)
+
+// downBus is a queue.Bus that can't publish anything.
+type downBus struct {
+	*queue.Memory
+}
+
+func (downBus) Publish(string, []byte) error {
+	return errors.New("bus is down")
+}
+
+func TestShutdownWaitsForSends(t *testing.T) {
+	bus := queue.NewMemory()
+	recv := subscribe(t, bus, queue.SubjectPollers)
+
+	srv := NewServer(":9001", bus, store.NewMemory())
+	srv.send(logrus.WithField("test", t.Name()), queue.SubjectPollers, []byte("hello"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("got error shutting down: %v", err)
+	}
+
+	select {
+	case msg := <-recv:
+		if string(msg.Data) != "hello" {
+			t.Fatalf("expected hello, got %s", msg.Data)
+		}
+	default:
+		t.Fatal("expected message to be sent before shutdown returned")
+	}
+}
+
+func TestShutdownGivesUp(t *testing.T) {
+	srv := NewServer(":9001", downBus{queue.NewMemory()}, store.NewMemory())
+	srv.send(logrus.WithField("test", t.Name()), queue.SubjectPollers, []byte("hello"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestShutdownTwice(t *testing.T) {
+	srv := NewServer(":9001", queue.NewMemory(), store.NewMemory())
+
+	for i := 0; i < 2; i++ {
+		if err := srv.Shutdown(context.Background()); err != nil {
+			t.Fatalf("got error shutting down: %v", err)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	srv := NewServer(":9001", queue.NewMemory(), store.NewMemory())
+	srv.SetAdminToken(testAdminToken)
+
+	req := httptest.NewRequest(http.MethodGet, "http://test/runs/42", nil)
+	setToken(req, testAdminToken)
+	srv.Handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest(http.MethodGet, "http://test/metrics", nil)
+	rw := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rw, req)
+
+	resp := rw.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	payload, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("got error reading response body: %v", err)
+	}
+	defer resp.Body.Close()
+
+	for _, want := range []string{
+		`run_http_requests_total{method="GET",route="/runs/{id}",status="404"} 1`,
+		`run_http_request_duration_seconds_count{method="GET",route="/runs/{id}",status="404"} 1`,
+	} {
+		if !strings.Contains(string(payload), want) {
+			t.Fatalf("expected metrics to contain %q, got:\n%s", want, payload)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/run-ci/run-server/logstream"
+	"github.com/run-ci/run-server/store"
+)
+
+// logKeepAlive is how often idle log streams are pinged, which is also
+// how often they check whether their run finished without saying so.
+var logKeepAlive = 15 * time.Second
+
+// SetLogHub replaces the hub log streams are served from, so that it can
+// be fed from the queue.
+func (srv *Server) SetLogHub(hub *logstream.Hub) {
+	srv.logs = hub
+}
+
+// logWriter sends log lines to a single viewer.
+type logWriter interface {
+	// Line sends `line`. Lines marked EOF end the stream.
+	Line(logstream.Line) error
+
+	// Ping lets the viewer know the stream is still alive.
+	Ping() error
+}
+
+// getRunLogs streams the output of a run as it happens, over Server-Sent
+// Events or, for requests asking for an upgrade, a WebSocket. Each line is
+// numbered, and viewers can resume after the last line they got by sending
+// its number as the Last-Event-ID header or the `after` argument. Runs
+// that are already done get the output that's kept for them and then the
+// end of the stream.
+func (srv *Server) getRunLogs(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	id, err := strconv.Atoi(mux.Vars(req)["id"])
+	if err != nil {
+		logger.WithField("error", err).Error("invalid run ID")
+
+		writeErrResp(rw, errors.New("invalid run ID"), http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("run_id", id)
+
+	after := 0
+	raw := req.Header.Get("Last-Event-ID")
+	if raw == "" {
+		raw = req.URL.Query().Get("after")
+	}
+	if raw != "" {
+		after, err = strconv.Atoi(raw)
+		if err != nil || after < 0 {
+			logger.WithField("error", err).Error("invalid last event ID")
+
+			writeErrResp(rw, errors.New("invalid last event ID"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	run, err := srv.st.GetRun(id)
+	if err == store.ErrNotFound {
+		logger.WithField("error", err).Error("run not found in database")
+
+		writeErrResp(rw, errors.New("run not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.WithField("error", err).Error("unable to fetch run from database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	// Streams don't end on their own, so they have to be told when the
+	// server is going away.
+	go func() {
+		select {
+		case <-srv.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var w logWriter
+	if isWebSocket(req) {
+		conn, err := upgradeWebSocket(rw, req)
+		if err != nil {
+			logger.WithField("error", err).Error("unable to upgrade to websocket")
+			return
+		}
+		defer conn.Close()
+
+		go func() {
+			conn.readLoop()
+			cancel()
+		}()
+
+		w = wsLogWriter{conn}
+	} else {
+		flusher, ok := rw.(http.Flusher)
+		if !ok {
+			logger.Error("response can't be streamed")
+
+			writeErrResp(rw, errors.New("streaming unsupported"), http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Header().Set("Cache-Control", "no-cache")
+		rw.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		w = sseLogWriter{rw, flusher}
+	}
+
+	logger.Debugf("streaming logs after line %v", after)
+	if err := srv.streamLogs(ctx, w, run, after); err != nil {
+		logger.WithField("error", err).Debug("log stream ended")
+	}
+}
+
+// streamLogs sends the output of `run` after line `after` to `w` until the
+// run's output ends or `ctx` is done.
+func (srv *Server) streamLogs(ctx context.Context, w logWriter, run store.Run, after int) error {
+	logger := logger.WithField("run_id", run.ID)
+
+	if run.Status.Done() {
+		return srv.sendFinished(w, run, after)
+	}
+
+	lines, v := srv.logs.Watch(run.ID, after)
+	defer v.Close()
+
+	if err := sendLines(w, lines, after, false); err != nil {
+		return err
+	}
+	if len(lines) > 0 {
+		after = lines[len(lines)-1].Seq
+	}
+
+	ticker := time.NewTicker(logKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case line, ok := <-v.C():
+			// A closed channel without the end of the output means
+			// the viewer was cut off. It can resume from where it got
+			// to, so the stream just ends.
+			if !ok {
+				return nil
+			}
+
+			if err := w.Line(line); err != nil || line.EOF {
+				return err
+			}
+			after = line.Seq
+
+		case <-ticker.C:
+			if err := w.Ping(); err != nil {
+				return err
+			}
+
+			// Runs can end without the end of their output ever
+			// arriving, for example when their agent went away.
+			current, err := srv.st.GetRun(run.ID)
+			if err != nil {
+				logger.WithField("error", err).Warn("unable to check on run")
+				continue
+			}
+
+			if current.Status.Done() {
+				lines, _ := srv.logs.Lines(run.ID, after)
+				return sendLines(w, lines, after, true)
+			}
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sendFinished sends the output of `run`, which is done, after line
+// `after`. The output that's stored is preferred, since it's all there,
+// but what's been streamed through this server is used otherwise.
+func (srv *Server) sendFinished(w logWriter, run store.Run, after int) error {
+	lines, found, err := srv.storedLines(run, after)
+	if err != nil {
+		logger.WithField("run_id", run.ID).WithField("error", err).
+			Warn("unable to read stored logs")
+	}
+
+	if !found || err != nil {
+		lines, _ = srv.logs.Lines(run.ID, after)
+	}
+
+	return sendLines(w, lines, after, true)
+}
+
+// sendLines sends `lines`, which come after line `after`. If `end` is set,
+// the stream is ended afterwards if the lines didn't end it already.
+func sendLines(w logWriter, lines []logstream.Line, after int, end bool) error {
+	for _, line := range lines {
+		if err := w.Line(line); err != nil || line.EOF {
+			return err
+		}
+		after = line.Seq
+	}
+
+	if !end {
+		return nil
+	}
+
+	return w.Line(logstream.Line{Seq: after, EOF: true})
+}
+
+// sseLogWriter sends lines as Server-Sent Events, using their numbers as
+// event IDs so browsers resume from the right place on their own.
+type sseLogWriter struct {
+	rw      http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (w sseLogWriter) Line(line logstream.Line) error {
+	var err error
+	if line.EOF {
+		_, err = fmt.Fprintf(w.rw, "id: %v\nevent: end\ndata: {}\n\n", line.Seq)
+	} else {
+		var buf []byte
+		buf, err = json.Marshal(line)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w.rw, "id: %v\ndata: %s\n\n", line.Seq, buf)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.flusher.Flush()
+	return nil
+}
+
+func (w sseLogWriter) Ping() error {
+	if _, err := fmt.Fprint(w.rw, ": ping\n\n"); err != nil {
+		return err
+	}
+
+	w.flusher.Flush()
+	return nil
+}
+
+// wsLogWriter sends each line as a JSON text message. The end of the
+// output is sent as a line marked EOF.
+type wsLogWriter struct {
+	conn *wsConn
+}
+
+func (w wsLogWriter) Line(line logstream.Line) error {
+	buf, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+
+	return w.conn.WriteText(buf)
+}
+
+func (w wsLogWriter) Ping() error {
+	return w.conn.Ping()
+}
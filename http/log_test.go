@@ -0,0 +1,277 @@
+package http
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/run-ci/run-server/logstream"
+	"github.com/run-ci/run-server/store"
+)
+
+// sseEvent is a single event read off a Server-Sent Events stream.
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// readEvents reads `n` events from `r`, skipping comments.
+func readEvents(t *testing.T, r *bufio.Reader, n int) []sseEvent {
+	events := []sseEvent{}
+	ev := sseEvent{}
+
+	for len(events) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("got error reading event stream after %+v: %v", events, err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "":
+			if ev != (sseEvent{}) {
+				events = append(events, ev)
+			}
+			ev = sseEvent{}
+		case strings.HasPrefix(line, "id: "):
+			ev.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			ev.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+
+	return events
+}
+
+func getLogs(t *testing.T, ts *httptest.Server, url, lastEventID string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, ts.URL+url, nil)
+	if err != nil {
+		t.Fatalf("got error building request: %v", err)
+	}
+	setToken(req, testAdminToken)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("got error getting logs: %v", err)
+	}
+
+	return resp
+}
+
+func TestGetRunLogsFinished(t *testing.T) {
+	srv, st := newRunServer(t)
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	if _, err := st.UpdateRunStatus(1, store.RunCancelled); err != nil {
+		t.Fatalf("got error finishing run: %v", err)
+	}
+
+	// The end of the output never made it, but the run is over anyway.
+	srv.logs.Add(1, logstream.Line{Seq: 1, Text: "one"})
+	srv.logs.Add(1, logstream.Line{Seq: 2, Text: "two"})
+
+	resp := getLogs(t, ts, "/runs/1/logs", "1")
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %v", ct)
+	}
+
+	events := readEvents(t, bufio.NewReader(resp.Body), 2)
+
+	line := logstream.Line{}
+	if err := json.Unmarshal([]byte(events[0].data), &line); err != nil {
+		t.Fatalf("got error unmarshalling line: %v", err)
+	}
+
+	if events[0].id != "2" || line.Text != "two" {
+		t.Fatalf("expected line two, got %+v", events[0])
+	}
+
+	if events[1].event != "end" || events[1].id != "2" {
+		t.Fatalf("expected the end after line two, got %+v", events[1])
+	}
+}
+
+func TestGetRunLogsLive(t *testing.T) {
+	srv, _ := newRunServer(t)
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	srv.logs.Add(1, logstream.Line{Seq: 1, Text: "one"})
+
+	resp := getLogs(t, ts, "/runs/1/logs", "")
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+
+	if events := readEvents(t, r, 1); events[0].id != "1" {
+		t.Fatalf("expected line one, got %+v", events)
+	}
+
+	srv.logs.Add(1, logstream.Line{Seq: 2, Text: "two"})
+	srv.logs.Add(1, logstream.Line{EOF: true})
+
+	events := readEvents(t, r, 2)
+	if events[0].id != "2" || events[1].event != "end" || events[1].id != "3" {
+		t.Fatalf("expected line two and the end, got %+v", events)
+	}
+}
+
+func TestGetRunLogsEndsWithRun(t *testing.T) {
+	defer func(d time.Duration) { logKeepAlive = d }(logKeepAlive)
+	logKeepAlive = 10 * time.Millisecond
+
+	srv, st := newRunServer(t)
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	resp := getLogs(t, ts, "/runs/2/logs", "")
+	defer resp.Body.Close()
+
+	if _, err := st.UpdateRunStatus(2, store.RunErrored); err != nil {
+		t.Fatalf("got error finishing run: %v", err)
+	}
+
+	if events := readEvents(t, bufio.NewReader(resp.Body), 1); events[0].event != "end" {
+		t.Fatalf("expected the end, got %+v", events)
+	}
+}
+
+func TestGetRunLogsInvalid(t *testing.T) {
+	srv, _ := newRunServer(t)
+
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{"/runs/nope/logs", http.StatusBadRequest},
+		{"/runs/1/logs?after=-1", http.StatusBadRequest},
+		{"/runs/42/logs", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		if resp := do(t, srv, http.MethodGet, test.url, nil); resp.StatusCode != test.status {
+			t.Fatalf("expected status %v for %v, got %v", test.status, test.url, resp.StatusCode)
+		}
+	}
+}
+
+// dialLogs opens a WebSocket to the logs at `url` with `dialer`.
+func dialLogs(t *testing.T, ts *httptest.Server, dialer *websocket.Dialer, url string) *websocket.Conn {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+testAdminToken)
+
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+url, header)
+	if err != nil {
+		t.Fatalf("got error dialing logs: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected websocket handshake, got %v", resp.Status)
+	}
+
+	return conn
+}
+
+// readWSLine reads a single line sent as a text message.
+func readWSLine(t *testing.T, conn *websocket.Conn) logstream.Line {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	typ, buf, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("got error reading message: %v", err)
+	}
+
+	if typ != websocket.TextMessage {
+		t.Fatalf("expected a text message, got type %v", typ)
+	}
+
+	line := logstream.Line{}
+	if err := json.Unmarshal(buf, &line); err != nil {
+		t.Fatalf("got error unmarshalling line: %v", err)
+	}
+
+	return line
+}
+
+func TestGetRunLogsWebSocket(t *testing.T) {
+	srv, _ := newRunServer(t)
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	srv.logs.Add(1, logstream.Line{Seq: 1, Text: "one"})
+	srv.logs.Add(1, logstream.Line{Seq: 2, Text: "two"})
+
+	conn := dialLogs(t, ts, websocket.DefaultDialer, "/runs/1/logs?after=1")
+	defer conn.Close()
+
+	srv.logs.Add(1, logstream.Line{EOF: true})
+
+	got := []logstream.Line{readWSLine(t, conn), readWSLine(t, conn)}
+	if got[0].Text != "two" || !got[1].EOF {
+		t.Fatalf("expected line two and the end, got %+v", got)
+	}
+}
+
+func TestGetRunLogsWebSocketFragmented(t *testing.T) {
+	srv, _ := newRunServer(t)
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	// A small write buffer makes the client split its messages into
+	// several frames.
+	dialer := &websocket.Dialer{WriteBufferSize: 16}
+	conn := dialLogs(t, ts, dialer, "/runs/1/logs")
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 100))); err != nil {
+		t.Fatalf("got error writing message: %v", err)
+	}
+
+	// Pongs come back in order, so once this one arrives the server has
+	// read the whole message and is still streaming.
+	conn.SetPongHandler(func(string) error {
+		srv.logs.Add(1, logstream.Line{Seq: 1, Text: "one"})
+		return nil
+	})
+
+	if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("got error writing ping: %v", err)
+	}
+
+	if line := readWSLine(t, conn); line.Text != "one" {
+		t.Fatalf("expected line one, got %+v", line)
+	}
+}
+
+func TestGetRunLogsWebSocketClose(t *testing.T) {
+	srv, _ := newRunServer(t)
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	conn := dialLogs(t, ts, websocket.DefaultDialer, "/runs/1/logs")
+	defer conn.Close()
+
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("got error writing close: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected the close to be echoed, got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package http
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/run-ci/run-server/metrics"
+)
+
+var (
+	requests = metrics.NewCounterVec("run_http_requests_total",
+		"HTTP requests handled, by route, method and status.", "route", "method", "status")
+
+	requestDuration = metrics.NewHistogramVec("run_http_request_duration_seconds",
+		"How long HTTP requests took to handle, by route, method and status.",
+		metrics.DefaultBuckets, "route", "method", "status")
+
+	sendRetries = metrics.NewCounterVec("run_send_retries_total",
+		"Times sending a message had to be retried.", "subject")
+
+	sendDrops = metrics.NewCounterVec("run_send_dropped_total",
+		"Messages given up on after running out of retries.", "subject")
+)
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes flushes through, so that streamed responses aren't held
+// back by being recorded.
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack passes hijacking through for connections being upgraded, which
+// are recorded as switching protocols.
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+
+	rec.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
+
+// Instrument records the number and duration of requests. Requests are
+// labeled with the route's path template rather than the actual path, so
+// that things like run IDs don't each get their own series.
+func instrument(f http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(req); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		rec := &statusRecorder{
+			ResponseWriter: rw,
+			status:         http.StatusOK,
+		}
+
+		start := time.Now()
+		f(rec, req)
+
+		status := strconv.Itoa(rec.status)
+		requestDuration.Observe(time.Since(start).Seconds(), route, req.Method, status)
+		requests.Inc(route, req.Method, status)
+	}
+}
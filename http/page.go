@@ -0,0 +1,71 @@
+package http
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+var errBadCursor = errors.New("invalid 'cursor' argument")
+
+// pageLimit returns the page size asked for in the "limit" argument.
+func pageLimit(req *http.Request) (int, error) {
+	raw := req.URL.Query().Get("limit")
+	if raw == "" {
+		return defaultPageLimit, nil
+	}
+
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 1 || limit > maxPageLimit {
+		return 0, fmt.Errorf("'limit' must be between 1 and %v", maxPageLimit)
+	}
+
+	return limit, nil
+}
+
+// encodeCursor returns an opaque cursor pointing just past `v`.
+func encodeCursor(v interface{}) (string, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// decodeCursor reads a cursor made by encodeCursor into `v`.
+func decodeCursor(cursor string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return errBadCursor
+	}
+
+	if err := json.Unmarshal(buf, v); err != nil {
+		return errBadCursor
+	}
+
+	return nil
+}
+
+// setNextLink points clients at the next page of results, which is the
+// current request with its cursor replaced, in the Link header. It returns
+// the link too, for the response body.
+func setNextLink(rw http.ResponseWriter, req *http.Request, cursor string) string {
+	next := *req.URL
+	query := next.Query()
+	query.Set("cursor", cursor)
+	next.RawQuery = query.Encode()
+
+	link := next.RequestURI()
+	rw.Header().Set("Link", fmt.Sprintf(`<%v>; rel="next"`, link))
+
+	return link
+}
@@ -0,0 +1,564 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/run-ci/run-server/branches"
+	"github.com/run-ci/run-server/remote"
+	"github.com/run-ci/run-server/store"
+	"github.com/sirupsen/logrus"
+)
+
+type projectRequest struct {
+	Name          string   `json:"name"`
+	Remote        string   `json:"remote"`
+	DefaultBranch string   `json:"default_branch"`
+	Branches      []string `json:"branches"`
+	Credentials   string   `json:"credentials"`
+	ConfigPath    string   `json:"config_path"`
+	Enabled       *bool    `json:"enabled"`
+}
+
+// projectPatchRequest only changes the fields that are set.
+type projectPatchRequest struct {
+	Name          *string   `json:"name"`
+	Remote        *string   `json:"remote"`
+	DefaultBranch *string   `json:"default_branch"`
+	Branches      *[]string `json:"branches"`
+	Credentials   *string   `json:"credentials"`
+	ConfigPath    *string   `json:"config_path"`
+	Enabled       *bool     `json:"enabled"`
+}
+
+type projectResponse struct {
+	ID              int       `json:"id"`
+	Name            string    `json:"name"`
+	Remote          string    `json:"remote"`
+	CanonicalRemote string    `json:"canonical_remote"`
+	DefaultBranch   string    `json:"default_branch"`
+	Branches        []string  `json:"branches"`
+	Credentials     string    `json:"credentials"`
+	ConfigPath      string    `json:"config_path"`
+	Enabled         bool      `json:"enabled"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+func newProjectResponse(p store.Project) projectResponse {
+	return projectResponse{
+		ID:              p.ID,
+		Name:            p.Name,
+		Remote:          p.CloneURL(),
+		CanonicalRemote: p.Remote,
+		DefaultBranch:   p.DefaultBranch,
+		Branches:        p.Branches,
+		Credentials:     p.Credentials,
+		ConfigPath:      p.ConfigPath,
+		Enabled:         p.Enabled,
+		CreatedAt:       p.CreatedAt,
+	}
+}
+
+// setProjectRemote parses `raw` and sets it as the project's remote.
+func setProjectRemote(p *store.Project, raw string) error {
+	r, err := remote.Parse(raw)
+	if rerr, ok := err.(*remote.Error); ok {
+		return fieldErrors{"remote": rerr.Reason}
+	}
+	if err != nil {
+		return err
+	}
+
+	p.Remote = r.Canonical()
+	p.URL = strings.TrimSpace(raw)
+
+	if p.Name == "" {
+		p.Name = strings.TrimSuffix(path.Base(r.Path), ".git")
+	}
+
+	return nil
+}
+
+// validateProject returns field errors for anything wrong with `p`, or nil
+// if there's nothing wrong with it.
+func validateProject(p store.Project) error {
+	errs := fieldErrors{}
+
+	if p.Name == "" {
+		errs["name"] = "name is empty"
+	}
+
+	if p.DefaultBranch == "" {
+		errs["default_branch"] = "default branch is empty"
+	}
+
+	for _, branch := range p.Branches {
+		if err := branches.Validate(branch); err != nil {
+			errs["branches"] = err.Error()
+		}
+	}
+
+	if path.IsAbs(p.ConfigPath) || strings.HasPrefix(path.Clean(p.ConfigPath), "..") {
+		errs["config_path"] = "config path must be inside the repo"
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// projectPollerMessages builds the poller messages that get pollers from
+// tracking the project as it was to tracking it as it is after a change.
+// Either can be nil, for projects that are being created or deleted.
+// Disabled projects aren't tracked at all.
+//
+// Pollers get a create or delete for every pattern that starts or stops
+// being tracked, each carrying the project's whole pattern set. Changes to
+// exclusions alone don't start or stop tracking anything, so pollers are
+// sent the new pattern set on its own instead.
+func projectPollerMessages(logger *logrus.Entry) store.MessageFunc {
+	return func(old, new *store.Project) []store.Message {
+		return projectChangeMessages(logger, old, new)
+	}
+}
+
+// projectChangeMessages returns the poller messages for the change from
+// `old` to `new`, as described by projectPollerMessages.
+func projectChangeMessages(logger *logrus.Entry, old, new *store.Project) []store.Message {
+	tracked := func(p *store.Project) []store.GitRepo {
+		if !polled(p) {
+			return nil
+		}
+
+		repos := []store.GitRepo{}
+		for _, repo := range p.GitRepos() {
+			if !branches.IsExclusion(repo.Branch) {
+				repos = append(repos, repo)
+			}
+		}
+
+		return repos
+	}
+
+	// Pollers know repos by the URL they clone, so a change of URL means
+	// a different repo as far as they're concerned.
+	contains := func(repos []store.GitRepo, repo store.GitRepo) bool {
+		for _, r := range repos {
+			if r.CloneURL() == repo.CloneURL() && r.Branch == repo.Branch {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	before, after := tracked(old), tracked(new)
+
+	msgs := []map[string]interface{}{}
+	for _, repo := range before {
+		if !contains(after, repo) {
+			msgs = append(msgs, map[string]interface{}{
+				"op":       "delete",
+				"remote":   repo.CloneURL(),
+				"branch":   repo.Branch,
+				"patterns": patternsOf(new),
+			})
+		}
+	}
+
+	for _, repo := range after {
+		if !contains(before, repo) {
+			msgs = append(msgs, map[string]interface{}{
+				"op":       "create",
+				"remote":   repo.CloneURL(),
+				"branch":   repo.Branch,
+				"patterns": patternsOf(new),
+			})
+		}
+	}
+
+	if len(before) > 0 && len(after) > 0 && old.CloneURL() == new.CloneURL() &&
+		!equalStrings(exclusions(old.Branches), exclusions(new.Branches)) {
+		msgs = append(msgs, patternsMessage(new.CloneURL(), patternsOf(new)))
+	}
+
+	return pollerMessages(logger, msgs...)
+}
+
+// polled returns whether pollers track `p`, which they only do for
+// projects that exist and are enabled.
+func polled(p *store.Project) bool {
+	return p != nil && p.Enabled
+}
+
+// patternsOf returns the patterns `p` tracks sorted, or none if it's nil
+// or disabled.
+func patternsOf(p *store.Project) []string {
+	if !polled(p) {
+		return []string{}
+	}
+
+	patterns := append([]string{}, p.Branches...)
+	sort.Strings(patterns)
+	return patterns
+}
+
+// patternsMessage tells pollers the pattern set of `remote` changed
+// without any pattern starting or stopping being tracked.
+func patternsMessage(remote string, patterns []string) map[string]interface{} {
+	return map[string]interface{}{
+		"op":       "patterns",
+		"remote":   remote,
+		"patterns": patterns,
+	}
+}
+
+// exclusions returns the exclusions in `patterns`, sorted.
+func exclusions(patterns []string) []string {
+	excl := []string{}
+	for _, pattern := range patterns {
+		if branches.IsExclusion(pattern) {
+			excl = append(excl, pattern)
+		}
+	}
+
+	sort.Strings(excl)
+	return excl
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (srv *Server) postProject(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	logger.Debug("reading request body")
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to read request body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	logger.Debug("unmarshaling request body")
+	var preq projectRequest
+	err = json.Unmarshal(buf, &preq)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to unmarshal request body")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	p := store.Project{
+		Name:          preq.Name,
+		DefaultBranch: preq.DefaultBranch,
+		Branches:      preq.Branches,
+		Credentials:   preq.Credentials,
+		ConfigPath:    preq.ConfigPath,
+		Enabled:       preq.Enabled == nil || *preq.Enabled,
+	}
+
+	if p.DefaultBranch == "" {
+		p.DefaultBranch = "master"
+	}
+
+	if p.Branches == nil {
+		p.Branches = []string{p.DefaultBranch}
+	}
+
+	if p.ConfigPath == "" {
+		p.ConfigPath = store.DefaultConfigPath
+	}
+
+	if err := setProjectRemote(&p, preq.Remote); err != nil {
+		logger.WithField("error", err).Error("invalid remote")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := validateProject(p); err != nil {
+		logger.WithField("error", err).Error("invalid project")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("remote", p.Remote)
+
+	logger.Info("adding project")
+	p, err = srv.st.CreateProject(p, projectPollerMessages(logger))
+	if err == store.ErrConflict {
+		logger.WithField("error", err).Error("project already exists")
+
+		writeErrResp(rw, errors.New("project already exists for remote"), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to save project in database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	buf, err = json.Marshal(newProjectResponse(p))
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to marshal response body")
+
+		writeErrResp(rw, err, http.StatusAccepted)
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+	rw.Write(buf)
+	return
+}
+
+func (srv *Server) getProjects(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	logger.Debug("getting projects")
+
+	projects, err := srv.st.GetProjects()
+	if err != nil {
+		logger.WithField("error", err).Error("unable to get projects from database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := []projectResponse{}
+	for _, p := range projects {
+		resp = append(resp, newProjectResponse(p))
+	}
+
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		logger.WithField("error", err).Error("unable to marshal response body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf)
+	return
+}
+
+// projectFromPath fetches the project whose ID is in the request path,
+// writing an error response if it can't.
+func (srv *Server) projectFromPath(logger *logrus.Entry, rw http.ResponseWriter, req *http.Request) (store.Project, bool) {
+	id, err := strconv.Atoi(mux.Vars(req)["id"])
+	if err != nil {
+		logger.WithField("error", err).Error("invalid project ID")
+
+		writeErrResp(rw, errors.New("invalid project ID"), http.StatusBadRequest)
+		return store.Project{}, false
+	}
+
+	p, err := srv.st.GetProject(id)
+	if err == store.ErrNotFound {
+		logger.WithField("error", err).Error("project not found in database")
+
+		writeErrResp(rw, errors.New("project not found"), http.StatusNotFound)
+		return p, false
+	}
+	if err != nil {
+		logger.WithField("error", err).Error("unable to fetch project from database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return p, false
+	}
+
+	return p, true
+}
+
+func (srv *Server) getProject(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	p, ok := srv.projectFromPath(logger, rw, req)
+	if !ok {
+		return
+	}
+
+	buf, err := json.Marshal(newProjectResponse(p))
+	if err != nil {
+		logger.WithField("error", err).Error("unable to marshal response body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf)
+	return
+}
+
+func (srv *Server) patchProject(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	old, ok := srv.projectFromPath(logger, rw, req)
+	if !ok {
+		return
+	}
+
+	logger = logger.WithField("project_id", old.ID)
+
+	logger.Debug("reading request body")
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to read request body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	logger.Debug("unmarshaling request body")
+	var patch projectPatchRequest
+	err = json.Unmarshal(buf, &patch)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to unmarshal request body")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	// Branches are left to the store unless they're being replaced, so
+	// branches tracked since the project was read aren't lost.
+	p := old
+	p.Branches = nil
+
+	if patch.Name != nil {
+		p.Name = *patch.Name
+	}
+	if patch.DefaultBranch != nil {
+		p.DefaultBranch = *patch.DefaultBranch
+	}
+	if patch.Branches != nil {
+		p.Branches = append([]string{}, *patch.Branches...)
+	}
+	if patch.Credentials != nil {
+		p.Credentials = *patch.Credentials
+	}
+	if patch.ConfigPath != nil {
+		p.ConfigPath = *patch.ConfigPath
+	}
+	if patch.Enabled != nil {
+		p.Enabled = *patch.Enabled
+	}
+
+	if patch.Remote != nil {
+		if err := setProjectRemote(&p, *patch.Remote); err != nil {
+			logger.WithField("error", err).Error("invalid remote")
+
+			writeErrResp(rw, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := validateProject(p); err != nil {
+		logger.WithField("error", err).Error("invalid project")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Info("updating project")
+	p, err = srv.st.UpdateProject(p, projectPollerMessages(logger))
+	if err == store.ErrNotFound {
+		logger.WithField("error", err).Error("project not found in database")
+
+		writeErrResp(rw, errors.New("project not found"), http.StatusNotFound)
+		return
+	}
+	if err == store.ErrConflict {
+		logger.WithField("error", err).Error("project already exists")
+
+		writeErrResp(rw, errors.New("project already exists for remote"), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to update project in database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	buf, err = json.Marshal(newProjectResponse(p))
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to marshal response body")
+
+		writeErrResp(rw, err, http.StatusAccepted)
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+	rw.Write(buf)
+	return
+}
+
+func (srv *Server) deleteProject(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	p, ok := srv.projectFromPath(logger, rw, req)
+	if !ok {
+		return
+	}
+
+	logger = logger.WithField("project_id", p.ID)
+
+	logger.Info("deleting project")
+	err := srv.st.DeleteProject(p.ID, projectPollerMessages(logger))
+	if err == store.ErrNotFound {
+		logger.WithField("error", err).Error("project not found in database")
+
+		writeErrResp(rw, errors.New("project not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to delete project from database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+	return
+}
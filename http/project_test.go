@@ -0,0 +1,248 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/store"
+)
+
+// do sends an admin request for `url` with `body` marshaled as JSON, if
+// it isn't nil, through the server's router.
+func do(t *testing.T, srv *Server, method, url string, body interface{}) *http.Response {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatalf("got error when marshaling request payload: %v", err)
+		}
+	}
+
+	req := httptest.NewRequest(method, "http://test"+url, &buf)
+	setToken(req, testAdminToken)
+	rw := httptest.NewRecorder()
+
+	srv.Handler.ServeHTTP(rw, req)
+
+	return rw.Result()
+}
+
+// pollerOps returns the "op remote#branch" of every message waiting in the
+// outbox, and marks them delivered.
+func pollerOps(t *testing.T, st store.Repo) []string {
+	msgs, err := st.GetPendingMessages(100)
+	if err != nil {
+		t.Fatalf("got error getting pending messages: %v", err)
+	}
+
+	ops := []string{}
+	for _, msg := range msgs {
+		plrmsg := pollerMessage{}
+		if err := json.Unmarshal(msg.Payload, &plrmsg); err != nil {
+			t.Fatalf("got error unmarshalling poller message: %v", err)
+		}
+
+		ops = append(ops, fmt.Sprintf("%v %v#%v", plrmsg.Op, plrmsg.Remote, plrmsg.Branch))
+
+		if err := st.MarkMessageDelivered(msg.ID); err != nil {
+			t.Fatalf("got error marking message delivered: %v", err)
+		}
+	}
+
+	return ops
+}
+
+func TestProjectLifecycle(t *testing.T) {
+	st := store.NewMemory()
+	srv := NewServer(":9001", queue.NewMemory(), st)
+	srv.SetAdminToken(testAdminToken)
+
+	resp := do(t, srv, http.MethodPost, "/projects", projectRequest{
+		Remote:   "git@example.com:team/run.git",
+		Branches: []string{"master", "release/*"},
+	})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status %v, got %v", http.StatusAccepted, resp.StatusCode)
+	}
+
+	created := projectResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	if created.Name != "run" || created.DefaultBranch != "master" || !created.Enabled ||
+		created.ConfigPath != store.DefaultConfigPath || created.CanonicalRemote != "example.com/team/run" {
+		t.Fatalf("expected project with defaults filled in, got %+v", created)
+	}
+
+	want := []string{
+		"create git@example.com:team/run.git#master",
+		"create git@example.com:team/run.git#release/*",
+	}
+	if ops := pollerOps(t, st); !reflect.DeepEqual(ops, want) {
+		t.Fatalf("expected poller messages %v, got %v", want, ops)
+	}
+
+	// Tracked branches show up as git repos.
+	resp = do(t, srv, http.MethodGet, "/repos/git?remote=https://example.com/team/run", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %v getting repo, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	url := fmt.Sprintf("/projects/%v", created.ID)
+	enabled := false
+	branches := []string{"master", "develop"}
+	resp = do(t, srv, http.MethodPatch, url, projectPatchRequest{Branches: &branches})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status %v, got %v", http.StatusAccepted, resp.StatusCode)
+	}
+
+	want = []string{
+		"delete git@example.com:team/run.git#release/*",
+		"create git@example.com:team/run.git#develop",
+	}
+	if ops := pollerOps(t, st); !reflect.DeepEqual(ops, want) {
+		t.Fatalf("expected poller messages %v, got %v", want, ops)
+	}
+
+	// Disabling a project stops everything from being polled.
+	resp = do(t, srv, http.MethodPatch, url, projectPatchRequest{Enabled: &enabled})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status %v, got %v", http.StatusAccepted, resp.StatusCode)
+	}
+
+	want = []string{
+		"delete git@example.com:team/run.git#develop",
+		"delete git@example.com:team/run.git#master",
+	}
+	if ops := pollerOps(t, st); !reflect.DeepEqual(ops, want) {
+		t.Fatalf("expected poller messages %v, got %v", want, ops)
+	}
+
+	resp = do(t, srv, http.MethodGet, url, nil)
+	got := projectResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	if got.Enabled || !reflect.DeepEqual(got.Branches, []string{"develop", "master"}) {
+		t.Fatalf("expected disabled project tracking develop and master, got %+v", got)
+	}
+
+	resp = do(t, srv, http.MethodDelete, url, nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status %v, got %v", http.StatusAccepted, resp.StatusCode)
+	}
+
+	if ops := pollerOps(t, st); len(ops) != 0 {
+		t.Fatalf("expected no poller messages deleting a disabled project, got %v", ops)
+	}
+
+	resp = do(t, srv, http.MethodGet, url, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %v after deleting, got %v", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestPatchProjectExclusions(t *testing.T) {
+	st := store.NewMemory()
+	srv := NewServer(":9001", queue.NewMemory(), st)
+	srv.SetAdminToken(testAdminToken)
+
+	resp := do(t, srv, http.MethodPost, "/projects", projectRequest{
+		Remote:   "https://example.com/run.git",
+		Branches: []string{"feature/**"},
+	})
+	created := projectResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+	pollerOps(t, st)
+
+	// Exclusions aren't polled, so adding one only tells pollers about the
+	// new pattern set.
+	branches := []string{"feature/**", "!feature/wip-*"}
+	url := fmt.Sprintf("/projects/%v", created.ID)
+	resp = do(t, srv, http.MethodPatch, url, projectPatchRequest{Branches: &branches})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status %v, got %v", http.StatusAccepted, resp.StatusCode)
+	}
+
+	msgs, err := st.GetPendingMessages(100)
+	if err != nil {
+		t.Fatalf("got error getting pending messages: %v", err)
+	}
+
+	if len(msgs) != 1 {
+		t.Fatalf("expected a single poller message, got %v", len(msgs))
+	}
+
+	plrmsg := pollerMessage{}
+	if err := json.Unmarshal(msgs[0].Payload, &plrmsg); err != nil {
+		t.Fatalf("got error unmarshalling poller message: %v", err)
+	}
+
+	want := []string{"!feature/wip-*", "feature/**"}
+	if plrmsg.Op != "patterns" || plrmsg.Branch != "" || !reflect.DeepEqual(plrmsg.Patterns, want) {
+		t.Fatalf("expected patterns message with %v, got %+v", want, plrmsg)
+	}
+}
+
+func TestPostProjectInvalid(t *testing.T) {
+	srv := NewServer(":9001", queue.NewMemory(), store.NewMemory())
+	srv.SetAdminToken(testAdminToken)
+
+	tests := []struct {
+		field string
+		req   projectRequest
+	}{
+		{"remote", projectRequest{Remote: "run.git"}},
+		{"branches", projectRequest{Remote: "https://example.com/run.git", Branches: []string{""}}},
+		{"branches", projectRequest{Remote: "https://example.com/run.git", Branches: []string{"/release-(/"}}},
+		{"config_path", projectRequest{Remote: "https://example.com/run.git", ConfigPath: "../tasks"}},
+	}
+
+	for _, test := range tests {
+		resp := do(t, srv, http.MethodPost, "/projects", test.req)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status %v for bad %v, got %v", http.StatusBadRequest, test.field, resp.StatusCode)
+		}
+
+		body := struct {
+			Fields map[string]string `json:"fields"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("got error decoding response body: %v", err)
+		}
+
+		if body.Fields[test.field] == "" {
+			t.Fatalf("expected an error for %v, got %v", test.field, body.Fields)
+		}
+	}
+}
+
+func TestPostProjectConflict(t *testing.T) {
+	srv := NewServer(":9001", queue.NewMemory(), newSeededStore(t))
+	srv.SetAdminToken(testAdminToken)
+
+	// The seeded git repos already made a project for this remote.
+	resp := do(t, srv, http.MethodPost, "/projects", projectRequest{Remote: "git@example.com:test"})
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected status %v, got %v", http.StatusConflict, resp.StatusCode)
+	}
+
+	resp = do(t, srv, http.MethodGet, "/projects", nil)
+	projects := []projectResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&projects); err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	if len(projects) != 2 {
+		t.Fatalf("expected a project per seeded remote, got %+v", projects)
+	}
+}
@@ -1,12 +1,15 @@
 package http
 
 import (
-	"database/sql"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
+	"github.com/run-ci/run-server/branches"
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/remote"
 	"github.com/run-ci/run-server/store"
 	"github.com/sirupsen/logrus"
 )
@@ -16,11 +19,42 @@ type gitRepoRequest struct {
 	Branch string `json:"branch"`
 }
 
-type gitRepoResponse struct {
-	Remote string `json:"remote"`
+type gitRepoPatchRequest struct {
 	Branch string `json:"branch"`
 }
 
+type gitRepoResponse struct {
+	Remote          string `json:"remote"`
+	Branch          string `json:"branch"`
+	CanonicalRemote string `json:"canonical_remote"`
+}
+
+// gitReposResponse is a page of a listing of repos. Next is the URL of the
+// next page, if there is one.
+type gitReposResponse struct {
+	Repos []gitRepoResponse `json:"repos"`
+	Next  string            `json:"next,omitempty"`
+}
+
+func newGitRepoResponse(repo store.GitRepo) gitRepoResponse {
+	return gitRepoResponse{
+		Remote:          repo.CloneURL(),
+		Branch:          repo.Branch,
+		CanonicalRemote: repo.Remote,
+	}
+}
+
+// canonicalRemote returns the canonical form of the remote in the request
+// field `field`, or field errors explaining why it isn't valid.
+func canonicalRemote(field, raw string) (string, error) {
+	canonical, err := remote.Canonical(raw)
+	if rerr, ok := err.(*remote.Error); ok {
+		return "", fieldErrors{field: rerr.Reason}
+	}
+
+	return canonical, err
+}
+
 func (srv *Server) postGitRepo(rw http.ResponseWriter, req *http.Request) {
 	reqID := req.Context().Value(keyReqID).(string)
 	logger := logger.WithField("request_id", reqID)
@@ -50,16 +84,47 @@ func (srv *Server) postGitRepo(rw http.ResponseWriter, req *http.Request) {
 		repo.Branch = "master"
 	}
 
+	canonical, err := canonicalRemote("remote", repo.Remote)
+	if err != nil {
+		logger.WithField("error", err).Error("invalid remote")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := validateBranch("branch", repo.Branch); err != nil {
+		logger.WithField("error", err).Error("invalid branch")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	created := store.GitRepo{
+		Remote: canonical,
+		Branch: repo.Branch,
+		URL:    strings.TrimSpace(repo.Remote),
+	}
+
 	logger = logger.WithFields(logrus.Fields{
-		"remote": repo.Remote,
-		"branch": repo.Branch,
+		"remote": created.Remote,
+		"branch": created.Branch,
 	})
 
-	logger.Info("adding git repo")
-	err = srv.st.CreateGitRepo(store.GitRepo{
-		Remote: repo.Remote,
-		Branch: repo.Branch,
+	msgs := gitRepoMessages(logger, func(msg map[string]interface{}) {
+		if !branches.IsExclusion(created.Branch) {
+			msg["op"] = "create"
+			msg["branch"] = created.Branch
+		}
 	})
+
+	logger.Info("adding git repo")
+	err = srv.st.CreateGitRepo(created, msgs)
+	if err == store.ErrConflict {
+		logger.WithField("error", err).Error("repo already exists")
+
+		writeErrResp(rw, errors.New("repo already exists"), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		logger.WithField("error", err).
 			Error("unable to save git repo in database")
@@ -68,26 +133,7 @@ func (srv *Server) postGitRepo(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	msg := map[string]string{
-		"op":     "create",
-		"remote": repo.Remote,
-		"branch": repo.Branch,
-	}
-	rawmsg, err := json.Marshal(msg)
-	if err != nil {
-		logger.WithField("error", err).
-			Warn("unable to marshal poller create message")
-	} else {
-		// Not being able to send to the poller is not enough to cause the
-		// request to fail. For this reason, we should try as hard as possible
-		// to send the request.
-		go sendWithBackoff(logger, srv.pollch, rawmsg)
-	}
-
-	resp := gitRepoResponse{
-		Remote: repo.Remote,
-		Branch: repo.Branch,
-	}
+	resp := newGitRepoResponse(created)
 	buf, err = json.Marshal(resp)
 	if err != nil {
 		logger.WithField("error", err).
@@ -111,14 +157,16 @@ func (srv *Server) getGitRepo(rw http.ResponseWriter, req *http.Request) {
 	if _, ok := req.URL.Query()["remote"]; !ok {
 		logger.Info("missing 'remote' argument, fetching all repos")
 
-		srv.getAllRepos(logger, rw)
+		srv.getAllRepos(logger, rw, req)
 		return
 	}
-	remote := req.URL.Query()["remote"][0]
 
-	branch := "master"
-	if _, ok := req.URL.Query()["branch"]; ok {
-		branch = req.URL.Query()["branch"][0]
+	remote, branch, err := repoKeyFromQuery(req)
+	if err != nil {
+		logger.WithField("error", err).Error("invalid query")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
 	}
 
 	logger.Infof("using %v as branch", branch)
@@ -127,8 +175,66 @@ func (srv *Server) getGitRepo(rw http.ResponseWriter, req *http.Request) {
 	return
 }
 
-func (srv *Server) getAllRepos(logger *logrus.Entry, rw http.ResponseWriter) {
-	repos, err := srv.st.GetGitRepos()
+// gitRepoCursor is the key of the last repo on a page.
+type gitRepoCursor struct {
+	Remote string `json:"r"`
+	Branch string `json:"b"`
+}
+
+// gitRepoQuery builds the store query for a listing of repos from the
+// request's arguments.
+func gitRepoQuery(req *http.Request) (store.GitRepoQuery, error) {
+	args := req.URL.Query()
+
+	q := store.GitRepoQuery{
+		RemotePrefix: args.Get("remote_prefix"),
+		BranchGlob:   args.Get("branch_glob"),
+	}
+
+	switch args.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, errors.New("'order' must be asc or desc")
+	}
+
+	limit, err := pageLimit(req)
+	if err != nil {
+		return q, err
+	}
+	q.Limit = limit
+
+	if cursor := args.Get("cursor"); cursor != "" {
+		var after gitRepoCursor
+		if err := decodeCursor(cursor, &after); err != nil {
+			return q, err
+		}
+
+		q.After = &store.GitRepo{
+			Remote: after.Remote,
+			Branch: after.Branch,
+		}
+	}
+
+	return q, nil
+}
+
+func (srv *Server) getAllRepos(logger *logrus.Entry, rw http.ResponseWriter, req *http.Request) {
+	q, err := gitRepoQuery(req)
+	if err != nil {
+		logger.WithField("error", err).Error("invalid listing arguments")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	// Asking for one more repo than fits on the page tells us whether
+	// there's a next page without a separate count.
+	limit := q.Limit
+	q.Limit++
+
+	repos, err := srv.st.QueryGitRepos(q)
 	if err != nil {
 		logger.WithField("error", err).Error("unable to get git repos from database")
 
@@ -136,12 +242,32 @@ func (srv *Server) getAllRepos(logger *logrus.Entry, rw http.ResponseWriter) {
 		return
 	}
 
-	resp := []gitRepoResponse{}
+	more := len(repos) > limit
+	if more {
+		repos = repos[:limit]
+	}
+
+	resp := gitReposResponse{
+		Repos: []gitRepoResponse{},
+	}
 	for _, repo := range repos {
-		resp = append(resp, gitRepoResponse{
-			Remote: repo.Remote,
-			Branch: repo.Branch,
+		resp.Repos = append(resp.Repos, newGitRepoResponse(repo))
+	}
+
+	if more {
+		last := repos[len(repos)-1]
+		cursor, err := encodeCursor(gitRepoCursor{
+			Remote: last.Remote,
+			Branch: last.Branch,
 		})
+		if err != nil {
+			logger.WithField("error", err).Error("unable to encode cursor")
+
+			writeErrResp(rw, err, http.StatusInternalServerError)
+			return
+		}
+
+		resp.Next = setNextLink(rw, req, cursor)
 	}
 
 	buf, err := json.Marshal(resp)
@@ -165,7 +291,7 @@ func (srv *Server) getRepo(remote, branch string, logger *logrus.Entry, rw http.
 	logger.Debug("getting repo")
 
 	repo, err := srv.st.GetGitRepo(remote, branch)
-	if err == sql.ErrNoRows {
+	if err == store.ErrNotFound {
 		logger.WithField("error", err).Error("repo not found in database")
 
 		writeErrResp(rw, errors.New("repo not found"), http.StatusNotFound)
@@ -178,10 +304,7 @@ func (srv *Server) getRepo(remote, branch string, logger *logrus.Entry, rw http.
 		return
 	}
 
-	resp := gitRepoResponse{
-		Remote: repo.Remote,
-		Branch: repo.Branch,
-	}
+	resp := newGitRepoResponse(repo)
 	buf, err := json.Marshal(resp)
 	if err != nil {
 		logger.WithField("error", err).Error("unable to marshal response body")
@@ -193,3 +316,240 @@ func (srv *Server) getRepo(remote, branch string, logger *logrus.Entry, rw http.
 	rw.Write(buf)
 	return
 }
+
+func (srv *Server) patchGitRepo(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	remote, branch, err := repoKeyFromQuery(req)
+	if err != nil {
+		logger.WithField("error", err).Error("invalid query")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithFields(logrus.Fields{
+		"remote": remote,
+		"branch": branch,
+	})
+
+	logger.Debug("reading request body")
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to read request body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	logger.Debug("unmarshaling request body")
+	var patch gitRepoPatchRequest
+	err = json.Unmarshal(buf, &patch)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to unmarshal request body")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	if patch.Branch == "" {
+		logger.Error("missing branch in request body")
+
+		writeErrResp(rw, errors.New("missing 'branch' in request body"), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateBranch("branch", patch.Branch); err != nil {
+		logger.WithField("error", err).Error("invalid branch")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	// The existing repo is needed for the URL it was registered with.
+	old, err := srv.st.GetGitRepo(remote, branch)
+	if err == store.ErrNotFound {
+		logger.WithField("error", err).Error("repo not found in database")
+
+		writeErrResp(rw, errors.New("repo not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.WithField("error", err).Error("unable to fetch repo from database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	updated := old
+	updated.Branch = patch.Branch
+
+	// Swapping a branch for another is an update as far as pollers are
+	// concerned, but exclusions aren't polled so there's nothing to swap.
+	msgs := gitRepoMessages(logger, func(msg map[string]interface{}) {
+		if !branches.IsExclusion(branch) && !branches.IsExclusion(patch.Branch) {
+			msg["op"] = "update"
+			msg["branch"] = patch.Branch
+			msg["old_branch"] = branch
+		}
+	})
+
+	logger.Infof("changing branch to %v", patch.Branch)
+	err = srv.st.UpdateGitRepo(remote, branch, updated, msgs)
+	if err == store.ErrNotFound {
+		logger.WithField("error", err).Error("repo not found in database")
+
+		writeErrResp(rw, errors.New("repo not found"), http.StatusNotFound)
+		return
+	}
+	if err == store.ErrConflict {
+		logger.WithField("error", err).Error("repo already exists")
+
+		writeErrResp(rw, errors.New("repo already exists"), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to update git repo in database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := newGitRepoResponse(updated)
+	buf, err = json.Marshal(resp)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to marshal response body")
+
+		writeErrResp(rw, err, http.StatusAccepted)
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+	rw.Write(buf)
+	return
+}
+
+func (srv *Server) deleteGitRepo(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	remote, branch, err := repoKeyFromQuery(req)
+	if err != nil {
+		logger.WithField("error", err).Error("invalid query")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithFields(logrus.Fields{
+		"remote": remote,
+		"branch": branch,
+	})
+
+	msgs := gitRepoMessages(logger, func(msg map[string]interface{}) {
+		if !branches.IsExclusion(branch) {
+			msg["op"] = "delete"
+			msg["branch"] = branch
+		}
+	})
+
+	logger.Info("deleting git repo")
+	err = srv.st.DeleteGitRepo(remote, branch, msgs)
+	if err == store.ErrNotFound {
+		logger.WithField("error", err).Error("repo not found in database")
+
+		writeErrResp(rw, errors.New("repo not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to delete git repo from database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+	return
+}
+
+// repoKeyFromQuery pulls the remote and branch identifying a single repo
+// out of the request's query string. The remote is required, and can be
+// any spelling of it since it's returned in canonical form. The branch
+// defaults to "master".
+func repoKeyFromQuery(req *http.Request) (string, string, error) {
+	raw := req.URL.Query().Get("remote")
+	if raw == "" {
+		return "", "", errors.New("missing 'remote' argument")
+	}
+
+	remote, err := canonicalRemote("remote", raw)
+	if err != nil {
+		return "", "", err
+	}
+
+	branch := req.URL.Query().Get("branch")
+	if branch == "" {
+		branch = "master"
+	}
+
+	return remote, branch, nil
+}
+
+// validateBranch returns field errors if the branch pattern in the request
+// field `field` isn't valid.
+func validateBranch(field, pattern string) error {
+	if err := branches.Validate(pattern); err != nil {
+		return fieldErrors{field: err.Error()}
+	}
+
+	return nil
+}
+
+// gitRepoMessages returns the MessageFunc for a change to a branch made
+// through the git repo view. Pollers are told the project's new pattern
+// set, and `op` turns that into the message for the change itself if
+// there is one. Pollers need something they can clone, so they're told
+// about the remote as it was registered rather than its canonical form.
+// They don't track disabled projects, so nothing is sent for those.
+func gitRepoMessages(logger *logrus.Entry, op func(map[string]interface{})) store.MessageFunc {
+	return func(old, new *store.Project) []store.Message {
+		if !polled(new) {
+			return nil
+		}
+
+		msg := patternsMessage(new.CloneURL(), patternsOf(new))
+		op(msg)
+
+		return pollerMessages(logger, msg)
+	}
+}
+
+// pollerMessages returns the outbox messages that tell pollers about
+// `msgs`. They're saved along with the change they describe, and the
+// outbox relay sends them on afterwards.
+func pollerMessages(logger *logrus.Entry, msgs ...map[string]interface{}) []store.Message {
+	out := []store.Message{}
+	for _, msg := range msgs {
+		rawmsg, err := json.Marshal(msg)
+		if err != nil {
+			// Not being able to tell the pollers is not enough to cause
+			// the request to fail.
+			logger.WithField("error", err).
+				Warnf("unable to marshal poller %v message", msg["op"])
+			continue
+		}
+
+		out = append(out, store.Message{
+			Subject: queue.SubjectPollers,
+			Payload: rawmsg,
+		})
+	}
+
+	return out
+}
@@ -8,67 +8,94 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/run-ci/run-server/queue"
 	"github.com/run-ci/run-server/store"
 )
 
-type memStore struct {
-	db map[string]store.GitRepo
+// pollerMessage is what pollers are told about the repos they track.
+type pollerMessage struct {
+	Op        string   `json:"op"`
+	Remote    string   `json:"remote"`
+	Branch    string   `json:"branch"`
+	OldBranch string   `json:"old_branch"`
+	Patterns  []string `json:"patterns"`
 }
 
-func (st *memStore) CreateGitRepo(repo store.GitRepo) error {
-	key := fmt.Sprintf("%v#%v", repo.Remote, repo.Branch)
-	st.db[key] = repo
-
-	return nil
-}
-
-func (st *memStore) GetGitRepo(remote, branch string) (store.GitRepo, error) {
-	key := fmt.Sprintf("%v#%v", remote, branch)
+// pendingMessage returns the payload of the newest message waiting in the
+// outbox for pollers. It fails the test if there isn't one.
+func pendingMessage(t *testing.T, st store.Repo) []byte {
+	msgs, err := st.GetPendingMessages(100)
+	if err != nil {
+		t.Fatalf("got error getting pending messages: %v", err)
+	}
 
-	return st.db[key], nil
-}
+	if len(msgs) == 0 {
+		t.Fatal("expected a message in the outbox")
+	}
 
-func (st *memStore) GetGitRepos() ([]store.GitRepo, error) {
-	ret := make([]store.GitRepo, len(st.db))
-	i := 0
-	for _, repo := range st.db {
-		ret[i] = repo
-		i++
+	msg := msgs[len(msgs)-1]
+	if msg.Subject != queue.SubjectPollers {
+		t.Fatalf("expected message for %v, got %v", queue.SubjectPollers, msg.Subject)
 	}
 
-	return ret, nil
+	return msg.Payload
 }
 
-func (st *memStore) seedRepos() {
-	st.db["test.git#master"] = store.GitRepo{
-		Remote: "test.git",
+// seedRepos are the repos most tests start out with.
+var seedRepos = []store.GitRepo{
+	{
+		Remote: "example.com/test",
 		Branch: "master",
-	}
-
-	st.db["test.git#feature"] = store.GitRepo{
-		Remote: "test.git",
+		URL:    "https://example.com/test.git",
+	},
+	{
+		Remote: "example.com/test",
 		Branch: "feature",
+		URL:    "https://example.com/test.git",
+	},
+	{
+		Remote: "github.com/run-ci/run-server",
+		Branch: "master",
+		URL:    "https://github.com/run-ci/run-server.git",
+	},
+}
+
+// newSeededStore returns an in-memory store holding seedRepos.
+func newSeededStore(t *testing.T) *store.Memory {
+	st := store.NewMemory()
+	for _, repo := range seedRepos {
+		if err := st.CreateGitRepo(repo); err != nil {
+			t.Fatalf("got error seeding repo %v: %v", repo, err)
+		}
 	}
 
-	st.db["https://github.com/run-ci/run-server.git#master"] = store.GitRepo{
-		Remote: "https://github.com/run-ci/run-server.git",
-		Branch: "master",
+	return st
+}
+
+// subscribe returns a channel receiving messages published on `subj`. It
+// fails the test if it can't subscribe.
+func subscribe(t *testing.T, bus queue.Bus, subj string) <-chan queue.Message {
+	recv, err := bus.Subscribe(subj)
+	if err != nil {
+		t.Fatalf("got error subscribing to %v: %v", subj, err)
 	}
+
+	return recv
 }
 
 func TestPostGitRepo(t *testing.T) {
-	send := make(chan []byte)
-	st := &memStore{
-		db: make(map[string]store.GitRepo),
-	}
-	srv := NewServer(":9001", send, st)
+	bus := queue.NewMemory()
+	st := store.NewMemory()
+	srv := NewServer(":9001", bus, st)
 
 	repo := gitRepoRequest{
-		Remote: "test",
+		Remote: "git@example.com:test.git",
 		Branch: "master",
 	}
 	payload, err := json.Marshal(repo)
@@ -88,35 +115,36 @@ func TestPostGitRepo(t *testing.T) {
 		t.Fatalf("expected status %v, got %v", http.StatusAccepted, resp.StatusCode)
 	}
 
-	// This will time out if the request to create the poller wasn't sent. This
-	// timeout should fail the test.
-	rawmsg := <-send
-	plrmsg := map[string]string{}
+	// The poller message is saved in the outbox along with the repo and
+	// sent on from there.
+	rawmsg := pendingMessage(t, st)
+	plrmsg := pollerMessage{}
 	err = json.Unmarshal(rawmsg, &plrmsg)
 	if err != nil {
 		t.Fatalf("got error unmarshalling poller message: %v", err)
 	}
 
-	if op, ok := plrmsg["op"]; !ok || op != "create" {
+	if op := plrmsg.Op; op != "create" {
 		t.Fatalf(`expected "op" to be set to "create", got %v`, op)
 	}
 
-	if remote, ok := plrmsg["remote"]; !ok || remote != "test" {
-		t.Fatalf(`expected "remote" to be set to "test", got %v`, remote)
+	if remote := plrmsg.Remote; remote != "git@example.com:test.git" {
+		t.Fatalf(`expected "remote" to be set to "git@example.com:test.git", got %v`, remote)
 	}
 
-	if branch, ok := plrmsg["branch"]; !ok || branch != "master" {
+	if branch := plrmsg.Branch; branch != "master" {
 		t.Fatalf(`expected "branch" to be set to "master", got %v`, branch)
 	}
+
+	if want := []string{"master"}; !reflect.DeepEqual(plrmsg.Patterns, want) {
+		t.Fatalf(`expected "patterns" to be %v, got %v`, want, plrmsg.Patterns)
+	}
 }
 
 func TestGetAllGitRepos(t *testing.T) {
-	st := &memStore{
-		db: make(map[string]store.GitRepo),
-	}
-	st.seedRepos()
+	st := newSeededStore(t)
 
-	srv := NewServer(":9001", make(chan []byte), st)
+	srv := NewServer(":9001", queue.NewMemory(), st)
 
 	req := httptest.NewRequest(http.MethodGet, "http://test/repos/git", nil)
 	req = req.WithContext(context.WithValue(context.Background(), keyReqID, "test"))
@@ -131,20 +159,24 @@ func TestGetAllGitRepos(t *testing.T) {
 	}
 	defer resp.Body.Close()
 
-	repos := []gitRepoResponse{}
-	err = json.Unmarshal(payload, &repos)
+	page := gitReposResponse{}
+	err = json.Unmarshal(payload, &page)
 	if err != nil {
 		t.Fatalf("got error unmarshaling response body: %v", err)
 	}
+	repos := page.Repos
+
+	if page.Next != "" {
+		t.Fatalf("expected no next page, got %q", page.Next)
+	}
 
-	if len(repos) != len(st.db) {
-		t.Fatalf("expected to get %v repos, got %v", len(st.db), len(repos))
+	if len(repos) != len(seedRepos) {
+		t.Fatalf("expected to get %v repos, got %v", len(seedRepos), len(repos))
 	}
 
 	for _, repo := range repos {
-		key := fmt.Sprintf("%v#%v", repo.Remote, repo.Branch)
-		if _, ok := st.db[key]; !ok {
-			t.Fatalf("got repo %v that isn't in DB", key)
+		if _, err := st.GetGitRepo(repo.CanonicalRemote, repo.Branch); err != nil {
+			t.Fatalf("got repo %v#%v that isn't in DB", repo.Remote, repo.Branch)
 		}
 	}
 }
@@ -152,15 +184,12 @@ func TestGetAllGitRepos(t *testing.T) {
 func TestGetGitRepo(t *testing.T) {
 	logrus.SetLevel(logrus.DebugLevel)
 
-	st := &memStore{
-		db: make(map[string]store.GitRepo),
-	}
-	st.seedRepos()
+	st := newSeededStore(t)
 
-	srv := NewServer(":9001", make(chan []byte), st)
+	srv := NewServer(":9001", queue.NewMemory(), st)
 
-	remote := "test.git"
-	url := fmt.Sprintf("http://test/repos/git?remote=%v", remote)
+	remote := "https://example.com/test.git"
+	url := fmt.Sprintf("http://test/repos/git?remote=%v", "git@example.com:test")
 
 	req := httptest.NewRequest(http.MethodGet, url, nil)
 	req = req.WithContext(context.WithValue(context.Background(), keyReqID, "test"))
@@ -195,14 +224,11 @@ func TestGetGitRepo(t *testing.T) {
 func TestGetGitRepoWithBranch(t *testing.T) {
 	logrus.SetLevel(logrus.DebugLevel)
 
-	st := &memStore{
-		db: make(map[string]store.GitRepo),
-	}
-	st.seedRepos()
+	st := newSeededStore(t)
 
-	srv := NewServer(":9001", make(chan []byte), st)
+	srv := NewServer(":9001", queue.NewMemory(), st)
 
-	remote := "test.git"
+	remote := "https://example.com/test.git"
 	branch := "feature"
 	url := fmt.Sprintf("http://test/repos/git?remote=%v&branch=%v", remote, branch)
 
@@ -235,3 +261,331 @@ func TestGetGitRepoWithBranch(t *testing.T) {
 		t.Fatalf("expected branch to be %v, got %v", branch, repo.Branch)
 	}
 }
+
+func TestPatchGitRepo(t *testing.T) {
+	bus := queue.NewMemory()
+	st := newSeededStore(t)
+
+	srv := NewServer(":9001", bus, st)
+
+	payload, err := json.Marshal(gitRepoPatchRequest{Branch: "develop"})
+	if err != nil {
+		t.Fatalf("got error when marshaling request payload: %v", err)
+	}
+
+	url := "http://test/repos/git?remote=ssh://git@example.com/test&branch=feature"
+	req := httptest.NewRequest(http.MethodPatch, url, bytes.NewBuffer(payload))
+	req = req.WithContext(context.WithValue(context.Background(), keyReqID, "test"))
+	rw := httptest.NewRecorder()
+
+	srv.patchGitRepo(rw, req)
+
+	resp := rw.Result()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status %v, got %v", http.StatusAccepted, resp.StatusCode)
+	}
+
+	if _, err := st.GetGitRepo("example.com/test", "feature"); err != store.ErrNotFound {
+		t.Fatal("expected old branch to be gone from DB")
+	}
+
+	if _, err := st.GetGitRepo("example.com/test", "develop"); err != nil {
+		t.Fatal("expected new branch to be in DB")
+	}
+
+	rawmsg := pendingMessage(t, st)
+	plrmsg := pollerMessage{}
+	err = json.Unmarshal(rawmsg, &plrmsg)
+	if err != nil {
+		t.Fatalf("got error unmarshalling poller message: %v", err)
+	}
+
+	if op := plrmsg.Op; op != "update" {
+		t.Fatalf(`expected "op" to be set to "update", got %v`, op)
+	}
+
+	if branch := plrmsg.Branch; branch != "develop" {
+		t.Fatalf(`expected "branch" to be set to "develop", got %v`, branch)
+	}
+
+	if branch := plrmsg.OldBranch; branch != "feature" {
+		t.Fatalf(`expected "old_branch" to be set to "feature", got %v`, branch)
+	}
+
+	if want := []string{"develop", "master"}; !reflect.DeepEqual(plrmsg.Patterns, want) {
+		t.Fatalf(`expected "patterns" to be %v, got %v`, want, plrmsg.Patterns)
+	}
+}
+
+func TestDeleteGitRepo(t *testing.T) {
+	bus := queue.NewMemory()
+	st := newSeededStore(t)
+
+	srv := NewServer(":9001", bus, st)
+
+	url := "http://test/repos/git?remote=ssh://git@example.com/test&branch=feature"
+	req := httptest.NewRequest(http.MethodDelete, url, nil)
+	req = req.WithContext(context.WithValue(context.Background(), keyReqID, "test"))
+	rw := httptest.NewRecorder()
+
+	srv.deleteGitRepo(rw, req)
+
+	resp := rw.Result()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status %v, got %v", http.StatusAccepted, resp.StatusCode)
+	}
+
+	if _, err := st.GetGitRepo("example.com/test", "feature"); err != store.ErrNotFound {
+		t.Fatal("expected repo to be deleted from DB")
+	}
+
+	rawmsg := pendingMessage(t, st)
+	plrmsg := pollerMessage{}
+	err := json.Unmarshal(rawmsg, &plrmsg)
+	if err != nil {
+		t.Fatalf("got error unmarshalling poller message: %v", err)
+	}
+
+	if op := plrmsg.Op; op != "delete" {
+		t.Fatalf(`expected "op" to be set to "delete", got %v`, op)
+	}
+
+	if remote := plrmsg.Remote; remote != "https://example.com/test.git" {
+		t.Fatalf(`expected "remote" to be the registered URL, got %v`, remote)
+	}
+
+	if branch := plrmsg.Branch; branch != "feature" {
+		t.Fatalf(`expected "branch" to be set to "feature", got %v`, branch)
+	}
+
+	if want := []string{"master"}; !reflect.DeepEqual(plrmsg.Patterns, want) {
+		t.Fatalf(`expected "patterns" to be %v, got %v`, want, plrmsg.Patterns)
+	}
+}
+
+func TestDeleteGitRepoNotFound(t *testing.T) {
+	st := store.NewMemory()
+
+	srv := NewServer(":9001", queue.NewMemory(), st)
+
+	url := "http://test/repos/git?remote=https://example.com/missing.git"
+	req := httptest.NewRequest(http.MethodDelete, url, nil)
+	req = req.WithContext(context.WithValue(context.Background(), keyReqID, "test"))
+	rw := httptest.NewRecorder()
+
+	srv.deleteGitRepo(rw, req)
+
+	resp := rw.Result()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %v, got %v", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestPostGitRepoConflict(t *testing.T) {
+	st := newSeededStore(t)
+	srv := NewServer(":9001", queue.NewMemory(), st)
+
+	payload, err := json.Marshal(gitRepoRequest{
+		Remote: "https://EXAMPLE.com/test/",
+		Branch: "feature",
+	})
+	if err != nil {
+		t.Fatalf("got error when marshaling request payload: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://test/repos/git", bytes.NewBuffer(payload))
+	req = req.WithContext(context.WithValue(context.Background(), keyReqID, "test"))
+	rw := httptest.NewRecorder()
+
+	srv.postGitRepo(rw, req)
+
+	resp := rw.Result()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected status %v, got %v", http.StatusConflict, resp.StatusCode)
+	}
+}
+
+func TestPostGitRepoDisabledProject(t *testing.T) {
+	st := store.NewMemory()
+	srv := NewServer(":9001", queue.NewMemory(), st)
+
+	_, err := st.CreateProject(store.Project{
+		Name:          "test",
+		Remote:        "example.com/test",
+		URL:           "https://example.com/test.git",
+		DefaultBranch: "master",
+		Branches:      []string{"master"},
+		ConfigPath:    store.DefaultConfigPath,
+		Enabled:       false,
+	})
+	if err != nil {
+		t.Fatalf("got error creating project: %v", err)
+	}
+
+	payload, err := json.Marshal(gitRepoRequest{
+		Remote: "https://example.com/test.git",
+		Branch: "feature",
+	})
+	if err != nil {
+		t.Fatalf("got error when marshaling request payload: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://test/repos/git", bytes.NewBuffer(payload))
+	req = req.WithContext(context.WithValue(context.Background(), keyReqID, "test"))
+	rw := httptest.NewRecorder()
+
+	srv.postGitRepo(rw, req)
+
+	resp := rw.Result()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status %v, got %v", http.StatusAccepted, resp.StatusCode)
+	}
+
+	// Pollers don't track disabled projects, so they mustn't be told to
+	// start watching the new branch.
+	msgs, err := st.GetPendingMessages(100)
+	if err != nil {
+		t.Fatalf("got error getting pending messages: %v", err)
+	}
+
+	if len(msgs) != 0 {
+		t.Fatalf("expected no poller messages for a disabled project, got %s", msgs[0].Payload)
+	}
+}
+
+// nextLink returns the URL of the next page from the response's Link
+// header, or "" if there isn't one.
+func nextLink(t *testing.T, resp *http.Response) string {
+	link := resp.Header.Get("Link")
+	if link == "" {
+		return ""
+	}
+
+	end := strings.Index(link, `>; rel="next"`)
+	if !strings.HasPrefix(link, "<") || end < 0 {
+		t.Fatalf("expected a next link, got %q", link)
+	}
+
+	return "http://test" + link[1:end]
+}
+
+func TestGetAllGitReposPaged(t *testing.T) {
+	st := newSeededStore(t)
+	srv := NewServer(":9001", queue.NewMemory(), st)
+
+	got := []gitRepoResponse{}
+	pages := 0
+	for url := "http://test/repos/git?limit=2&order=desc"; url != ""; pages++ {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req = req.WithContext(context.WithValue(context.Background(), keyReqID, "test"))
+		rw := httptest.NewRecorder()
+
+		srv.getGitRepo(rw, req)
+
+		resp := rw.Result()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %v, got %v", http.StatusOK, resp.StatusCode)
+		}
+
+		page := gitReposResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+			t.Fatalf("got error decoding response body: %v", err)
+		}
+
+		got = append(got, page.Repos...)
+		url = nextLink(t, resp)
+
+		// The body points at the same page as the header.
+		if page.Next != "" {
+			if next := "http://test" + page.Next; next != url {
+				t.Fatalf("expected next page %q in the body, got %q", url, next)
+			}
+		} else if url != "" {
+			t.Fatalf("expected next page %q in the body, got none", url)
+		}
+	}
+
+	if pages != 2 {
+		t.Fatalf("expected 2 pages, got %v", pages)
+	}
+
+	want := []gitRepoResponse{
+		newGitRepoResponse(seedRepos[2]),
+		newGitRepoResponse(seedRepos[0]),
+		newGitRepoResponse(seedRepos[1]),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestGetAllGitReposFiltered(t *testing.T) {
+	st := newSeededStore(t)
+	srv := NewServer(":9001", queue.NewMemory(), st)
+
+	url := "http://test/repos/git?remote_prefix=example.com/&branch_glob=f*"
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	req = req.WithContext(context.WithValue(context.Background(), keyReqID, "test"))
+	rw := httptest.NewRecorder()
+
+	srv.getGitRepo(rw, req)
+
+	page := gitReposResponse{}
+	if err := json.NewDecoder(rw.Result().Body).Decode(&page); err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+	repos := page.Repos
+
+	if len(repos) != 1 || repos[0].Branch != "feature" {
+		t.Fatalf("expected only example.com/test#feature, got %v", repos)
+	}
+}
+
+func TestGetAllGitReposBadArgs(t *testing.T) {
+	srv := NewServer(":9001", queue.NewMemory(), store.NewMemory())
+
+	for _, args := range []string{"limit=0", "limit=abc", "order=sideways", "cursor=!!"} {
+		req := httptest.NewRequest(http.MethodGet, "http://test/repos/git?"+args, nil)
+		req = req.WithContext(context.WithValue(context.Background(), keyReqID, "test"))
+		rw := httptest.NewRecorder()
+
+		srv.getGitRepo(rw, req)
+
+		if status := rw.Result().StatusCode; status != http.StatusBadRequest {
+			t.Fatalf("expected status %v for %v, got %v", http.StatusBadRequest, args, status)
+		}
+	}
+}
+
+func TestPostGitRepoInvalidRemote(t *testing.T) {
+	srv := NewServer(":9001", queue.NewMemory(), store.NewMemory())
+
+	for _, remote := range []string{"", "test.git", "ftp://example.com/test.git", "ext::sh -c touch% /tmp/x", "fd::17"} {
+		payload, err := json.Marshal(gitRepoRequest{Remote: remote})
+		if err != nil {
+			t.Fatalf("got error when marshaling request payload: %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "http://test/repos/git", bytes.NewBuffer(payload))
+		req = req.WithContext(context.WithValue(context.Background(), keyReqID, "test"))
+		rw := httptest.NewRecorder()
+
+		srv.postGitRepo(rw, req)
+
+		resp := rw.Result()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status %v for %q, got %v", http.StatusBadRequest, remote, resp.StatusCode)
+		}
+
+		body := struct {
+			Fields map[string]string `json:"fields"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("got error decoding response body: %v", err)
+		}
+
+		if body.Fields["remote"] == "" {
+			t.Fatalf("expected an error for the remote field of %q, got %v", remote, body.Fields)
+		}
+	}
+}
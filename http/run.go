@@ -0,0 +1,493 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/run-ci/run-server/agents"
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/store"
+	"github.com/run-ci/run-server/tasks"
+	"github.com/sirupsen/logrus"
+)
+
+type runResponse struct {
+	ID         int               `json:"id"`
+	Remote     string            `json:"remote"`
+	Branch     string            `json:"branch"`
+	Commit     string            `json:"commit"`
+	Trigger    string            `json:"trigger"`
+	Task       string            `json:"task,omitempty"`
+	Arguments  map[string]string `json:"arguments,omitempty"`
+	Labels     []string          `json:"labels,omitempty"`
+	Status     string            `json:"status"`
+	AgentID    string            `json:"agent_id,omitempty"`
+	Timeout    string            `json:"timeout,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+	StartedAt  *time.Time        `json:"started_at,omitempty"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+	Steps      []stepResponse    `json:"steps,omitempty"`
+
+	CancelRequestedAt *time.Time `json:"cancel_requested_at,omitempty"`
+}
+
+type stepResponse struct {
+	ID         int        `json:"id"`
+	Task       string     `json:"task"`
+	ExitCode   int        `json:"exit_code"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+func newRunResponse(run store.Run) runResponse {
+	resp := runResponse{
+		ID:         run.ID,
+		Remote:     run.Remote,
+		Branch:     run.Branch,
+		Commit:     run.Commit,
+		Trigger:    run.Trigger,
+		Task:       run.Task,
+		Arguments:  run.Args,
+		Labels:     run.Labels,
+		Status:     string(run.Status),
+		AgentID:    run.AgentID,
+		CreatedAt:  run.CreatedAt,
+		StartedAt:  timeOrNil(run.StartedAt),
+		FinishedAt: timeOrNil(run.FinishedAt),
+
+		CancelRequestedAt: timeOrNil(run.CancelRequestedAt),
+	}
+
+	if run.Timeout != 0 {
+		resp.Timeout = run.Timeout.String()
+	}
+
+	for _, step := range run.Steps {
+		resp.Steps = append(resp.Steps, stepResponse{
+			ID:         step.ID,
+			Task:       step.Task,
+			ExitCode:   step.ExitCode,
+			StartedAt:  timeOrNil(step.StartedAt),
+			FinishedAt: timeOrNil(step.FinishedAt),
+		})
+	}
+
+	return resp
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+type runRequest struct {
+	Remote    string            `json:"remote"`
+	Branch    string            `json:"branch"`
+	Commit    string            `json:"commit"`
+	Task      string            `json:"task"`
+	Arguments map[string]string `json:"arguments"`
+
+	// Labels are the labels an agent needs to have to run the run.
+	Labels []string `json:"labels"`
+
+	// Timeout overrides the task's timeout, as a duration like "1h30m".
+	Timeout string `json:"timeout"`
+}
+
+// taskFetchTimeout bounds how long getting the task file of a run started
+// by hand can take.
+const taskFetchTimeout = 30 * time.Second
+
+// SetFetcher replaces what gets the task files of runs started by hand.
+func (srv *Server) SetFetcher(f tasks.Fetcher) {
+	srv.fetcher = f
+}
+
+var commitRE = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// validateRunRequest returns field errors for anything wrong with `run`,
+// or nil if there's nothing wrong with it.
+func validateRunRequest(run runRequest) error {
+	errs := fieldErrors{}
+
+	if run.Task == "" {
+		errs["task"] = "task is empty"
+	} else if !tasks.ValidName(run.Task) {
+		errs["task"] = "invalid task name"
+	}
+
+	if strings.HasPrefix(run.Branch, "-") {
+		errs["branch"] = "invalid branch"
+	}
+
+	if run.Commit != "" && !commitRE.MatchString(run.Commit) {
+		errs["commit"] = "commit must be a full commit hash"
+	}
+
+	if _, err := agents.NormalizeLabels(run.Labels); err != nil {
+		errs["labels"] = err.Error()
+	}
+
+	if run.Timeout != "" {
+		if d, err := time.ParseDuration(run.Timeout); err != nil || d <= 0 {
+			errs["timeout"] = "timeout must be a positive duration like 90s or 1h30m"
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// taskFieldErrors turns the errors from resolving a task's arguments into
+// field errors.
+func taskFieldErrors(errs tasks.Errors) fieldErrors {
+	fe := fieldErrors{}
+	for _, err := range errs {
+		fe[err.Field] = err.Message
+	}
+
+	return fe
+}
+
+// postGitRepoRun starts a run of a single task by hand. The task is read
+// from the project's repo at the commit being built, so the arguments can
+// be checked against the ones it takes.
+func (srv *Server) postGitRepoRun(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	logger.Debug("reading request body")
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to read request body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	logger.Debug("unmarshaling request body")
+	var runreq runRequest
+	err = json.Unmarshal(buf, &runreq)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to unmarshal request body")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	remote, err := canonicalRemote("remote", runreq.Remote)
+	if err != nil {
+		logger.WithField("error", err).Error("invalid remote")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := validateRunRequest(runreq); err != nil {
+		logger.WithField("error", err).Error("invalid run request")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithFields(logrus.Fields{
+		"remote": remote,
+		"task":   runreq.Task,
+	})
+
+	p, err := srv.st.GetProjectByRemote(remote)
+	if err == store.ErrNotFound {
+		logger.WithField("error", err).Error("project not found in database")
+
+		writeErrResp(rw, errors.New("project not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.WithField("error", err).Error("unable to fetch project from database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	if !p.Enabled {
+		logger.Error("project is disabled")
+
+		writeErrResp(rw, errors.New("project is disabled"), http.StatusConflict)
+		return
+	}
+
+	branch := runreq.Branch
+	if branch == "" {
+		branch = p.DefaultBranch
+	}
+
+	ref := runreq.Commit
+	if ref == "" {
+		ref = branch
+	}
+
+	logger = logger.WithFields(logrus.Fields{
+		"branch": branch,
+		"ref":    ref,
+	})
+
+	file := path.Join(p.ConfigPath, runreq.Task+tasks.Ext)
+
+	logger.Debugf("fetching %v", file)
+	taskbuf, commit, err := srv.fetcher.Fetch(p.CloneURL(), ref, file)
+	if err == tasks.ErrNoTask {
+		logger.WithField("error", err).Errorf("%v not found", file)
+
+		writeErrResp(rw, fieldErrors{"task": fmt.Sprintf("no %v at %v", file, ref)}, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logger.WithField("error", err).Error("unable to fetch task file")
+
+		writeErrResp(rw, fmt.Errorf("unable to fetch task file: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	task, err := tasks.Parse(runreq.Task, taskbuf)
+	if err != nil {
+		logger.WithField("error", err).Error("invalid task file")
+
+		writeErrResp(rw, fmt.Errorf("invalid task file %v: %v", file, err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	args, err := task.Resolve(runreq.Arguments)
+	if errs, ok := err.(tasks.Errors); ok {
+		logger.WithField("error", err).Error("invalid task arguments")
+
+		writeErrResp(rw, taskFieldErrors(errs), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logger.WithField("error", err).Error("unable to resolve task arguments")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	// Validating the request already made sure the labels are fine.
+	labels, _ := agents.NormalizeLabels(runreq.Labels)
+	if len(labels) == 0 {
+		labels = nil
+	}
+
+	timeout := task.Timeout
+	if runreq.Timeout != "" {
+		timeout, _ = time.ParseDuration(runreq.Timeout)
+	}
+
+	run, err := srv.st.CreateRun(store.Run{
+		Remote:  remote,
+		Branch:  branch,
+		Commit:  commit,
+		Trigger: "manual",
+		Task:    task.Name,
+		Args:    args,
+		Labels:  labels,
+		Timeout: timeout,
+	})
+	if err != nil {
+		logger.WithField("error", err).Error("unable to save run in database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	logger = logger.WithField("run_id", run.ID)
+
+	// The run is queued whether or not agents hear about it, so not being
+	// able to tell them doesn't fail the request.
+	rawmsg, err := json.Marshal(agents.NewJob(srv.st, run))
+	if err != nil {
+		logger.WithField("error", err).Warn("unable to marshal job message")
+	} else {
+		srv.send(logger, queue.SubjectJobs, rawmsg)
+	}
+
+	logger.Info("queued manual run")
+
+	buf, err = json.Marshal(newRunResponse(run))
+	if err != nil {
+		logger.WithField("error", err).Error("unable to marshal response body")
+
+		writeErrResp(rw, err, http.StatusAccepted)
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+	rw.Write(buf)
+	return
+}
+
+func (srv *Server) getGitRepoRuns(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	raw := req.URL.Query().Get("remote")
+	if raw == "" {
+		logger.Error("missing 'remote' argument")
+
+		writeErrResp(rw, errors.New("missing 'remote' argument"), http.StatusBadRequest)
+		return
+	}
+
+	remote, err := canonicalRemote("remote", raw)
+	if err != nil {
+		logger.WithField("error", err).Error("invalid remote")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+	branch := req.URL.Query().Get("branch")
+
+	logger = logger.WithFields(logrus.Fields{
+		"remote": remote,
+		"branch": branch,
+	})
+	logger.Debug("getting runs")
+
+	runs, err := srv.st.GetRuns(remote, branch)
+	if err != nil {
+		logger.WithField("error", err).Error("unable to get runs from database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := []runResponse{}
+	for _, run := range runs {
+		resp = append(resp, newRunResponse(run))
+	}
+
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		logger.WithField("error", err).Error("unable to marshal response body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf)
+	return
+}
+
+func (srv *Server) getRun(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	id, err := strconv.Atoi(mux.Vars(req)["id"])
+	if err != nil {
+		logger.WithField("error", err).Error("invalid run ID")
+
+		writeErrResp(rw, errors.New("invalid run ID"), http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("run_id", id)
+	logger.Debug("getting run")
+
+	run, err := srv.st.GetRun(id)
+	if err == store.ErrNotFound {
+		logger.WithField("error", err).Error("run not found in database")
+
+		writeErrResp(rw, errors.New("run not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.WithField("error", err).Error("unable to fetch run from database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	buf, err := json.Marshal(newRunResponse(run))
+	if err != nil {
+		logger.WithField("error", err).Error("unable to marshal response body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf)
+	return
+}
+
+// postRunCancel cancels a run. Queued runs are cancelled straight away,
+// but running ones stay cancelling until their agent stops them, so the
+// request is only accepted for those.
+func (srv *Server) postRunCancel(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	id, err := strconv.Atoi(mux.Vars(req)["id"])
+	if err != nil {
+		logger.WithField("error", err).Error("invalid run ID")
+
+		writeErrResp(rw, errors.New("invalid run ID"), http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("run_id", id)
+	logger.Debug("cancelling run")
+
+	run, err := srv.dispatcher.Cancel(id)
+	switch err {
+	case nil:
+	case store.ErrNotFound:
+		logger.WithField("error", err).Error("run not found in database")
+
+		writeErrResp(rw, errors.New("run not found"), http.StatusNotFound)
+		return
+	case store.ErrIllegalTransition:
+		logger.WithField("error", err).Errorf("run is already %v", run.Status)
+
+		writeErrResp(rw, fmt.Errorf("run is already %v", run.Status), http.StatusConflict)
+		return
+	default:
+		logger.WithField("error", err).Error("unable to cancel run")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if run.Status == store.RunCancelling {
+		status = http.StatusAccepted
+	}
+
+	buf, err := json.Marshal(newRunResponse(run))
+	if err != nil {
+		logger.WithField("error", err).Error("unable to marshal response body")
+
+		writeErrResp(rw, err, status)
+		return
+	}
+
+	rw.WriteHeader(status)
+	rw.Write(buf)
+	return
+}
@@ -0,0 +1,338 @@
+package http
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/run-ci/run-server/agents"
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/store"
+	"github.com/run-ci/run-server/tasks"
+)
+
+func newRunServer(t *testing.T) (*Server, *store.Memory) {
+	st := newSeededStore(t)
+
+	for _, branch := range []string{"master", "feature", "master"} {
+		_, err := st.CreateRun(store.Run{
+			Remote:  "example.com/test",
+			Branch:  branch,
+			Commit:  "abc123",
+			Trigger: "push",
+		})
+		if err != nil {
+			t.Fatalf("got error creating run: %v", err)
+		}
+	}
+
+	_, err := st.CreateStep(store.Step{RunID: 1, Task: "build"})
+	if err != nil {
+		t.Fatalf("got error creating step: %v", err)
+	}
+
+	srv := NewServer(":9001", queue.NewMemory(), st)
+	srv.SetAdminToken(testAdminToken)
+
+	return srv, st
+}
+
+func TestGetGitRepoRuns(t *testing.T) {
+	srv, _ := newRunServer(t)
+
+	req := httptest.NewRequest(http.MethodGet, "http://test/repos/git/runs?remote=https://example.com/test.git&branch=master", nil)
+	setToken(req, testAdminToken)
+	rw := httptest.NewRecorder()
+
+	srv.Handler.ServeHTTP(rw, req)
+
+	resp := rw.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	payload, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("got error reading response body: %v", err)
+	}
+	defer resp.Body.Close()
+
+	runs := []runResponse{}
+	err = json.Unmarshal(payload, &runs)
+	if err != nil {
+		t.Fatalf("got error unmarshaling response body: %v", err)
+	}
+
+	if len(runs) != 2 {
+		t.Fatalf("expected to get 2 runs, got %v", len(runs))
+	}
+
+	if runs[0].ID != 3 || runs[1].ID != 1 {
+		t.Fatalf("expected runs to be newest first, got %v then %v", runs[0].ID, runs[1].ID)
+	}
+}
+
+func TestGetRun(t *testing.T) {
+	srv, _ := newRunServer(t)
+
+	req := httptest.NewRequest(http.MethodGet, "http://test/runs/1", nil)
+	setToken(req, testAdminToken)
+	rw := httptest.NewRecorder()
+
+	srv.Handler.ServeHTTP(rw, req)
+
+	resp := rw.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	payload, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("got error reading response body: %v", err)
+	}
+	defer resp.Body.Close()
+
+	run := runResponse{}
+	err = json.Unmarshal(payload, &run)
+	if err != nil {
+		t.Fatalf("got error unmarshaling response body: %v", err)
+	}
+
+	if run.Status != string(store.RunQueued) {
+		t.Fatalf("expected status %v, got %v", store.RunQueued, run.Status)
+	}
+
+	if len(run.Steps) != 1 || run.Steps[0].Task != "build" {
+		t.Fatalf("expected a single build step, got %#v", run.Steps)
+	}
+}
+
+func TestGetRunNotFound(t *testing.T) {
+	srv, _ := newRunServer(t)
+
+	req := httptest.NewRequest(http.MethodGet, "http://test/runs/42", nil)
+	setToken(req, testAdminToken)
+	rw := httptest.NewRecorder()
+
+	srv.Handler.ServeHTTP(rw, req)
+
+	resp := rw.Result()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %v, got %v", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+// fakeFetcher serves task files from memory, keyed by their path, as if
+// every ref pointed at the same commit.
+type fakeFetcher struct {
+	files map[string]string
+
+	url, ref string
+}
+
+const fakeCommit = "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c"
+
+func (f *fakeFetcher) Fetch(url, ref, file string) ([]byte, string, error) {
+	f.url, f.ref = url, ref
+
+	content, ok := f.files[file]
+	if !ok {
+		return nil, "", tasks.ErrNoTask
+	}
+
+	return []byte(content), fakeCommit, nil
+}
+
+func newManualRunServer(t *testing.T) (*Server, *store.Memory, *fakeFetcher) {
+	srv, st := newRunServer(t)
+
+	fetcher := &fakeFetcher{files: map[string]string{
+		"tasks/build.yaml": `
+image: golang:1.16
+command: go build
+timeout: 30m
+arguments:
+  GOOS:
+    default: linux
+  VERSION:
+    description: Version to stamp.
+`,
+	}}
+	srv.fetcher = fetcher
+
+	return srv, st, fetcher
+}
+
+func TestPostGitRepoRun(t *testing.T) {
+	srv, st, fetcher := newManualRunServer(t)
+	jobs := subscribe(t, srv.bus, queue.SubjectJobs)
+
+	resp := do(t, srv, http.MethodPost, "/repos/git/runs", runRequest{
+		Remote:    "git@example.com:test",
+		Task:      "build",
+		Arguments: map[string]string{"VERSION": "1.0"},
+	})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status %v, got %v", http.StatusAccepted, resp.StatusCode)
+	}
+
+	// The task comes from the default branch at the URL the project was
+	// registered with.
+	if fetcher.url != "https://example.com/test.git" || fetcher.ref != "master" {
+		t.Fatalf("expected task fetched from master of the registered URL, got %v at %v", fetcher.url, fetcher.ref)
+	}
+
+	created := runResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	run, err := st.GetRun(created.ID)
+	if err != nil {
+		t.Fatalf("got error getting run: %v", err)
+	}
+
+	wantArgs := map[string]string{"GOOS": "linux", "VERSION": "1.0"}
+	if run.Status != store.RunQueued || run.Trigger != "manual" || run.Task != "build" ||
+		run.Commit != fakeCommit || !reflect.DeepEqual(run.Args, wantArgs) {
+		t.Fatalf("expected queued manual build run with %v, got %+v", wantArgs, run)
+	}
+
+	if run.Timeout != 30*time.Minute {
+		t.Fatalf("expected the task's timeout, got %v", run.Timeout)
+	}
+
+	srv.pending.Wait()
+
+	job := agents.Job{}
+	if err := json.Unmarshal((<-jobs).Data, &job); err != nil {
+		t.Fatalf("got error unmarshalling job message: %v", err)
+	}
+
+	// Agents read the task from the same commit, so they aren't sent it.
+	if job.RunID != run.ID || job.Task != "build" || job.Commit != fakeCommit ||
+		!reflect.DeepEqual(job.Arguments, wantArgs) {
+		t.Fatalf("expected job for run %v, got %+v", run.ID, job)
+	}
+}
+
+func TestPostGitRepoRunInvalid(t *testing.T) {
+	srv, st, _ := newManualRunServer(t)
+
+	tests := []struct {
+		req    runRequest
+		status int
+		field  string
+	}{
+		{runRequest{Remote: "https://example.com/test.git"}, http.StatusBadRequest, "task"},
+		{runRequest{Remote: "https://example.com/test.git", Task: "../build"}, http.StatusBadRequest, "task"},
+		{runRequest{Remote: "https://example.com/test.git", Task: "test"}, http.StatusBadRequest, "task"},
+		{runRequest{Remote: "https://example.com/test.git", Task: "build", Commit: "abc"}, http.StatusBadRequest, "commit"},
+		{runRequest{Remote: "https://example.com/test.git", Task: "build"}, http.StatusBadRequest, "arguments.VERSION"},
+		{runRequest{Remote: "https://example.com/test.git", Task: "build", Timeout: "soon"}, http.StatusBadRequest, "timeout"},
+		{
+			runRequest{Remote: "https://example.com/test.git", Task: "build", Arguments: map[string]string{"VERSION": "1", "GOARCH": "arm"}},
+			http.StatusBadRequest, "arguments.GOARCH",
+		},
+		{runRequest{Remote: "https://example.com/unknown.git", Task: "build"}, http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		resp := do(t, srv, http.MethodPost, "/repos/git/runs", test.req)
+		if resp.StatusCode != test.status {
+			t.Fatalf("expected status %v for %+v, got %v", test.status, test.req, resp.StatusCode)
+		}
+
+		if test.field == "" {
+			continue
+		}
+
+		body := struct {
+			Fields map[string]string `json:"fields"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("got error decoding response body: %v", err)
+		}
+
+		if body.Fields[test.field] == "" {
+			t.Fatalf("expected an error for %v, got %v", test.field, body.Fields)
+		}
+	}
+
+	runs, err := st.GetRuns("example.com/test", "")
+	if err != nil {
+		t.Fatalf("got error listing runs: %v", err)
+	}
+
+	if len(runs) != 3 {
+		t.Fatalf("expected only the seeded runs, got %v", len(runs))
+	}
+}
+
+func TestPostRunCancel(t *testing.T) {
+	srv, st := newRunServer(t)
+	cancels := subscribe(t, srv.bus, agents.CancelSubject("a"))
+
+	if _, err := srv.dispatcher.Register(store.Agent{ID: "a"}); err != nil {
+		t.Fatalf("got error registering agent: %v", err)
+	}
+	if _, _, err := srv.dispatcher.Heartbeat(agents.Heartbeat{AgentID: "a"}); err != nil {
+		t.Fatalf("got error sending heartbeat: %v", err)
+	}
+
+	tests := []struct {
+		url    string
+		status int
+		run    store.RunStatus
+	}{
+		// Run 1 is leased to a, so it waits for a to stop it.
+		{"/runs/1/cancel", http.StatusAccepted, store.RunCancelling},
+		{"/runs/1/cancel", http.StatusAccepted, store.RunCancelling},
+		{"/runs/2/cancel", http.StatusOK, store.RunCancelled},
+		{"/runs/2/cancel", http.StatusConflict, ""},
+		{"/runs/42/cancel", http.StatusNotFound, ""},
+		{"/runs/x/cancel", http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		resp := do(t, srv, http.MethodPost, test.url, nil)
+		if resp.StatusCode != test.status {
+			t.Fatalf("expected status %v for %v, got %v", test.status, test.url, resp.StatusCode)
+		}
+
+		if test.run == "" {
+			continue
+		}
+
+		run := runResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&run); err != nil {
+			t.Fatalf("got error decoding response body: %v", err)
+		}
+
+		if run.Status != string(test.run) {
+			t.Fatalf("expected run %v for %v, got %v", test.run, test.url, run.Status)
+		}
+	}
+
+	cancel := agents.Cancel{}
+	if err := json.Unmarshal((<-cancels).Data, &cancel); err != nil {
+		t.Fatalf("got error unmarshalling cancellation: %v", err)
+	}
+
+	if cancel.RunID != 1 || cancel.Force {
+		t.Fatalf("expected a to be asked to stop run 1, got %+v", cancel)
+	}
+
+	run, err := st.GetRun(1)
+	if err != nil {
+		t.Fatalf("got error getting run: %v", err)
+	}
+
+	if run.Status != store.RunCancelling || run.CancelRequestedAt.IsZero() {
+		t.Fatalf("expected run 1 to be cancelling, got %+v", run)
+	}
+}
@@ -0,0 +1,488 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/run-ci/run-server/agents"
+	"github.com/run-ci/run-server/schedules"
+	"github.com/run-ci/run-server/store"
+	"github.com/run-ci/run-server/tasks"
+	"github.com/sirupsen/logrus"
+)
+
+type scheduleRequest struct {
+	Remote    string            `json:"remote"`
+	Branch    string            `json:"branch"`
+	Cron      string            `json:"cron"`
+	Timezone  string            `json:"timezone"`
+	Task      string            `json:"task"`
+	Arguments map[string]string `json:"arguments"`
+	Labels    []string          `json:"labels"`
+	Enabled   *bool             `json:"enabled"`
+}
+
+// schedulePatchRequest only changes the fields that are set. Schedules
+// can't be moved to another project.
+type schedulePatchRequest struct {
+	Branch    *string            `json:"branch"`
+	Cron      *string            `json:"cron"`
+	Timezone  *string            `json:"timezone"`
+	Task      *string            `json:"task"`
+	Arguments *map[string]string `json:"arguments"`
+	Labels    *[]string          `json:"labels"`
+	Enabled   *bool              `json:"enabled"`
+}
+
+type scheduleResponse struct {
+	ID          int               `json:"id"`
+	ProjectID   int               `json:"project_id"`
+	Remote      string            `json:"remote"`
+	Branch      string            `json:"branch,omitempty"`
+	Cron        string            `json:"cron"`
+	Timezone    string            `json:"timezone,omitempty"`
+	Task        string            `json:"task"`
+	Arguments   map[string]string `json:"arguments,omitempty"`
+	Labels      []string          `json:"labels,omitempty"`
+	Enabled     bool              `json:"enabled"`
+	NextFireAt  *time.Time        `json:"next_fire_at,omitempty"`
+	LastFiredAt *time.Time        `json:"last_fired_at,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+func newScheduleResponse(sched store.Schedule, remote string) scheduleResponse {
+	return scheduleResponse{
+		ID:          sched.ID,
+		ProjectID:   sched.ProjectID,
+		Remote:      remote,
+		Branch:      sched.Branch,
+		Cron:        sched.Cron,
+		Timezone:    sched.Timezone,
+		Task:        sched.Task,
+		Arguments:   sched.Args,
+		Labels:      sched.Labels,
+		Enabled:     sched.Enabled,
+		NextFireAt:  timeOrNil(sched.NextFireAt),
+		LastFiredAt: timeOrNil(sched.LastFiredAt),
+		CreatedAt:   sched.CreatedAt,
+	}
+}
+
+// prepareSchedule checks `sched`, normalizes its labels and works out when
+// it fires next, counting from now. It returns field errors for anything
+// wrong with it.
+func prepareSchedule(sched *store.Schedule) error {
+	errs := fieldErrors{}
+
+	if _, err := time.LoadLocation(sched.Timezone); err != nil {
+		errs["timezone"] = "unknown timezone"
+	}
+
+	if _, ok := errs["timezone"]; !ok {
+		spec, err := schedules.Parse(sched.Cron, sched.Timezone)
+		switch {
+		case err != nil:
+			errs["cron"] = err.Error()
+		default:
+			sched.NextFireAt = spec.Next(time.Now())
+			if sched.NextFireAt.IsZero() {
+				errs["cron"] = "schedule never fires"
+			}
+		}
+	}
+
+	if sched.Task == "" {
+		errs["task"] = "task is empty"
+	} else if !tasks.ValidName(sched.Task) {
+		errs["task"] = "invalid task name"
+	}
+
+	if strings.HasPrefix(sched.Branch, "-") {
+		errs["branch"] = "invalid branch"
+	}
+
+	labels, err := agents.NormalizeLabels(sched.Labels)
+	if err != nil {
+		errs["labels"] = err.Error()
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	sched.Labels = labels
+	if len(sched.Labels) == 0 {
+		sched.Labels = nil
+	}
+
+	return nil
+}
+
+func (srv *Server) postSchedule(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	logger.Debug("reading request body")
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to read request body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	logger.Debug("unmarshaling request body")
+	var schedreq scheduleRequest
+	err = json.Unmarshal(buf, &schedreq)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to unmarshal request body")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	remote, err := canonicalRemote("remote", schedreq.Remote)
+	if err != nil {
+		logger.WithField("error", err).Error("invalid remote")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("remote", remote)
+
+	sched := store.Schedule{
+		Branch:   schedreq.Branch,
+		Cron:     schedreq.Cron,
+		Timezone: schedreq.Timezone,
+		Task:     schedreq.Task,
+		Args:     schedreq.Arguments,
+		Labels:   schedreq.Labels,
+		Enabled:  schedreq.Enabled == nil || *schedreq.Enabled,
+	}
+
+	if err := prepareSchedule(&sched); err != nil {
+		logger.WithField("error", err).Error("invalid schedule")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	p, err := srv.st.GetProjectByRemote(remote)
+	if err == store.ErrNotFound {
+		logger.WithField("error", err).Error("project not found in database")
+
+		writeErrResp(rw, errors.New("project not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.WithField("error", err).Error("unable to fetch project from database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+	sched.ProjectID = p.ID
+
+	logger.Info("adding schedule")
+	sched, err = srv.st.CreateSchedule(sched)
+	if err == store.ErrNotFound {
+		logger.WithField("error", err).Error("project not found in database")
+
+		writeErrResp(rw, errors.New("project not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to save schedule in database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	buf, err = json.Marshal(newScheduleResponse(sched, p.Remote))
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to marshal response body")
+
+		writeErrResp(rw, err, http.StatusCreated)
+		return
+	}
+
+	rw.WriteHeader(http.StatusCreated)
+	rw.Write(buf)
+	return
+}
+
+// getSchedules lists schedules, optionally only the ones of the project
+// with the given remote and only the ones on the given branch.
+func (srv *Server) getSchedules(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	var projects []store.Project
+	var err error
+
+	if raw := req.URL.Query().Get("remote"); raw != "" {
+		remote, err := canonicalRemote("remote", raw)
+		if err != nil {
+			logger.WithField("error", err).Error("invalid remote")
+
+			writeErrResp(rw, err, http.StatusBadRequest)
+			return
+		}
+
+		logger = logger.WithField("remote", remote)
+
+		p, err := srv.st.GetProjectByRemote(remote)
+		if err == store.ErrNotFound {
+			logger.WithField("error", err).Error("project not found in database")
+
+			writeErrResp(rw, errors.New("project not found"), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logger.WithField("error", err).Error("unable to fetch project from database")
+
+			writeErrResp(rw, err, http.StatusInternalServerError)
+			return
+		}
+
+		projects = []store.Project{p}
+	} else {
+		projects, err = srv.st.GetProjects()
+		if err != nil {
+			logger.WithField("error", err).Error("unable to get projects from database")
+
+			writeErrResp(rw, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	branch := req.URL.Query().Get("branch")
+
+	resp := []scheduleResponse{}
+	for _, p := range projects {
+		scheds, err := srv.st.GetSchedules(p.ID)
+		if err != nil {
+			logger.WithField("error", err).Error("unable to get schedules from database")
+
+			writeErrResp(rw, err, http.StatusInternalServerError)
+			return
+		}
+
+		for _, sched := range scheds {
+			// Schedules without a branch are on the default branch.
+			if branch != "" && branch != sched.Branch && (sched.Branch != "" || branch != p.DefaultBranch) {
+				continue
+			}
+
+			resp = append(resp, newScheduleResponse(sched, p.Remote))
+		}
+	}
+
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		logger.WithField("error", err).Error("unable to marshal response body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf)
+	return
+}
+
+// scheduleFromPath fetches the schedule whose ID is in the request path,
+// along with its project, writing an error response if it can't.
+func (srv *Server) scheduleFromPath(logger *logrus.Entry, rw http.ResponseWriter, req *http.Request) (store.Schedule, store.Project, bool) {
+	id, err := strconv.Atoi(mux.Vars(req)["id"])
+	if err != nil {
+		logger.WithField("error", err).Error("invalid schedule ID")
+
+		writeErrResp(rw, errors.New("invalid schedule ID"), http.StatusBadRequest)
+		return store.Schedule{}, store.Project{}, false
+	}
+
+	sched, err := srv.st.GetSchedule(id)
+	if err == store.ErrNotFound {
+		logger.WithField("error", err).Error("schedule not found in database")
+
+		writeErrResp(rw, errors.New("schedule not found"), http.StatusNotFound)
+		return sched, store.Project{}, false
+	}
+	if err != nil {
+		logger.WithField("error", err).Error("unable to fetch schedule from database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return sched, store.Project{}, false
+	}
+
+	p, err := srv.st.GetProject(sched.ProjectID)
+	if err != nil {
+		logger.WithField("error", err).Error("unable to fetch schedule's project from database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return sched, p, false
+	}
+
+	return sched, p, true
+}
+
+func (srv *Server) getSchedule(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	sched, p, ok := srv.scheduleFromPath(logger, rw, req)
+	if !ok {
+		return
+	}
+
+	buf, err := json.Marshal(newScheduleResponse(sched, p.Remote))
+	if err != nil {
+		logger.WithField("error", err).Error("unable to marshal response body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf)
+	return
+}
+
+// patchSchedule changes a schedule. Its next firing is worked out again
+// from now, so a schedule that's re-enabled doesn't make up for the
+// firings it missed while it was disabled.
+func (srv *Server) patchSchedule(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	sched, p, ok := srv.scheduleFromPath(logger, rw, req)
+	if !ok {
+		return
+	}
+
+	logger = logger.WithField("schedule_id", sched.ID)
+
+	logger.Debug("reading request body")
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to read request body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	logger.Debug("unmarshaling request body")
+	var patch schedulePatchRequest
+	err = json.Unmarshal(buf, &patch)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to unmarshal request body")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	if patch.Branch != nil {
+		sched.Branch = *patch.Branch
+	}
+	if patch.Cron != nil {
+		sched.Cron = *patch.Cron
+	}
+	if patch.Timezone != nil {
+		sched.Timezone = *patch.Timezone
+	}
+	if patch.Task != nil {
+		sched.Task = *patch.Task
+	}
+	if patch.Arguments != nil {
+		sched.Args = *patch.Arguments
+	}
+	if patch.Labels != nil {
+		sched.Labels = *patch.Labels
+	}
+	if patch.Enabled != nil {
+		sched.Enabled = *patch.Enabled
+	}
+
+	if err := prepareSchedule(&sched); err != nil {
+		logger.WithField("error", err).Error("invalid schedule")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	logger.Info("updating schedule")
+	sched, err = srv.st.UpdateSchedule(sched)
+	if err == store.ErrNotFound {
+		logger.WithField("error", err).Error("schedule not found in database")
+
+		writeErrResp(rw, errors.New("schedule not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to update schedule in database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	buf, err = json.Marshal(newScheduleResponse(sched, p.Remote))
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to marshal response body")
+
+		writeErrResp(rw, err, http.StatusOK)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf)
+	return
+}
+
+func (srv *Server) deleteSchedule(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	id, err := strconv.Atoi(mux.Vars(req)["id"])
+	if err != nil {
+		logger.WithField("error", err).Error("invalid schedule ID")
+
+		writeErrResp(rw, errors.New("invalid schedule ID"), http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("schedule_id", id)
+
+	logger.Info("deleting schedule")
+	err = srv.st.DeleteSchedule(id)
+	if err == store.ErrNotFound {
+		logger.WithField("error", err).Error("schedule not found in database")
+
+		writeErrResp(rw, errors.New("schedule not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to delete schedule from database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+	return
+}
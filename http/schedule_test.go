@@ -0,0 +1,175 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/store"
+)
+
+func newScheduleServer(t *testing.T) (*Server, *store.Memory) {
+	st := store.NewMemory()
+	srv := NewServer(":9001", queue.NewMemory(), st)
+	srv.SetAdminToken(testAdminToken)
+
+	_, err := st.CreateProject(store.Project{
+		Name:          "run",
+		Remote:        "example.com/team/run",
+		URL:           "https://example.com/team/run.git",
+		DefaultBranch: "master",
+		Branches:      []string{"master"},
+		Enabled:       true,
+	})
+	if err != nil {
+		t.Fatalf("got error creating project: %v", err)
+	}
+
+	return srv, st
+}
+
+func TestScheduleLifecycle(t *testing.T) {
+	srv, st := newScheduleServer(t)
+
+	resp := do(t, srv, http.MethodPost, "/repos/git/schedules", scheduleRequest{
+		Remote:    "https://example.com/team/run.git",
+		Cron:      "0 2 * * mon-fri",
+		Timezone:  "America/New_York",
+		Task:      "nightly",
+		Arguments: map[string]string{"SUITE": "full"},
+		Labels:    []string{"os=linux", "docker", "docker"},
+	})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %v, got %v", http.StatusCreated, resp.StatusCode)
+	}
+
+	created := scheduleResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	if created.Remote != "example.com/team/run" || !created.Enabled || created.LastFiredAt != nil {
+		t.Fatalf("expected enabled schedule that hasn't fired, got %+v", created)
+	}
+
+	if want := []string{"docker", "os=linux"}; !reflect.DeepEqual(created.Labels, want) {
+		t.Fatalf("expected labels %v, got %v", want, created.Labels)
+	}
+
+	ny, _ := time.LoadLocation("America/New_York")
+	if created.NextFireAt == nil || !created.NextFireAt.After(time.Now()) || created.NextFireAt.In(ny).Hour() != 2 {
+		t.Fatalf("expected schedule to fire next at 2am in New York, got %v", created.NextFireAt)
+	}
+
+	for _, query := range []string{"", "?remote=https://example.com/team/run", "?branch=master"} {
+		resp = do(t, srv, http.MethodGet, "/repos/git/schedules"+query, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %v listing schedules, got %v", http.StatusOK, resp.StatusCode)
+		}
+
+		list := []scheduleResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+			t.Fatalf("got error decoding response body: %v", err)
+		}
+
+		if len(list) != 1 || list[0].ID != created.ID {
+			t.Fatalf("expected schedule %v listed for %q, got %+v", created.ID, query, list)
+		}
+	}
+
+	resp = do(t, srv, http.MethodGet, "/repos/git/schedules?branch=develop", nil)
+	list := []scheduleResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	if len(list) != 0 {
+		t.Fatalf("expected no schedules on develop, got %+v", list)
+	}
+
+	url := fmt.Sprintf("/repos/git/schedules/%v", created.ID)
+	cron := "@hourly"
+	enabled := false
+	resp = do(t, srv, http.MethodPatch, url, schedulePatchRequest{Cron: &cron, Enabled: &enabled})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	resp = do(t, srv, http.MethodGet, url, nil)
+	got := scheduleResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	if got.Cron != "@hourly" || got.Enabled || got.Task != "nightly" || got.Arguments["SUITE"] != "full" {
+		t.Fatalf("expected disabled hourly schedule, got %+v", got)
+	}
+
+	if got.NextFireAt == nil || got.NextFireAt.Minute() != 0 || got.NextFireAt.Sub(time.Now()) > time.Hour {
+		t.Fatalf("expected schedule to fire next within the hour, got %v", got.NextFireAt)
+	}
+
+	resp = do(t, srv, http.MethodDelete, url, nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status %v, got %v", http.StatusNoContent, resp.StatusCode)
+	}
+
+	if _, err := st.GetSchedule(created.ID); err != store.ErrNotFound {
+		t.Fatalf("expected %v after deleting schedule, got %v", store.ErrNotFound, err)
+	}
+
+	resp = do(t, srv, http.MethodGet, url, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %v after deleting, got %v", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestPostScheduleInvalid(t *testing.T) {
+	srv, _ := newScheduleServer(t)
+
+	remote := "https://example.com/team/run.git"
+	tests := []struct {
+		field string
+		req   scheduleRequest
+	}{
+		{"remote", scheduleRequest{Remote: "run.git", Cron: "@daily", Task: "nightly"}},
+		{"cron", scheduleRequest{Remote: remote, Cron: "61 * * * *", Task: "nightly"}},
+		{"cron", scheduleRequest{Remote: remote, Cron: "0 0 30 2 *", Task: "nightly"}},
+		{"timezone", scheduleRequest{Remote: remote, Cron: "@daily", Timezone: "Mars/Base", Task: "nightly"}},
+		{"task", scheduleRequest{Remote: remote, Cron: "@daily"}},
+		{"task", scheduleRequest{Remote: remote, Cron: "@daily", Task: "../nightly"}},
+		{"branch", scheduleRequest{Remote: remote, Cron: "@daily", Task: "nightly", Branch: "-x"}},
+		{"labels", scheduleRequest{Remote: remote, Cron: "@daily", Task: "nightly", Labels: []string{"os linux"}}},
+	}
+
+	for _, test := range tests {
+		resp := do(t, srv, http.MethodPost, "/repos/git/schedules", test.req)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status %v for bad %v, got %v", http.StatusBadRequest, test.field, resp.StatusCode)
+		}
+
+		body := struct {
+			Fields map[string]string `json:"fields"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("got error decoding response body: %v", err)
+		}
+
+		if body.Fields[test.field] == "" {
+			t.Fatalf("expected an error for %v, got %v", test.field, body.Fields)
+		}
+	}
+
+	resp := do(t, srv, http.MethodPost, "/repos/git/schedules", scheduleRequest{
+		Remote: "https://example.com/team/other.git",
+		Cron:   "@daily",
+		Task:   "nightly",
+	})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %v for unknown project, got %v", http.StatusNotFound, resp.StatusCode)
+	}
+}
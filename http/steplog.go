@@ -0,0 +1,246 @@
+package http
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/run-ci/run-server/logs"
+	"github.com/run-ci/run-server/logstream"
+	"github.com/run-ci/run-server/store"
+	"github.com/sirupsen/logrus"
+)
+
+// SetLogStore sets where step logs are read from. Without one, no step
+// has a log.
+func (srv *Server) SetLogStore(ls logs.LogStore) {
+	srv.logstore = ls
+}
+
+// getStepLog serves the log of a single step as plain text. Ranges are
+// supported, so following a log that's still being written only needs
+// what was added since last time.
+func (srv *Server) getStepLog(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	vars := mux.Vars(req)
+
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		logger.WithField("error", err).Error("invalid run ID")
+
+		writeErrResp(rw, errors.New("invalid run ID"), http.StatusBadRequest)
+		return
+	}
+
+	stepID, err := strconv.Atoi(vars["step"])
+	if err != nil {
+		logger.WithField("error", err).Error("invalid step ID")
+
+		writeErrResp(rw, errors.New("invalid step ID"), http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithFields(logrus.Fields{
+		"run_id":  id,
+		"step_id": stepID,
+	})
+
+	run, err := srv.st.GetRun(id)
+	if err == store.ErrNotFound {
+		logger.WithField("error", err).Error("run not found in database")
+
+		writeErrResp(rw, errors.New("run not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.WithField("error", err).Error("unable to fetch run from database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	if !hasStep(run, stepID) {
+		logger.Error("step not found in run")
+
+		writeErrResp(rw, errors.New("step not found"), http.StatusNotFound)
+		return
+	}
+
+	if srv.logstore == nil {
+		logger.Error("no log store configured")
+
+		writeErrResp(rw, errors.New("log not found"), http.StatusNotFound)
+		return
+	}
+
+	info, err := srv.logstore.Stat(id, stepID)
+	if err == logs.ErrNotFound {
+		logger.WithField("error", err).Error("log not found")
+
+		writeErrResp(rw, errors.New("log not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.WithField("error", err).Error("unable to get log")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if info.Truncated {
+		rw.Header().Set("X-Log-Truncated", "true")
+	}
+
+	// Logs that are still being written change under the same
+	// modification time as far as HTTP can tell, so they can't be cached.
+	modtime := info.Updated
+	if !info.Final {
+		rw.Header().Set("Cache-Control", "no-cache")
+		modtime = time.Time{}
+	}
+
+	r := &logReader{
+		ls:     srv.logstore,
+		runID:  id,
+		stepID: stepID,
+		size:   info.Size,
+	}
+	defer r.Close()
+
+	http.ServeContent(rw, req, "", modtime, r)
+}
+
+func hasStep(run store.Run, stepID int) bool {
+	for _, step := range run.Steps {
+		if step.ID == stepID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// logReader reads a step log of a known size, for serving it with
+// http.ServeContent. Reading goes through a single reader from the store,
+// which is only reopened when seeking somewhere else.
+type logReader struct {
+	ls            logs.LogStore
+	runID, stepID int
+	size, off     int64
+
+	// rc reads from `off` on, once something has been read.
+	rc io.ReadCloser
+}
+
+func (r *logReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.rc == nil {
+		rc, err := r.ls.Open(r.runID, r.stepID, r.off)
+		if err != nil {
+			return 0, err
+		}
+		r.rc = rc
+	}
+
+	if int64(len(p)) > r.size-r.off {
+		p = p[:r.size-r.off]
+	}
+
+	n, err := r.rc.Read(p)
+	r.off += int64(n)
+	return n, err
+}
+
+func (r *logReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	if offset != r.off {
+		r.Close()
+	}
+
+	r.off = offset
+	return offset, nil
+}
+
+// Close closes the reader from the store, if there is one.
+func (r *logReader) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+
+	err := r.rc.Close()
+	r.rc = nil
+	return err
+}
+
+// storedLines returns the stored output of `run` after line `after`,
+// numbered the way it was streamed. Lines kept before they were numbered
+// in the store can't be told apart, so they aren't returned. It returns
+// false if nothing is stored for the run.
+func (srv *Server) storedLines(run store.Run, after int) ([]logstream.Line, bool, error) {
+	lines := []logstream.Line{}
+	if srv.logstore == nil {
+		return lines, false, nil
+	}
+
+	spans, err := srv.logstore.Lines(run.ID, after)
+	if err != nil || len(spans) == 0 {
+		return lines, false, err
+	}
+
+	names := map[int]string{}
+	for _, step := range run.Steps {
+		names[step.ID] = step.Task
+	}
+
+	// Each step's log is read once, however many lines it has.
+	stored := map[int][]byte{}
+	for _, span := range spans {
+		buf, ok := stored[span.StepID]
+		if !ok {
+			buf, err = srv.logstore.ReadRange(run.ID, span.StepID, 0, -1)
+			if err != nil {
+				return lines, false, err
+			}
+			stored[span.StepID] = buf
+		}
+
+		end := span.Pos + span.Size
+		if end > int64(len(buf)) {
+			end = int64(len(buf))
+		}
+		if span.Pos > end {
+			continue
+		}
+
+		lines = append(lines, logstream.Line{
+			Seq:  span.Seq,
+			Step: names[span.StepID],
+			Text: strings.TrimSuffix(string(buf[span.Pos:end]), "\n"),
+		})
+	}
+
+	return lines, true, nil
+}
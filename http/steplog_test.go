@@ -0,0 +1,158 @@
+package http
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/run-ci/run-server/logs"
+	"github.com/run-ci/run-server/logstream"
+	"github.com/run-ci/run-server/store"
+)
+
+func newStepLogServer(t *testing.T) (*Server, *store.Memory) {
+	srv, st := newRunServer(t)
+
+	dir, err := ioutil.TempDir("", "steplog")
+	if err != nil {
+		t.Fatalf("got error creating temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	ls, err := logs.NewDisk(dir)
+	if err != nil {
+		t.Fatalf("got error creating log store: %v", err)
+	}
+	srv.SetLogStore(ls)
+
+	// Run 1 has a build step with ID 1 already. The lines in between
+	// came from other steps and were lost.
+	lines := []struct {
+		seq  int
+		text string
+	}{
+		{2, "one\n"},
+		{5, "two\n"},
+		{7, "three\n"},
+	}
+	for _, line := range lines {
+		if err := ls.Append(1, 1, line.seq, []byte(line.text)); err != nil {
+			t.Fatalf("got error appending to log: %v", err)
+		}
+	}
+
+	return srv, st
+}
+
+func getStepLog(t *testing.T, srv *Server, url, rangeHeader string) *http.Response {
+	req := httptest.NewRequest(http.MethodGet, "http://test"+url, nil)
+	setToken(req, testAdminToken)
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	rw := httptest.NewRecorder()
+
+	srv.Handler.ServeHTTP(rw, req)
+
+	return rw.Result()
+}
+
+func TestGetStepLog(t *testing.T) {
+	srv, _ := newStepLogServer(t)
+
+	tests := []struct {
+		rangeHeader string
+		status      int
+		body        string
+	}{
+		{"", http.StatusOK, "one\ntwo\nthree\n"},
+		{"bytes=4-7", http.StatusPartialContent, "two\n"},
+		{"bytes=8-", http.StatusPartialContent, "three\n"},
+		{"bytes=100-", http.StatusRequestedRangeNotSatisfiable, ""},
+	}
+
+	for _, test := range tests {
+		resp := getStepLog(t, srv, "/runs/1/steps/1/log", test.rangeHeader)
+		if resp.StatusCode != test.status {
+			t.Fatalf("expected status %v for range %q, got %v", test.status, test.rangeHeader, resp.StatusCode)
+		}
+
+		if test.body == "" {
+			continue
+		}
+
+		buf, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("got error reading response body: %v", err)
+		}
+
+		if string(buf) != test.body {
+			t.Fatalf("expected %q for range %q, got %q", test.body, test.rangeHeader, buf)
+		}
+
+		if cc := resp.Header.Get("Cache-Control"); cc != "no-cache" {
+			t.Fatalf("expected open log not to be cached, got %q", cc)
+		}
+	}
+}
+
+func TestGetStepLogNotFound(t *testing.T) {
+	srv, st := newStepLogServer(t)
+
+	// Step 2 exists but hasn't logged anything.
+	if _, err := st.CreateStep(store.Step{RunID: 1, Task: "test"}); err != nil {
+		t.Fatalf("got error creating step: %v", err)
+	}
+
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{"/runs/x/steps/1/log", http.StatusBadRequest},
+		{"/runs/1/steps/x/log", http.StatusBadRequest},
+		{"/runs/42/steps/1/log", http.StatusNotFound},
+		{"/runs/2/steps/1/log", http.StatusNotFound},
+		{"/runs/1/steps/2/log", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		resp := getStepLog(t, srv, test.url, "")
+		if resp.StatusCode != test.status {
+			t.Fatalf("expected status %v for %v, got %v", test.status, test.url, resp.StatusCode)
+		}
+	}
+}
+
+func TestGetRunLogsStored(t *testing.T) {
+	srv, st := newStepLogServer(t)
+
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	if _, err := st.UpdateRunStatus(1, store.RunCancelled); err != nil {
+		t.Fatalf("got error finishing run: %v", err)
+	}
+
+	// Nothing is left in memory, as if the server had restarted since.
+	resp := getLogs(t, ts, "/runs/1/logs", "2")
+	defer resp.Body.Close()
+
+	events := readEvents(t, bufio.NewReader(resp.Body), 3)
+
+	line := logstream.Line{}
+	if err := json.Unmarshal([]byte(events[1].data), &line); err != nil {
+		t.Fatalf("got error unmarshalling line: %v", err)
+	}
+
+	if events[1].id != "7" || line.Text != "three" || line.Step != "build" {
+		t.Fatalf("expected line three of build, got %+v", events[1])
+	}
+
+	if events[2].event != "end" || events[2].id != "7" {
+		t.Fatalf("expected the end after line three, got %+v", events[2])
+	}
+}
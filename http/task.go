@@ -0,0 +1,138 @@
+package http
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/run-ci/run-server/tasks"
+)
+
+// defaultTaskName is what tasks being validated are called if the request
+// doesn't name them.
+const defaultTaskName = "task"
+
+type taskResponse struct {
+	Name        string                      `json:"name"`
+	Summary     string                      `json:"summary"`
+	Description string                      `json:"description"`
+	Image       string                      `json:"image"`
+	Mount       string                      `json:"mount"`
+	Command     string                      `json:"command"`
+	Shell       string                      `json:"shell,omitempty"`
+	Timeout     string                      `json:"timeout,omitempty"`
+	Arguments   map[string]argumentResponse `json:"arguments"`
+}
+
+type argumentResponse struct {
+	Description string  `json:"description"`
+	Default     *string `json:"default"`
+}
+
+func newTaskResponse(task tasks.Task) taskResponse {
+	resp := taskResponse{
+		Name:        task.Name,
+		Summary:     task.Summary,
+		Description: task.Description,
+		Image:       task.Image,
+		Mount:       task.Mount,
+		Command:     task.Command,
+		Shell:       task.Shell,
+		Arguments:   map[string]argumentResponse{},
+	}
+
+	if task.Timeout != 0 {
+		resp.Timeout = task.Timeout.String()
+	}
+
+	for name, arg := range task.Arguments {
+		argresp := argumentResponse{Description: arg.Description}
+		if arg.HasDefault {
+			def := arg.Default
+			argresp.Default = &def
+		}
+
+		resp.Arguments[name] = argresp
+	}
+
+	return resp
+}
+
+type taskError struct {
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+type taskValidateResponse struct {
+	Valid  bool          `json:"valid"`
+	Task   *taskResponse `json:"task,omitempty"`
+	Errors []taskError   `json:"errors,omitempty"`
+}
+
+// postTaskValidate parses the task file in the request body and reports
+// whether it's valid, along with everything that's wrong with it if it
+// isn't. The task is named by the `name` argument, since task names come
+// from their file names.
+func (srv *Server) postTaskValidate(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	logger.Debug("reading request body")
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to read request body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		name = defaultTaskName
+	}
+	logger = logger.WithField("task", name)
+
+	resp := taskValidateResponse{Valid: true}
+	status := http.StatusOK
+
+	task, err := tasks.Parse(name, buf)
+	if errs, ok := err.(tasks.Errors); ok {
+		logger.Infof("task has %v errors", len(errs))
+
+		resp.Valid = false
+		status = http.StatusUnprocessableEntity
+
+		for _, e := range errs {
+			resp.Errors = append(resp.Errors, taskError{
+				Line:    e.Line,
+				Column:  e.Column,
+				Field:   e.Field,
+				Message: e.Message,
+			})
+		}
+	} else if err != nil {
+		logger.WithField("error", err).Error("unable to parse task")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	} else {
+		taskresp := newTaskResponse(task)
+		resp.Task = &taskresp
+	}
+
+	buf, err = json.Marshal(resp)
+	if err != nil {
+		logger.WithField("error", err).Error("unable to marshal response body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(buf)
+	return
+}
@@ -0,0 +1,83 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/store"
+)
+
+// validateTask posts `doc` to /tasks/validate as the task `name`.
+func validateTask(t *testing.T, name, doc string) (int, taskValidateResponse) {
+	srv := NewServer(":9001", queue.NewMemory(), store.NewMemory())
+	srv.SetAdminToken(testAdminToken)
+
+	req := httptest.NewRequest(http.MethodPost, "http://test/tasks/validate?name="+name, strings.NewReader(doc))
+	setToken(req, testAdminToken)
+	rw := httptest.NewRecorder()
+
+	srv.Handler.ServeHTTP(rw, req)
+
+	resp := taskValidateResponse{}
+	if err := json.NewDecoder(rw.Result().Body).Decode(&resp); err != nil {
+		t.Fatalf("got error decoding response body: %v", err)
+	}
+
+	return rw.Result().StatusCode, resp
+}
+
+func TestPostTaskValidate(t *testing.T) {
+	doc := `
+summary: Build it.
+image: golang:1.16
+command: go build
+arguments:
+  GOOS:
+    default: linux
+  VERSION:
+    description: Version to stamp.
+`
+
+	status, resp := validateTask(t, "build", doc)
+	if status != http.StatusOK || !resp.Valid {
+		t.Fatalf("expected valid task, got status %v and %+v", status, resp)
+	}
+
+	if resp.Task == nil || resp.Task.Name != "build" || resp.Task.Image != "golang:1.16" {
+		t.Fatalf("expected parsed build task, got %+v", resp.Task)
+	}
+
+	goos := resp.Task.Arguments["GOOS"]
+	if goos.Default == nil || *goos.Default != "linux" {
+		t.Fatalf("expected GOOS to default to linux, got %+v", goos)
+	}
+
+	if resp.Task.Arguments["VERSION"].Default != nil {
+		t.Fatalf("expected VERSION to have no default, got %+v", resp.Task.Arguments["VERSION"])
+	}
+}
+
+func TestPostTaskValidateInvalid(t *testing.T) {
+	doc := "image: golang:1.16\ncommnd: go build\n"
+
+	status, resp := validateTask(t, "build", doc)
+	if status != http.StatusUnprocessableEntity || resp.Valid {
+		t.Fatalf("expected invalid task, got status %v and %+v", status, resp)
+	}
+
+	if len(resp.Errors) != 2 {
+		t.Fatalf("expected 2 errors, got %+v", resp.Errors)
+	}
+
+	if e := resp.Errors[0]; e.Line != 2 || e.Column != 1 || e.Field != "commnd" {
+		t.Fatalf("expected unknown field error on line 2, got %+v", e)
+	}
+
+	if e := resp.Errors[1]; e.Field != "command" {
+		t.Fatalf("expected missing command error, got %+v", e)
+	}
+}
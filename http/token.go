@@ -0,0 +1,195 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/run-ci/run-server/store"
+)
+
+type tokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type tokenResponse struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Token is only ever set in the response to minting it.
+	Token string `json:"token,omitempty"`
+}
+
+func newTokenResponse(token store.Token) tokenResponse {
+	return tokenResponse{
+		ID:        token.ID,
+		Name:      token.Name,
+		Scopes:    token.Scopes,
+		CreatedAt: token.CreatedAt,
+	}
+}
+
+func (srv *Server) postToken(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	logger.Debug("reading request body")
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to read request body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	logger.Debug("unmarshaling request body")
+	var treq tokenRequest
+	err = json.Unmarshal(buf, &treq)
+	if err != nil {
+		logger.WithField("error", err).
+			Error("unable to unmarshal request body")
+
+		writeErrResp(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	if treq.Name == "" {
+		logger.Error("missing 'name' argument")
+
+		writeErrResp(rw, errors.New("missing 'name' argument"), http.StatusBadRequest)
+		return
+	}
+
+	if len(treq.Scopes) == 0 {
+		logger.Error("missing 'scopes' argument")
+
+		writeErrResp(rw, errors.New("missing 'scopes' argument"), http.StatusBadRequest)
+		return
+	}
+
+	for _, scope := range treq.Scopes {
+		if !store.ValidScope(scope) {
+			logger.Errorf("unknown scope %q", scope)
+
+			writeErrResp(rw, fmt.Errorf("unknown scope %q, need one of %v", scope, store.Scopes),
+				http.StatusBadRequest)
+			return
+		}
+	}
+
+	raw, err := newToken()
+	if err != nil {
+		logger.WithField("error", err).Error("unable to generate token")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	logger = logger.WithField("token", treq.Name)
+	logger.Debug("saving token")
+
+	token, err := srv.st.CreateToken(store.Token{
+		Name:   treq.Name,
+		Hash:   hashToken(raw),
+		Scopes: treq.Scopes,
+	})
+	if err != nil {
+		logger.WithField("error", err).Error("unable to save token")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := newTokenResponse(token)
+	resp.Token = raw
+
+	buf, err = json.Marshal(resp)
+	if err != nil {
+		logger.WithField("error", err).Error("unable to marshal response body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	logger.Infof("minted token %v", token.ID)
+
+	rw.WriteHeader(http.StatusCreated)
+	rw.Write(buf)
+	return
+}
+
+func (srv *Server) getTokens(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	logger.Debug("getting tokens")
+
+	tokens, err := srv.st.GetTokens()
+	if err != nil {
+		logger.WithField("error", err).Error("unable to get tokens from database")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := []tokenResponse{}
+	for _, token := range tokens {
+		resp = append(resp, newTokenResponse(token))
+	}
+
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		logger.WithField("error", err).Error("unable to marshal response body")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf)
+	return
+}
+
+func (srv *Server) deleteToken(rw http.ResponseWriter, req *http.Request) {
+	reqID := req.Context().Value(keyReqID).(string)
+	logger := logger.WithField("request_id", reqID)
+
+	id, err := strconv.Atoi(mux.Vars(req)["id"])
+	if err != nil {
+		logger.WithField("error", err).Error("invalid token ID")
+
+		writeErrResp(rw, errors.New("invalid token ID"), http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.WithField("token_id", id)
+	logger.Debug("revoking token")
+
+	err = srv.st.DeleteToken(id)
+	if err == store.ErrNotFound {
+		logger.WithField("error", err).Error("token not found in database")
+
+		writeErrResp(rw, errors.New("token not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.WithField("error", err).Error("unable to revoke token")
+
+		writeErrResp(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("revoked token")
+
+	rw.WriteHeader(http.StatusNoContent)
+	return
+}
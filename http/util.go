@@ -2,20 +2,43 @@ package http
 
 import (
 	"encoding/json"
+	"fmt"
 	"math"
 	"math/rand"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/run-ci/run-server/queue"
 	"github.com/sirupsen/logrus"
 )
 
+// fieldErrors maps the fields of a request to what's wrong with them.
+type fieldErrors map[string]string
+
+func (fe fieldErrors) Error() string {
+	fields := make([]string, 0, len(fe))
+	for field, reason := range fe {
+		fields = append(fields, fmt.Sprintf("%v: %v", field, reason))
+	}
+	sort.Strings(fields)
+
+	return "invalid request: " + strings.Join(fields, ", ")
+}
+
 func writeErrResp(rw http.ResponseWriter, err error, status int) {
 	rw.WriteHeader(status)
 
-	buf, err := json.Marshal(map[string]string{
+	body := map[string]interface{}{
 		"error": err.Error(),
-	})
+	}
+	if fe, ok := err.(fieldErrors); ok {
+		body["error"] = "invalid request"
+		body["fields"] = fe
+	}
+
+	buf, err := json.Marshal(body)
 	if err != nil {
 		return
 	}
@@ -24,21 +47,29 @@ func writeErrResp(rw http.ResponseWriter, err error, status int) {
 	return
 }
 
-func sendWithBackoff(logger *logrus.Entry, ch chan<- []byte, msg []byte) {
+func sendWithBackoff(logger *logrus.Entry, bus queue.Bus, subj string, msg []byte) {
 	jittersrc := rand.NewSource(time.Now().Unix())
 	jitter := rand.New(jittersrc)
 
+	logger = logger.WithField("subject", subj)
+
 	for i := 0; i < 5; i++ {
-		select {
-		case ch <- msg:
+		err := bus.Publish(subj, msg)
+		if err == nil {
 			logger.Debug("message sent")
 			return
-		default:
-			base := math.Pow(float64(2), float64(i))
-			backoff := time.Duration(jitter.Intn(int(base))) * time.Second
-
-			logger.Warnf("unable to send poller create message, sleeping for %v", backoff)
-			time.Sleep(backoff)
 		}
+
+		sendRetries.Inc(subj)
+
+		base := math.Pow(float64(2), float64(i))
+		backoff := time.Duration(jitter.Intn(int(base))) * time.Second
+
+		logger.WithField("error", err).
+			Warnf("unable to send message, sleeping for %v", backoff)
+		time.Sleep(backoff)
 	}
+
+	sendDrops.Inc(subj)
+	logger.Error("giving up sending message")
 }
@@ -0,0 +1,79 @@
+package http
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsWriteTimeout bounds how long writing a single message can take, so a
+// viewer that stopped reading doesn't hold its stream open forever.
+const wsWriteTimeout = 10 * time.Second
+
+// wsMaxMessage is the largest message read from clients. Viewers don't
+// have anything to say, so anything they send is small.
+const wsMaxMessage = 4096
+
+// upgrader turns down bad handshakes in the server's own error format.
+// Only pages from the server's own origin can open streams.
+var upgrader = websocket.Upgrader{
+	Error: func(rw http.ResponseWriter, req *http.Request, status int, reason error) {
+		rw.Header().Set("Sec-WebSocket-Version", "13")
+		writeErrResp(rw, reason, status)
+	},
+}
+
+// isWebSocket returns whether `req` asks to be upgraded to a WebSocket.
+func isWebSocket(req *http.Request) bool {
+	return websocket.IsWebSocketUpgrade(req)
+}
+
+// wsConn is the server side of a WebSocket. Only one goroutine may send
+// messages at a time, but pings and closing can happen from anywhere.
+type wsConn struct {
+	conn *websocket.Conn
+}
+
+// upgradeWebSocket completes the WebSocket handshake for `req` and takes
+// over its connection. Nothing can be written to `rw` afterwards.
+func upgradeWebSocket(rw http.ResponseWriter, req *http.Request) (*wsConn, error) {
+	conn, err := upgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadLimit(wsMaxMessage)
+	return &wsConn{conn: conn}, nil
+}
+
+// WriteText sends `buf` as a text message.
+func (c *wsConn) WriteText(buf []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteMessage(websocket.TextMessage, buf)
+}
+
+// Ping sends a ping, which clients answer to show they're still there.
+func (c *wsConn) Ping() error {
+	return c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+}
+
+// Close sends a normal closure, unless the client closed first and has
+// already had its close echoed, and closes the connection.
+func (c *wsConn) Close() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteTimeout))
+
+	return c.conn.Close()
+}
+
+// readLoop reads from the client until it closes the connection or
+// something goes wrong. Pings are answered and closes echoed along the way,
+// and any messages the client sends are ignored.
+func (c *wsConn) readLoop() error {
+	for {
+		if _, _, err := c.conn.NextReader(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Package leader picks one of the servers sharing a store to do the work
+// only one of them should be doing, like firing schedules, requeueing runs
+// and relaying the outbox.
+//
+// Servers take turns trying to take a Lock. Whoever holds it is leader
+// until it lets go or loses it, and the others keep trying in case that
+// happens. Work that must only happen in one place is started when a
+// server becomes leader and stopped when it stops being one.
+package leader
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/run-ci/run-server/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+var logger *logrus.Entry
+
+var leading = metrics.NewGaugeVec("run_leader",
+	"Whether this server is the leader, 1 if it is and 0 if it isn't.")
+
+func init() {
+	logger = logrus.WithField("package", "leader")
+}
+
+// checkTimeout bounds how long taking the lock, or finding out who holds
+// it, can take.
+const checkTimeout = 5 * time.Second
+
+// Lock is held by at most one instance at a time.
+type Lock interface {
+	// Acquire tries to take the lock for the instance with the given ID,
+	// or makes sure it still holds it if it already does. It returns
+	// whether the instance holds the lock.
+	Acquire(ctx context.Context, id string) (bool, error)
+
+	// Release lets go of the lock if the instance with the given ID
+	// holds it.
+	Release(ctx context.Context, id string) error
+
+	// Holder returns the ID of the instance holding the lock, or an empty
+	// string if nobody does.
+	Holder(ctx context.Context) (string, error)
+}
+
+// Elector keeps trying to make this instance leader by taking a Lock,
+// and tells whoever's interested when it becomes leader or stops being
+// one.
+type Elector struct {
+	lock Lock
+
+	// ID identifies this instance to the others.
+	ID string
+
+	// Interval is how often the lock is checked. It's also how long a
+	// leader can go on after losing the lock without noticing.
+	Interval time.Duration
+
+	mu        sync.Mutex
+	leader    bool
+	onElected []func()
+	onDemoted []func()
+}
+
+// New returns an Elector taking `lock` for the instance with the given ID.
+func New(lock Lock, id string) *Elector {
+	return &Elector{
+		lock: lock,
+		ID:   id,
+
+		Interval: 5 * time.Second,
+	}
+}
+
+// OnElected calls `f` whenever this instance becomes leader. Callbacks are
+// called one after the other, in the order they were added.
+func (e *Elector) OnElected(f func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.onElected = append(e.onElected, f)
+}
+
+// OnDemoted calls `f` whenever this instance stops being leader, after it
+// has been elected. Callbacks are called one after the other, in the
+// order they were added.
+func (e *Elector) OnDemoted(f func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.onDemoted = append(e.onDemoted, f)
+}
+
+// Go runs `run` for as long as this instance is leader. It's started
+// with a new context every time the instance is elected, and the context
+// is cancelled when it's demoted. Demotion waits for `run` to return, so
+// that it's never running on two instances at once for longer than it
+// takes to notice the lock is gone.
+func (e *Elector) Go(run func(context.Context)) {
+	var cancel context.CancelFunc
+	var done chan struct{}
+
+	e.OnElected(func() {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		done = make(chan struct{})
+
+		go func(done chan struct{}) {
+			defer close(done)
+			run(ctx)
+		}(done)
+	})
+
+	e.OnDemoted(func() {
+		cancel()
+		<-done
+	})
+}
+
+// IsLeader returns whether this instance is leader.
+func (e *Elector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.leader
+}
+
+// Leader returns the ID of the leader, whichever instance that is, or an
+// empty string if there isn't one.
+func (e *Elector) Leader() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	return e.lock.Holder(ctx)
+}
+
+// Run tries to become leader, or stay leader, every Interval until `ctx`
+// is done. It steps down before returning if it's leader by then.
+func (e *Elector) Run(ctx context.Context) {
+	logger := logger.WithField("instance", e.ID)
+	logger.Info("starting leader election")
+
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := e.Check(); err != nil {
+			logger.WithField("error", err).Error("unable to check leadership")
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Info("stopping leader election")
+			if err := e.Resign(); err != nil {
+				logger.WithField("error", err).Warn("unable to release leadership")
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check takes the lock if nobody holds it, or makes sure this instance
+// still does if it's leader, and returns whether it's leader. The
+// callbacks are called if that changed. Errors checking the lock count as
+// losing it, since another instance may well have it by then.
+func (e *Elector) Check() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	held, err := e.lock.Acquire(ctx, e.ID)
+	if err != nil {
+		held = false
+	}
+
+	e.set(held)
+	return held, err
+}
+
+// Resign lets go of the lock, if this instance holds it, so that another
+// one can take over straight away.
+func (e *Elector) Resign() error {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	e.set(false)
+	return e.lock.Release(ctx, e.ID)
+}
+
+// set records whether this instance is leader and calls the callbacks if
+// that changed.
+func (e *Elector) set(leader bool) {
+	e.mu.Lock()
+	if e.leader == leader {
+		e.mu.Unlock()
+		return
+	}
+	e.leader = leader
+
+	callbacks := e.onDemoted
+	if leader {
+		callbacks = e.onElected
+	}
+	callbacks = append([]func(){}, callbacks...)
+	e.mu.Unlock()
+
+	logger := logger.WithField("instance", e.ID)
+	if leader {
+		logger.Info("became leader")
+		leading.Set(1)
+	} else {
+		logger.Warn("no longer leader")
+		leading.Set(0)
+	}
+
+	for _, f := range callbacks {
+		f()
+	}
+}
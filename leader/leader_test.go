@@ -0,0 +1,157 @@
+package leader
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+func TestElector(t *testing.T) {
+	lock := NewMemory()
+	a, b := New(lock, "a"), New(lock, "b")
+
+	events := []string{}
+	a.OnElected(func() { events = append(events, "elected") })
+	a.OnDemoted(func() { events = append(events, "demoted") })
+
+	if leader, err := a.Check(); err != nil || !leader {
+		t.Fatalf("expected a to become leader, got %v, %v", leader, err)
+	}
+
+	// Staying leader doesn't count as being elected again.
+	if leader, err := a.Check(); err != nil || !leader {
+		t.Fatalf("expected a to stay leader, got %v, %v", leader, err)
+	}
+
+	if leader, err := b.Check(); err != nil || leader {
+		t.Fatalf("expected b not to become leader, got %v, %v", leader, err)
+	}
+
+	if id, err := b.Leader(); err != nil || id != "a" {
+		t.Fatalf("expected b to see a as leader, got %q, %v", id, err)
+	}
+
+	if err := a.Resign(); err != nil {
+		t.Fatalf("got error resigning: %v", err)
+	}
+
+	if a.IsLeader() {
+		t.Fatal("expected a not to be leader after resigning")
+	}
+
+	if leader, err := b.Check(); err != nil || !leader || !b.IsLeader() {
+		t.Fatalf("expected b to take over, got %v, %v", leader, err)
+	}
+
+	if len(events) != 2 || events[0] != "elected" || events[1] != "demoted" {
+		t.Fatalf("expected a to be elected and demoted once, got %v", events)
+	}
+}
+
+// brokenLock can be taken until it breaks.
+type brokenLock struct {
+	*Memory
+	broken bool
+}
+
+func (l *brokenLock) Acquire(ctx context.Context, id string) (bool, error) {
+	if l.broken {
+		return false, errors.New("connection lost")
+	}
+
+	return l.Memory.Acquire(ctx, id)
+}
+
+func TestElectorGo(t *testing.T) {
+	lock := &brokenLock{Memory: NewMemory()}
+	e := New(lock, "a")
+
+	started := make(chan struct{}, 2)
+	stopped := make(chan struct{}, 2)
+	e.Go(func(ctx context.Context) {
+		started <- struct{}{}
+		<-ctx.Done()
+		stopped <- struct{}{}
+	})
+
+	if _, err := e.Check(); err != nil {
+		t.Fatalf("got error checking leadership: %v", err)
+	}
+	<-started
+
+	// Not being able to tell counts as losing the lock, and demotion
+	// waits for the work to stop.
+	lock.broken = true
+	if leader, err := e.Check(); err == nil || leader {
+		t.Fatalf("expected error and no leadership, got %v, %v", leader, err)
+	}
+
+	select {
+	case <-stopped:
+	default:
+		t.Fatal("expected work to be stopped on demotion")
+	}
+
+	// It starts again with a new context when leadership comes back.
+	lock.broken = false
+	if _, err := e.Check(); err != nil {
+		t.Fatalf("got error checking leadership: %v", err)
+	}
+	<-started
+
+	if err := e.Resign(); err != nil {
+		t.Fatalf("got error resigning: %v", err)
+	}
+	<-stopped
+}
+
+func TestPostgres(t *testing.T) {
+	connstr := os.Getenv("RUN_TEST_POSTGRES_URL")
+	if connstr == "" {
+		t.Skip("RUN_TEST_POSTGRES_URL not set")
+	}
+
+	db, err := sql.Open("postgres", connstr)
+	if err != nil {
+		t.Fatalf("got error connecting to postgres: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	key := DefaultKey + 1
+	a, b := NewPostgres(db, key), NewPostgres(db, key)
+
+	if held, err := a.Acquire(ctx, "a"); err != nil || !held {
+		t.Fatalf("expected a to take the lock, got %v, %v", held, err)
+	}
+	defer a.Release(ctx, "a")
+
+	if held, err := a.Acquire(ctx, "a"); err != nil || !held {
+		t.Fatalf("expected a to still hold the lock, got %v, %v", held, err)
+	}
+
+	if held, err := b.Acquire(ctx, "b"); err != nil || held {
+		t.Fatalf("expected b not to take the lock, got %v, %v", held, err)
+	}
+
+	if id, err := b.Holder(ctx); err != nil || id != "a" {
+		t.Fatalf("expected a to hold the lock, got %q, %v", id, err)
+	}
+
+	if err := a.Release(ctx, "a"); err != nil {
+		t.Fatalf("got error releasing lock: %v", err)
+	}
+
+	if id, err := b.Holder(ctx); err != nil || id != "" {
+		t.Fatalf("expected nobody to hold the lock, got %q, %v", id, err)
+	}
+
+	if held, err := b.Acquire(ctx, "b"); err != nil || !held {
+		t.Fatalf("expected b to take the lock, got %v, %v", held, err)
+	}
+	defer b.Release(ctx, "b")
+}
@@ -0,0 +1,51 @@
+package leader
+
+import (
+	"context"
+	"sync"
+)
+
+// Memory is a Lock that lives in memory. It's for servers that don't
+// share a database with anyone else, so the only instances contending
+// for it are in the same process.
+type Memory struct {
+	mu     sync.Mutex
+	holder string
+}
+
+// NewMemory returns a Lock nobody holds yet.
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Acquire implements Lock.
+func (m *Memory) Acquire(ctx context.Context, id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.holder == "" {
+		m.holder = id
+	}
+
+	return m.holder == id, nil
+}
+
+// Release implements Lock.
+func (m *Memory) Release(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.holder == id {
+		m.holder = ""
+	}
+
+	return nil
+}
+
+// Holder implements Lock.
+func (m *Memory) Holder(ctx context.Context) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.holder, nil
+}
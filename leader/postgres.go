@@ -0,0 +1,170 @@
+package leader
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"sync"
+)
+
+// DefaultKey is the advisory lock key servers contend for, "run" in
+// ASCII.
+const DefaultKey int64 = 0x72756e
+
+// appNamePrefix marks the connections of instances holding the lock, so
+// the others can tell who the leader is.
+const appNamePrefix = "run-server:"
+
+// Postgres is a Lock built on a Postgres session level advisory lock. The
+// lock belongs to a single connection taken out of the pool, and goes
+// away with it, so an instance that loses its connection loses the lock
+// with it.
+type Postgres struct {
+	db  *sql.DB
+	key int64
+
+	mu   sync.Mutex
+	conn *sql.Conn
+	id   string
+}
+
+// NewPostgres returns a Lock on the advisory lock `key` in `db`.
+func NewPostgres(db *sql.DB, key int64) *Postgres {
+	return &Postgres{
+		db:  db,
+		key: key,
+	}
+}
+
+// Acquire implements Lock.
+func (pg *Postgres) Acquire(ctx context.Context, id string) (bool, error) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	// The lock is held for as long as the connection that took it is
+	// alive.
+	if pg.conn != nil {
+		_, err := pg.conn.ExecContext(ctx, `SELECT 1;`)
+		if err == nil && pg.id == id {
+			return true, nil
+		}
+
+		pg.discard()
+		if err != nil {
+			logger.WithField("error", err).Debug("lost connection holding the lock")
+			return false, err
+		}
+	}
+
+	conn, err := pg.db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	// Everyone else finds the leader by the name of the connection
+	// holding the lock, so it's named before it can take it.
+	_, err = conn.ExecContext(ctx, `SELECT set_config('application_name', $1, false);`, appName(id))
+	if err != nil {
+		conn.Close()
+		return false, err
+	}
+
+	// The lock may have been taken even if finding out failed.
+	var held bool
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1);`, pg.key).Scan(&held)
+	if err != nil {
+		discard(conn)
+		return false, err
+	}
+	if !held {
+		conn.Close()
+		return false, nil
+	}
+
+	pg.conn = conn
+	pg.id = id
+	return true, nil
+}
+
+// Release implements Lock.
+func (pg *Postgres) Release(ctx context.Context, id string) error {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	if pg.conn == nil || pg.id != id {
+		return nil
+	}
+
+	// Connections go back to the pool once they're closed, so they can't
+	// go back still holding the lock.
+	var released bool
+	err := pg.conn.QueryRowContext(ctx, `SELECT pg_advisory_unlock($1);`, pg.key).Scan(&released)
+	if err != nil || !released {
+		pg.discard()
+		return err
+	}
+
+	if _, err := pg.conn.ExecContext(ctx, `RESET application_name;`); err != nil {
+		pg.discard()
+		return err
+	}
+
+	err = pg.conn.Close()
+	pg.conn = nil
+	pg.id = ""
+	return err
+}
+
+// Holder implements Lock.
+func (pg *Postgres) Holder(ctx context.Context) (string, error) {
+	// Keys are split into two halves in pg_locks.
+	sqlq := `
+	SELECT a.application_name
+	FROM pg_locks l
+	JOIN pg_stat_activity a ON a.pid = l.pid
+	WHERE l.locktype = 'advisory' AND l.granted AND l.objsubid = 1
+		AND ((l.classid::bigint << 32) | l.objid::bigint) = $1;
+	`
+
+	var name string
+	err := pg.db.QueryRowContext(ctx, sqlq, pg.key).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimPrefix(name, appNamePrefix), nil
+}
+
+// discard throws away the connection holding the lock, which lets go of
+// the lock if it's still held. It must be called with the mutex held.
+func (pg *Postgres) discard() {
+	discard(pg.conn)
+
+	pg.conn = nil
+	pg.id = ""
+}
+
+// discard closes `conn` for good rather than putting it back in the pool,
+// which ends its session along with any locks it holds.
+func discard(conn *sql.Conn) {
+	conn.Raw(func(interface{}) error {
+		return driver.ErrBadConn
+	})
+	conn.Close()
+}
+
+// appName returns the application name of the connection holding the
+// lock for the instance with the given ID, cut to the length Postgres
+// keeps.
+func appName(id string) string {
+	name := appNamePrefix + id
+	if len(name) > 63 {
+		name = name[:63]
+	}
+
+	return name
+}
@@ -0,0 +1,453 @@
+package logs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File extensions of the files a Disk keeps for each step.
+const (
+	extOpen      = ".log"
+	extFinal     = ".log.gz"
+	extTruncated = ".truncated"
+)
+
+// indexFile is where a Disk keeps the index of each run's lines, with a
+// record of indexRecord bytes per line: its seq, step ID, position and
+// size, as little-endian int64s.
+const (
+	indexFile   = "lines"
+	indexRecord = 32
+)
+
+// Disk is a LogStore keeping logs in files under a single directory, with
+// a directory per run. Logs are appended to plain files while they're
+// open and gzipped when they're finalized.
+type Disk struct {
+	// mu keeps appends, finalizing and pruning from racing each other.
+	// Reads don't need it.
+	mu  sync.Mutex
+	dir string
+
+	// MaxRunBytes caps how much output is kept for each run, before
+	// compression.
+	MaxRunBytes int64
+}
+
+// NewDisk returns a Disk keeping logs under `dir`, which is created if it
+// doesn't exist.
+func NewDisk(dir string) (*Disk, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Disk{
+		dir: dir,
+
+		MaxRunBytes: DefaultMaxRunBytes,
+	}, nil
+}
+
+func (d *Disk) runDir(runID int) string {
+	return filepath.Join(d.dir, strconv.Itoa(runID))
+}
+
+func (d *Disk) path(runID, stepID int, ext string) string {
+	return filepath.Join(d.runDir(runID), strconv.Itoa(stepID)+ext)
+}
+
+// Append adds `chunk` to the end of the step's log. Lines are only ever
+// appended in order by a single server, so anything numbered at or below
+// the last indexed line has already been appended.
+func (d *Disk) Append(runID, stepID, seq int, chunk []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	last, err := d.lastSeq(runID)
+	if err != nil {
+		return err
+	}
+	if seq <= last {
+		return nil
+	}
+
+	if exists(d.path(runID, stepID, extFinal)) {
+		return ErrFinalized
+	}
+
+	if err := os.MkdirAll(d.runDir(runID), 0755); err != nil {
+		return err
+	}
+
+	used, err := d.runSize(runID)
+	if err != nil {
+		return err
+	}
+
+	chunk, whole := clip(chunk, d.MaxRunBytes-used)
+
+	f, err := os.OpenFile(d.path(runID, stepID, extOpen), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	pos, err := f.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = f.Write(chunk)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if len(chunk) > 0 {
+		if err := d.index(runID, seq, stepID, pos, int64(len(chunk))); err != nil {
+			return err
+		}
+	}
+
+	if whole {
+		return nil
+	}
+
+	if err := ioutil.WriteFile(d.path(runID, stepID, extTruncated), nil, 0644); err != nil {
+		return err
+	}
+
+	return ErrTooLarge
+}
+
+// ReadRange returns up to `n` bytes of the step's log starting at `off`.
+func (d *Disk) ReadRange(runID, stepID int, off, n int64) ([]byte, error) {
+	rc, err := d.Open(runID, stepID, off)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var r io.Reader = rc
+	if n >= 0 {
+		r = io.LimitReader(r, n)
+	}
+
+	return ioutil.ReadAll(r)
+}
+
+// Open returns a reader over the step's log from `off` on. Finalized logs
+// can't be seeked in, so they're decompressed up to `off` first.
+//
+// Nothing is locked while reading, so slow readers don't hold up appends.
+// Open logs are only ever appended to, and finalized logs are in place
+// before the open ones go away, so there's always one of the two to read.
+func (d *Disk) Open(runID, stepID int, off int64) (io.ReadCloser, error) {
+	if f, err := os.Open(d.path(runID, stepID, extOpen)); err == nil {
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		return f, nil
+	}
+
+	f, err := os.Open(d.path(runID, stepID, extFinal))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, zr, off); err != nil && err != io.EOF {
+		f.Close()
+		return nil, err
+	}
+
+	return gzipFile{zr, f}, nil
+}
+
+// gzipFile reads a gzip file, closing the file along with the reader.
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g gzipFile) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+// Stat describes the step's log. The size of finalized logs comes from
+// the end of the gzip file rather than decompressing it.
+func (d *Disk) Stat(runID, stepID int) (Info, error) {
+	info := Info{
+		Truncated: exists(d.path(runID, stepID, extTruncated)),
+	}
+
+	if fi, err := os.Stat(d.path(runID, stepID, extOpen)); err == nil {
+		info.Size = fi.Size()
+		info.Updated = fi.ModTime()
+		return info, nil
+	}
+
+	fi, err := os.Stat(d.path(runID, stepID, extFinal))
+	if os.IsNotExist(err) {
+		return info, ErrNotFound
+	}
+	if err != nil {
+		return info, err
+	}
+
+	info.Final = true
+	info.Updated = fi.ModTime()
+	info.Size, err = gzipSize(d.path(runID, stepID, extFinal))
+	return info, err
+}
+
+// Lines reads the run's index.
+func (d *Disk) Lines(runID, after int) ([]Span, error) {
+	spans := []Span{}
+
+	buf, err := ioutil.ReadFile(filepath.Join(d.runDir(runID), indexFile))
+	if os.IsNotExist(err) {
+		return spans, nil
+	}
+	if err != nil {
+		return spans, err
+	}
+
+	for len(buf) >= indexRecord {
+		record := make([]int64, 4)
+		if err := binary.Read(bytes.NewReader(buf[:indexRecord]), binary.LittleEndian, record); err != nil {
+			return spans, err
+		}
+		buf = buf[indexRecord:]
+
+		if int(record[0]) <= after {
+			continue
+		}
+
+		spans = append(spans, Span{
+			Seq:    int(record[0]),
+			StepID: int(record[1]),
+			Pos:    record[2],
+			Size:   record[3],
+		})
+	}
+
+	return spans, nil
+}
+
+// Finalize gzips the step's log.
+func (d *Disk) Finalize(runID, stepID int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	final := d.path(runID, stepID, extFinal)
+	if exists(final) {
+		return nil
+	}
+
+	open := d.path(runID, stepID, extOpen)
+	src, err := os.Open(open)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Like the file store, the compressed log is written next to where
+	// it's going and renamed into place, so a crash never leaves half a
+	// log behind.
+	tmp, err := ioutil.TempFile(d.runDir(runID), filepath.Base(final)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(tmp)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), final); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Remove(open)
+}
+
+// Prune deletes the directories of runs whose logs haven't been written
+// to since `before`.
+func (d *Disk) Prune(before time.Time) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	runs, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	for _, run := range runs {
+		if _, err := strconv.Atoi(run.Name()); err != nil || !run.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(d.dir, run.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return pruned, err
+		}
+
+		latest := run.ModTime()
+		for _, f := range files {
+			if f.ModTime().After(latest) {
+				latest = f.ModTime()
+			}
+		}
+
+		if !latest.Before(before) {
+			continue
+		}
+
+		if err := os.RemoveAll(dir); err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+
+	return pruned, nil
+}
+
+// runSize returns how much output is kept for the run, before
+// compression. It must be called with the lock held.
+func (d *Disk) runSize(runID int) (int64, error) {
+	files, err := ioutil.ReadDir(d.runDir(runID))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, f := range files {
+		switch {
+		case strings.HasSuffix(f.Name(), extFinal):
+			n, err := gzipSize(filepath.Join(d.runDir(runID), f.Name()))
+			if err != nil {
+				return 0, err
+			}
+			size += n
+		case strings.HasSuffix(f.Name(), extOpen):
+			size += f.Size()
+		}
+	}
+
+	return size, nil
+}
+
+// index adds a line to the run's index. It must be called with the lock
+// held.
+func (d *Disk) index(runID, seq, stepID int, pos, size int64) error {
+	f, err := os.OpenFile(filepath.Join(d.runDir(runID), indexFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	record := []int64{int64(seq), int64(stepID), pos, size}
+	if err := binary.Write(f, binary.LittleEndian, record); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// lastSeq returns the seq of the last line in the run's index, or 0 if
+// nothing's been indexed yet. It must be called with the lock held.
+func (d *Disk) lastSeq(runID int) (int, error) {
+	f, err := os.Open(filepath.Join(d.runDir(runID), indexFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil || end < indexRecord {
+		return 0, err
+	}
+
+	// A record only half written by a crash is skipped over.
+	if _, err := f.Seek(end-end%indexRecord-indexRecord, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	var seq int64
+	if err := binary.Read(f, binary.LittleEndian, &seq); err != nil {
+		return 0, err
+	}
+
+	return int(seq), nil
+}
+
+// gzipSize returns the uncompressed size of the gzip file at `path`,
+// which gzip keeps at the end of the file. It's only kept modulo 4GiB,
+// which is well over any size cap worth having.
+func gzipSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(-4, io.SeekEnd); err != nil {
+		return 0, err
+	}
+
+	var size uint32
+	if err := binary.Read(f, binary.LittleEndian, &size); err != nil {
+		return 0, err
+	}
+
+	return int64(size), nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
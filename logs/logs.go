@@ -0,0 +1,163 @@
+// Package logs keeps the output of every step of every run. Output is
+// appended to a step's log as it comes in, and the log is finalized once
+// the step is done, after which it can only be read.
+package logs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var logger *logrus.Entry
+
+func init() {
+	logger = logrus.WithField("package", "logs")
+}
+
+// DefaultMaxRunBytes caps how much output is kept across all the steps of
+// a single run.
+const DefaultMaxRunBytes = 64 << 20
+
+// Errors returned by every LogStore.
+var (
+	ErrNotFound  = errors.New("log not found")
+	ErrFinalized = errors.New("log is finalized")
+
+	// ErrTooLarge is returned when output doesn't fit under the run's
+	// size cap. As much of it as fits is still kept, and the log is
+	// marked truncated.
+	ErrTooLarge = errors.New("run's output is over the size cap")
+)
+
+// Info describes a single step's log.
+type Info struct {
+	Size int64
+
+	// Final logs are done and won't change anymore.
+	Final bool
+
+	// Truncated logs ran into their run's size cap, so they're missing
+	// whatever came after.
+	Truncated bool
+
+	Updated time.Time
+}
+
+// Span is where a single line of a run's output is kept: `Size` bytes of
+// the step's log from `Pos` on, newline included.
+type Span struct {
+	Seq    int
+	StepID int
+	Pos    int64
+	Size   int64
+}
+
+// LogStore keeps step logs, keyed by the IDs of their run and step.
+type LogStore interface {
+	// Append adds `chunk`, which is line `seq` of the run's output, to
+	// the end of the step's log, creating the log if it doesn't exist
+	// yet. Lines of the run that were already appended are skipped, so
+	// a line can safely be appended more than once. It returns
+	// ErrFinalized if the log has been finalized.
+	Append(runID, stepID, seq int, chunk []byte) error
+
+	// ReadRange returns up to `n` bytes of the step's log starting at
+	// `off`, or everything from `off` on if `n` is negative.
+	ReadRange(runID, stepID int, off, n int64) ([]byte, error)
+
+	// Open returns a reader over the step's log from `off` on, for
+	// reading it through without going back to the store for every
+	// piece. Readers must be closed.
+	Open(runID, stepID int, off int64) (io.ReadCloser, error)
+
+	Stat(runID, stepID int) (Info, error)
+
+	// Lines returns where each of the run's lines after line `after` is
+	// kept, in order. Lines that didn't fit under the run's size cap
+	// aren't kept anywhere, so they're missing.
+	Lines(runID, after int) ([]Span, error)
+
+	// Finalize marks the step's log done. Finalizing a log more than once
+	// does nothing.
+	Finalize(runID, stepID int) error
+
+	// Prune deletes the logs of every run that hasn't been written to
+	// since `before` and returns how many runs' logs it deleted.
+	Prune(before time.Time) (int, error)
+}
+
+// Pruner deletes logs once they're too old to keep.
+type Pruner struct {
+	ls LogStore
+
+	// MaxAge is how long logs are kept after they were last written to.
+	MaxAge time.Duration
+
+	// Interval is how often old logs are looked for.
+	Interval time.Duration
+}
+
+// NewPruner returns a Pruner deleting logs from `ls` once they're older
+// than `maxAge`.
+func NewPruner(ls LogStore, maxAge time.Duration) *Pruner {
+	return &Pruner{
+		ls: ls,
+
+		MaxAge:   maxAge,
+		Interval: time.Hour,
+	}
+}
+
+// Run prunes logs every Interval until `ctx` is done.
+func (p *Pruner) Run(ctx context.Context) {
+	logger.Info("starting log pruner")
+
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := p.Prune(); err != nil {
+			logger.WithField("error", err).Error("unable to prune logs")
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Info("stopping log pruner")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Prune deletes every log older than MaxAge and returns how many runs'
+// logs were deleted.
+func (p *Pruner) Prune() (int, error) {
+	n, err := p.ls.Prune(time.Now().Add(-p.MaxAge))
+	if err != nil {
+		return n, err
+	}
+
+	if n > 0 {
+		logger.Infof("pruned logs of %v runs", n)
+	}
+
+	return n, nil
+}
+
+// clip returns as much of `chunk` as fits in `room` bytes, and whether
+// that's all of it.
+func clip(chunk []byte, room int64) ([]byte, bool) {
+	if room < 0 {
+		room = 0
+	}
+
+	if int64(len(chunk)) <= room {
+		return chunk, true
+	}
+
+	return chunk[:room], false
+}
@@ -0,0 +1,380 @@
+package logs
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/run-ci/run-server/store"
+)
+
+var tests = []struct {
+	name string
+	test func(*testing.T, LogStore)
+}{
+	{"AppendRead", testAppendRead},
+	{"ReadRange", testReadRange},
+	{"Open", testOpen},
+	{"Finalize", testFinalize},
+	{"NotFound", testNotFound},
+	{"Duplicates", testDuplicates},
+	{"Lines", testLines},
+	{"SizeCap", testSizeCap},
+	{"Prune", testPrune},
+}
+
+// runTests runs every test against a fresh LogStore from `open`, which
+// caps runs at 16 bytes.
+func runTests(t *testing.T, open func(*testing.T) LogStore) {
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, open(t))
+		})
+	}
+}
+
+func TestDisk(t *testing.T) {
+	runTests(t, func(t *testing.T) LogStore {
+		return newDisk(t)
+	})
+}
+
+// TestPostgres needs a database it's allowed to wipe, given as a connection
+// string in RUN_TEST_POSTGRES_URL.
+func TestPostgres(t *testing.T) {
+	connstr := os.Getenv("RUN_TEST_POSTGRES_URL")
+	if connstr == "" {
+		t.Skip("RUN_TEST_POSTGRES_URL not set")
+	}
+
+	m, err := store.NewMigrator(connstr)
+	if err != nil {
+		t.Fatalf("got error connecting to postgres: %v", err)
+	}
+	defer m.Close()
+
+	if err := m.Up(); err != nil {
+		t.Fatalf("got error migrating database: %v", err)
+	}
+
+	db, err := sql.Open("postgres", connstr)
+	if err != nil {
+		t.Fatalf("got error connecting to postgres: %v", err)
+	}
+	defer db.Close()
+
+	runTests(t, func(t *testing.T) LogStore {
+		if _, err := db.Exec(`TRUNCATE step_logs, log_chunks, log_lines;`); err != nil {
+			t.Fatalf("got error truncating tables: %v", err)
+		}
+
+		pg := NewPostgres(db)
+		pg.MaxRunBytes = 16
+		return pg
+	})
+}
+
+func newDisk(t *testing.T) *Disk {
+	dir, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatalf("got error creating temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	d, err := NewDisk(filepath.Join(dir, "logs"))
+	if err != nil {
+		t.Fatalf("got error creating disk store: %v", err)
+	}
+	d.MaxRunBytes = 16
+
+	return d
+}
+
+// appendAll appends `chunks` as lines of the run numbered from `seq` on.
+func appendAll(t *testing.T, ls LogStore, runID, stepID, seq int, chunks ...string) {
+	for i, chunk := range chunks {
+		if err := ls.Append(runID, stepID, seq+i, []byte(chunk)); err != nil {
+			t.Fatalf("got error appending %q: %v", chunk, err)
+		}
+	}
+}
+
+func readAll(t *testing.T, ls LogStore, runID, stepID int) string {
+	buf, err := ls.ReadRange(runID, stepID, 0, -1)
+	if err != nil {
+		t.Fatalf("got error reading log: %v", err)
+	}
+
+	return string(buf)
+}
+
+func testAppendRead(t *testing.T, ls LogStore) {
+	appendAll(t, ls, 1, 1, 1, "one\n", "two\n")
+	appendAll(t, ls, 1, 2, 3, "three\n")
+
+	if got := readAll(t, ls, 1, 1); got != "one\ntwo\n" {
+		t.Fatalf("expected both lines, got %q", got)
+	}
+
+	info, err := ls.Stat(1, 1)
+	if err != nil {
+		t.Fatalf("got error getting log info: %v", err)
+	}
+
+	if info.Size != 8 || info.Final || info.Truncated || info.Updated.IsZero() {
+		t.Fatalf("expected open log of 8 bytes, got %+v", info)
+	}
+}
+
+func testReadRange(t *testing.T, ls LogStore) {
+	appendAll(t, ls, 1, 1, 1, "abc", "def", "gh")
+
+	tests := []struct {
+		off, n int64
+		want   string
+	}{
+		{0, 2, "ab"},
+		{2, 3, "cde"},
+		{4, -1, "efgh"},
+		{7, 10, "h"},
+		{8, 1, ""},
+		{20, -1, ""},
+	}
+
+	for _, test := range tests {
+		buf, err := ls.ReadRange(1, 1, test.off, test.n)
+		if err != nil {
+			t.Fatalf("got error reading %v bytes at %v: %v", test.n, test.off, err)
+		}
+
+		if string(buf) != test.want {
+			t.Fatalf("expected %q reading %v bytes at %v, got %q", test.want, test.n, test.off, buf)
+		}
+	}
+}
+
+func testOpen(t *testing.T, ls LogStore) {
+	appendAll(t, ls, 1, 1, 1, "abc", "def", "gh")
+
+	for _, finalize := range []bool{false, true} {
+		if finalize {
+			if err := ls.Finalize(1, 1); err != nil {
+				t.Fatalf("got error finalizing log: %v", err)
+			}
+		}
+
+		r, err := ls.Open(1, 1, 2)
+		if err != nil {
+			t.Fatalf("got error opening log: %v", err)
+		}
+
+		// Small reads make sure the reader picks up where it left off.
+		buf, err := ioutil.ReadAll(iotest.OneByteReader(r))
+		r.Close()
+		if err != nil {
+			t.Fatalf("got error reading log: %v", err)
+		}
+
+		if string(buf) != "cdefgh" {
+			t.Fatalf("expected cdefgh reading from 2, got %q", buf)
+		}
+	}
+
+	if _, err := ls.Open(1, 2, 0); err != ErrNotFound {
+		t.Fatalf("expected %v, got %v", ErrNotFound, err)
+	}
+}
+
+func testFinalize(t *testing.T, ls LogStore) {
+	appendAll(t, ls, 1, 1, 1, "abc", "def")
+
+	for i := 0; i < 2; i++ {
+		if err := ls.Finalize(1, 1); err != nil {
+			t.Fatalf("got error finalizing log: %v", err)
+		}
+	}
+
+	if err := ls.Append(1, 1, 3, []byte("more")); err != ErrFinalized {
+		t.Fatalf("expected %v, got %v", ErrFinalized, err)
+	}
+
+	info, err := ls.Stat(1, 1)
+	if err != nil {
+		t.Fatalf("got error getting log info: %v", err)
+	}
+
+	if !info.Final || info.Size != 6 {
+		t.Fatalf("expected final log of 6 bytes, got %+v", info)
+	}
+
+	buf, err := ls.ReadRange(1, 1, 2, 3)
+	if err != nil {
+		t.Fatalf("got error reading log: %v", err)
+	}
+
+	if string(buf) != "cde" {
+		t.Fatalf("expected cde, got %q", buf)
+	}
+}
+
+func testNotFound(t *testing.T, ls LogStore) {
+	if _, err := ls.Stat(1, 1); err != ErrNotFound {
+		t.Fatalf("expected %v getting info, got %v", ErrNotFound, err)
+	}
+
+	if _, err := ls.ReadRange(1, 1, 0, -1); err != ErrNotFound {
+		t.Fatalf("expected %v reading, got %v", ErrNotFound, err)
+	}
+
+	if err := ls.Finalize(1, 1); err != ErrNotFound {
+		t.Fatalf("expected %v finalizing, got %v", ErrNotFound, err)
+	}
+}
+
+func testDuplicates(t *testing.T, ls LogStore) {
+	appendAll(t, ls, 1, 1, 1, "one\n", "two\n")
+	appendAll(t, ls, 1, 1, 1, "one\n", "two\n")
+
+	if got := readAll(t, ls, 1, 1); got != "one\ntwo\n" {
+		t.Fatalf("expected each line once, got %q", got)
+	}
+
+	if err := ls.Finalize(1, 1); err != nil {
+		t.Fatalf("got error finalizing log: %v", err)
+	}
+
+	// Lines that made it in before the log was finalized are still just
+	// skipped.
+	if err := ls.Append(1, 1, 2, []byte("two\n")); err != nil {
+		t.Fatalf("got error appending line again: %v", err)
+	}
+}
+
+func testLines(t *testing.T, ls LogStore) {
+	appendAll(t, ls, 1, 1, 1, "a\n")
+	appendAll(t, ls, 1, 2, 2, "b\nc\n")
+	appendAll(t, ls, 1, 1, 3, "d\n")
+	if err := ls.Append(1, 2, 4, []byte("0123456789")); err != ErrTooLarge {
+		t.Fatalf("expected %v, got %v", ErrTooLarge, err)
+	}
+
+	want := []Span{
+		{Seq: 1, StepID: 1, Pos: 0, Size: 2},
+		{Seq: 2, StepID: 2, Pos: 0, Size: 4},
+		{Seq: 3, StepID: 1, Pos: 2, Size: 2},
+		{Seq: 4, StepID: 2, Pos: 4, Size: 8},
+	}
+
+	// Finalizing doesn't move anything.
+	for _, finalize := range []bool{false, true} {
+		if finalize {
+			for _, stepID := range []int{1, 2} {
+				if err := ls.Finalize(1, stepID); err != nil {
+					t.Fatalf("got error finalizing log: %v", err)
+				}
+			}
+		}
+
+		spans, err := ls.Lines(1, 0)
+		if err != nil {
+			t.Fatalf("got error getting lines: %v", err)
+		}
+		if !reflect.DeepEqual(spans, want) {
+			t.Fatalf("expected %+v, got %+v", want, spans)
+		}
+
+		spans, err = ls.Lines(1, 2)
+		if err != nil {
+			t.Fatalf("got error getting lines: %v", err)
+		}
+		if !reflect.DeepEqual(spans, want[2:]) {
+			t.Fatalf("expected %+v after line 2, got %+v", want[2:], spans)
+		}
+	}
+
+	spans, err := ls.Lines(2, 0)
+	if err != nil {
+		t.Fatalf("got error getting lines of other run: %v", err)
+	}
+	if len(spans) != 0 {
+		t.Fatalf("expected no lines for other run, got %+v", spans)
+	}
+}
+
+func testSizeCap(t *testing.T, ls LogStore) {
+	appendAll(t, ls, 1, 1, 1, "0123456789")
+
+	// The cap is for the whole run, so the second step only gets what's
+	// left of it.
+	if err := ls.Append(1, 2, 2, []byte("abcdefghij")); err != ErrTooLarge {
+		t.Fatalf("expected %v, got %v", ErrTooLarge, err)
+	}
+
+	if got := readAll(t, ls, 1, 2); got != "abcdef" {
+		t.Fatalf("expected what fits, got %q", got)
+	}
+
+	info, err := ls.Stat(1, 2)
+	if err != nil {
+		t.Fatalf("got error getting log info: %v", err)
+	}
+	if !info.Truncated {
+		t.Fatalf("expected truncated log, got %+v", info)
+	}
+
+	if err := ls.Append(1, 1, 3, []byte("x")); err != ErrTooLarge {
+		t.Fatalf("expected %v for full run, got %v", ErrTooLarge, err)
+	}
+
+	// Other runs have caps of their own.
+	appendAll(t, ls, 2, 1, 1, "0123456789")
+}
+
+func testPrune(t *testing.T, ls LogStore) {
+	appendAll(t, ls, 1, 1, 1, "one")
+	appendAll(t, ls, 1, 2, 2, "two")
+	appendAll(t, ls, 2, 1, 1, "three")
+	if err := ls.Finalize(1, 1); err != nil {
+		t.Fatalf("got error finalizing log: %v", err)
+	}
+
+	n, err := ls.Prune(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("got error pruning: %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("expected nothing pruned, got %v", n)
+	}
+
+	n, err = ls.Prune(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("got error pruning: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 runs pruned, got %v", n)
+	}
+
+	for _, ids := range [][2]int{{1, 1}, {1, 2}, {2, 1}} {
+		if _, err := ls.Stat(ids[0], ids[1]); err != ErrNotFound {
+			t.Fatalf("expected log %v to be gone, got %v", ids, err)
+		}
+	}
+}
+
+func TestDiskCompresses(t *testing.T) {
+	d := newDisk(t)
+	appendAll(t, d, 1, 1, 1, "abc")
+
+	if err := d.Finalize(1, 1); err != nil {
+		t.Fatalf("got error finalizing log: %v", err)
+	}
+
+	if exists(d.path(1, 1, extOpen)) || !exists(d.path(1, 1, extFinal)) {
+		t.Fatal("expected finalized log to be gzipped")
+	}
+}
@@ -0,0 +1,432 @@
+package logs
+
+import (
+	"database/sql"
+	"io"
+	"time"
+)
+
+// Postgres is a LogStore keeping logs in Postgres, as chunks of output
+// in the order they came in, along with an index of the run's lines. Finalizing a log merges its chunks into
+// fewer, bigger ones. It uses the tables created by the store's
+// migrations.
+type Postgres struct {
+	db *sql.DB
+
+	// MaxRunBytes caps how much output is kept for each run.
+	MaxRunBytes int64
+}
+
+// NewPostgres returns a Postgres keeping logs in `db`.
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{
+		db: db,
+
+		MaxRunBytes: DefaultMaxRunBytes,
+	}
+}
+
+// Append adds `chunk` to the end of the step's log. Every server records
+// every line, so the first one to get the run's logs locked appends it
+// and the rest find it already there.
+func (pg *Postgres) Append(runID, stepID, seq int, chunk []byte) error {
+	logger := logger.WithField("run_id", runID)
+
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	sqlinsert := `
+	INSERT INTO step_logs (run_id, step_id, updated_at)
+	VALUES
+		($1, $2, $3)
+	ON CONFLICT DO NOTHING;
+	`
+
+	if _, err := tx.Exec(sqlinsert, runID, stepID, now); err != nil {
+		logger.WithField("error", err).Debug("unable to create log")
+		return err
+	}
+
+	// Locking every log of the run keeps concurrent appends to different
+	// steps from going over the run's cap together.
+	sqlq := `
+	SELECT step_id, size, final FROM step_logs
+	WHERE run_id = $1
+	FOR UPDATE;
+	`
+
+	rows, err := tx.Query(sqlq, runID)
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to lock logs")
+		return err
+	}
+
+	var used, size int64
+	var final bool
+	for rows.Next() {
+		var id int
+		var n int64
+		var f bool
+		if err := rows.Scan(&id, &n, &f); err != nil {
+			rows.Close()
+			return err
+		}
+
+		used += n
+		if id == stepID {
+			size, final = n, f
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var appended bool
+	sqlexists := `
+	SELECT EXISTS (
+		SELECT 1 FROM log_lines
+		WHERE run_id = $1 AND seq = $2
+	);
+	`
+
+	if err := tx.QueryRow(sqlexists, runID, seq).Scan(&appended); err != nil {
+		logger.WithField("error", err).Debug("unable to look up line")
+		return err
+	}
+	if appended {
+		return nil
+	}
+
+	if final {
+		return ErrFinalized
+	}
+
+	chunk, whole := clip(chunk, pg.MaxRunBytes-used)
+
+	if len(chunk) > 0 {
+		sqlchunk := `
+		INSERT INTO log_chunks (run_id, step_id, pos, data)
+		VALUES
+			($1, $2, $3, $4);
+		`
+
+		if _, err := tx.Exec(sqlchunk, runID, stepID, size, chunk); err != nil {
+			logger.WithField("error", err).Debug("unable to save chunk")
+			return err
+		}
+
+		sqlline := `
+		INSERT INTO log_lines (run_id, seq, step_id, pos, size)
+		VALUES
+			($1, $2, $3, $4, $5);
+		`
+
+		if _, err := tx.Exec(sqlline, runID, seq, stepID, size, len(chunk)); err != nil {
+			logger.WithField("error", err).Debug("unable to index line")
+			return err
+		}
+	}
+
+	sqlupdate := `
+	UPDATE step_logs
+	SET size = size + $3, truncated = truncated OR $4, updated_at = $5
+	WHERE run_id = $1 AND step_id = $2;
+	`
+
+	_, err = tx.Exec(sqlupdate, runID, stepID, len(chunk), !whole, now)
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to update log")
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if !whole {
+		return ErrTooLarge
+	}
+
+	return nil
+}
+
+// ReadRange returns up to `n` bytes of the step's log starting at `off`.
+// Only the chunks overlapping the range are read.
+func (pg *Postgres) ReadRange(runID, stepID int, off, n int64) ([]byte, error) {
+	info, err := pg.Stat(runID, stepID)
+	if err != nil {
+		return nil, err
+	}
+
+	end := info.Size
+	if n >= 0 && off+n < end {
+		end = off + n
+	}
+	if off >= end {
+		return []byte{}, nil
+	}
+
+	// The chunk holding `off` is the last one starting at or before it,
+	// which lets the range be found from the index alone.
+	sqlq := `
+	SELECT pos, data FROM log_chunks
+	WHERE run_id = $1 AND step_id = $2 AND pos < $4 AND pos >= COALESCE((
+		SELECT MAX(pos) FROM log_chunks
+		WHERE run_id = $1 AND step_id = $2 AND pos <= $3
+	), 0)
+	ORDER BY pos;
+	`
+
+	rows, err := pg.db.Query(sqlq, runID, stepID, off, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buf := make([]byte, 0, end-off)
+	for rows.Next() {
+		var pos int64
+		var data []byte
+		if err := rows.Scan(&pos, &data); err != nil {
+			return nil, err
+		}
+
+		from, to := int64(0), int64(len(data))
+		if pos < off {
+			from = off - pos
+		}
+		if pos+to > end {
+			to = end - pos
+		}
+
+		buf = append(buf, data[from:to]...)
+	}
+
+	return buf, rows.Err()
+}
+
+// Open returns a reader over the step's log from `off` on. Each read
+// only loads the chunks it needs.
+func (pg *Postgres) Open(runID, stepID int, off int64) (io.ReadCloser, error) {
+	if _, err := pg.Stat(runID, stepID); err != nil {
+		return nil, err
+	}
+
+	return &pgReader{pg: pg, runID: runID, stepID: stepID, off: off}, nil
+}
+
+// pgReader reads a step's log a range at a time.
+type pgReader struct {
+	pg            *Postgres
+	runID, stepID int
+	off           int64
+}
+
+func (r *pgReader) Read(p []byte) (int, error) {
+	buf, err := r.pg.ReadRange(r.runID, r.stepID, r.off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	if len(buf) == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+
+	r.off += int64(len(buf))
+	return copy(p, buf), nil
+}
+
+func (r *pgReader) Close() error {
+	return nil
+}
+
+// Stat describes the step's log.
+func (pg *Postgres) Stat(runID, stepID int) (Info, error) {
+	sqlq := `
+	SELECT size, final, truncated, updated_at FROM step_logs
+	WHERE run_id = $1 AND step_id = $2;
+	`
+
+	var info Info
+	err := pg.db.QueryRow(sqlq, runID, stepID).
+		Scan(&info.Size, &info.Final, &info.Truncated, &info.Updated)
+	if err == sql.ErrNoRows {
+		return info, ErrNotFound
+	}
+
+	return info, err
+}
+
+// Lines reads the run's lines from its index.
+func (pg *Postgres) Lines(runID, after int) ([]Span, error) {
+	sqlq := `
+	SELECT seq, step_id, pos, size FROM log_lines
+	WHERE run_id = $1 AND seq > $2
+	ORDER BY seq;
+	`
+
+	spans := []Span{}
+	rows, err := pg.db.Query(sqlq, runID, after)
+	if err != nil {
+		return spans, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var span Span
+		if err := rows.Scan(&span.Seq, &span.StepID, &span.Pos, &span.Size); err != nil {
+			return spans, err
+		}
+		spans = append(spans, span)
+	}
+
+	return spans, rows.Err()
+}
+
+// finalChunkSize is about how big the chunks of finalized logs are. Big
+// enough to keep the number of rows down, but small enough that reading
+// part of a log doesn't mean loading all of it.
+const finalChunkSize = 1 << 20
+
+// Finalize merges the step's chunks into chunks of about finalChunkSize
+// and marks the log final. Chunks are merged a batch at a time, so the
+// log never has to be held in memory all at once.
+func (pg *Postgres) Finalize(runID, stepID int) error {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var final bool
+	err = tx.QueryRow(`
+	SELECT final FROM step_logs
+	WHERE run_id = $1 AND step_id = $2
+	FOR UPDATE;
+	`, runID, stepID).Scan(&final)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if final {
+		return nil
+	}
+
+	batches, err := chunkBatches(tx, runID, stepID)
+	if err != nil {
+		return err
+	}
+
+	for _, batch := range batches {
+		if err := mergeChunks(tx, runID, stepID, batch); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+	UPDATE step_logs
+	SET final = true, updated_at = $3
+	WHERE run_id = $1 AND step_id = $2;
+	`, runID, stepID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// chunkBatches returns the batches the step's chunks are merged in, each
+// one made of the chunks starting in the same finalChunkSize stretch of
+// the log. Batches of a single chunk are left out, since there's nothing
+// to merge.
+func chunkBatches(tx *sql.Tx, runID, stepID int) ([]int64, error) {
+	sqlq := `
+	SELECT pos / $3 AS batch FROM log_chunks
+	WHERE run_id = $1 AND step_id = $2
+	GROUP BY batch
+	HAVING COUNT(*) > 1
+	ORDER BY batch;
+	`
+
+	rows, err := tx.Query(sqlq, runID, stepID, finalChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	batches := []int64{}
+	for rows.Next() {
+		var batch int64
+		if err := rows.Scan(&batch); err != nil {
+			return nil, err
+		}
+		batches = append(batches, batch)
+	}
+
+	return batches, rows.Err()
+}
+
+// mergeChunks replaces the chunks in `batch` with a single one.
+func mergeChunks(tx *sql.Tx, runID, stepID int, batch int64) error {
+	sqldelete := `
+	WITH merged AS (
+		DELETE FROM log_chunks
+		WHERE run_id = $1 AND step_id = $2 AND pos / $3 = $4
+		RETURNING pos, data
+	)
+	SELECT MIN(pos), string_agg(data, ''::bytea ORDER BY pos) FROM merged;
+	`
+
+	var pos int64
+	var data []byte
+	err := tx.QueryRow(sqldelete, runID, stepID, finalChunkSize, batch).Scan(&pos, &data)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+	INSERT INTO log_chunks (run_id, step_id, pos, data)
+	VALUES
+		($1, $2, $3, $4);
+	`, runID, stepID, pos, data)
+	return err
+}
+
+// Prune deletes the logs of runs that haven't been written to since
+// `before`. Their chunks go with them.
+func (pg *Postgres) Prune(before time.Time) (int, error) {
+	sqldelete := `
+	DELETE FROM step_logs
+	WHERE run_id IN (
+		SELECT run_id FROM step_logs
+		GROUP BY run_id
+		HAVING MAX(updated_at) < $1
+	)
+	RETURNING run_id;
+	`
+
+	rows, err := pg.db.Query(sqldelete, before)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	runs := map[int]bool{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return len(runs), err
+		}
+		runs[id] = true
+	}
+
+	return len(runs), rows.Err()
+}
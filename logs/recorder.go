@@ -0,0 +1,176 @@
+package logs
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/run-ci/run-server/logstream"
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/store"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultStep is the step lines that don't name one are recorded under.
+const DefaultStep = "main"
+
+// maxRecording is how many runs a Recorder remembers the steps of. Runs
+// whose output never ended are forgotten once there are more than this.
+const maxRecording = 1000
+
+// Recorder writes the log lines agents publish to a LogStore, each one to
+// the log of the step it came from. Steps are created as their first line
+// comes in, and their logs are finalized when the run's output ends.
+//
+// Every server records every line, in the order the agent sent them.
+// Whichever server gets to a line first writes it and the others skip it,
+// so a run's lines are written in order and none are lost to another
+// server finalizing the run before getting to them.
+type Recorder struct {
+	ls LogStore
+	st store.Repo
+
+	mu sync.Mutex
+
+	// steps maps the runs being recorded to the IDs of their steps, by
+	// name.
+	steps map[int]map[string]int
+
+	// full tracks the runs that went over their size cap, so it's only
+	// logged once.
+	full map[int]bool
+}
+
+// NewRecorder returns a Recorder writing logs to `ls` for the runs in `st`.
+func NewRecorder(ls LogStore, st store.Repo) *Recorder {
+	return &Recorder{
+		ls: ls,
+		st: st,
+
+		steps: map[int]map[string]int{},
+		full:  map[int]bool{},
+	}
+}
+
+// Consume records every line received on `recv`, which should be
+// subscribed to logstream.SubjectAll. It returns when `recv` is closed.
+func (r *Recorder) Consume(recv <-chan queue.Message) {
+	logger.Info("recording run logs")
+
+	for msg := range recv {
+		logger := logger.WithField("subject", msg.Subject)
+
+		id, err := strconv.Atoi(strings.TrimPrefix(msg.Subject, queue.SubjectLogs+"."))
+		if err != nil {
+			logger.Warn("dropping log line for invalid run ID")
+			continue
+		}
+
+		var line logstream.Line
+		if err := json.Unmarshal(msg.Data, &line); err != nil {
+			logger.WithField("error", err).Warnf("dropping invalid log line: %s", msg.Data)
+			continue
+		}
+
+		r.Record(id, line)
+	}
+
+	logger.Info("log channel closed, done recording")
+}
+
+// Record writes `line` to the log of its step. The end of a run's output
+// finalizes the logs of all its steps.
+func (r *Recorder) Record(runID int, line logstream.Line) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	logger := logger.WithField("run_id", runID)
+
+	if line.EOF {
+		return r.finalize(logger, runID)
+	}
+
+	name := line.Step
+	if name == "" {
+		name = DefaultStep
+	}
+
+	stepID, err := r.step(runID, name, line)
+	if err != nil {
+		logger.WithField("error", err).Errorf("unable to find step %v", name)
+		return err
+	}
+
+	err = r.ls.Append(runID, stepID, line.Seq, []byte(line.Text+"\n"))
+	switch err {
+	case nil:
+	case ErrFinalized:
+		// Another server got to the end of the run first, and so to this
+		// line too.
+		logger.Debugf("step %v already finalized, skipping line %v", name, line.Seq)
+		return nil
+	case ErrTooLarge:
+		if !r.full[runID] {
+			logger.Warn("run's output is over the size cap, dropping the rest")
+			r.full[runID] = true
+		}
+	default:
+		logger.WithField("error", err).Errorf("unable to record line for step %v", name)
+	}
+
+	return err
+}
+
+// step returns the ID of the step of the run with the given name, creating
+// it if it doesn't exist yet. The store hands back the step other servers
+// created if they got there first. It must be called with the lock held.
+func (r *Recorder) step(runID int, name string, line logstream.Line) (int, error) {
+	if id, ok := r.steps[runID][name]; ok {
+		return id, nil
+	}
+
+	step, err := r.st.CreateStep(store.Step{
+		RunID:     runID,
+		Task:      name,
+		StartedAt: line.Time,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if r.steps[runID] == nil {
+		if len(r.steps) >= maxRecording {
+			r.steps = map[int]map[string]int{}
+			r.full = map[int]bool{}
+		}
+		r.steps[runID] = map[string]int{}
+	}
+
+	r.steps[runID][name] = step.ID
+	return step.ID, nil
+}
+
+// finalize finalizes the logs of every step of the run. It must be called
+// with the lock held.
+func (r *Recorder) finalize(logger *logrus.Entry, runID int) error {
+	delete(r.steps, runID)
+	delete(r.full, runID)
+
+	run, err := r.st.GetRun(runID)
+	if err != nil {
+		logger.WithField("error", err).Error("unable to get run")
+		return err
+	}
+
+	for _, step := range run.Steps {
+		err := r.ls.Finalize(runID, step.ID)
+		if err != nil && err != ErrNotFound {
+			logger.WithField("error", err).Errorf("unable to finalize log of step %v", step.ID)
+			return err
+		}
+	}
+
+	logger.Debug("finalized logs")
+	return nil
+}
@@ -0,0 +1,112 @@
+package logs
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/run-ci/run-server/logstream"
+	"github.com/run-ci/run-server/store"
+)
+
+func TestRecorder(t *testing.T) {
+	st := store.NewMemory()
+	run, err := st.CreateRun(store.Run{Remote: "example.com/a", Branch: "master", Trigger: "push"})
+	if err != nil {
+		t.Fatalf("got error creating run: %v", err)
+	}
+
+	d := newDisk(t)
+	d.MaxRunBytes = DefaultMaxRunBytes
+	r := NewRecorder(d, st)
+
+	lines := []logstream.Line{
+		{Seq: 1, Step: "build", Text: "compiling"},
+		{Seq: 2, Step: "test", Text: "ok"},
+		{Seq: 3, Step: "build", Text: "done"},
+		{Seq: 4, Text: "no step"},
+		{EOF: true},
+	}
+	for _, line := range lines {
+		if err := r.Record(run.ID, line); err != nil {
+			t.Fatalf("got error recording %+v: %v", line, err)
+		}
+	}
+
+	run, err = st.GetRun(run.ID)
+	if err != nil {
+		t.Fatalf("got error getting run: %v", err)
+	}
+
+	if len(run.Steps) != 3 || run.Steps[0].Task != "build" || run.Steps[1].Task != "test" ||
+		run.Steps[2].Task != DefaultStep {
+		t.Fatalf("expected build, test and %v steps, got %+v", DefaultStep, run.Steps)
+	}
+
+	if got := readAll(t, d, run.ID, run.Steps[0].ID); got != "compiling\ndone\n" {
+		t.Fatalf("expected build output, got %q", got)
+	}
+
+	for _, step := range run.Steps {
+		info, err := d.Stat(run.ID, step.ID)
+		if err != nil {
+			t.Fatalf("got error getting log info: %v", err)
+		}
+
+		if !info.Final {
+			t.Fatalf("expected log of step %v to be finalized", step.Task)
+		}
+	}
+}
+
+func TestRecorderServers(t *testing.T) {
+	st := store.NewMemory()
+	run, err := st.CreateRun(store.Run{Remote: "example.com/a", Branch: "master", Trigger: "push"})
+	if err != nil {
+		t.Fatalf("got error creating run: %v", err)
+	}
+
+	d := newDisk(t)
+	d.MaxRunBytes = DefaultMaxRunBytes
+
+	lines := []logstream.Line{
+		{Seq: 1, Step: "build", Text: "compiling"},
+		{Seq: 2, Step: "test", Text: "ok"},
+		{Seq: 3, Step: "build", Text: "done"},
+		{Seq: 4, Step: "test", Text: "passed"},
+		{EOF: true},
+	}
+
+	// Two servers get the same lines, each at its own pace.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		r := NewRecorder(d, st)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, line := range lines {
+				if err := r.Record(run.ID, line); err != nil {
+					t.Errorf("got error recording %+v: %v", line, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	run, err = st.GetRun(run.ID)
+	if err != nil {
+		t.Fatalf("got error getting run: %v", err)
+	}
+
+	if len(run.Steps) != 2 || run.Steps[0].Task != "build" || run.Steps[1].Task != "test" {
+		t.Fatalf("expected a single build and test step, got %+v", run.Steps)
+	}
+
+	if got := readAll(t, d, run.ID, run.Steps[0].ID); got != "compiling\ndone\n" {
+		t.Fatalf("expected build output once, got %q", got)
+	}
+
+	if got := readAll(t, d, run.ID, run.Steps[1].ID); got != "ok\npassed\n" {
+		t.Fatalf("expected test output once, got %q", got)
+	}
+}
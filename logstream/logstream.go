@@ -0,0 +1,325 @@
+// Package logstream fans the log lines agents publish while runs are going
+// out to everyone watching them. Agents publish lines for a run on
+// queue.SubjectLogs followed by the run's ID, numbered from 1, and end
+// with a line marked EOF once there's nothing more to come.
+//
+// Every server keeps the most recent lines of each run it has heard
+// about, so viewers that reconnect can pick up where they left off and
+// runs that just finished can still be read in full.
+package logstream
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/run-ci/run-server/metrics"
+	"github.com/run-ci/run-server/queue"
+	"github.com/sirupsen/logrus"
+)
+
+var logger *logrus.Entry
+
+var viewers = metrics.NewGaugeVec("run_log_viewers",
+	"Viewers currently watching run logs.")
+
+func init() {
+	logger = logrus.WithField("package", "logstream")
+}
+
+// Defaults for how much a Hub remembers.
+const (
+	DefaultMaxLines = 10000
+	DefaultMaxRuns  = 1000
+)
+
+// viewerBuffer is how many lines a viewer can fall behind before it's cut
+// off. Cut off viewers can reconnect and resume from the last line they
+// got.
+const viewerBuffer = 256
+
+// Subject returns the subject the log lines of the run with the given ID
+// are published on.
+func Subject(runID int) string {
+	return queue.SubjectLogs + "." + strconv.Itoa(runID)
+}
+
+// SubjectAll matches the Subject of every run.
+const SubjectAll = queue.SubjectLogs + ".*"
+
+// Line is a single line of output from a run.
+type Line struct {
+	// Seq numbers the lines of a run from 1. Lines are sent to viewers
+	// with it as their event ID.
+	Seq int `json:"seq"`
+
+	Step string    `json:"step,omitempty"`
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+
+	// EOF marks the end of the run's output. Lines marked EOF don't carry
+	// any text.
+	EOF bool `json:"eof,omitempty"`
+}
+
+// Hub keeps track of the log lines of every run and who's watching them.
+type Hub struct {
+	mu     sync.Mutex
+	runs   map[int]*runLog
+	closed bool
+
+	// MaxLines is how many of the most recent lines are kept per run.
+	MaxLines int
+
+	// MaxRuns is how many runs lines are kept for. The runs that were
+	// least recently written to and that nobody is watching are
+	// forgotten first.
+	MaxRuns int
+}
+
+type runLog struct {
+	lines   []Line
+	last    int
+	eof     bool
+	touched time.Time
+	viewers map[*Viewer]bool
+}
+
+// NewHub returns an empty Hub.
+func NewHub() *Hub {
+	return &Hub{
+		runs: map[int]*runLog{},
+
+		MaxLines: DefaultMaxLines,
+		MaxRuns:  DefaultMaxRuns,
+	}
+}
+
+// Consume adds every line received on `recv`, which should be subscribed
+// to every run's Subject. It returns when `recv` is closed, after cutting
+// off every viewer.
+func (h *Hub) Consume(recv <-chan queue.Message) {
+	logger.Info("consuming run logs")
+
+	for msg := range recv {
+		logger := logger.WithField("subject", msg.Subject)
+
+		id, err := strconv.Atoi(strings.TrimPrefix(msg.Subject, queue.SubjectLogs+"."))
+		if err != nil {
+			logger.Warn("dropping log line for invalid run ID")
+			continue
+		}
+
+		var line Line
+		if err := json.Unmarshal(msg.Data, &line); err != nil {
+			logger.WithField("error", err).Warnf("dropping invalid log line: %s", msg.Data)
+			continue
+		}
+
+		h.Add(id, line)
+	}
+
+	logger.Info("log channel closed, done consuming")
+	h.Close()
+}
+
+// Add records `line` for the run with the given ID and sends it to
+// everyone watching. Lines that were already added are ignored, as are
+// lines that come after the end of the run's output.
+func (h *Hub) Add(runID int, line Line) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+
+	rl := h.runs[runID]
+	if rl == nil {
+		rl = &runLog{viewers: map[*Viewer]bool{}, touched: time.Now()}
+		h.runs[runID] = rl
+		h.evict()
+	}
+
+	if rl.eof || (!line.EOF && line.Seq <= rl.last) {
+		return
+	}
+
+	rl.touched = time.Now()
+
+	if line.EOF {
+		rl.eof = true
+
+		// The end of the output has to be numbered like everything
+		// else, so viewers that got it don't get it again.
+		line.Seq = rl.last + 1
+		line.Text = ""
+	}
+	rl.last = line.Seq
+
+	rl.lines = append(rl.lines, line)
+	if over := len(rl.lines) - h.MaxLines; over > 0 {
+		rl.lines = append([]Line{}, rl.lines[over:]...)
+	}
+
+	for v := range rl.viewers {
+		select {
+		case v.c <- line:
+		default:
+			logger.WithField("run_id", runID).Warn("viewer fell behind, cutting it off")
+			h.drop(rl, v)
+			continue
+		}
+
+		if line.EOF {
+			h.drop(rl, v)
+		}
+	}
+}
+
+// evict forgets the runs written to least recently until there are at
+// most MaxRuns, skipping runs that are being watched. It must be called
+// with the lock held.
+func (h *Hub) evict() {
+	for len(h.runs) > h.MaxRuns {
+		oldest := 0
+		var oldestAt time.Time
+
+		for id, rl := range h.runs {
+			if len(rl.viewers) > 0 {
+				continue
+			}
+
+			if oldest == 0 || rl.touched.Before(oldestAt) {
+				oldest, oldestAt = id, rl.touched
+			}
+		}
+
+		if oldest == 0 {
+			return
+		}
+
+		delete(h.runs, oldest)
+	}
+}
+
+// Lines returns the lines of the run with the given ID that come after
+// line `after`, and whether the end of the run's output is among them.
+func (h *Hub) Lines(runID, after int) ([]Line, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	rl := h.runs[runID]
+	if rl == nil {
+		return []Line{}, false
+	}
+
+	return rl.after(after), rl.eof
+}
+
+// Watch returns the lines of the run with the given ID that come after
+// line `after`, along with a Viewer receiving every line added from now
+// on. If the end of the run's output is among the lines returned, the
+// Viewer's channel is already closed.
+func (h *Hub) Watch(runID, after int) ([]Line, *Viewer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	v := &Viewer{
+		hub:   h,
+		runID: runID,
+		c:     make(chan Line, viewerBuffer),
+	}
+
+	rl := h.runs[runID]
+	if rl == nil {
+		rl = &runLog{viewers: map[*Viewer]bool{}, touched: time.Now()}
+		h.runs[runID] = rl
+		h.evict()
+	}
+
+	lines := rl.after(after)
+
+	if rl.eof || h.closed {
+		close(v.c)
+		return lines, v
+	}
+
+	rl.viewers[v] = true
+	h.countViewers()
+
+	return lines, v
+}
+
+// Close cuts off every viewer and stops taking new lines.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for _, rl := range h.runs {
+		for v := range rl.viewers {
+			h.drop(rl, v)
+		}
+	}
+}
+
+// drop stops sending lines to `v`. It must be called with the lock held.
+func (h *Hub) drop(rl *runLog, v *Viewer) {
+	if !rl.viewers[v] {
+		return
+	}
+
+	delete(rl.viewers, v)
+	close(v.c)
+	h.countViewers()
+}
+
+// countViewers updates the viewers gauge. It must be called with the lock
+// held.
+func (h *Hub) countViewers() {
+	n := 0
+	for _, rl := range h.runs {
+		n += len(rl.viewers)
+	}
+
+	viewers.Set(float64(n))
+}
+
+// after returns the lines that come after line `seq`.
+func (rl *runLog) after(seq int) []Line {
+	lines := []Line{}
+	for _, line := range rl.lines {
+		if line.Seq > seq {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+// Viewer receives the lines of a single run as they're added.
+type Viewer struct {
+	hub   *Hub
+	runID int
+	c     chan Line
+}
+
+// C returns the channel lines are sent on. It's closed after the line
+// marking the end of the run's output, when the viewer falls too far
+// behind, or when the Hub is closed.
+func (v *Viewer) C() <-chan Line {
+	return v.c
+}
+
+// Close stops sending lines to the viewer.
+func (v *Viewer) Close() {
+	v.hub.mu.Lock()
+	defer v.hub.mu.Unlock()
+
+	if rl := v.hub.runs[v.runID]; rl != nil {
+		v.hub.drop(rl, v)
+	}
+}
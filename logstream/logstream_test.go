@@ -0,0 +1,147 @@
+package logstream
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/run-ci/run-server/queue"
+)
+
+func line(seq int, text string) Line {
+	return Line{Seq: seq, Text: text}
+}
+
+func TestWatch(t *testing.T) {
+	h := NewHub()
+	h.Add(1, line(1, "a"))
+	h.Add(1, line(2, "b"))
+
+	// Viewers resuming after line 1 get line 2 straight away, and
+	// everything added afterwards as it's added.
+	lines, v := h.Watch(1, 1)
+	if len(lines) != 1 || lines[0].Text != "b" {
+		t.Fatalf("expected line b, got %+v", lines)
+	}
+
+	h.Add(1, line(2, "b again"))
+	h.Add(1, line(3, "c"))
+	h.Add(1, Line{EOF: true})
+
+	got := []Line{}
+	for line := range v.C() {
+		got = append(got, line)
+	}
+
+	if len(got) != 2 || got[0].Text != "c" || !got[1].EOF || got[1].Seq != 4 {
+		t.Fatalf("expected line c and the end, got %+v", got)
+	}
+
+	// Once the output is over, viewers just get what's kept.
+	lines, v = h.Watch(1, 0)
+	if len(lines) != 4 {
+		t.Fatalf("expected every line, got %+v", lines)
+	}
+
+	if _, ok := <-v.C(); ok {
+		t.Fatal("expected viewer of finished run to be closed")
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	h := NewHub()
+
+	_, a := h.Watch(1, 0)
+	_, b := h.Watch(1, 0)
+	h.Add(1, line(1, "a"))
+
+	for _, v := range []*Viewer{a, b} {
+		if got := <-v.C(); got.Text != "a" {
+			t.Fatalf("expected line a, got %+v", got)
+		}
+	}
+
+	a.Close()
+	h.Add(1, line(2, "b"))
+
+	if _, ok := <-a.C(); ok {
+		t.Fatal("expected closed viewer to get nothing")
+	}
+	if got := <-b.C(); got.Text != "b" {
+		t.Fatalf("expected line b, got %+v", got)
+	}
+}
+
+func TestSlowViewerCutOff(t *testing.T) {
+	h := NewHub()
+	_, v := h.Watch(1, 0)
+
+	for i := 1; i <= viewerBuffer+1; i++ {
+		h.Add(1, line(i, "x"))
+	}
+
+	n := 0
+	for range v.C() {
+		n++
+	}
+
+	if n != viewerBuffer {
+		t.Fatalf("expected %v lines before being cut off, got %v", viewerBuffer, n)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	h := NewHub()
+	h.MaxLines = 2
+	h.MaxRuns = 2
+
+	for i := 1; i <= 3; i++ {
+		h.Add(1, line(i, "x"))
+	}
+
+	if lines, _ := h.Lines(1, 0); len(lines) != 2 || lines[0].Seq != 2 {
+		t.Fatalf("expected the last 2 lines, got %+v", lines)
+	}
+
+	h.Add(2, line(1, "x"))
+	h.Add(3, line(1, "x"))
+
+	if lines, _ := h.Lines(1, 0); len(lines) != 0 {
+		t.Fatalf("expected run 1 to be forgotten, got %+v", lines)
+	}
+}
+
+func TestConsume(t *testing.T) {
+	bus := queue.NewMemory()
+	recv, err := bus.Subscribe(SubjectAll)
+	if err != nil {
+		t.Fatalf("got error subscribing: %v", err)
+	}
+
+	h := NewHub()
+	done := make(chan struct{})
+	go func() {
+		h.Consume(recv)
+		close(done)
+	}()
+
+	msgs := []interface{}{line(1, "a"), Line{EOF: true}}
+	for _, msg := range msgs {
+		buf, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("got error marshalling line: %v", err)
+		}
+
+		if err := bus.Publish(Subject(7), buf); err != nil {
+			t.Fatalf("got error publishing: %v", err)
+		}
+	}
+	bus.Publish(queue.SubjectLogs+".nope", []byte(`{"seq": 1}`))
+
+	bus.Close()
+	<-done
+
+	lines, eof := h.Lines(7, 0)
+	if len(lines) != 2 || !eof {
+		t.Fatalf("expected line a and the end, got %+v", lines)
+	}
+}
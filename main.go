@@ -1,12 +1,28 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	nethttp "net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/run-ci/run-server/agents"
 	"github.com/run-ci/run-server/http"
+	"github.com/run-ci/run-server/leader"
+	"github.com/run-ci/run-server/logs"
+	"github.com/run-ci/run-server/logstream"
+	"github.com/run-ci/run-server/outbox"
 	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/schedules"
 	"github.com/run-ci/run-server/store"
+	"github.com/run-ci/run-server/tasks"
+	"github.com/run-ci/run-server/triggers"
 
 	nats "github.com/nats-io/go-nats"
 
@@ -15,7 +31,30 @@ import (
 
 var logger *logrus.Entry
 
-var pgconnstr, natsURL string
+var storeKind, storePath, pgconnstr string
+
+var busKind, natsURL string
+
+var shutdownTimeout = 30 * time.Second
+
+var leaseTimeout = agents.DefaultLeaseTimeout
+
+var runTimeout time.Duration
+
+var cancelTimeout = agents.DefaultCancelTimeout
+
+var logStoreKind, logDir string
+
+// instanceID tells servers apart when they elect a leader.
+var instanceID string
+
+// gitAllowFile lets task files be fetched from file:// remotes.
+var gitAllowFile bool
+
+var (
+	logRetention   = 30 * 24 * time.Hour
+	logMaxRunBytes = int64(logs.DefaultMaxRunBytes)
+)
 
 func init() {
 	lvl, err := logrus.ParseLevel(os.Getenv("RUN_LOG_LEVEL"))
@@ -27,6 +66,332 @@ func init() {
 
 	logger = logrus.WithField("package", "main")
 
+	storeKind = os.Getenv("RUN_STORE")
+	if storeKind == "" {
+		storeKind = "postgres"
+	}
+
+	switch storeKind {
+	case "postgres":
+		pgconnstr = postgresConnStr()
+	case "file":
+		storePath = os.Getenv("RUN_STORE_PATH")
+		if storePath == "" {
+			logger.Info("RUN_STORE_PATH not set - defaulting to run-server.json")
+			storePath = "run-server.json"
+		}
+	case "memory":
+		logger.Warn("using in-memory store, nothing will survive a restart")
+	default:
+		logger.Fatalf("unknown RUN_STORE %q, need postgres, file or memory", storeKind)
+	}
+
+	if timeout := os.Getenv("RUN_SHUTDOWN_TIMEOUT"); timeout != "" {
+		shutdownTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			logger.WithField("error", err).Fatal("invalid RUN_SHUTDOWN_TIMEOUT")
+		}
+	}
+
+	if timeout := os.Getenv("RUN_AGENT_LEASE_TIMEOUT"); timeout != "" {
+		leaseTimeout, err = time.ParseDuration(timeout)
+		if err != nil || leaseTimeout <= 0 {
+			logger.WithField("error", err).Fatal("invalid RUN_AGENT_LEASE_TIMEOUT")
+		}
+	}
+
+	// Runs can go on forever unless they, their task or this say otherwise.
+	if timeout := os.Getenv("RUN_RUN_TIMEOUT"); timeout != "" {
+		runTimeout, err = time.ParseDuration(timeout)
+		if err != nil || runTimeout < 0 {
+			logger.WithField("error", err).Fatal("invalid RUN_RUN_TIMEOUT")
+		}
+	}
+
+	if timeout := os.Getenv("RUN_CANCEL_TIMEOUT"); timeout != "" {
+		cancelTimeout, err = time.ParseDuration(timeout)
+		if err != nil || cancelTimeout <= 0 {
+			logger.WithField("error", err).Fatal("invalid RUN_CANCEL_TIMEOUT")
+		}
+	}
+
+	// Logs go in the database along with everything else if there is
+	// one, and on disk otherwise.
+	logStoreKind = os.Getenv("RUN_LOG_STORE")
+	if logStoreKind == "" {
+		logStoreKind = "disk"
+		if storeKind == "postgres" {
+			logStoreKind = "postgres"
+		}
+	}
+
+	switch logStoreKind {
+	case "postgres":
+		if storeKind != "postgres" {
+			logger.Fatal("RUN_LOG_STORE=postgres needs RUN_STORE=postgres")
+		}
+	case "disk":
+		// Servers sharing a database split the lines they record
+		// between them, so each one's disk would only have part of
+		// every log, and only the leader's would ever be pruned.
+		if storeKind == "postgres" {
+			logger.Fatal("RUN_LOG_STORE=disk needs RUN_STORE=file or memory")
+		}
+
+		logDir = os.Getenv("RUN_LOG_DIR")
+		if logDir == "" {
+			logger.Info("RUN_LOG_DIR not set - defaulting to run-server-logs")
+			logDir = "run-server-logs"
+		}
+	default:
+		logger.Fatalf("unknown RUN_LOG_STORE %q, need postgres or disk", logStoreKind)
+	}
+
+	if retention := os.Getenv("RUN_LOG_RETENTION"); retention != "" {
+		logRetention, err = time.ParseDuration(retention)
+		if err != nil || logRetention <= 0 {
+			logger.WithField("error", err).Fatal("invalid RUN_LOG_RETENTION")
+		}
+	}
+
+	if max := os.Getenv("RUN_LOG_MAX_RUN_BYTES"); max != "" {
+		logMaxRunBytes, err = strconv.ParseInt(max, 10, 64)
+		if err != nil || logMaxRunBytes <= 0 {
+			logger.WithField("error", err).Fatal("invalid RUN_LOG_MAX_RUN_BYTES")
+		}
+	}
+
+	if allow := os.Getenv("RUN_GIT_ALLOW_FILE"); allow != "" {
+		gitAllowFile, err = strconv.ParseBool(allow)
+		if err != nil {
+			logger.WithField("error", err).Fatal("invalid RUN_GIT_ALLOW_FILE")
+		}
+	}
+
+	instanceID = os.Getenv("RUN_INSTANCE_ID")
+	if instanceID == "" {
+		host, _ := os.Hostname()
+		instanceID = fmt.Sprintf("%v-%v", host, os.Getpid())
+	}
+
+	busKind = os.Getenv("RUN_BUS")
+	if busKind == "" {
+		busKind = "nats"
+	}
+
+	switch busKind {
+	case "nats":
+		natsURL = os.Getenv("RUN_NATS_URL")
+		if natsURL == "" {
+			logger.Warnf("setting NATS url to %v", nats.DefaultURL)
+			natsURL = nats.DefaultURL
+		}
+	case "memory":
+		logger.Warn("using in-memory bus, pollers and agents outside this process won't hear from it")
+	default:
+		logger.Fatalf("unknown RUN_BUS %q, need nats or memory", busKind)
+	}
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(os.Args[2:])
+		return
+	}
+
+	logger.Info("booting server...")
+
+	logger.Infof("connecting to %v store", storeKind)
+	rawst, err := openStore()
+	if err == store.ErrSchemaBehind {
+		logger.Fatal("database schema is out of date, run `run-server migrate up` first")
+	}
+	if err != nil {
+		logger.WithField("error", err).Fatalf("unable to open %v store", storeKind)
+	}
+	st := store.Instrument(rawst)
+
+	logger.Infof("connecting to %v bus", busKind)
+	rawbus, err := openBus()
+	if err != nil {
+		// Without a bus the server can't tell pollers about anything,
+		// so there's no point in carrying on.
+		logger.WithField("error", err).Fatalf("unable to connect to %v bus", busKind)
+	}
+	bus := queue.Instrument(rawbus)
+
+	logger.Info("subscribing to build triggers")
+	trig, err := bus.QueueSubscribe(queue.SubjectTriggers, triggers.Group)
+	if err != nil {
+		logger.WithField("error", err).Fatal("unable to subscribe to build triggers")
+	}
+	consumed := make(chan struct{})
+	go func() {
+		triggers.Consume(trig, st)
+		close(consumed)
+	}()
+
+	dispatcher := agents.NewDispatcher(st, bus)
+	dispatcher.LeaseTimeout = leaseTimeout
+
+	logger.Info("subscribing to agent registrations and heartbeats")
+	var agentsConsumed sync.WaitGroup
+	for _, subj := range []string{queue.SubjectAgentRegister, queue.SubjectAgentHeartbeat} {
+		recv, err := bus.QueueSubscribe(subj, agents.Group)
+		if err != nil {
+			logger.WithField("error", err).Fatalf("unable to subscribe to %v", subj)
+		}
+
+		agentsConsumed.Add(1)
+		go func() {
+			defer agentsConsumed.Done()
+			agents.Consume(recv, dispatcher)
+		}()
+	}
+
+	// Every server has viewers of its own, so each one gets every line
+	// rather than splitting them with the others.
+	logger.Info("subscribing to run logs")
+	lines, err := bus.Subscribe(logstream.SubjectAll)
+	if err != nil {
+		logger.WithField("error", err).Fatal("unable to subscribe to run logs")
+	}
+	hub := logstream.NewHub()
+	go hub.Consume(lines)
+
+	logger.Infof("opening %v log store", logStoreKind)
+	logstore, err := openLogStore(rawst)
+	if err != nil {
+		logger.WithField("error", err).Fatalf("unable to open %v log store", logStoreKind)
+	}
+
+	// Like viewers, every server gets every line, so each one sees a run's
+	// lines in order. The log store skips lines another server already
+	// wrote.
+	recorded, err := bus.Subscribe(logstream.SubjectAll)
+	if err != nil {
+		logger.WithField("error", err).Fatal("unable to subscribe to run logs")
+	}
+	recorder := logs.NewRecorder(logstore, st)
+	go recorder.Consume(recorded)
+
+	// Pruning logs, reaping runs, firing schedules and relaying the
+	// outbox only happen on whichever server is leader.
+	logger.Infof("starting leader election as %v", instanceID)
+	elector := leader.New(openLock(rawst), instanceID)
+
+	pruner := logs.NewPruner(logstore, logRetention)
+	elector.Go(pruner.Run)
+
+	reaper := agents.NewReaper(st, bus)
+	reaper.Timeout = runTimeout
+	reaper.CancelTimeout = cancelTimeout
+	elector.Go(reaper.Run)
+
+	// Scheduled runs read their task files the same way runs started by
+	// hand do.
+	fetcher := tasks.Git{Timeout: 30 * time.Second, AllowFile: gitAllowFile}
+	scheduler := schedules.NewScheduler(st, bus, fetcher)
+	elector.Go(scheduler.Run)
+
+	relay := outbox.NewRelay(st, bus)
+	elector.Go(relay.Run)
+
+	electorCtx, stopElector := context.WithCancel(context.Background())
+	elected := make(chan struct{})
+	go func() {
+		elector.Run(electorCtx)
+		close(elected)
+	}()
+
+	srv := http.NewServer(":9001", bus, st)
+	srv.SetDispatcher(dispatcher)
+	srv.SetLogHub(hub)
+	srv.SetLogStore(logstore)
+	srv.SetElector(elector)
+	srv.SetFetcher(fetcher)
+
+	if token := os.Getenv("RUN_ADMIN_TOKEN"); token != "" {
+		srv.SetAdminToken(token)
+	} else {
+		logger.Warn("RUN_ADMIN_TOKEN not set, only tokens already in the store will work")
+	}
+
+	for _, provider := range []string{"github", "gitlab", "gitea"} {
+		env := fmt.Sprintf("RUN_%v_HOOK_SECRET", strings.ToUpper(provider))
+		if secret := os.Getenv(env); secret != "" {
+			logger.Infof("enabling %v webhooks", provider)
+			srv.SetHookSecret(provider, secret)
+		}
+	}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != nethttp.ErrServerClosed {
+			logger.WithField("error", err).Fatal("shutting down server")
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-sigs
+	logger.Infof("got %v, shutting down within %v", sig, shutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.WithField("error", err).Warn("unable to shut down server cleanly")
+	}
+
+	// Stepping down stops everything only the leader does, so another
+	// server can take over straight away.
+	stopElector()
+	<-elected
+
+	// Requests that just finished may have left messages in the outbox,
+	// so give them one last chance to go out before the bus is closed.
+	// Messages can go out more than once anyway, so it doesn't matter if
+	// the new leader sends them too.
+	logger.Info("flushing outbox")
+	if _, err := relay.Flush(); err != nil {
+		logger.WithField("error", err).Warn("unable to flush outbox")
+	}
+
+	// Closing the bus drains it, which closes the triggers channel once
+	// everything that was already received has been handed over.
+	logger.Infof("draining %v bus", busKind)
+	bus.Close()
+
+	select {
+	case <-consumed:
+	case <-ctx.Done():
+		logger.Warn("gave up waiting for triggers to be recorded")
+	}
+
+	agentsDone := make(chan struct{})
+	go func() {
+		agentsConsumed.Wait()
+		close(agentsDone)
+	}()
+
+	select {
+	case <-agentsDone:
+	case <-ctx.Done():
+		logger.Warn("gave up waiting for agent messages to be handled")
+	}
+
+	logger.Info("closing store")
+	if err := st.Close(); err != nil {
+		logger.WithField("error", err).Warn("unable to close store")
+	}
+
+	logger.Info("shut down")
+}
+
+// PostgresConnStr builds the Postgres connection string from the
+// RUN_POSTGRES_* environment variables.
+func postgresConnStr() string {
 	pguser := os.Getenv("RUN_POSTGRES_USER")
 	if pguser == "" {
 		logger.Fatal("need RUN_POSTGRES_USER")
@@ -53,37 +418,61 @@ func init() {
 		pgssl = "verify-full"
 	}
 
-	pgconnstr = fmt.Sprintf("postgres://%v:%v@%v/%v?sslmode=%v",
+	return fmt.Sprintf("postgres://%v:%v@%v/%v?sslmode=%v",
 		pguser, pgpass, pghref, pgdb, pgssl)
+}
+
+// OpenLogStore opens the log store selected by RUN_LOG_STORE. Logs kept in
+// Postgres share the store's database.
+func openLogStore(st store.Repo) (logs.LogStore, error) {
+	if logStoreKind == "postgres" {
+		pg := logs.NewPostgres(st.(*store.Postgres).DB())
+		pg.MaxRunBytes = logMaxRunBytes
+		return pg, nil
+	}
 
-	natsURL = os.Getenv("RUN_NATS_URL")
-	if natsURL == "" {
-		logger.Warnf("setting NATS url to %v", nats.DefaultURL)
-		natsURL = nats.DefaultURL
+	disk, err := logs.NewDisk(logDir)
+	if err != nil {
+		return nil, err
 	}
+	disk.MaxRunBytes = logMaxRunBytes
+
+	return disk, nil
 }
 
-func main() {
-	logger.Info("booting server...")
+// OpenLock returns the lock servers sharing `st` contend for to be leader.
+// Stores other than Postgres aren't shared, so their servers are always
+// leader.
+func openLock(st store.Repo) leader.Lock {
+	if pg, ok := st.(*store.Postgres); ok {
+		return leader.NewPostgres(pg.DB(), leader.DefaultKey)
+	}
 
-	logger.Info("connecting to database")
-	st, err := store.NewPostgres(pgconnstr)
-	if err != nil {
-		logger.WithField("error", err).Fatal("unable to connect to postgres")
+	return leader.NewMemory()
+}
+
+// OpenBus connects to the bus selected by RUN_BUS.
+func openBus() (queue.Bus, error) {
+	if busKind == "memory" {
+		return queue.NewMemory(), nil
 	}
 
-	logger.Info("setting up NATS connection")
-	bus, err := queue.NewNATS(natsURL)
+	nc, err := queue.NewNATS(natsURL)
 	if err != nil {
-		logger.WithField("error", err).Warn("unable to connect to NATS")
+		return nil, err
 	}
 
-	logger.Info("setting up pollers send channel")
-	send := bus.SenderOn("pollers")
-
-	srv := http.NewServer(":9001", send, st)
+	return nc, nil
+}
 
-	if err := srv.ListenAndServe(); err != nil {
-		logger.WithField("error", err).Fatal("shutting down server")
+// OpenStore opens the store selected by RUN_STORE.
+func openStore() (store.Repo, error) {
+	switch storeKind {
+	case "file":
+		return store.NewFile(storePath)
+	case "memory":
+		return store.NewMemory(), nil
+	default:
+		return store.NewPostgres(pgconnstr)
 	}
 }
@@ -0,0 +1,129 @@
+// Package metrics keeps counters, gauges and histograms and exposes them in
+// the Prometheus text exposition format. It's a thin layer over the
+// Prometheus client, so that the rest of the server can record values by
+// label without holding on to the client's types.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// DefaultBuckets are histogram buckets suited to timing requests and
+// database calls, in seconds.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultRegistry is where metrics created with the package level
+// constructors are registered. Registering two metrics with the same name
+// is a programming error, so it panics.
+var DefaultRegistry = prometheus.NewRegistry()
+
+// Handler returns an http.Handler serving the metrics in DefaultRegistry.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(DefaultRegistry, promhttp.HandlerOpts{})
+}
+
+// read returns the current state of `m`.
+func read(m prometheus.Metric) *dto.Metric {
+	var out dto.Metric
+	if err := m.Write(&out); err != nil {
+		// Only metrics with invalid label values fail to write, and
+		// those can't be created in the first place.
+		panic(err)
+	}
+
+	return &out
+}
+
+// CounterVec is a set of counters split by label values.
+type CounterVec struct {
+	vec *prometheus.CounterVec
+}
+
+// NewCounterVec registers a counter with the given labels in
+// DefaultRegistry.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		vec: prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels),
+	}
+	DefaultRegistry.MustRegister(c.vec)
+
+	return c
+}
+
+// Inc adds one to the counter with the given label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.vec.WithLabelValues(values...).Inc()
+}
+
+// Add adds `v` to the counter with the given label values.
+func (c *CounterVec) Add(v float64, values ...string) {
+	c.vec.WithLabelValues(values...).Add(v)
+}
+
+// Value returns the current value of the counter with the given label
+// values.
+func (c *CounterVec) Value(values ...string) float64 {
+	return read(c.vec.WithLabelValues(values...)).GetCounter().GetValue()
+}
+
+// GaugeVec is a set of gauges split by label values.
+type GaugeVec struct {
+	vec *prometheus.GaugeVec
+}
+
+// NewGaugeVec registers a gauge with the given labels in DefaultRegistry.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{
+		vec: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels),
+	}
+	DefaultRegistry.MustRegister(g.vec)
+
+	return g
+}
+
+// Set sets the gauge with the given label values to `v`.
+func (g *GaugeVec) Set(v float64, values ...string) {
+	g.vec.WithLabelValues(values...).Set(v)
+}
+
+// Value returns the current value of the gauge with the given label
+// values.
+func (g *GaugeVec) Value(values ...string) float64 {
+	return read(g.vec.WithLabelValues(values...)).GetGauge().GetValue()
+}
+
+// HistogramVec is a set of histograms split by label values.
+type HistogramVec struct {
+	vec *prometheus.HistogramVec
+}
+
+// NewHistogramVec registers a histogram with the given buckets and labels
+// in DefaultRegistry. Buckets must be sorted in increasing order.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		vec: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    name,
+			Help:    help,
+			Buckets: buckets,
+		}, labels),
+	}
+	DefaultRegistry.MustRegister(h.vec)
+
+	return h
+}
+
+// Observe records `v` in the histogram with the given label values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.vec.WithLabelValues(values...).Observe(v)
+}
+
+// Count returns how many values have been observed by the histogram with
+// the given label values.
+func (h *HistogramVec) Count(values ...string) uint64 {
+	m := h.vec.WithLabelValues(values...).(prometheus.Metric)
+	return read(m).GetHistogram().GetSampleCount()
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	reqs := NewCounterVec("test_requests_total", "Requests handled.", "route", "status")
+	reqs.Inc("/repos/git", "200")
+	reqs.Inc("/repos/git", "200")
+	reqs.Inc(`/we"ird`, "500")
+
+	pending := NewGaugeVec("test_pending", "Things pending.")
+	pending.Set(3)
+
+	dur := NewHistogramVec("test_duration_seconds", "How long things took.",
+		[]float64{.1, 1}, "method")
+	dur.Observe(.05, "get")
+	dur.Observe(.5, "get")
+
+	rw := httptest.NewRecorder()
+	Handler().ServeHTTP(rw, httptest.NewRequest("GET", "http://test/metrics", nil))
+
+	payload, err := ioutil.ReadAll(rw.Result().Body)
+	if err != nil {
+		t.Fatalf("got error reading metrics: %v", err)
+	}
+	out := string(payload)
+
+	want := []string{
+		"# TYPE test_requests_total counter\n",
+		`test_requests_total{route="/repos/git",status="200"} 2` + "\n",
+		`test_requests_total{route="/we\"ird",status="500"} 1` + "\n",
+		"# TYPE test_pending gauge\ntest_pending 3\n",
+		"# TYPE test_duration_seconds histogram\n",
+		`test_duration_seconds_bucket{method="get",le="0.1"} 1` + "\n",
+		`test_duration_seconds_bucket{method="get",le="1"} 2` + "\n",
+		`test_duration_seconds_bucket{method="get",le="+Inf"} 2` + "\n",
+		`test_duration_seconds_sum{method="get"} 0.55` + "\n",
+		`test_duration_seconds_count{method="get"} 2` + "\n",
+	}
+
+	for _, line := range want {
+		if !strings.Contains(out, line) {
+			t.Fatalf("expected output to contain %q, got:\n%v", line, out)
+		}
+	}
+}
+
+func TestValues(t *testing.T) {
+	reqs := NewCounterVec("test_values_total", "Counted.", "route")
+	reqs.Add(2, "/runs")
+
+	if got := reqs.Value("/runs"); got != 2 {
+		t.Fatalf("expected counter to be 2, got %v", got)
+	}
+
+	dur := NewHistogramVec("test_values_seconds", "Timed.", DefaultBuckets, "method")
+	dur.Observe(1, "get")
+
+	if got := dur.Count("get"); got != 1 {
+		t.Fatalf("expected histogram to count 1, got %v", got)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	NewCounterVec("test_twice_total", "Registered twice.")
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected registering the same name twice to panic")
+		}
+	}()
+
+	NewCounterVec("test_twice_total", "Registered twice.")
+}
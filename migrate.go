@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/run-ci/run-server/store"
+)
+
+const migrateUsage = "usage: run-server migrate up|down|status"
+
+// Migrate runs the `migrate` subcommand with the given arguments.
+func migrate(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+
+	logger := logger.WithField("command", "migrate")
+
+	if storeKind != "postgres" {
+		logger.Fatalf("migrations only apply to the postgres store, not %v", storeKind)
+	}
+
+	m, err := store.NewMigrator(pgconnstr)
+	if err != nil {
+		logger.WithField("error", err).Fatal("unable to connect to postgres")
+	}
+	defer m.Close()
+
+	switch args[0] {
+	case "up":
+		if err := m.Up(); err != nil {
+			logger.WithField("error", err).Fatal("unable to apply migrations")
+		}
+
+		logger.Infof("schema is at version %v", store.LatestVersion())
+	case "down":
+		if err := m.Down(); err != nil {
+			logger.WithField("error", err).Fatal("unable to revert migration")
+		}
+	case "status":
+		statuses, err := m.Status()
+		if err != nil {
+			logger.WithField("error", err).Fatal("unable to get migration status")
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, st := range statuses {
+			applied := "no"
+			if st.Applied {
+				applied = st.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+
+			fmt.Fprintf(tw, "%v\t%v\t%v\n", st.Version, st.Name, applied)
+		}
+		tw.Flush()
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,160 @@
+// Package outbox publishes the messages saved in the store's outbox to the
+// queue, retrying them until they're delivered.
+package outbox
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/run-ci/run-server/metrics"
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/store"
+	"github.com/sirupsen/logrus"
+)
+
+var logger *logrus.Entry
+
+var (
+	pending = metrics.NewGaugeVec("run_outbox_pending",
+		"Messages in the outbox that haven't been delivered yet.")
+
+	delivered = metrics.NewCounterVec("run_outbox_delivered_total",
+		"Messages delivered from the outbox.")
+
+	failed = metrics.NewCounterVec("run_outbox_failed_total",
+		"Failed attempts at delivering messages from the outbox.")
+)
+
+func init() {
+	logger = logrus.WithField("package", "outbox")
+}
+
+// maxBackoff caps how long a message that keeps failing waits between
+// attempts.
+const maxBackoff = 5 * time.Minute
+
+// Relay moves messages from the outbox onto the queue.
+type Relay struct {
+	st  store.Repo
+	bus queue.Bus
+
+	// Interval is how often the outbox is checked for messages.
+	Interval time.Duration
+
+	// BatchSize is how many messages are sent per check.
+	BatchSize int
+}
+
+// NewRelay returns a Relay sending messages from `st` on `bus`.
+func NewRelay(st store.Repo, bus queue.Bus) *Relay {
+	return &Relay{
+		st:  st,
+		bus: bus,
+
+		Interval:  time.Second,
+		BatchSize: 100,
+	}
+}
+
+// Run flushes the outbox every Interval until `ctx` is done.
+func (r *Relay) Run(ctx context.Context) {
+	logger.Info("starting outbox relay")
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := r.Flush(); err != nil {
+			logger.WithField("error", err).Error("unable to flush outbox")
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Info("stopping outbox relay")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Flush sends every message that's due, a batch at a time, and returns how
+// many were delivered. Messages that can't be published are rescheduled
+// with exponential backoff.
+func (r *Relay) Flush() (int, error) {
+	sent := 0
+	defer r.updatePending()
+
+	for {
+		msgs, err := r.st.GetPendingMessages(r.BatchSize)
+		if err != nil {
+			return sent, err
+		}
+
+		progress := false
+		for _, msg := range msgs {
+			ok, err := r.send(msg)
+			if err != nil {
+				return sent, err
+			}
+
+			if ok {
+				sent++
+				progress = true
+			}
+		}
+
+		// Stop once there's nothing left, or when everything left just
+		// failed and has been pushed back.
+		if len(msgs) < r.BatchSize || !progress {
+			return sent, nil
+		}
+	}
+}
+
+// send publishes a single message and records the outcome. It only returns
+// an error when the outcome can't be saved.
+func (r *Relay) send(msg store.Message) (bool, error) {
+	logger := logger.WithFields(logrus.Fields{
+		"message_id": msg.ID,
+		"subject":    msg.Subject,
+		"attempts":   msg.Attempts,
+	})
+
+	err := r.bus.Publish(msg.Subject, msg.Payload)
+	if err != nil {
+		failed.Inc()
+
+		next := time.Now().Add(backoff(msg.Attempts))
+		logger.WithField("error", err).
+			Warnf("unable to publish message, retrying at %v", next)
+
+		return false, r.st.MarkMessageFailed(msg.ID, err.Error(), next)
+	}
+
+	logger.Debug("message delivered")
+	delivered.Inc()
+
+	return true, r.st.MarkMessageDelivered(msg.ID)
+}
+
+func (r *Relay) updatePending() {
+	n, err := r.st.CountPendingMessages()
+	if err != nil {
+		logger.WithField("error", err).Warn("unable to count pending messages")
+		return
+	}
+
+	pending.Set(float64(n))
+}
+
+// backoff returns how long to wait before retrying a message that has
+// already failed `attempts` times.
+func backoff(attempts int) time.Duration {
+	d := time.Duration(math.Pow(2, float64(attempts))) * time.Second
+	if d > maxBackoff || d <= 0 {
+		return maxBackoff
+	}
+
+	return d
+}
@@ -0,0 +1,109 @@
+package outbox
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/store"
+)
+
+// flakyBus fails to publish until it's been told to work.
+type flakyBus struct {
+	*queue.Memory
+	up bool
+}
+
+func (b *flakyBus) Publish(subj string, msg []byte) error {
+	if !b.up {
+		return errors.New("bus is down")
+	}
+
+	return b.Memory.Publish(subj, msg)
+}
+
+func TestFlush(t *testing.T) {
+	st := store.NewMemory()
+	bus := &flakyBus{Memory: queue.NewMemory()}
+
+	recv, err := bus.Subscribe(queue.SubjectPollers)
+	if err != nil {
+		t.Fatalf("got error subscribing: %v", err)
+	}
+
+	err = st.CreateGitRepo(store.GitRepo{Remote: "a.git", Branch: "master"}, store.Messages(store.Message{
+		Subject: queue.SubjectPollers,
+		Payload: []byte("hello"),
+	}))
+	if err != nil {
+		t.Fatalf("got error creating repo: %v", err)
+	}
+
+	relay := NewRelay(st, bus)
+
+	n, err := relay.Flush()
+	if err != nil {
+		t.Fatalf("got error flushing outbox: %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("expected nothing to be delivered while the bus is down, got %v", n)
+	}
+
+	msgs, err := st.GetPendingMessages(10)
+	if err != nil {
+		t.Fatalf("got error getting pending messages: %v", err)
+	}
+	if len(msgs) != 0 {
+		t.Fatalf("expected failed message to be pushed back, got %v due", len(msgs))
+	}
+
+	count, err := st.CountPendingMessages()
+	if err != nil {
+		t.Fatalf("got error counting pending messages: %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("expected 1 pending message, got %v", count)
+	}
+
+	// Make the message due again instead of waiting out the backoff.
+	if err := st.MarkMessageFailed(1, "bus is down", time.Now()); err != nil {
+		t.Fatalf("got error rescheduling message: %v", err)
+	}
+	bus.up = true
+
+	n, err = relay.Flush()
+	if err != nil {
+		t.Fatalf("got error flushing outbox: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 message to be delivered, got %v", n)
+	}
+
+	msg := <-recv
+	if string(msg.Data) != "hello" {
+		t.Fatalf("expected hello, got %s", msg.Data)
+	}
+
+	count, err = st.CountPendingMessages()
+	if err != nil {
+		t.Fatalf("got error counting pending messages: %v", err)
+	}
+	if count != 0 {
+		t.Fatalf("expected no pending messages, got %v", count)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	if d := backoff(0); d != time.Second {
+		t.Fatalf("expected first retry after 1s, got %v", d)
+	}
+
+	if d := backoff(3); d != 8*time.Second {
+		t.Fatalf("expected fourth retry after 8s, got %v", d)
+	}
+
+	if d := backoff(100); d != maxBackoff {
+		t.Fatalf("expected backoff to be capped at %v, got %v", maxBackoff, d)
+	}
+}
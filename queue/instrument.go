@@ -0,0 +1,30 @@
+package queue
+
+import "github.com/run-ci/run-server/metrics"
+
+var publishes = metrics.NewCounterVec("run_queue_publish_total",
+	"Messages published on the queue, by subject and result.", "subject", "result")
+
+// instrumented is a Bus that counts the messages published through it.
+type instrumented struct {
+	Bus
+}
+
+// Instrument wraps `bus` so that publish successes and failures show up
+// in metrics.
+func Instrument(bus Bus) Bus {
+	return &instrumented{
+		Bus: bus,
+	}
+}
+
+func (i *instrumented) Publish(subj string, msg []byte) error {
+	err := i.Bus.Publish(subj, msg)
+	if err != nil {
+		publishes.Inc(subj, "failure")
+		return err
+	}
+
+	publishes.Inc(subj, "success")
+	return nil
+}
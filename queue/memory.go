@@ -0,0 +1,240 @@
+package queue
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrClosed is returned when using a Bus that's been closed.
+var ErrClosed = errors.New("bus is closed")
+
+// subscriberBuffer is how many messages a subscriber's channel holds. A
+// Memory bus queues messages past that until the subscriber catches up,
+// and NATS subscribers wait for room, leaving NATS to hold on to the rest.
+const subscriberBuffer = 1024
+
+// Memory is a Bus that lives entirely in the current process. Like NATS,
+// publishing never blocks. Messages wait for subscribers that fall behind
+// instead of being dropped, however far behind they fall. It supports the
+// same `*` and `>` subject wildcards.
+type Memory struct {
+	mu     sync.Mutex
+	subs   []*memSub
+	next   map[string]int
+	closed bool
+}
+
+// memSub is a single subscription to a Memory bus. Messages go straight to
+// the subscriber's channel while there's room in it, and are queued in
+// `pending` once there isn't, to be handed over in order as it catches up.
+type memSub struct {
+	pattern string
+	group   string
+	ch      chan Message
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []Message
+	closed  bool
+}
+
+func newMemSub(pattern, group string) *memSub {
+	sub := &memSub{
+		pattern: pattern,
+		group:   group,
+		ch:      make(chan Message, subscriberBuffer),
+	}
+	sub.cond = sync.NewCond(&sub.mu)
+
+	go sub.pump()
+
+	return sub
+}
+
+// push hands `msg` to the subscriber, or queues it if the subscriber has
+// fallen behind.
+func (sub *memSub) push(msg Message) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if sub.closed {
+		return
+	}
+
+	// Anything already queued has to go first.
+	if len(sub.pending) == 0 {
+		select {
+		case sub.ch <- msg:
+			return
+		default:
+		}
+	}
+
+	sub.pending = append(sub.pending, msg)
+	sub.cond.Signal()
+}
+
+// close stops the subscription once every message already queued has been
+// handed over.
+func (sub *memSub) close() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	sub.closed = true
+	sub.cond.Signal()
+}
+
+// pump hands queued messages to the subscriber until the subscription is
+// closed and there are none left, and then closes its channel. A message
+// stays queued until it's been handed over, so that push doesn't get
+// ahead of it.
+func (sub *memSub) pump() {
+	defer close(sub.ch)
+
+	for {
+		sub.mu.Lock()
+		for len(sub.pending) == 0 && !sub.closed {
+			sub.cond.Wait()
+		}
+
+		if len(sub.pending) == 0 {
+			sub.mu.Unlock()
+			return
+		}
+
+		msg := sub.pending[0]
+		sub.mu.Unlock()
+
+		sub.ch <- msg
+
+		sub.mu.Lock()
+		sub.pending[0] = Message{}
+		sub.pending = sub.pending[1:]
+		sub.mu.Unlock()
+	}
+}
+
+// NewMemory returns an empty in-process Bus.
+func NewMemory() *Memory {
+	return &Memory{
+		next: map[string]int{},
+	}
+}
+
+// Publish delivers `msg` to every current subscriber of `subj`, and to
+// one subscriber of each queue group on `subj`.
+func (q *Memory) Publish(subj string, msg []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+
+	logger.WithField("subject", subj).Debugf("sending data: %s", msg)
+
+	groups := map[string][]*memSub{}
+	for _, sub := range q.subs {
+		if !matchSubject(sub.pattern, subj) {
+			continue
+		}
+
+		if sub.group != "" {
+			groups[sub.group] = append(groups[sub.group], sub)
+			continue
+		}
+
+		sub.push(Message{Subject: subj, Data: msg})
+	}
+
+	for group, members := range groups {
+		i := q.next[group] % len(members)
+		q.next[group]++
+
+		members[i].push(Message{Subject: subj, Data: msg})
+	}
+
+	return nil
+}
+
+// Subscribe returns a channel receiving messages published on `subj`.
+func (q *Memory) Subscribe(subj string) (<-chan Message, error) {
+	return q.QueueSubscribe(subj, "")
+}
+
+// QueueSubscribe returns a channel receiving the messages published on
+// `subj` that are handed to it as a member of `group`.
+func (q *Memory) QueueSubscribe(subj, group string) (<-chan Message, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, ErrClosed
+	}
+
+	logger.WithFields(logrus.Fields{
+		"subject": subj,
+		"group":   group,
+	}).Debug("setting up queue receiver")
+
+	sub := newMemSub(subj, group)
+	q.subs = append(q.subs, sub)
+
+	return sub.ch, nil
+}
+
+// Ping returns ErrClosed once the bus has been closed.
+func (q *Memory) Ping() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+
+	return nil
+}
+
+// Close closes every subscriber channel, once the messages already
+// published to it have been received. Publishing after Close returns
+// ErrClosed.
+func (q *Memory) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+
+	for _, sub := range q.subs {
+		sub.close()
+	}
+}
+
+// matchSubject reports whether `subj` matches the NATS-style `pattern`,
+// where `*` matches a single token and `>` matches one or more trailing
+// tokens.
+func matchSubject(pattern, subj string) bool {
+	ptoks := strings.Split(pattern, ".")
+	stoks := strings.Split(subj, ".")
+
+	for i, ptok := range ptoks {
+		if ptok == ">" {
+			return len(stoks) > i
+		}
+
+		if i >= len(stoks) {
+			return false
+		}
+
+		if ptok != "*" && ptok != stoks[i] {
+			return false
+		}
+	}
+
+	return len(ptoks) == len(stoks)
+}
@@ -0,0 +1,165 @@
+package queue
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestMemoryPublishSubscribe(t *testing.T) {
+	bus := NewMemory()
+
+	a, err := bus.Subscribe("pollers")
+	if err != nil {
+		t.Fatalf("got error subscribing: %v", err)
+	}
+
+	b, err := bus.Subscribe("pollers")
+	if err != nil {
+		t.Fatalf("got error subscribing: %v", err)
+	}
+
+	other, err := bus.Subscribe("triggers")
+	if err != nil {
+		t.Fatalf("got error subscribing: %v", err)
+	}
+
+	err = bus.Publish("pollers", []byte("hello"))
+	if err != nil {
+		t.Fatalf("got error publishing: %v", err)
+	}
+
+	for _, sub := range []<-chan Message{a, b} {
+		msg := <-sub
+		if msg.Subject != "pollers" || string(msg.Data) != "hello" {
+			t.Fatalf("expected hello on pollers, got %s on %v", msg.Data, msg.Subject)
+		}
+	}
+
+	select {
+	case msg := <-other:
+		t.Fatalf("expected nothing on other subject, got %s", msg.Data)
+	default:
+	}
+
+	if err := bus.Ping(); err != nil {
+		t.Fatalf("expected open bus to be up, got %v", err)
+	}
+
+	bus.Close()
+
+	if err := bus.Ping(); err != ErrClosed {
+		t.Fatalf("expected %v pinging closed bus, got %v", ErrClosed, err)
+	}
+
+	if _, ok := <-a; ok {
+		t.Fatal("expected subscriber channel to be closed")
+	}
+
+	if err := bus.Publish("pollers", []byte("hello")); err != ErrClosed {
+		t.Fatalf("expected %v publishing on closed bus, got %v", ErrClosed, err)
+	}
+}
+
+func TestMatchSubject(t *testing.T) {
+	tests := []struct {
+		pattern string
+		subj    string
+		match   bool
+	}{
+		{"pollers", "pollers", true},
+		{"pollers", "triggers", false},
+		{"agents.*", "agents.linux", true},
+		{"agents.*", "agents.linux.amd64", false},
+		{"agents.>", "agents.linux.amd64", true},
+		{"agents.>", "agents", false},
+		{"*.linux", "agents.linux", true},
+	}
+
+	for _, test := range tests {
+		if got := matchSubject(test.pattern, test.subj); got != test.match {
+			t.Fatalf("expected match(%v, %v) to be %v, got %v",
+				test.pattern, test.subj, test.match, got)
+		}
+	}
+}
+
+func TestMemoryQueueSubscribe(t *testing.T) {
+	bus := NewMemory()
+
+	var members []<-chan Message
+	for i := 0; i < 2; i++ {
+		sub, err := bus.QueueSubscribe("triggers", "servers")
+		if err != nil {
+			t.Fatalf("got error subscribing: %v", err)
+		}
+		members = append(members, sub)
+	}
+
+	all, err := bus.Subscribe("triggers")
+	if err != nil {
+		t.Fatalf("got error subscribing: %v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := bus.Publish("triggers", []byte("hello")); err != nil {
+			t.Fatalf("got error publishing: %v", err)
+		}
+	}
+	bus.Close()
+
+	total := 0
+	for i, sub := range members {
+		n := 0
+		for range sub {
+			n++
+		}
+
+		if n != 2 {
+			t.Fatalf("expected group member %v to get 2 messages, got %v", i, n)
+		}
+		total += n
+	}
+
+	if total != 4 {
+		t.Fatalf("expected the group to get each message once, got %v", total)
+	}
+
+	n := 0
+	for range all {
+		n++
+	}
+	if n != 4 {
+		t.Fatalf("expected plain subscriber to get every message, got %v", n)
+	}
+}
+
+func TestMemoryBurst(t *testing.T) {
+	bus := NewMemory()
+
+	sub, err := bus.Subscribe("triggers")
+	if err != nil {
+		t.Fatalf("got error subscribing: %v", err)
+	}
+
+	// Nothing reads while the burst is published, so every message has
+	// to wait for the subscriber rather than be dropped.
+	burst := 4 * subscriberBuffer
+	for i := 0; i < burst; i++ {
+		if err := bus.Publish("triggers", []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("got error publishing: %v", err)
+		}
+	}
+	bus.Close()
+
+	n := 0
+	for msg := range sub {
+		if string(msg.Data) != strconv.Itoa(n) {
+			t.Fatalf("expected message %v, got %s", n, msg.Data)
+		}
+		n++
+	}
+
+	if n != burst {
+		t.Fatalf("expected all %v messages, got %v", burst, n)
+	}
+}
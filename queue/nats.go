@@ -3,6 +3,7 @@ package queue
 import (
 	"fmt"
 	"math"
+	"sync"
 	"time"
 
 	nats "github.com/nats-io/go-nats"
@@ -13,22 +14,50 @@ import (
 // for creating channels to send and receive.
 type NATS struct {
 	conn *nats.Conn
+
+	// done is closed once the connection is closed for good.
+	done chan struct{}
+
+	mu   sync.Mutex
+	subs []chan Message
+
+	// delivering is held for reading while a message is handed to a
+	// subscriber, so that the subscriber channels aren't closed halfway.
+	// closed is only changed with both it and mu held.
+	delivering sync.RWMutex
+	closed     bool
 }
 
 // NewNATS establishes a connection to NATS.
-func NewNATS(url string) (NATS, error) {
-	conn, err := getNatsConn(url)
+func NewNATS(url string) (*NATS, error) {
+	done := make(chan struct{})
+	closed := nats.ClosedHandler(func(*nats.Conn) {
+		close(done)
+	})
+
+	// Slow consumers are reported asynchronously, and nowhere else.
+	errs := nats.ErrorHandler(func(_ *nats.Conn, sub *nats.Subscription, err error) {
+		logger := logger.WithField("error", err)
+		if sub != nil {
+			logger = logger.WithField("subject", sub.Subject)
+		}
+
+		logger.Error("error receiving messages")
+	})
+
+	conn, err := getNatsConn(url, closed, errs)
 	if err != nil {
-		return NATS{}, err
+		return nil, err
 	}
 
-	return NATS{
+	return &NATS{
 		conn: conn,
+		done: done,
 	}, nil
 }
 
-func getNatsConn(url string) (*nats.Conn, error) {
-	nc, err := nats.Connect(url)
+func getNatsConn(url string, opts ...nats.Option) (*nats.Conn, error) {
+	nc, err := nats.Connect(url, opts...)
 	if err != nil {
 		for i := 1; i <= 3; i++ {
 			timeout := time.Duration(math.Pow(2, float64(i))) * time.Second
@@ -38,7 +67,7 @@ func getNatsConn(url string) (*nats.Conn, error) {
 			}).Warnf("error connecting to nats, retrying after %v seconds", timeout)
 
 			time.Sleep(timeout)
-			nc, err = nats.Connect(url)
+			nc, err = nats.Connect(url, opts...)
 			if err == nil {
 				break
 			}
@@ -48,31 +77,116 @@ func getNatsConn(url string) (*nats.Conn, error) {
 	return nc, err
 }
 
-// Close shuts down the underlying NATS connection.
+// Close drains the underlying NATS connection, so that messages that
+// have already been published are sent and messages that have already
+// been received are delivered. It then closes every channel returned by
+// Subscribe.
 func (q *NATS) Close() {
-	q.conn.Close()
+	if err := q.conn.Drain(); err != nil {
+		logger.WithField("error", err).Debug("unable to drain connection, closing it")
+		q.conn.Close()
+	}
+	<-q.done
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.delivering.Lock()
+	defer q.delivering.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+
+	for _, sub := range q.subs {
+		close(sub)
+	}
 }
 
-// SenderOn returns a channel to send messages on the given subject.
-func (q *NATS) SenderOn(subj string) chan<- []byte {
-	logger := logger.WithField("subject", subj)
+// Ping returns an error unless the connection to NATS is up.
+func (q *NATS) Ping() error {
+	if !q.conn.IsConnected() {
+		return fmt.Errorf("not connected to NATS, connection is %v", natsStatus(q.conn.Status()))
+	}
 
-	logger.Debug("setting up queue sender")
+	return nil
+}
 
-	send := make(chan []byte)
-	go func(logger *logrus.Entry, send <-chan []byte, nc *nats.Conn, subj string) {
-		for msg := range send {
-			logger.Debugf("sending data: %s", msg)
+func natsStatus(status nats.Status) string {
+	switch status {
+	case nats.DISCONNECTED:
+		return "disconnected"
+	case nats.CLOSED:
+		return "closed"
+	case nats.RECONNECTING:
+		return "reconnecting"
+	case nats.CONNECTING:
+		return "connecting"
+	case nats.DRAINING_SUBS, nats.DRAINING_PUBS:
+		return "draining"
+	}
 
-			err := nc.Publish(subj, msg)
-			if err != nil {
-				logger.WithError(err).WithField("message", fmt.Sprintf("%s", msg)).
-					Error("unable to send message")
-			}
+	return "connected"
+}
+
+// Publish sends `msg` on the given subject.
+func (q *NATS) Publish(subj string, msg []byte) error {
+	logger.WithField("subject", subj).Debugf("sending data: %s", msg)
+
+	return q.conn.Publish(subj, msg)
+}
+
+// Subscribe returns a channel receiving messages published on `subj`.
+func (q *NATS) Subscribe(subj string) (<-chan Message, error) {
+	return q.QueueSubscribe(subj, "")
+}
+
+// QueueSubscribe returns a channel receiving the messages published on
+// `subj` that NATS hands to it as a member of the queue group `group`.
+// An empty group receives every message.
+func (q *NATS) QueueSubscribe(subj, group string) (<-chan Message, error) {
+	logger := logger.WithFields(logrus.Fields{
+		"subject": subj,
+		"group":   group,
+	})
+
+	logger.Debug("setting up queue receiver")
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, ErrClosed
+	}
+
+	// Messages are build triggers and the like, so rather than dropping
+	// them when the receiver falls behind, this waits for it and leaves
+	// NATS to hold on to the rest. It only gives up once the connection
+	// is closed for good.
+	recv := make(chan Message, subscriberBuffer)
+	_, err := q.conn.QueueSubscribe(subj, group, func(m *nats.Msg) {
+		q.delivering.RLock()
+		defer q.delivering.RUnlock()
+
+		if q.closed {
+			return
+		}
+
+		select {
+		case recv <- Message{Subject: m.Subject, Data: m.Data}:
+		case <-q.done:
+			logger.Warn("connection closed, dropping message")
 		}
-	}(logger, send, q.conn, subj)
+	})
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to subscribe")
+		return nil, err
+	}
+
+	q.subs = append(q.subs, recv)
 
-	logger.Debug("queue sender initialized successfully")
+	logger.Debug("queue receiver initialized successfully")
 
-	return send
+	return recv, nil
 }
@@ -7,3 +7,57 @@ var logger *logrus.Entry
 func init() {
 	logger = logrus.WithField("package", "queue")
 }
+
+// Subjects the server publishes and subscribes on.
+const (
+	// SubjectPollers is where messages telling pollers which repos to
+	// watch go.
+	SubjectPollers = "pollers"
+
+	// SubjectTriggers is where build triggers go.
+	SubjectTriggers = "triggers"
+
+	// SubjectJobs is where runs that are ready to be picked up by agents
+	// are announced.
+	SubjectJobs = "jobs"
+
+	// SubjectAgentRegister and SubjectAgentHeartbeat are where agents
+	// that talk to the server over the queue register and send their
+	// heartbeats.
+	SubjectAgentRegister  = "agents.register"
+	SubjectAgentHeartbeat = "agents.heartbeat"
+
+	// SubjectLogs is where agents publish the output of runs, on a
+	// subject of its own for each run under this one.
+	SubjectLogs = "logs"
+)
+
+// Message is a single message received from a Bus.
+type Message struct {
+	Subject string
+	Data    []byte
+}
+
+// Bus is anything that can carry messages between the server and the
+// rest of the system.
+type Bus interface {
+	// Publish sends `msg` on the given subject. It doesn't wait for
+	// anyone to receive it.
+	Publish(subj string, msg []byte) error
+
+	// Subscribe returns a channel receiving every message published on
+	// the given subject from now on. The channel is closed when the
+	// Bus is closed.
+	Subscribe(subj string) (<-chan Message, error)
+
+	// QueueSubscribe is like Subscribe, except that each message is only
+	// delivered to one of the subscribers in `group`. This lets several
+	// servers split the work coming in on a subject.
+	QueueSubscribe(subj, group string) (<-chan Message, error)
+
+	// Ping returns an error if the Bus can't currently deliver messages.
+	Ping() error
+
+	// Close shuts the Bus down after flushing whatever is in flight.
+	Close()
+}
@@ -0,0 +1,181 @@
+// Package remote parses git remotes and reduces them to a canonical form,
+// so that different spellings of the same repository can be recognized.
+package remote
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Error is returned when a remote can't be parsed.
+type Error struct {
+	Remote string
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("invalid remote %q: %v", e.Remote, e.Reason)
+}
+
+// Remote is a parsed git remote.
+type Remote struct {
+	// Scheme is one of "https", "http", "ssh", "git" or "file". Scp-style
+	// remotes like git@github.com:x/y.git are ssh remotes.
+	Scheme string
+	User   string
+
+	// Host is lower case and includes the port, unless it's the default
+	// one for the scheme.
+	Host string
+
+	// Path is the repository path on the host, without the leading slash,
+	// trailing slash or ".git" suffix. For file remotes it's the cleaned
+	// absolute path instead.
+	Path string
+}
+
+// defaultPorts are left out of the host, so that spelling them out doesn't
+// make a different remote.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ssh":   "22",
+	"git":   "9418",
+}
+
+// transport matches the <transport>:: prefix git uses to hand a remote to
+// a remote helper, like ext::, which runs arbitrary commands, or fd::.
+var transport = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9+.-]*::`)
+
+// Parse parses `raw`, which can be an https, http, ssh, git or file URL,
+// an scp-style remote like git@github.com:x/y.git, or an absolute path.
+// Remotes handed to git remote helpers, like ext::command, are refused.
+func Parse(raw string) (Remote, error) {
+	raw = strings.TrimSpace(raw)
+
+	switch {
+	case raw == "":
+		return Remote{}, &Error{raw, "remote is empty"}
+	case transport.MatchString(raw):
+		return Remote{}, &Error{raw, "remote helpers (transport::address) aren't allowed"}
+	case strings.Contains(raw, "://"):
+		return parseURL(raw)
+	case strings.HasPrefix(raw, "/"):
+		return parseURL("file://" + raw)
+	}
+
+	// Git treats anything with a colon before the first slash as scp
+	// syntax, so this does too.
+	colon := strings.Index(raw, ":")
+	if colon < 0 || strings.Contains(raw[:colon], "/") {
+		return Remote{}, &Error{raw, "need a URL (https://, ssh://, git://, file://) or user@host:path"}
+	}
+
+	user, host := "", raw[:colon]
+	if at := strings.LastIndex(host, "@"); at >= 0 {
+		user, host = host[:at], host[at+1:]
+	}
+
+	if host == "" {
+		return Remote{}, &Error{raw, "missing host"}
+	}
+
+	return network(raw, "ssh", user, host, raw[colon+1:])
+}
+
+func parseURL(raw string) (Remote, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return Remote{}, &Error{raw, "malformed URL"}
+	}
+
+	if u.RawQuery != "" || u.Fragment != "" {
+		return Remote{}, &Error{raw, "query strings and fragments aren't allowed"}
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	switch scheme {
+	case "git+ssh", "ssh+git":
+		scheme = "ssh"
+	case "https", "http", "ssh", "git":
+	case "file":
+		if u.Host != "" && u.Host != "localhost" {
+			return Remote{}, &Error{raw, "file remotes can't have a host"}
+		}
+
+		if u.Path == "" || u.Path == "/" {
+			return Remote{}, &Error{raw, "missing path"}
+		}
+
+		return Remote{Scheme: "file", Path: path.Clean(u.Path)}, nil
+	default:
+		return Remote{}, &Error{raw, fmt.Sprintf("unsupported scheme %q", u.Scheme)}
+	}
+
+	host := u.Hostname()
+	if host == "" {
+		return Remote{}, &Error{raw, "missing host"}
+	}
+
+	if port := u.Port(); port != "" && port != defaultPorts[scheme] {
+		host += ":" + port
+	}
+
+	return network(raw, scheme, u.User.Username(), host, u.Path)
+}
+
+// network builds a remote for a repository on another host.
+func network(raw, scheme, user, host, repoPath string) (Remote, error) {
+	if strings.IndexFunc(user+host, invalidHostRune) >= 0 {
+		return Remote{}, &Error{raw, "host can't contain spaces or control characters"}
+	}
+
+	// Git hands the host to ssh, which would read a leading dash as an
+	// option.
+	if strings.HasPrefix(user+host, "-") {
+		return Remote{}, &Error{raw, "host can't start with a dash"}
+	}
+
+	repoPath = strings.Trim(path.Clean("/"+repoPath), "/")
+	repoPath = strings.TrimSuffix(repoPath, ".git")
+
+	if repoPath == "" {
+		return Remote{}, &Error{raw, "missing repository path"}
+	}
+
+	return Remote{
+		Scheme: scheme,
+		User:   user,
+		Host:   strings.ToLower(host),
+		Path:   repoPath,
+	}, nil
+}
+
+func invalidHostRune(r rune) bool {
+	return unicode.IsSpace(r) || unicode.IsControl(r)
+}
+
+// Canonical returns the form of the remote that's the same for every way
+// of spelling it. The scheme and user are left out, since the same
+// repository is usually reachable over both https and ssh.
+func (r Remote) Canonical() string {
+	if r.Scheme == "file" {
+		return "file://" + r.Path
+	}
+
+	return r.Host + "/" + r.Path
+}
+
+// Canonical parses `raw` and returns its canonical form.
+func Canonical(raw string) (string, error) {
+	r, err := Parse(raw)
+	if err != nil {
+		return "", err
+	}
+
+	return r.Canonical(), nil
+}
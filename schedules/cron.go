@@ -0,0 +1,245 @@
+package schedules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// Schedules can be in any timezone, and the server may well be
+	// running somewhere without a timezone database.
+	_ "time/tzdata"
+)
+
+// maxYears is how far ahead Next looks before giving up. Leap days are the
+// rarest thing a schedule can match, so this is plenty.
+const maxYears = 8
+
+// macros are the shorthands Parse accepts for common schedules.
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// field describes one of the five fields of a cron expression.
+type field struct {
+	name     string
+	min, max int
+
+	// names are accepted in place of the numbers from min up.
+	names []string
+}
+
+var fields = []field{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, monthNames},
+	// Both 0 and 7 are Sunday.
+	{"day of week", 0, 7, dayNames},
+}
+
+// Spec is a parsed cron expression along with the timezone it's in.
+type Spec struct {
+	minute, hour, dom, month, dow uint64
+
+	// Days match if either the day of the month or the day of the week
+	// does, unless one of them is `*`, in which case only the other one
+	// counts.
+	domStar, dowStar bool
+
+	loc *time.Location
+}
+
+// Parse parses a standard five field cron expression, or one of the
+// @yearly, @monthly, @weekly, @daily or @hourly shorthands, in the IANA
+// timezone `tz`. An empty timezone is UTC.
+func Parse(expr, tz string) (*Spec, error) {
+	if tz == "" {
+		tz = "UTC"
+	}
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", tz)
+	}
+
+	expr = strings.TrimSpace(expr)
+	if macro, ok := macros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("expected %v fields, got %v", len(fields), len(parts))
+	}
+
+	bits := make([]uint64, len(fields))
+	for i, part := range parts {
+		if bits[i], err = parseField(part, fields[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	spec := &Spec{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: strings.HasPrefix(parts[2], "*"),
+		dowStar: strings.HasPrefix(parts[4], "*"),
+		loc:     loc,
+	}
+
+	// Sunday is 0 as far as time.Weekday is concerned.
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+
+	return spec, nil
+}
+
+// parseField parses a comma separated list of values, ranges and steps
+// like `1,5-10,*/15` into a set of bits, one for every value it matches.
+func parseField(expr string, f field) (uint64, error) {
+	var bits uint64
+
+	for _, item := range strings.Split(expr, ",") {
+		rng, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			rng = item[:i]
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q in %v", item[i+1:], f.name)
+			}
+		}
+
+		lo, hi := f.min, f.max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			i := strings.Index(rng, "-")
+
+			var err error
+			if lo, err = parseValue(rng[:i], f); err != nil {
+				return 0, err
+			}
+			if hi, err = parseValue(rng[i+1:], f); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range %q in %v", rng, f.name)
+			}
+		default:
+			var err error
+			if lo, err = parseValue(rng, f); err != nil {
+				return 0, err
+			}
+
+			// A single value with a step, like `5/15`, runs to the end
+			// of the field.
+			hi = lo
+			if step > 1 {
+				hi = f.max
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+func parseValue(s string, f field) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(s, name) {
+			return f.min + i, nil
+		}
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %v %q", f.name, s)
+	}
+
+	return v, nil
+}
+
+// Next returns the first time after `after` the spec matches, in the
+// spec's timezone. It returns the zero time if the spec never matches,
+// like it would for the 30th of February.
+//
+// Times are matched against the wall clock, so a time skipped when
+// daylight saving starts doesn't match at all that day, and a time that
+// happens twice when it ends only matches the first time around.
+func (s *Spec) Next(after time.Time) time.Time {
+	after = after.In(s.loc)
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(maxYears, 0, 0)
+
+	for t.Before(end) {
+		switch {
+		case !has(s.month, int(t.Month())):
+			t = step(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.loc))
+		case !s.dayMatches(t):
+			t = step(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.loc))
+		case !has(s.hour, t.Hour()):
+			t = step(t, time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, s.loc))
+		case !has(s.minute, t.Minute()) || !wall(t).After(wall(after)):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+func (s *Spec) dayMatches(t time.Time) bool {
+	dom := has(s.dom, t.Day())
+	dow := has(s.dow, int(t.Weekday()))
+
+	switch {
+	case s.domStar:
+		return dow
+	case s.dowStar:
+		return dom
+	}
+
+	return dom || dow
+}
+
+func has(bits uint64, v int) bool {
+	return bits&(1<<uint(v)) != 0
+}
+
+// step returns `next`, or the minute after `t` if `next` isn't after it.
+// That happens when `next` is a wall clock time daylight saving skips.
+func step(t, next time.Time) time.Time {
+	if next.After(t) {
+		return next
+	}
+
+	return t.Add(time.Minute)
+}
+
+// wall returns the wall clock time of `t` to the minute, without its
+// timezone, so times can be compared the way a clock on the wall would.
+func wall(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
@@ -0,0 +1,89 @@
+package schedules
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		expr, tz string
+	}{
+		{"* * * *", ""},
+		{"* * * * * *", ""},
+		{"60 * * * *", ""},
+		{"* 24 * * *", ""},
+		{"* * 0 * *", ""},
+		{"* * * 13 *", ""},
+		{"* * * * 8", ""},
+		{"5-1 * * * *", ""},
+		{"*/0 * * * *", ""},
+		{"1,,2 * * * *", ""},
+		{"* * * foo *", ""},
+		{"@sometimes", ""},
+		{"* * * * *", "Mars/Olympus_Mons"},
+	}
+
+	for _, test := range tests {
+		if _, err := Parse(test.expr, test.tz); err == nil {
+			t.Fatalf("expected error parsing %q in %q", test.expr, test.tz)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		expr, tz    string
+		after, want string
+	}{
+		{"* * * * *", "", "2021-03-04T10:15:30Z", "2021-03-04T10:16:00Z"},
+		{"*/15 * * * *", "", "2021-03-04T10:15:00Z", "2021-03-04T10:30:00Z"},
+		{"5/20 * * * *", "", "2021-03-04T10:26:00Z", "2021-03-04T10:45:00Z"},
+		{"0 2 * * *", "", "2021-03-04T10:15:00Z", "2021-03-05T02:00:00Z"},
+		{"@daily", "", "2021-12-31T23:59:00Z", "2022-01-01T00:00:00Z"},
+		{"30 9 * * mon-fri", "", "2021-03-05T10:00:00Z", "2021-03-08T09:30:00Z"},
+		{"0 0 * * 7", "", "2021-03-04T10:00:00Z", "2021-03-07T00:00:00Z"},
+		{"0 0 1 jan,jul *", "", "2021-03-04T10:00:00Z", "2021-07-01T00:00:00Z"},
+		{"0 0 29 2 *", "", "2021-03-04T10:00:00Z", "2024-02-29T00:00:00Z"},
+
+		// With both days restricted, either one will do.
+		{"0 0 13 * fri", "", "2021-03-04T10:00:00Z", "2021-03-05T00:00:00Z"},
+		{"0 0 13 * fri", "", "2021-03-12T10:00:00Z", "2021-03-13T00:00:00Z"},
+
+		{"0 2 * * *", "America/New_York", "2021-01-10T12:00:00Z", "2021-01-11T07:00:00Z"},
+		{"0 2 * * *", "Asia/Kolkata", "2021-01-10T12:00:00Z", "2021-01-10T20:30:00Z"},
+
+		// 2:30 doesn't happen in New York on the 14th of March 2021, and
+		// 1:30 happens twice on the 7th of November.
+		{"30 2 * * *", "America/New_York", "2021-03-13T12:00:00Z", "2021-03-15T06:30:00Z"},
+		{"30 1 * * *", "America/New_York", "2021-11-07T04:00:00Z", "2021-11-07T05:30:00Z"},
+		{"30 1 * * *", "America/New_York", "2021-11-07T05:30:00Z", "2021-11-08T06:30:00Z"},
+		{"0 * * * *", "America/New_York", "2021-11-07T05:00:00Z", "2021-11-07T07:00:00Z"},
+	}
+
+	for _, test := range tests {
+		spec, err := Parse(test.expr, test.tz)
+		if err != nil {
+			t.Fatalf("got error parsing %q: %v", test.expr, err)
+		}
+
+		after, _ := time.Parse(time.RFC3339, test.after)
+		want, _ := time.Parse(time.RFC3339, test.want)
+
+		got := spec.Next(after)
+		if !got.Equal(want) {
+			t.Fatalf("expected %q in %q after %v to be %v, got %v", test.expr, test.tz, after, want, got.UTC())
+		}
+	}
+}
+
+func TestNextNever(t *testing.T) {
+	spec, err := Parse("0 0 30 2 *", "")
+	if err != nil {
+		t.Fatalf("got error parsing: %v", err)
+	}
+
+	if next := spec.Next(time.Now()); !next.IsZero() {
+		t.Fatalf("expected the 30th of February never to come, got %v", next)
+	}
+}
@@ -0,0 +1,207 @@
+// Package schedules starts runs on cron schedules. Each schedule runs a
+// task of a project on one of its branches, whether or not anything has
+// changed.
+//
+// Schedules are fired by moving them on to their next firing in the
+// store, which only works for the first server to try, so a schedule is
+// fired once however many servers are running. Firings missed while no
+// server was running are made up for with a single run.
+package schedules
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/run-ci/run-server/agents"
+	"github.com/run-ci/run-server/metrics"
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/store"
+	"github.com/run-ci/run-server/tasks"
+	"github.com/sirupsen/logrus"
+)
+
+var logger *logrus.Entry
+
+var fired = metrics.NewCounterVec("run_schedule_firings_total",
+	"Schedules fired, by whether they started a run.",
+	"result")
+
+func init() {
+	logger = logrus.WithField("package", "schedules")
+}
+
+// Trigger is the trigger of runs started by schedules.
+const Trigger = "schedule"
+
+// Scheduler fires schedules once they're due.
+type Scheduler struct {
+	st      store.Repo
+	bus     queue.Bus
+	fetcher tasks.Fetcher
+
+	// Interval is how often schedules are checked. Schedules only go down
+	// to the minute, so anything under one is plenty.
+	Interval time.Duration
+}
+
+// NewScheduler returns a Scheduler firing the schedules in `st`, reading
+// task files with `fetcher` and announcing runs on `bus`.
+func NewScheduler(st store.Repo, bus queue.Bus, fetcher tasks.Fetcher) *Scheduler {
+	return &Scheduler{
+		st:      st,
+		bus:     bus,
+		fetcher: fetcher,
+
+		Interval: 10 * time.Second,
+	}
+}
+
+// Run fires due schedules every Interval until `ctx` is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	logger.Info("starting scheduler")
+
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.Fire(); err != nil {
+			logger.WithField("error", err).Error("unable to fire schedules")
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Info("stopping scheduler")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Fire fires every schedule that's due and returns the runs it started.
+// Schedules fired by someone else in the meantime are skipped. A schedule
+// whose run can't be started is still moved on to its next firing, so
+// that one broken task file doesn't have it firing over and over.
+func (s *Scheduler) Fire() ([]store.Run, error) {
+	now := time.Now()
+
+	scheds, err := s.st.GetDueSchedules(now)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := []store.Run{}
+	for _, sched := range scheds {
+		logger := logger.WithFields(logrus.Fields{
+			"schedule_id": sched.ID,
+			"project_id":  sched.ProjectID,
+		})
+
+		// Moving the schedule on is what makes it ours to fire, so it
+		// happens before anything else. Invalid expressions can't have
+		// made it past the API, but they'd stop firing if they did.
+		var next time.Time
+		spec, err := Parse(sched.Cron, sched.Timezone)
+		if err != nil {
+			logger.WithField("error", err).Error("invalid schedule, it won't fire again")
+		} else {
+			next = spec.Next(now)
+		}
+
+		_, err = s.st.FireSchedule(sched.ID, sched.NextFireAt, next)
+		if err == store.ErrConflict || err == store.ErrNotFound {
+			logger.Debug("schedule already fired or changed, skipping")
+			continue
+		}
+		if err != nil {
+			return runs, err
+		}
+
+		run, err := s.start(sched)
+		if err != nil {
+			logger.WithField("error", err).Error("unable to start scheduled run")
+			fired.Inc("failed")
+			continue
+		}
+		if run.ID == 0 {
+			fired.Inc("skipped")
+			continue
+		}
+
+		logger.WithField("run_id", run.ID).Info("queued scheduled run")
+		fired.Inc("started")
+		runs = append(runs, run)
+	}
+
+	return runs, nil
+}
+
+// start starts the run for a firing of `sched`. It returns an empty run
+// if the schedule's project is disabled.
+func (s *Scheduler) start(sched store.Schedule) (store.Run, error) {
+	p, err := s.st.GetProject(sched.ProjectID)
+	if err != nil {
+		return store.Run{}, err
+	}
+
+	logger := logger.WithFields(logrus.Fields{
+		"schedule_id": sched.ID,
+		"remote":      p.Remote,
+	})
+
+	if !p.Enabled {
+		logger.Info("project is disabled, skipping scheduled run")
+		return store.Run{}, nil
+	}
+
+	branch := sched.Branch
+	if branch == "" {
+		branch = p.DefaultBranch
+	}
+
+	file := path.Join(p.ConfigPath, sched.Task+tasks.Ext)
+
+	logger.Debugf("fetching %v", file)
+	buf, commit, err := s.fetcher.Fetch(p.CloneURL(), branch, file)
+	if err != nil {
+		return store.Run{}, fmt.Errorf("fetching %v at %v: %v", file, branch, err)
+	}
+
+	task, err := tasks.Parse(sched.Task, buf)
+	if err != nil {
+		return store.Run{}, fmt.Errorf("invalid task file %v: %v", file, err)
+	}
+
+	args, err := task.Resolve(sched.Args)
+	if err != nil {
+		return store.Run{}, err
+	}
+
+	run, err := s.st.CreateRun(store.Run{
+		Remote:  p.Remote,
+		Branch:  branch,
+		Commit:  commit,
+		Trigger: Trigger,
+		Task:    task.Name,
+		Args:    args,
+		Labels:  sched.Labels,
+		Timeout: task.Timeout,
+	})
+	if err != nil {
+		return run, err
+	}
+
+	// The run is queued whether or not agents hear about it, like runs
+	// started by hand are.
+	rawmsg, err := json.Marshal(agents.NewJob(s.st, run))
+	if err == nil {
+		err = s.bus.Publish(queue.SubjectJobs, rawmsg)
+	}
+	if err != nil {
+		logger.WithField("error", err).Warn("unable to announce scheduled run")
+	}
+
+	return run, nil
+}
@@ -0,0 +1,180 @@
+package schedules
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/run-ci/run-server/agents"
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/store"
+	"github.com/run-ci/run-server/tasks"
+)
+
+// fakeFetcher serves task files from memory, keyed by their path.
+type fakeFetcher map[string]string
+
+const fakeCommit = "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c"
+
+func (f fakeFetcher) Fetch(url, ref, file string) ([]byte, string, error) {
+	content, ok := f[file]
+	if !ok {
+		return nil, "", tasks.ErrNoTask
+	}
+
+	return []byte(content), fakeCommit, nil
+}
+
+var fetcher = fakeFetcher{
+	"ci/nightly.yaml": `
+image: golang:1.16
+command: go test ./...
+timeout: 2h
+arguments:
+  SUITE:
+    default: short
+`,
+}
+
+func newScheduler(t *testing.T, enabled bool, sched store.Schedule) (*Scheduler, *store.Memory, *queue.Memory, store.Schedule) {
+	st := store.NewMemory()
+	bus := queue.NewMemory()
+
+	p, err := st.CreateProject(store.Project{
+		Name:          "run",
+		Remote:        "example.com/run",
+		URL:           "https://example.com/run.git",
+		DefaultBranch: "master",
+		Branches:      []string{"master"},
+		ConfigPath:    "ci",
+		Enabled:       enabled,
+	})
+	if err != nil {
+		t.Fatalf("got error creating project: %v", err)
+	}
+
+	sched.ProjectID = p.ID
+	sched, err = st.CreateSchedule(sched)
+	if err != nil {
+		t.Fatalf("got error creating schedule: %v", err)
+	}
+
+	return NewScheduler(st, bus, fetcher), st, bus, sched
+}
+
+func TestFire(t *testing.T) {
+	due := time.Now().Add(-time.Minute).Truncate(time.Minute)
+	s, st, bus, sched := newScheduler(t, true, store.Schedule{
+		Cron:       "*/5 * * * *",
+		Task:       "nightly",
+		Args:       map[string]string{"SUITE": "full"},
+		Labels:     []string{"os=linux"},
+		Enabled:    true,
+		NextFireAt: due,
+	})
+
+	jobs, err := bus.Subscribe(queue.SubjectJobs)
+	if err != nil {
+		t.Fatalf("got error subscribing: %v", err)
+	}
+
+	// Another server firing the same schedules doesn't fire them again.
+	other := NewScheduler(st, bus, fetcher)
+
+	runs, err := s.Fire()
+	if err != nil {
+		t.Fatalf("got error firing schedules: %v", err)
+	}
+
+	if again, err := other.Fire(); err != nil || len(again) != 0 {
+		t.Fatalf("expected schedule to fire once, got %+v, %v", again, err)
+	}
+
+	if len(runs) != 1 {
+		t.Fatalf("expected 1 run, got %+v", runs)
+	}
+
+	run := runs[0]
+	if run.Remote != "example.com/run" || run.Branch != "master" || run.Commit != fakeCommit ||
+		run.Trigger != Trigger || run.Task != "nightly" || run.Timeout != 2*time.Hour {
+		t.Fatalf("expected nightly run of master, got %+v", run)
+	}
+
+	if run.Args["SUITE"] != "full" || len(run.Labels) != 1 {
+		t.Fatalf("expected schedule's arguments and labels, got %+v", run)
+	}
+
+	job := agents.Job{}
+	if err := json.Unmarshal((<-jobs).Data, &job); err != nil {
+		t.Fatalf("got error unmarshalling job: %v", err)
+	}
+
+	if job.RunID != run.ID || job.Remote != "https://example.com/run.git" || job.Task != sched.Task {
+		t.Fatalf("expected job for run %v, got %+v", run.ID, job)
+	}
+
+	got, err := st.GetSchedule(sched.ID)
+	if err != nil {
+		t.Fatalf("got error getting schedule: %v", err)
+	}
+
+	if !got.LastFiredAt.Equal(due) {
+		t.Fatalf("expected schedule last fired at %v, got %v", due, got.LastFiredAt)
+	}
+
+	if !got.NextFireAt.After(time.Now()) || got.NextFireAt.Minute()%5 != 0 {
+		t.Fatalf("expected schedule to fire next on the next 5 minutes, got %v", got.NextFireAt)
+	}
+}
+
+func TestFireNotDue(t *testing.T) {
+	s, _, _, _ := newScheduler(t, true, store.Schedule{
+		Cron:       "@daily",
+		Task:       "nightly",
+		Enabled:    true,
+		NextFireAt: time.Now().Add(time.Hour),
+	})
+
+	if runs, err := s.Fire(); err != nil || len(runs) != 0 {
+		t.Fatalf("expected nothing to fire, got %+v, %v", runs, err)
+	}
+}
+
+func TestFireWithoutRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		task    string
+	}{
+		{"disabled project", false, "nightly"},
+		{"missing task", true, "weekly"},
+	}
+
+	for _, test := range tests {
+		s, st, _, sched := newScheduler(t, test.enabled, store.Schedule{
+			Cron:       "@hourly",
+			Task:       test.task,
+			Enabled:    true,
+			NextFireAt: time.Now().Add(-time.Minute),
+		})
+
+		runs, err := s.Fire()
+		if err != nil {
+			t.Fatalf("%v: got error firing schedules: %v", test.name, err)
+		}
+
+		if len(runs) != 0 {
+			t.Fatalf("%v: expected no runs, got %+v", test.name, runs)
+		}
+
+		// The schedule still moves on, so it isn't fired over and over.
+		got, err := st.GetSchedule(sched.ID)
+		if err != nil {
+			t.Fatalf("%v: got error getting schedule: %v", test.name, err)
+		}
+
+		if !got.NextFireAt.After(time.Now()) {
+			t.Fatalf("%v: expected schedule to move on, got %v", test.name, got.NextFireAt)
+		}
+	}
+}
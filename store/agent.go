@@ -0,0 +1,64 @@
+package store
+
+import "time"
+
+// AgentState is what an agent is up to, as far as the server can tell.
+type AgentState string
+
+// States an Agent can be in.
+const (
+	AgentIdle AgentState = "idle"
+	AgentBusy AgentState = "busy"
+
+	// AgentLost agents haven't sent a heartbeat in too long. Whatever
+	// they were running is requeued once its lease runs out.
+	AgentLost AgentState = "lost"
+)
+
+// Agent is something that runs builds. Agents pick their own IDs, so they
+// keep them across restarts.
+type Agent struct {
+	ID   string
+	Name string
+
+	// Labels describe the agent, like its OS, its architecture and what
+	// it's capable of, for example "os=linux" or "docker". Runs are only
+	// leased to agents that have all the labels they ask for.
+	Labels []string
+
+	RegisteredAt  time.Time
+	LastHeartbeat time.Time
+
+	// RunID is the run the agent holds the lease of, if any.
+	RunID int
+}
+
+// State returns the agent's state at `now`, where agents that haven't
+// sent a heartbeat within `timeout` are lost.
+func (a Agent) State(now time.Time, timeout time.Duration) AgentState {
+	if now.Sub(a.LastHeartbeat) > timeout {
+		return AgentLost
+	}
+
+	if a.RunID != 0 {
+		return AgentBusy
+	}
+
+	return AgentIdle
+}
+
+// HasLabels returns whether the agent has every one of `labels`.
+func (a Agent) HasLabels(labels []string) bool {
+	have := map[string]bool{}
+	for _, label := range a.Labels {
+		have[label] = true
+	}
+
+	for _, label := range labels {
+		if !have[label] {
+			return false
+		}
+	}
+
+	return true
+}
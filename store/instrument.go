@@ -0,0 +1,258 @@
+package store
+
+import (
+	"time"
+
+	"github.com/run-ci/run-server/metrics"
+)
+
+var (
+	callDuration = metrics.NewHistogramVec("run_store_call_duration_seconds",
+		"How long calls to the store took.", metrics.DefaultBuckets, "method")
+
+	callErrors = metrics.NewCounterVec("run_store_errors_total",
+		"Calls to the store that returned an error, by kind of error.", "method", "error")
+)
+
+// instrumented is a Repo that records metrics about every call it passes
+// on to the Repo it wraps.
+type instrumented struct {
+	Repo
+}
+
+// Instrument wraps `st` so that the latency and errors of every call to it
+// show up in metrics.
+func Instrument(st Repo) Repo {
+	return &instrumented{
+		Repo: st,
+	}
+}
+
+// observe records a call to `method` that started at `start` and ended
+// with `*err`. It's meant to be deferred, so it takes a pointer to the
+// error that will eventually be returned.
+func observe(method string, start time.Time, err *error) {
+	callDuration.Observe(time.Since(start).Seconds(), method)
+
+	if *err != nil {
+		callErrors.Inc(method, errorKind(*err))
+	}
+}
+
+func errorKind(err error) string {
+	switch err {
+	case ErrNotFound:
+		return "not_found"
+	case ErrConflict:
+		return "conflict"
+	case ErrIllegalTransition:
+		return "illegal_transition"
+	}
+
+	return "other"
+}
+
+func (i *instrumented) CreateGitRepo(repo GitRepo, msgs ...MessageFunc) (err error) {
+	defer observe("CreateGitRepo", time.Now(), &err)
+	return i.Repo.CreateGitRepo(repo, msgs...)
+}
+
+func (i *instrumented) GetGitRepo(remote, branch string) (repo GitRepo, err error) {
+	defer observe("GetGitRepo", time.Now(), &err)
+	return i.Repo.GetGitRepo(remote, branch)
+}
+
+func (i *instrumented) GetGitRepos() (repos []GitRepo, err error) {
+	defer observe("GetGitRepos", time.Now(), &err)
+	return i.Repo.GetGitRepos()
+}
+
+func (i *instrumented) QueryGitRepos(q GitRepoQuery) (repos []GitRepo, err error) {
+	defer observe("QueryGitRepos", time.Now(), &err)
+	return i.Repo.QueryGitRepos(q)
+}
+
+func (i *instrumented) UpdateGitRepo(remote, branch string, repo GitRepo, msgs ...MessageFunc) (err error) {
+	defer observe("UpdateGitRepo", time.Now(), &err)
+	return i.Repo.UpdateGitRepo(remote, branch, repo, msgs...)
+}
+
+func (i *instrumented) DeleteGitRepo(remote, branch string, msgs ...MessageFunc) (err error) {
+	defer observe("DeleteGitRepo", time.Now(), &err)
+	return i.Repo.DeleteGitRepo(remote, branch, msgs...)
+}
+
+func (i *instrumented) CreateProject(p Project, msgs ...MessageFunc) (_ Project, err error) {
+	defer observe("CreateProject", time.Now(), &err)
+	return i.Repo.CreateProject(p, msgs...)
+}
+
+func (i *instrumented) GetProject(id int) (p Project, err error) {
+	defer observe("GetProject", time.Now(), &err)
+	return i.Repo.GetProject(id)
+}
+
+func (i *instrumented) GetProjectByRemote(remote string) (p Project, err error) {
+	defer observe("GetProjectByRemote", time.Now(), &err)
+	return i.Repo.GetProjectByRemote(remote)
+}
+
+func (i *instrumented) GetProjects() (projects []Project, err error) {
+	defer observe("GetProjects", time.Now(), &err)
+	return i.Repo.GetProjects()
+}
+
+func (i *instrumented) UpdateProject(p Project, msgs ...MessageFunc) (_ Project, err error) {
+	defer observe("UpdateProject", time.Now(), &err)
+	return i.Repo.UpdateProject(p, msgs...)
+}
+
+func (i *instrumented) DeleteProject(id int, msgs ...MessageFunc) (err error) {
+	defer observe("DeleteProject", time.Now(), &err)
+	return i.Repo.DeleteProject(id, msgs...)
+}
+
+func (i *instrumented) CreateRun(run Run) (_ Run, err error) {
+	defer observe("CreateRun", time.Now(), &err)
+	return i.Repo.CreateRun(run)
+}
+
+func (i *instrumented) GetRun(id int) (run Run, err error) {
+	defer observe("GetRun", time.Now(), &err)
+	return i.Repo.GetRun(id)
+}
+
+func (i *instrumented) GetRuns(remote, branch string) (runs []Run, err error) {
+	defer observe("GetRuns", time.Now(), &err)
+	return i.Repo.GetRuns(remote, branch)
+}
+
+func (i *instrumented) UpdateRunStatus(id int, status RunStatus) (run Run, err error) {
+	defer observe("UpdateRunStatus", time.Now(), &err)
+	return i.Repo.UpdateRunStatus(id, status)
+}
+
+func (i *instrumented) CancelRun(id int) (run Run, err error) {
+	defer observe("CancelRun", time.Now(), &err)
+	return i.Repo.CancelRun(id)
+}
+
+func (i *instrumented) CreateStep(step Step) (_ Step, err error) {
+	defer observe("CreateStep", time.Now(), &err)
+	return i.Repo.CreateStep(step)
+}
+
+func (i *instrumented) RegisterAgent(agent Agent) (_ Agent, err error) {
+	defer observe("RegisterAgent", time.Now(), &err)
+	return i.Repo.RegisterAgent(agent)
+}
+
+func (i *instrumented) GetAgent(id string) (agent Agent, err error) {
+	defer observe("GetAgent", time.Now(), &err)
+	return i.Repo.GetAgent(id)
+}
+
+func (i *instrumented) GetAgents() (agents []Agent, err error) {
+	defer observe("GetAgents", time.Now(), &err)
+	return i.Repo.GetAgents()
+}
+
+func (i *instrumented) HeartbeatAgent(id string, lease time.Duration) (agent Agent, err error) {
+	defer observe("HeartbeatAgent", time.Now(), &err)
+	return i.Repo.HeartbeatAgent(id, lease)
+}
+
+func (i *instrumented) LeaseRun(agentID string, lease time.Duration) (run Run, err error) {
+	defer observe("LeaseRun", time.Now(), &err)
+	return i.Repo.LeaseRun(agentID, lease)
+}
+
+func (i *instrumented) ExpireLeases() (runs []Run, err error) {
+	defer observe("ExpireLeases", time.Now(), &err)
+	return i.Repo.ExpireLeases()
+}
+
+func (i *instrumented) TimeoutRuns(timeout, cancelTimeout time.Duration) (runs []Run, err error) {
+	defer observe("TimeoutRuns", time.Now(), &err)
+	return i.Repo.TimeoutRuns(timeout, cancelTimeout)
+}
+
+func (i *instrumented) UpdateStep(step Step) (err error) {
+	defer observe("UpdateStep", time.Now(), &err)
+	return i.Repo.UpdateStep(step)
+}
+
+func (i *instrumented) CreateSchedule(sched Schedule) (_ Schedule, err error) {
+	defer observe("CreateSchedule", time.Now(), &err)
+	return i.Repo.CreateSchedule(sched)
+}
+
+func (i *instrumented) GetSchedule(id int) (_ Schedule, err error) {
+	defer observe("GetSchedule", time.Now(), &err)
+	return i.Repo.GetSchedule(id)
+}
+
+func (i *instrumented) GetSchedules(projectID int) (_ []Schedule, err error) {
+	defer observe("GetSchedules", time.Now(), &err)
+	return i.Repo.GetSchedules(projectID)
+}
+
+func (i *instrumented) UpdateSchedule(sched Schedule) (_ Schedule, err error) {
+	defer observe("UpdateSchedule", time.Now(), &err)
+	return i.Repo.UpdateSchedule(sched)
+}
+
+func (i *instrumented) DeleteSchedule(id int) (err error) {
+	defer observe("DeleteSchedule", time.Now(), &err)
+	return i.Repo.DeleteSchedule(id)
+}
+
+func (i *instrumented) GetDueSchedules(now time.Time) (_ []Schedule, err error) {
+	defer observe("GetDueSchedules", time.Now(), &err)
+	return i.Repo.GetDueSchedules(now)
+}
+
+func (i *instrumented) FireSchedule(id int, at, next time.Time) (_ Schedule, err error) {
+	defer observe("FireSchedule", time.Now(), &err)
+	return i.Repo.FireSchedule(id, at, next)
+}
+
+func (i *instrumented) GetPendingMessages(limit int) (msgs []Message, err error) {
+	defer observe("GetPendingMessages", time.Now(), &err)
+	return i.Repo.GetPendingMessages(limit)
+}
+
+func (i *instrumented) CountPendingMessages() (n int, err error) {
+	defer observe("CountPendingMessages", time.Now(), &err)
+	return i.Repo.CountPendingMessages()
+}
+
+func (i *instrumented) MarkMessageDelivered(id int) (err error) {
+	defer observe("MarkMessageDelivered", time.Now(), &err)
+	return i.Repo.MarkMessageDelivered(id)
+}
+
+func (i *instrumented) MarkMessageFailed(id int, reason string, next time.Time) (err error) {
+	defer observe("MarkMessageFailed", time.Now(), &err)
+	return i.Repo.MarkMessageFailed(id, reason, next)
+}
+
+func (i *instrumented) CreateToken(token Token) (_ Token, err error) {
+	defer observe("CreateToken", time.Now(), &err)
+	return i.Repo.CreateToken(token)
+}
+
+func (i *instrumented) GetTokenByHash(hash string) (token Token, err error) {
+	defer observe("GetTokenByHash", time.Now(), &err)
+	return i.Repo.GetTokenByHash(hash)
+}
+
+func (i *instrumented) GetTokens() (tokens []Token, err error) {
+	defer observe("GetTokens", time.Now(), &err)
+	return i.Repo.GetTokens()
+}
+
+func (i *instrumented) DeleteToken(id int) (err error) {
+	defer observe("DeleteToken", time.Now(), &err)
+	return i.Repo.DeleteToken(id)
+}
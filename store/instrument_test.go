@@ -0,0 +1,25 @@
+package store
+
+import "testing"
+
+func TestInstrument(t *testing.T) {
+	st := Instrument(NewMemory())
+
+	before := callErrors.Value("GetGitRepo", "not_found")
+	if _, err := st.GetGitRepo("missing.git", "master"); err != ErrNotFound {
+		t.Fatalf("expected %v, got %v", ErrNotFound, err)
+	}
+
+	if got := callErrors.Value("GetGitRepo", "not_found"); got != before+1 {
+		t.Fatalf("expected not found errors to go from %v to %v, got %v", before, before+1, got)
+	}
+
+	count := callDuration.Count("GetGitRepos")
+	if _, err := st.GetGitRepos(); err != nil {
+		t.Fatalf("got error listing repos: %v", err)
+	}
+
+	if got := callDuration.Count("GetGitRepos"); got != count+1 {
+		t.Fatalf("expected GetGitRepos to be timed once more, got %v calls", got-count)
+	}
+}
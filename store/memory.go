@@ -0,0 +1,1259 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory is a Repo that keeps everything in memory. When it's created
+// with NewFile, every change is also written out to a single JSON file
+// so that it survives restarts.
+type Memory struct {
+	mu   sync.RWMutex
+	path string
+	data memData
+
+	// saved is what was last written to the file. Changes are made in
+	// memory first, so if writing them out fails the store goes back to
+	// this rather than getting ahead of the file.
+	saved []byte
+}
+
+// memData is everything a Memory holds. It's what gets written to disk
+// for file-backed stores.
+type memData struct {
+	Projects      []Project `json:"projects"`
+	NextProjectID int       `json:"next_project_id"`
+
+	// GitRepos is only read from files written before projects existed.
+	// They're turned into projects as soon as the file is loaded.
+	GitRepos []GitRepo `json:"git_repos,omitempty"`
+
+	Runs       []Run `json:"runs"`
+	NextStepID int   `json:"next_step_id"`
+
+	Outbox        []Message `json:"outbox"`
+	NextMessageID int       `json:"next_message_id"`
+
+	Tokens      []Token `json:"tokens"`
+	NextTokenID int     `json:"next_token_id"`
+
+	Agents []Agent `json:"agents"`
+
+	Schedules      []Schedule `json:"schedules"`
+	NextScheduleID int        `json:"next_schedule_id"`
+}
+
+// NewMemory returns an empty Repo that lives in memory only.
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// NewFile returns a Repo backed by the JSON file at `path`. The file is
+// created on the first write if it doesn't exist yet.
+func NewFile(path string) (*Memory, error) {
+	logger := logger.WithField("store", "file")
+	logger.Debugf("loading store from %v", path)
+
+	m := &Memory{
+		path: path,
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		logger.Debug("store file doesn't exist yet, starting empty")
+		return m, nil
+	}
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to read store file")
+		return nil, err
+	}
+
+	if err := json.Unmarshal(buf, &m.data); err != nil {
+		logger.WithField("error", err).Debug("unable to parse store file")
+		return nil, fmt.Errorf("parsing %v: %v", path, err)
+	}
+
+	for _, repo := range m.data.GitRepos {
+		if err := m.addGitRepo(repo); err != nil && err != ErrConflict {
+			return nil, err
+		}
+	}
+	m.data.GitRepos = nil
+
+	m.canonicalizeRemotes()
+
+	m.saved, err = json.Marshal(m.data)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// canonicalizeRemotes brings remotes saved before they were canonicalized
+// over to their canonical form, merging projects for the same remote as
+// mergeRemotes works out. Runs get canonical remotes too, so they can be
+// looked up by them.
+func (m *Memory) canonicalizeRemotes() {
+	merged := map[int]bool{}
+	for _, merge := range mergeRemotes(m.data.Projects) {
+		p := &m.data.Projects[m.findProjectByID(merge.ID)]
+		p.Remote = merge.Remote
+		p.URL = merge.URL
+
+		for _, id := range merge.Merged {
+			merged[id] = true
+			p.Branches = append(p.Branches, m.data.Projects[m.findProjectByID(id)].Branches...)
+
+			for i := range m.data.Schedules {
+				if m.data.Schedules[i].ProjectID == id {
+					m.data.Schedules[i].ProjectID = merge.ID
+				}
+			}
+		}
+		p.Branches = sortedBranches(p.Branches)
+	}
+
+	projects := m.data.Projects[:0]
+	for _, p := range m.data.Projects {
+		if !merged[p.ID] {
+			projects = append(projects, p)
+		}
+	}
+	m.data.Projects = projects
+
+	for i := range m.data.Runs {
+		m.data.Runs[i].Remote = canonicalRemote(m.data.Runs[i].Remote)
+	}
+}
+
+// save writes the store out to its file, if it has one. If that fails,
+// the change that was being saved is undone. It must be called with the
+// write lock held.
+func (m *Memory) save() error {
+	if m.path == "" {
+		return nil
+	}
+
+	buf, err := json.Marshal(m.data)
+	if err == nil {
+		err = m.write(buf)
+	}
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to save store, undoing change")
+		m.restore()
+		return err
+	}
+
+	m.saved = buf
+	return nil
+}
+
+// write replaces the store's file with `buf`.
+func (m *Memory) write(buf []byte) error {
+	// Writing to a temporary file and renaming it over the old one means
+	// a crash halfway through never leaves a truncated store behind.
+	tmp, err := ioutil.TempFile(filepath.Dir(m.path), filepath.Base(m.path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), m.path)
+}
+
+// restore puts the store back the way it was when it was last saved. It
+// must be called with the write lock held.
+func (m *Memory) restore() {
+	data := memData{}
+	if m.saved != nil {
+		// This was marshaled from memData, so it can't fail to unmarshal.
+		json.Unmarshal(m.saved, &data)
+	}
+
+	m.data = data
+}
+
+// Ping always succeeds, since there's nothing to reach.
+func (m *Memory) Ping() error {
+	return nil
+}
+
+// Close does nothing, since every change is saved as it's made.
+func (m *Memory) Close() error {
+	return nil
+}
+
+// findProject returns the index of the project with the given remote, or
+// -1 if there isn't one.
+func (m *Memory) findProject(remote string) int {
+	for i, p := range m.data.Projects {
+		if p.Remote == remote {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// findGitRepo returns the index of the project with the given remote, or
+// -1 if it doesn't track `branch`.
+func (m *Memory) findGitRepo(remote, branch string) int {
+	i := m.findProject(remote)
+	if i < 0 || !m.data.Projects[i].HasBranch(branch) {
+		return -1
+	}
+
+	return i
+}
+
+// addGitRepo starts tracking the repo's branch in the project for its
+// remote, creating the project if there isn't one yet. It must be called
+// with the write lock held.
+func (m *Memory) addGitRepo(repo GitRepo) error {
+	i := m.findProject(repo.Remote)
+	if i < 0 {
+		p := newGitRepoProject(repo)
+		m.data.NextProjectID++
+		p.ID = m.data.NextProjectID
+		p.CreatedAt = time.Now()
+
+		m.data.Projects = append(m.data.Projects, p)
+		return nil
+	}
+
+	p := &m.data.Projects[i]
+	if p.HasBranch(repo.Branch) {
+		return ErrConflict
+	}
+
+	p.Branches = sortedBranches(append(p.Branches, repo.Branch))
+	if repo.URL != "" {
+		p.URL = repo.URL
+	}
+
+	return nil
+}
+
+// removeGitRepo stops tracking the branch in the project at index `i`.
+// The project itself is left alone. It must be called with the write lock
+// held.
+func (m *Memory) removeGitRepo(i int, branch string) {
+	p := &m.data.Projects[i]
+
+	branches := []string{}
+	for _, b := range p.Branches {
+		if b != branch {
+			branches = append(branches, b)
+		}
+	}
+	p.Branches = branches
+}
+
+// gitRepos returns every tracked branch of every project as a git repo.
+func (m *Memory) gitRepos() []GitRepo {
+	repos := []GitRepo{}
+	for _, p := range m.data.Projects {
+		repos = append(repos, p.GitRepos()...)
+	}
+
+	return repos
+}
+
+// CreateGitRepo saves the Git repository, along with `msgs`.
+func (m *Memory) CreateGitRepo(repo GitRepo, msgs ...MessageFunc) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old := m.projectByRemote(repo.Remote)
+	if err := m.addGitRepo(repo); err != nil {
+		return err
+	}
+
+	m.addMessages(msgs, old, m.projectByRemote(repo.Remote))
+	return m.save()
+}
+
+// GetGitRepo returns the git repo with the given remote and branch.
+func (m *Memory) GetGitRepo(remote, branch string) (GitRepo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i := m.findGitRepo(remote, branch)
+	if i < 0 {
+		return GitRepo{}, ErrNotFound
+	}
+
+	p := m.data.Projects[i]
+	return GitRepo{Remote: p.Remote, Branch: branch, URL: p.URL}, nil
+}
+
+// GetGitRepos returns all repos, ordered by remote and branch.
+func (m *Memory) GetGitRepos() ([]GitRepo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	repos := m.gitRepos()
+
+	sort.Slice(repos, func(i, j int) bool {
+		return gitRepoLess(repos[i], repos[j])
+	})
+
+	return repos, nil
+}
+
+// QueryGitRepos returns the repos matching `q`, in the order it asks for.
+func (m *Memory) QueryGitRepos(q GitRepoQuery) ([]GitRepo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	match := q.matcher()
+
+	repos := []GitRepo{}
+	for _, repo := range m.gitRepos() {
+		if match(repo) {
+			repos = append(repos, repo)
+		}
+	}
+
+	sort.Slice(repos, func(i, j int) bool {
+		if q.Desc {
+			return gitRepoLess(repos[j], repos[i])
+		}
+
+		return gitRepoLess(repos[i], repos[j])
+	})
+
+	if q.Limit > 0 && len(repos) > q.Limit {
+		repos = repos[:q.Limit]
+	}
+
+	return repos, nil
+}
+
+// UpdateGitRepo replaces the git repo with the given remote and branch
+// with `repo`, and saves `msgs`.
+func (m *Memory) UpdateGitRepo(remote, branch string, repo GitRepo, msgs ...MessageFunc) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findGitRepo(remote, branch)
+	if i < 0 {
+		return ErrNotFound
+	}
+
+	if j := m.findGitRepo(repo.Remote, repo.Branch); j >= 0 && (j != i || repo.Branch != branch) {
+		return ErrConflict
+	}
+
+	old := m.projectByRemote(remote)
+	m.removeGitRepo(i, branch)
+	if err := m.addGitRepo(repo); err != nil {
+		return err
+	}
+
+	m.addMessages(msgs, old, m.projectByRemote(repo.Remote))
+	return m.save()
+}
+
+// DeleteGitRepo deletes the git repo with the given remote and branch, and
+// saves `msgs`.
+func (m *Memory) DeleteGitRepo(remote, branch string, msgs ...MessageFunc) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findGitRepo(remote, branch)
+	if i < 0 {
+		return ErrNotFound
+	}
+
+	old := m.projectByRemote(remote)
+	m.removeGitRepo(i, branch)
+	m.addMessages(msgs, old, m.projectByRemote(remote))
+	return m.save()
+}
+
+// CreateRun saves a new queued run and returns it with its ID set.
+func (m *Memory) CreateRun(run Run) (Run, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	run.ID = len(m.data.Runs) + 1
+	run.Status = RunQueued
+	run.CreatedAt = time.Now()
+	run.Steps = nil
+	run = copyRun(run)
+
+	m.data.Runs = append(m.data.Runs, run)
+	return copyRun(run), m.save()
+}
+
+// getRun returns a pointer to the run with the given ID, or nil if there
+// isn't one. Runs are never deleted, so the ID doubles as an index.
+func (m *Memory) getRun(id int) *Run {
+	if id < 1 || id > len(m.data.Runs) {
+		return nil
+	}
+
+	return &m.data.Runs[id-1]
+}
+
+// GetRun returns the run with the given ID, along with its steps.
+func (m *Memory) GetRun(id int) (Run, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	run := m.getRun(id)
+	if run == nil {
+		return Run{}, ErrNotFound
+	}
+
+	return copyRun(*run), nil
+}
+
+// GetRuns returns all the runs for the repo with the given remote, newest
+// first. If `branch` isn't empty, only runs for that branch are returned.
+func (m *Memory) GetRuns(remote, branch string) ([]Run, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	runs := []Run{}
+	for i := len(m.data.Runs) - 1; i >= 0; i-- {
+		run := m.data.Runs[i]
+		if run.Remote != remote || (branch != "" && run.Branch != branch) {
+			continue
+		}
+
+		run.Steps = nil
+		runs = append(runs, run)
+	}
+
+	return runs, nil
+}
+
+// UpdateRunStatus moves the run with the given ID to `status` and returns
+// the updated run.
+func (m *Memory) UpdateRunStatus(id int, status RunStatus) (Run, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	run := m.getRun(id)
+	if run == nil {
+		return Run{}, ErrNotFound
+	}
+
+	updated := copyRun(*run)
+	if err := updated.Transition(status, time.Now()); err != nil {
+		return updated, err
+	}
+
+	*run = updated
+	return copyRun(updated), m.save()
+}
+
+// CancelRun cancels the run with the given ID as far as Run.Cancel can
+// take it and returns the updated run.
+func (m *Memory) CancelRun(id int) (Run, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	run := m.getRun(id)
+	if run == nil {
+		return Run{}, ErrNotFound
+	}
+
+	updated := copyRun(*run)
+	if err := updated.Cancel(time.Now()); err != nil {
+		return updated, err
+	}
+
+	*run = updated
+	return copyRun(updated), m.save()
+}
+
+// CreateStep saves a new step and returns it with its ID set. If the run
+// already has a step for the task, that one is returned instead.
+func (m *Memory) CreateStep(step Step) (Step, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	run := m.getRun(step.RunID)
+	if run == nil {
+		return step, ErrNotFound
+	}
+
+	for _, existing := range run.Steps {
+		if existing.Task == step.Task {
+			return existing, nil
+		}
+	}
+
+	m.data.NextStepID++
+	step.ID = m.data.NextStepID
+	run.Steps = append(run.Steps, step)
+
+	return step, m.save()
+}
+
+// UpdateStep saves the exit code and timings of `step`.
+func (m *Memory) UpdateStep(step Step) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.data.Runs {
+		steps := m.data.Runs[i].Steps
+		for j := range steps {
+			if steps[j].ID != step.ID {
+				continue
+			}
+
+			step.RunID = steps[j].RunID
+			step.Task = steps[j].Task
+			steps[j] = step
+			return m.save()
+		}
+	}
+
+	return ErrNotFound
+}
+
+// copyRun returns a copy of `run` that doesn't share its steps, so callers
+// can't change what's in the store behind its back.
+func copyRun(run Run) Run {
+	if run.Args != nil {
+		args := make(map[string]string, len(run.Args))
+		for k, v := range run.Args {
+			args[k] = v
+		}
+		run.Args = args
+	}
+
+	if run.Labels != nil {
+		run.Labels = append([]string{}, run.Labels...)
+	}
+
+	if run.Steps != nil {
+		steps := make([]Step, len(run.Steps))
+		copy(steps, run.Steps)
+		run.Steps = steps
+	}
+
+	return run
+}
+
+// addMessages puts the messages `fns` build for the change from `old` to
+// `new` in the outbox. It must be called with the write lock held.
+func (m *Memory) addMessages(fns []MessageFunc, old, new *Project) {
+	now := time.Now()
+
+	msgs := []Message{}
+	for _, fn := range fns {
+		msgs = append(msgs, fn(old, new)...)
+	}
+
+	for _, msg := range msgs {
+		m.data.NextMessageID++
+
+		m.data.Outbox = append(m.data.Outbox, Message{
+			ID:            m.data.NextMessageID,
+			Subject:       msg.Subject,
+			Payload:       msg.Payload,
+			CreatedAt:     now,
+			NextAttemptAt: now,
+		})
+	}
+}
+
+// GetPendingMessages returns up to `limit` undelivered messages that are
+// due to be sent, oldest first.
+func (m *Memory) GetPendingMessages(limit int) ([]Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	msgs := []Message{}
+	for _, msg := range m.data.Outbox {
+		if len(msgs) >= limit {
+			break
+		}
+
+		if msg.NextAttemptAt.After(now) {
+			continue
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+// CountPendingMessages returns how many messages haven't been delivered
+// yet, whether or not they're due.
+func (m *Memory) CountPendingMessages() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.data.Outbox), nil
+}
+
+func (m *Memory) findMessage(id int) int {
+	for i, msg := range m.data.Outbox {
+		if msg.ID == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// MarkMessageDelivered removes the message with the given ID from the
+// outbox, since there's no need to keep delivered messages in memory.
+func (m *Memory) MarkMessageDelivered(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findMessage(id)
+	if i < 0 {
+		return ErrNotFound
+	}
+
+	m.data.Outbox = append(m.data.Outbox[:i], m.data.Outbox[i+1:]...)
+	return m.save()
+}
+
+// MarkMessageFailed records a failed attempt at publishing the message
+// with the given ID, and when to try again.
+func (m *Memory) MarkMessageFailed(id int, reason string, next time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findMessage(id)
+	if i < 0 {
+		return ErrNotFound
+	}
+
+	m.data.Outbox[i].Attempts++
+	m.data.Outbox[i].LastError = reason
+	m.data.Outbox[i].NextAttemptAt = next
+	return m.save()
+}
+
+// CreateToken saves a new API token and returns it with its ID set.
+func (m *Memory) CreateToken(token Token) (Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, t := range m.data.Tokens {
+		if t.Hash == token.Hash {
+			return Token{}, ErrConflict
+		}
+	}
+
+	m.data.NextTokenID++
+	token.ID = m.data.NextTokenID
+	token.CreatedAt = time.Now()
+	token.Scopes = append([]string{}, token.Scopes...)
+
+	m.data.Tokens = append(m.data.Tokens, token)
+	return token, m.save()
+}
+
+// GetTokenByHash returns the token with the given hash.
+func (m *Memory) GetTokenByHash(hash string) (Token, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, t := range m.data.Tokens {
+		if t.Hash == hash {
+			return t, nil
+		}
+	}
+
+	return Token{}, ErrNotFound
+}
+
+// GetTokens returns all tokens, oldest first.
+func (m *Memory) GetTokens() ([]Token, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	tokens := make([]Token, len(m.data.Tokens))
+	copy(tokens, m.data.Tokens)
+
+	return tokens, nil
+}
+
+// DeleteToken revokes the token with the given ID.
+func (m *Memory) DeleteToken(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, t := range m.data.Tokens {
+		if t.ID == id {
+			m.data.Tokens = append(m.data.Tokens[:i], m.data.Tokens[i+1:]...)
+			return m.save()
+		}
+	}
+
+	return ErrNotFound
+}
+
+// copyProject returns a copy of `p` that doesn't share its branches.
+func copyProject(p Project) Project {
+	p.Branches = append([]string{}, p.Branches...)
+	return p
+}
+
+// projectByRemote returns a copy of the project for `remote`, or nil if
+// there isn't one. It must be called with the lock held.
+func (m *Memory) projectByRemote(remote string) *Project {
+	i := m.findProject(remote)
+	if i < 0 {
+		return nil
+	}
+
+	p := copyProject(m.data.Projects[i])
+	return &p
+}
+
+// projectByID returns a copy of the project with the given ID, or nil if
+// there isn't one. It must be called with the lock held.
+func (m *Memory) projectByID(id int) *Project {
+	i := m.findProjectByID(id)
+	if i < 0 {
+		return nil
+	}
+
+	p := copyProject(m.data.Projects[i])
+	return &p
+}
+
+func (m *Memory) findProjectByID(id int) int {
+	for i, p := range m.data.Projects {
+		if p.ID == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// CreateProject saves a new project, along with `msgs`, and returns it
+// with its ID set.
+func (m *Memory) CreateProject(p Project, msgs ...MessageFunc) (Project, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.findProject(p.Remote) >= 0 {
+		return Project{}, ErrConflict
+	}
+
+	m.data.NextProjectID++
+	p.ID = m.data.NextProjectID
+	p.CreatedAt = time.Now()
+	p.Branches = sortedBranches(p.Branches)
+
+	m.data.Projects = append(m.data.Projects, p)
+	m.addMessages(msgs, nil, m.projectByID(p.ID))
+	return copyProject(p), m.save()
+}
+
+// GetProject returns the project with the given ID.
+func (m *Memory) GetProject(id int) (Project, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i := m.findProjectByID(id)
+	if i < 0 {
+		return Project{}, ErrNotFound
+	}
+
+	return copyProject(m.data.Projects[i]), nil
+}
+
+// GetProjectByRemote returns the project for the canonical `remote`.
+func (m *Memory) GetProjectByRemote(remote string) (Project, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i := m.findProject(remote)
+	if i < 0 {
+		return Project{}, ErrNotFound
+	}
+
+	return copyProject(m.data.Projects[i]), nil
+}
+
+// GetProjects returns all projects, oldest first.
+func (m *Memory) GetProjects() ([]Project, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	projects := []Project{}
+	for _, p := range m.data.Projects {
+		projects = append(projects, copyProject(p))
+	}
+
+	sort.Slice(projects, func(i, j int) bool {
+		return projects[i].ID < projects[j].ID
+	})
+
+	return projects, nil
+}
+
+// UpdateProject replaces the project with the same ID as `p`, saves
+// `msgs`, and returns the updated project. Its branches are only replaced
+// if `p` has any.
+func (m *Memory) UpdateProject(p Project, msgs ...MessageFunc) (Project, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findProjectByID(p.ID)
+	if i < 0 {
+		return Project{}, ErrNotFound
+	}
+
+	if j := m.findProject(p.Remote); j >= 0 && j != i {
+		return Project{}, ErrConflict
+	}
+
+	if p.Branches == nil {
+		p.Branches = m.data.Projects[i].Branches
+	}
+
+	p.CreatedAt = m.data.Projects[i].CreatedAt
+	p.Branches = sortedBranches(p.Branches)
+
+	old := m.projectByID(p.ID)
+	m.data.Projects[i] = p
+	m.addMessages(msgs, old, m.projectByID(p.ID))
+	return copyProject(p), m.save()
+}
+
+// DeleteProject deletes the project with the given ID, and saves `msgs`.
+func (m *Memory) DeleteProject(id int, msgs ...MessageFunc) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findProjectByID(id)
+	if i < 0 {
+		return ErrNotFound
+	}
+
+	old := m.projectByID(id)
+	m.data.Projects = append(m.data.Projects[:i], m.data.Projects[i+1:]...)
+
+	// Schedules go with their project.
+	scheds := m.data.Schedules[:0]
+	for _, sched := range m.data.Schedules {
+		if sched.ProjectID != id {
+			scheds = append(scheds, sched)
+		}
+	}
+	m.data.Schedules = scheds
+
+	m.addMessages(msgs, old, nil)
+	return m.save()
+}
+
+// RegisterAgent saves `agent`, replacing the name and labels of the agent
+// with the same ID if it has registered before.
+func (m *Memory) RegisterAgent(agent Agent) (Agent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	agent.LastHeartbeat = now
+	agent.RegisteredAt = now
+	agent.RunID = 0
+	if agent.Labels != nil {
+		agent.Labels = append([]string{}, agent.Labels...)
+	}
+
+	if a := m.getAgent(agent.ID); a != nil {
+		agent.RegisteredAt = a.RegisteredAt
+		*a = agent
+	} else {
+		m.data.Agents = append(m.data.Agents, agent)
+		sort.Slice(m.data.Agents, func(i, j int) bool {
+			return m.data.Agents[i].ID < m.data.Agents[j].ID
+		})
+	}
+
+	return m.withRun(agent), m.save()
+}
+
+// getAgent returns a pointer to the agent with the given ID, or nil if
+// there isn't one.
+func (m *Memory) getAgent(id string) *Agent {
+	for i := range m.data.Agents {
+		if m.data.Agents[i].ID == id {
+			return &m.data.Agents[i]
+		}
+	}
+
+	return nil
+}
+
+// heldRun returns a pointer to the active run the agent with the given ID
+// holds the lease of, or nil if it doesn't hold one.
+func (m *Memory) heldRun(agentID string) *Run {
+	for i := range m.data.Runs {
+		run := &m.data.Runs[i]
+		if run.AgentID == agentID && run.Status.Active() {
+			return run
+		}
+	}
+
+	return nil
+}
+
+// withRun returns a copy of `agent` with the run it holds filled in.
+func (m *Memory) withRun(agent Agent) Agent {
+	if agent.Labels != nil {
+		agent.Labels = append([]string{}, agent.Labels...)
+	}
+
+	agent.RunID = 0
+	if run := m.heldRun(agent.ID); run != nil {
+		agent.RunID = run.ID
+	}
+
+	return agent
+}
+
+// GetAgent returns the agent with the given ID.
+func (m *Memory) GetAgent(id string) (Agent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	agent := m.getAgent(id)
+	if agent == nil {
+		return Agent{}, ErrNotFound
+	}
+
+	return m.withRun(*agent), nil
+}
+
+// GetAgents returns every agent that has ever registered, by ID.
+func (m *Memory) GetAgents() ([]Agent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	agents := make([]Agent, len(m.data.Agents))
+	for i, agent := range m.data.Agents {
+		agents[i] = m.withRun(agent)
+	}
+
+	return agents, nil
+}
+
+// HeartbeatAgent records that the agent with the given ID is still around
+// and extends the lease of the run it holds, if any, to `lease` from now.
+func (m *Memory) HeartbeatAgent(id string, lease time.Duration) (Agent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	agent := m.getAgent(id)
+	if agent == nil {
+		return Agent{}, ErrNotFound
+	}
+
+	now := time.Now()
+	agent.LastHeartbeat = now
+	if run := m.heldRun(id); run != nil {
+		run.LeaseExpires = now.Add(lease)
+	}
+
+	return m.withRun(*agent), m.save()
+}
+
+// LeaseRun leases the oldest queued run the agent with the given ID has
+// the labels for to it until `lease` from now, and moves it to running. If
+// the agent already holds a lease, that run is returned instead.
+func (m *Memory) LeaseRun(agentID string, lease time.Duration) (Run, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	agent := m.getAgent(agentID)
+	if agent == nil {
+		return Run{}, ErrNotFound
+	}
+
+	if run := m.heldRun(agentID); run != nil {
+		return copyRun(*run), nil
+	}
+
+	for i := range m.data.Runs {
+		run := &m.data.Runs[i]
+		if run.Status != RunQueued || !agent.HasLabels(run.Labels) {
+			continue
+		}
+
+		now := time.Now()
+		updated := copyRun(*run)
+		if err := updated.Transition(RunRunning, now); err != nil {
+			return updated, err
+		}
+		updated.AgentID = agentID
+		updated.LeaseExpires = now.Add(lease)
+
+		*run = updated
+		return copyRun(updated), m.save()
+	}
+
+	return Run{}, ErrNotFound
+}
+
+// ExpireLeases puts every running run whose lease has run out back in the
+// queue and returns them.
+func (m *Memory) ExpireLeases() ([]Run, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+
+	runs := []Run{}
+	for i := range m.data.Runs {
+		run := &m.data.Runs[i]
+		if run.Status != RunRunning || run.LeaseExpires.IsZero() || !run.LeaseExpires.Before(now) {
+			continue
+		}
+
+		if err := run.Transition(RunQueued, now); err != nil {
+			return nil, err
+		}
+
+		expired := copyRun(*run)
+		expired.Steps = nil
+		runs = append(runs, expired)
+	}
+
+	if len(runs) == 0 {
+		return runs, nil
+	}
+
+	return runs, m.save()
+}
+
+// TimeoutRuns fails every running run that has gone on for longer than
+// its timeout, or `timeout` if it doesn't have one, and cancels every run
+// that has been cancelling for longer than `cancelTimeout`. It returns
+// the runs it stopped. With a zero `timeout`, runs without a timeout of
+// their own can go on forever.
+func (m *Memory) TimeoutRuns(timeout, cancelTimeout time.Duration) ([]Run, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+
+	runs := []Run{}
+	for i := range m.data.Runs {
+		run := &m.data.Runs[i]
+
+		var err error
+		switch run.Status {
+		case RunRunning:
+			limit := run.Timeout
+			if limit == 0 {
+				limit = timeout
+			}
+			if limit <= 0 || !run.StartedAt.Add(limit).Before(now) {
+				continue
+			}
+
+			err = run.Transition(RunFailed, now)
+		case RunCancelling:
+			if !run.CancelRequestedAt.Add(cancelTimeout).Before(now) {
+				continue
+			}
+
+			err = run.Transition(RunCancelled, now)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		stopped := copyRun(*run)
+		stopped.Steps = nil
+		runs = append(runs, stopped)
+	}
+
+	if len(runs) == 0 {
+		return runs, nil
+	}
+
+	return runs, m.save()
+}
+
+// copySchedule returns a copy of `sched` that doesn't share its arguments
+// or labels.
+func copySchedule(sched Schedule) Schedule {
+	if sched.Args != nil {
+		args := make(map[string]string, len(sched.Args))
+		for k, v := range sched.Args {
+			args[k] = v
+		}
+		sched.Args = args
+	}
+
+	if sched.Labels != nil {
+		sched.Labels = append([]string{}, sched.Labels...)
+	}
+
+	return sched
+}
+
+func (m *Memory) getSchedule(id int) *Schedule {
+	for i := range m.data.Schedules {
+		if m.data.Schedules[i].ID == id {
+			return &m.data.Schedules[i]
+		}
+	}
+
+	return nil
+}
+
+// CreateSchedule saves a new schedule and returns it with its ID set. It
+// returns ErrNotFound if its project doesn't exist.
+func (m *Memory) CreateSchedule(sched Schedule) (Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.findProjectByID(sched.ProjectID) < 0 {
+		return Schedule{}, ErrNotFound
+	}
+
+	m.data.NextScheduleID++
+	sched.ID = m.data.NextScheduleID
+	sched.CreatedAt = time.Now()
+	sched.LastFiredAt = time.Time{}
+	sched = copySchedule(sched)
+
+	m.data.Schedules = append(m.data.Schedules, sched)
+	return copySchedule(sched), m.save()
+}
+
+// GetSchedule returns the schedule with the given ID.
+func (m *Memory) GetSchedule(id int) (Schedule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sched := m.getSchedule(id)
+	if sched == nil {
+		return Schedule{}, ErrNotFound
+	}
+
+	return copySchedule(*sched), nil
+}
+
+// GetSchedules returns the schedules of the project with the given ID,
+// oldest first. A zero ID returns every project's schedules.
+func (m *Memory) GetSchedules(projectID int) ([]Schedule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	scheds := []Schedule{}
+	for _, sched := range m.data.Schedules {
+		if projectID == 0 || sched.ProjectID == projectID {
+			scheds = append(scheds, copySchedule(sched))
+		}
+	}
+
+	return scheds, nil
+}
+
+// UpdateSchedule replaces the schedule with the same ID as `sched` and
+// returns it. Its project, creation time and last firing are kept.
+func (m *Memory) UpdateSchedule(sched Schedule) (Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing := m.getSchedule(sched.ID)
+	if existing == nil {
+		return Schedule{}, ErrNotFound
+	}
+
+	sched.ProjectID = existing.ProjectID
+	sched.CreatedAt = existing.CreatedAt
+	sched.LastFiredAt = existing.LastFiredAt
+
+	*existing = copySchedule(sched)
+	return copySchedule(sched), m.save()
+}
+
+// DeleteSchedule deletes the schedule with the given ID.
+func (m *Memory) DeleteSchedule(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, sched := range m.data.Schedules {
+		if sched.ID == id {
+			m.data.Schedules = append(m.data.Schedules[:i], m.data.Schedules[i+1:]...)
+			return m.save()
+		}
+	}
+
+	return ErrNotFound
+}
+
+// GetDueSchedules returns the enabled schedules due to fire at or before
+// `now`, the ones that have been due the longest first.
+func (m *Memory) GetDueSchedules(now time.Time) ([]Schedule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	scheds := []Schedule{}
+	for _, sched := range m.data.Schedules {
+		if sched.Enabled && !sched.NextFireAt.IsZero() && !sched.NextFireAt.After(now) {
+			scheds = append(scheds, copySchedule(sched))
+		}
+	}
+
+	sort.SliceStable(scheds, func(i, j int) bool {
+		return scheds[i].NextFireAt.Before(scheds[j].NextFireAt)
+	})
+
+	return scheds, nil
+}
+
+// FireSchedule records the schedule with the given ID as fired at `at`,
+// moves it on to fire next at `next` and returns it. It returns
+// ErrConflict unless the schedule is enabled and still due to fire at
+// `at`, which it isn't once someone else has fired it.
+func (m *Memory) FireSchedule(id int, at, next time.Time) (Schedule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sched := m.getSchedule(id)
+	if sched == nil {
+		return Schedule{}, ErrNotFound
+	}
+
+	if !sched.Enabled || !sched.NextFireAt.Equal(at) {
+		return copySchedule(*sched), ErrConflict
+	}
+
+	sched.LastFiredAt = at
+	sched.NextFireAt = next
+	return copySchedule(*sched), m.save()
+}
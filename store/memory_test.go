@@ -0,0 +1,233 @@
+package store_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/run-ci/run-server/store"
+	"github.com/run-ci/run-server/storetest"
+)
+
+func TestMemory(t *testing.T) {
+	storetest.Run(t, func(*testing.T) store.Repo {
+		return store.NewMemory()
+	})
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "run-server-store")
+	if err != nil {
+		t.Fatalf("got error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	n := 0
+	storetest.Run(t, func(t *testing.T) store.Repo {
+		n++
+
+		st, err := store.NewFile(filepath.Join(dir, fmt.Sprintf("store-%v.json", n)))
+		if err != nil {
+			t.Fatalf("got error creating file store: %v", err)
+		}
+
+		return st
+	})
+}
+
+func TestFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "run-server-store")
+	if err != nil {
+		t.Fatalf("got error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "store.json")
+
+	st, err := store.NewFile(path)
+	if err != nil {
+		t.Fatalf("got error creating file store: %v", err)
+	}
+
+	repo := store.GitRepo{Remote: "a.git", Branch: "master"}
+	if err := st.CreateGitRepo(repo); err != nil {
+		t.Fatalf("got error creating repo: %v", err)
+	}
+
+	st, err = store.NewFile(path)
+	if err != nil {
+		t.Fatalf("got error reloading file store: %v", err)
+	}
+
+	got, err := st.GetGitRepo(repo.Remote, repo.Branch)
+	if err != nil {
+		t.Fatalf("got error getting repo after reload: %v", err)
+	}
+	if got != repo {
+		t.Fatalf("expected %v after reload, got %v", repo, got)
+	}
+}
+
+func TestFileSaveFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "run-server-store")
+	if err != nil {
+		t.Fatalf("got error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := store.NewFile(filepath.Join(dir, "store", "store.json"))
+	if err != nil {
+		t.Fatalf("got error creating file store: %v", err)
+	}
+
+	// The directory the file goes in doesn't exist, so nothing can be
+	// written.
+	repo := store.GitRepo{Remote: "a.git", Branch: "master"}
+	if err := st.CreateGitRepo(repo); err == nil {
+		t.Fatal("expected error saving to a missing directory")
+	}
+
+	if _, err := st.GetGitRepo(repo.Remote, repo.Branch); err != store.ErrNotFound {
+		t.Fatalf("expected %v for a repo that wasn't saved, got %v", store.ErrNotFound, err)
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "store"), 0755); err != nil {
+		t.Fatalf("got error creating store directory: %v", err)
+	}
+
+	if err := st.CreateGitRepo(repo); err != nil {
+		t.Fatalf("got error creating repo once it can be saved: %v", err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(dir, "store")); err != nil {
+		t.Fatalf("got error removing store directory: %v", err)
+	}
+
+	if err := st.DeleteGitRepo(repo.Remote, repo.Branch); err == nil {
+		t.Fatal("expected error saving to a missing directory")
+	}
+
+	if _, err := st.GetGitRepo(repo.Remote, repo.Branch); err != nil {
+		t.Fatalf("expected repo to still be there after failing to delete it, got %v", err)
+	}
+}
+
+func TestFileLegacyGitRepos(t *testing.T) {
+	dir, err := ioutil.TempDir("", "run-server-store")
+	if err != nil {
+		t.Fatalf("got error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Files written before projects existed only have git repos.
+	path := filepath.Join(dir, "store.json")
+	legacy := `{"git_repos": [
+		{"Remote": "a.git", "Branch": "master"},
+		{"Remote": "a.git", "Branch": "feature"},
+		{"Remote": "b.git", "Branch": "master"}
+	]}`
+	if err := ioutil.WriteFile(path, []byte(legacy), 0644); err != nil {
+		t.Fatalf("got error writing legacy store file: %v", err)
+	}
+
+	st, err := store.NewFile(path)
+	if err != nil {
+		t.Fatalf("got error loading legacy store file: %v", err)
+	}
+
+	projects, err := st.GetProjects()
+	if err != nil {
+		t.Fatalf("got error getting projects: %v", err)
+	}
+
+	if len(projects) != 2 {
+		t.Fatalf("expected 2 projects, got %v", len(projects))
+	}
+
+	if p := projects[0]; p.Remote != "a.git" || len(p.Branches) != 2 || !p.Enabled {
+		t.Fatalf("expected enabled a.git project with 2 branches, got %+v", p)
+	}
+
+	if _, err := st.GetGitRepo("a.git", "feature"); err != nil {
+		t.Fatalf("got error getting legacy repo: %v", err)
+	}
+}
+
+func TestFileCanonicalRemotes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "run-server-store")
+	if err != nil {
+		t.Fatalf("got error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Files written before remotes were canonicalized key projects and
+	// runs by the remote as it was spelled, and can have two projects for
+	// the same remote.
+	path := filepath.Join(dir, "store.json")
+	old := `{
+		"projects": [
+			{"ID": 1, "Remote": "https://github.com/x/y.git", "Branches": ["master"], "Enabled": true},
+			{"ID": 2, "Remote": "git@GitHub.com:x/y.git", "Branches": ["develop", "master"], "Enabled": true}
+		],
+		"next_project_id": 2,
+		"runs": [{"ID": 1, "Remote": "https://github.com/x/y.git", "Branch": "master", "Status": "queued"}],
+		"schedules": [{"ID": 1, "ProjectID": 2, "Cron": "@daily", "Task": "nightly"}],
+		"next_schedule_id": 1
+	}`
+	if err := ioutil.WriteFile(path, []byte(old), 0644); err != nil {
+		t.Fatalf("got error writing old store file: %v", err)
+	}
+
+	st, err := store.NewFile(path)
+	if err != nil {
+		t.Fatalf("got error loading old store file: %v", err)
+	}
+
+	projects, err := st.GetProjects()
+	if err != nil {
+		t.Fatalf("got error getting projects: %v", err)
+	}
+
+	if len(projects) != 1 {
+		t.Fatalf("expected projects for the same remote to be merged, got %+v", projects)
+	}
+
+	p := projects[0]
+	if p.ID != 1 || p.Remote != "github.com/x/y" || p.URL != "https://github.com/x/y.git" {
+		t.Fatalf("expected project 1 with canonical remote and original URL, got %+v", p)
+	}
+
+	if len(p.Branches) != 2 {
+		t.Fatalf("expected branches of both projects, got %v", p.Branches)
+	}
+
+	for _, branch := range []string{"master", "develop"} {
+		if _, err := st.GetGitRepo("github.com/x/y", branch); err != nil {
+			t.Fatalf("got error getting %v by canonical remote: %v", branch, err)
+		}
+	}
+
+	scheds, err := st.GetSchedules(1)
+	if err != nil {
+		t.Fatalf("got error getting schedules: %v", err)
+	}
+	if len(scheds) != 1 {
+		t.Fatalf("expected the merged project's schedule to move, got %v", scheds)
+	}
+
+	runs, err := st.GetRuns("github.com/x/y", "")
+	if err != nil {
+		t.Fatalf("got error getting runs: %v", err)
+	}
+	if len(runs) != 1 {
+		t.Fatalf("expected run to be found by canonical remote, got %v", runs)
+	}
+}
+
+func TestInstrumented(t *testing.T) {
+	storetest.Run(t, func(*testing.T) store.Repo {
+		return store.Instrument(store.NewMemory())
+	})
+}
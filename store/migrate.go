@@ -0,0 +1,675 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrSchemaBehind is returned when the database schema is older than
+// what this version of the server needs.
+var ErrSchemaBehind = errors.New("database schema is behind, run migrations")
+
+// Migration is a single versioned change to the database schema. Up
+// applies the change and Down reverts it.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+
+	// Rewrite, if set, runs after Up in the same transaction, for changes
+	// to data that can't be made in SQL alone. Rewrites don't need to be
+	// undone, so Down can be empty for migrations that only rewrite.
+	Rewrite func(*sql.Tx) error
+}
+
+// Migrations are all the schema migrations known to the server, in the
+// order they have to be applied. Versions must be strictly increasing
+// and a migration must never be changed once it has been released.
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create git_repos",
+		// This table used to be created by bootstrap.sql, so it may
+		// already be there on older databases.
+		Up: `
+		CREATE TABLE IF NOT EXISTS git_repos (
+			remote varchar(255) NOT NULL,
+			branch varchar(255) NOT NULL,
+
+			PRIMARY KEY(remote, branch),
+			UNIQUE(remote, branch)
+		);
+		`,
+		Down: `
+		DROP TABLE git_repos;
+		`,
+	},
+	{
+		Version: 2,
+		Name:    "create runs and steps",
+		Up: `
+		CREATE TABLE runs (
+			id serial PRIMARY KEY,
+			remote varchar(255) NOT NULL,
+			branch varchar(255) NOT NULL,
+			commit varchar(64) NOT NULL,
+			trigger varchar(32) NOT NULL,
+			status varchar(16) NOT NULL,
+			created_at timestamp with time zone NOT NULL,
+			started_at timestamp with time zone,
+			finished_at timestamp with time zone
+		);
+
+		CREATE INDEX runs_remote_branch_idx ON runs (remote, branch);
+
+		CREATE TABLE steps (
+			id serial PRIMARY KEY,
+			run_id integer NOT NULL REFERENCES runs(id) ON DELETE CASCADE,
+			task varchar(255) NOT NULL,
+			exit_code integer NOT NULL DEFAULT 0,
+			started_at timestamp with time zone,
+			finished_at timestamp with time zone
+		);
+		`,
+		Down: `
+		DROP TABLE steps;
+		DROP TABLE runs;
+		`,
+	},
+	{
+		Version: 3,
+		Name:    "create outbox",
+		Up: `
+		CREATE TABLE outbox (
+			id serial PRIMARY KEY,
+			subject varchar(255) NOT NULL,
+			payload bytea NOT NULL,
+			created_at timestamp with time zone NOT NULL DEFAULT now(),
+			attempts integer NOT NULL DEFAULT 0,
+			last_error text NOT NULL DEFAULT '',
+			next_attempt_at timestamp with time zone NOT NULL DEFAULT now(),
+			delivered_at timestamp with time zone
+		);
+
+		CREATE INDEX outbox_pending_idx ON outbox (next_attempt_at)
+		WHERE delivered_at IS NULL;
+		`,
+		Down: `
+		DROP TABLE outbox;
+		`,
+	},
+	{
+		Version: 4,
+		Name:    "create tokens",
+		Up: `
+		CREATE TABLE tokens (
+			id serial PRIMARY KEY,
+			name varchar(255) NOT NULL,
+			hash char(64) NOT NULL UNIQUE,
+			scopes text[] NOT NULL DEFAULT '{}',
+			created_at timestamp with time zone NOT NULL DEFAULT now()
+		);
+		`,
+		Down: `
+		DROP TABLE tokens;
+		`,
+	},
+	{
+		// Remotes registered before this keep their original spelling as
+		// their key, and an empty URL.
+		Version: 5,
+		Name:    "add git repo urls",
+		Up: `
+		ALTER TABLE git_repos ADD COLUMN url text NOT NULL DEFAULT '';
+		`,
+		Down: `
+		ALTER TABLE git_repos DROP COLUMN url;
+		`,
+	},
+	{
+		// Git repos become the tracked branches of projects, and what's
+		// left of git_repos is a view over them.
+		Version: 6,
+		Name:    "create projects",
+		Up: `
+		CREATE TABLE projects (
+			id serial PRIMARY KEY,
+			name varchar(255) NOT NULL,
+			remote varchar(255) NOT NULL UNIQUE,
+			url text NOT NULL DEFAULT '',
+			default_branch varchar(255) NOT NULL,
+			credentials varchar(255) NOT NULL DEFAULT '',
+			config_path varchar(255) NOT NULL DEFAULT 'tasks',
+			enabled boolean NOT NULL DEFAULT true,
+			created_at timestamp with time zone NOT NULL DEFAULT now()
+		);
+
+		CREATE TABLE project_branches (
+			project_id integer NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+			branch varchar(255) NOT NULL,
+
+			PRIMARY KEY(project_id, branch)
+		);
+
+		INSERT INTO projects (name, remote, url, default_branch)
+		SELECT DISTINCT ON (remote) remote, remote, url, branch
+		FROM git_repos
+		ORDER BY remote, branch = 'master' DESC, branch;
+
+		INSERT INTO project_branches (project_id, branch)
+		SELECT p.id, g.branch
+		FROM git_repos g
+		JOIN projects p ON p.remote = g.remote;
+
+		DROP TABLE git_repos;
+
+		CREATE VIEW git_repos AS
+		SELECT p.remote, b.branch, p.url
+		FROM projects p
+		JOIN project_branches b ON b.project_id = p.id;
+		`,
+		Down: `
+		DROP VIEW git_repos;
+
+		CREATE TABLE git_repos (
+			remote varchar(255) NOT NULL,
+			branch varchar(255) NOT NULL,
+			url text NOT NULL DEFAULT '',
+
+			PRIMARY KEY(remote, branch)
+		);
+
+		INSERT INTO git_repos (remote, branch, url)
+		SELECT p.remote, b.branch, p.url
+		FROM projects p
+		JOIN project_branches b ON b.project_id = p.id;
+
+		DROP TABLE project_branches;
+		DROP TABLE projects;
+		`,
+	},
+	{
+		Version: 7,
+		Name:    "add run tasks and arguments",
+		Up: `
+		ALTER TABLE runs ADD COLUMN task varchar(255) NOT NULL DEFAULT '';
+		ALTER TABLE runs ADD COLUMN args jsonb NOT NULL DEFAULT '{}';
+		`,
+		Down: `
+		ALTER TABLE runs DROP COLUMN args;
+		ALTER TABLE runs DROP COLUMN task;
+		`,
+	},
+	{
+		Version: 8,
+		Name:    "add agents and run leases",
+		Up: `
+		CREATE TABLE agents (
+			id varchar(255) PRIMARY KEY,
+			name varchar(255) NOT NULL DEFAULT '',
+			labels text[] NOT NULL DEFAULT '{}',
+			registered_at timestamp with time zone NOT NULL,
+			last_heartbeat timestamp with time zone NOT NULL
+		);
+
+		ALTER TABLE runs ADD COLUMN labels text[] NOT NULL DEFAULT '{}';
+		ALTER TABLE runs ADD COLUMN agent_id varchar(255) NOT NULL DEFAULT '';
+		ALTER TABLE runs ADD COLUMN lease_expires timestamp with time zone NULL;
+
+		CREATE INDEX runs_status_idx ON runs (status, id);
+		`,
+		Down: `
+		DROP INDEX runs_status_idx;
+
+		ALTER TABLE runs DROP COLUMN lease_expires;
+		ALTER TABLE runs DROP COLUMN agent_id;
+		ALTER TABLE runs DROP COLUMN labels;
+
+		DROP TABLE agents;
+		`,
+	},
+	{
+		Version: 9,
+		Name:    "add step logs",
+		Up: `
+		CREATE TABLE step_logs (
+			run_id integer NOT NULL,
+			step_id integer NOT NULL,
+			size bigint NOT NULL DEFAULT 0,
+			final boolean NOT NULL DEFAULT false,
+			truncated boolean NOT NULL DEFAULT false,
+			updated_at timestamp with time zone NOT NULL,
+			PRIMARY KEY (run_id, step_id)
+		);
+
+		CREATE INDEX step_logs_updated_idx ON step_logs (updated_at);
+
+		CREATE TABLE log_chunks (
+			run_id integer NOT NULL,
+			step_id integer NOT NULL,
+			pos bigint NOT NULL,
+			data bytea NOT NULL,
+			PRIMARY KEY (run_id, step_id, pos),
+			FOREIGN KEY (run_id, step_id) REFERENCES step_logs (run_id, step_id) ON DELETE CASCADE
+		);
+		`,
+		Down: `
+		DROP TABLE log_chunks;
+		DROP TABLE step_logs;
+		`,
+	},
+	{
+		Version: 10,
+		Name:    "add run timeouts and cancellation",
+		Up: `
+		ALTER TABLE runs ADD COLUMN timeout_ms bigint NOT NULL DEFAULT 0;
+		ALTER TABLE runs ADD COLUMN cancel_requested_at timestamp with time zone NULL;
+		`,
+		Down: `
+		ALTER TABLE runs DROP COLUMN cancel_requested_at;
+		ALTER TABLE runs DROP COLUMN timeout_ms;
+		`,
+	},
+	{
+		Version: 11,
+		Name:    "add schedules",
+		Up: `
+		CREATE TABLE schedules (
+			id serial PRIMARY KEY,
+			project_id integer NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+			branch varchar(255) NOT NULL DEFAULT '',
+			cron varchar(255) NOT NULL,
+			timezone varchar(255) NOT NULL DEFAULT '',
+			task varchar(255) NOT NULL,
+			args jsonb NOT NULL DEFAULT '{}',
+			labels text[] NOT NULL DEFAULT '{}',
+			enabled boolean NOT NULL DEFAULT true,
+			next_fire_at timestamp with time zone NULL,
+			last_fired_at timestamp with time zone NULL,
+			created_at timestamp with time zone NOT NULL
+		);
+
+		CREATE INDEX schedules_next_fire_idx ON schedules (next_fire_at) WHERE enabled;
+		`,
+		Down: `
+		DROP TABLE schedules;
+		`,
+	},
+	{
+		// Remotes registered before they were canonicalized are rewritten
+		// into canonical form, keeping their spelling as their URL, and
+		// projects that turn out to share a remote are merged. Canonical
+		// remotes are still remotes, so there's nothing to undo.
+		Version: 12,
+		Name:    "canonicalize remotes",
+		Rewrite: canonicalizeRemotes,
+	},
+	{
+		// Servers racing to create the same step could each create their
+		// own, so the later copies are dropped before steps are made
+		// unique. Their logs are left for the pruner.
+		Version: 13,
+		Name:    "add log lines",
+		Up: `
+		DELETE FROM steps a USING steps b
+		WHERE a.run_id = b.run_id AND a.task = b.task AND a.id > b.id;
+
+		CREATE UNIQUE INDEX steps_run_task_idx ON steps (run_id, task);
+
+		CREATE TABLE log_lines (
+			run_id integer NOT NULL,
+			seq integer NOT NULL,
+			step_id integer NOT NULL,
+			pos bigint NOT NULL,
+			size bigint NOT NULL,
+			PRIMARY KEY (run_id, seq),
+			FOREIGN KEY (run_id, step_id) REFERENCES step_logs (run_id, step_id) ON DELETE CASCADE
+		);
+		`,
+		Down: `
+		DROP TABLE log_lines;
+		DROP INDEX steps_run_task_idx;
+		`,
+	},
+}
+
+// canonicalizeRemotes brings projects and runs saved before remotes were
+// canonicalized over to their canonical remotes, merging projects as
+// mergeRemotes works out.
+func canonicalizeRemotes(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, remote, url FROM projects ORDER BY id;`)
+	if err != nil {
+		return err
+	}
+
+	projects := []Project{}
+	for rows.Next() {
+		p := Project{}
+		if err := rows.Scan(&p.ID, &p.Remote, &p.URL); err != nil {
+			rows.Close()
+			return err
+		}
+		projects = append(projects, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, merge := range mergeRemotes(projects) {
+		for _, id := range merge.Merged {
+			_, err := tx.Exec(`
+			INSERT INTO project_branches (project_id, branch)
+			SELECT $1, branch FROM project_branches WHERE project_id = $2
+			ON CONFLICT DO NOTHING;
+			`, merge.ID, id)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(`UPDATE schedules SET project_id = $1 WHERE project_id = $2;`,
+				merge.ID, id)
+			if err != nil {
+				return err
+			}
+
+			if _, err := tx.Exec(`DELETE FROM projects WHERE id = $1;`, id); err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.Exec(`UPDATE projects SET remote = $2, url = $3 WHERE id = $1;`,
+			merge.ID, merge.Remote, merge.URL)
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err = tx.Query(`SELECT DISTINCT remote FROM runs;`)
+	if err != nil {
+		return err
+	}
+
+	remotes := []string{}
+	for rows.Next() {
+		var remote string
+		if err := rows.Scan(&remote); err != nil {
+			rows.Close()
+			return err
+		}
+		remotes = append(remotes, remote)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, remote := range remotes {
+		canonical := canonicalRemote(remote)
+		if canonical == remote {
+			continue
+		}
+
+		_, err := tx.Exec(`UPDATE runs SET remote = $2 WHERE remote = $1;`, remote, canonical)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MigrationStatus is a migration along with whether or not it has been
+// applied to the database.
+type MigrationStatus struct {
+	Migration
+
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator applies and reverts schema migrations on a Postgres database.
+type Migrator struct {
+	db *sql.DB
+}
+
+// NewMigrator returns a Migrator for the database at connstr.
+func NewMigrator(connstr string) (*Migrator, error) {
+	db, err := sql.Open("postgres", connstr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		db: db,
+	}, nil
+}
+
+// Close closes the underlying database connection.
+func (m *Migrator) Close() error {
+	return m.db.Close()
+}
+
+// migrationLockKey is the advisory lock key taken while migrating, so that
+// two servers migrating the same database at once take turns instead of
+// applying the same migration twice. It's "mig" in ASCII.
+const migrationLockKey int64 = 0x6d6967
+
+// Up applies every migration that hasn't been applied yet, in order. Each
+// migration runs in its own transaction.
+func (m *Migrator) Up() error {
+	for {
+		applied, err := m.step("applying", func(current int) (Migration, string, bool) {
+			for _, mig := range Migrations {
+				if mig.Version > current {
+					return mig, mig.Up, true
+				}
+			}
+
+			return Migration{}, "", false
+		}, func(tx *sql.Tx, mig Migration) error {
+			if mig.Rewrite != nil {
+				if err := mig.Rewrite(tx); err != nil {
+					return fmt.Errorf("rewriting data for migration %v: %v", mig.Version, err)
+				}
+			}
+
+			_, err := tx.Exec(`
+			INSERT INTO schema_migrations (version, name)
+			VALUES ($1, $2);
+			`, mig.Version, mig.Name)
+			return err
+		})
+		if err != nil || !applied {
+			return err
+		}
+	}
+}
+
+// Down reverts the most recently applied migration. It does nothing if
+// no migrations have been applied.
+func (m *Migrator) Down() error {
+	var unknown int
+
+	_, err := m.step("reverting", func(current int) (Migration, string, bool) {
+		for i := len(Migrations) - 1; i >= 0; i-- {
+			if Migrations[i].Version == current {
+				return Migrations[i], Migrations[i].Down, true
+			}
+		}
+
+		unknown = current
+		return Migration{}, "", false
+	}, func(tx *sql.Tx, mig Migration) error {
+		_, err := tx.Exec(`
+		DELETE FROM schema_migrations
+		WHERE version = $1;
+		`, mig.Version)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if unknown != 0 {
+		return fmt.Errorf("database is at unknown schema version %v", unknown)
+	}
+
+	return nil
+}
+
+// Status returns every known migration along with whether it has been
+// applied.
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	exists, err := hasMigrationsTable(m.db)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := map[int]time.Time{}
+	if exists {
+		applied, err = appliedMigrations(m.db)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	statuses := make([]MigrationStatus, len(Migrations))
+	for i, mig := range Migrations {
+		at, ok := applied[mig.Version]
+
+		statuses[i] = MigrationStatus{
+			Migration: mig,
+			Applied:   ok,
+			AppliedAt: at,
+		}
+	}
+
+	return statuses, nil
+}
+
+// appliedMigrations returns when each applied migration was applied, by
+// version.
+func appliedMigrations(q querier) (map[int]time.Time, error) {
+	rows, err := q.Query(`SELECT version, applied_at FROM schema_migrations;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+
+		applied[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return applied, nil
+}
+
+// step applies or reverts at most one migration in a single transaction,
+// holding the migration lock for as long as it lasts. `next` picks the
+// migration and statement to run from the version the database is at
+// once the lock is held, or returns false if there's nothing left to do.
+// `track` records the change in the same transaction, and `verb` describes
+// it in logs and errors. It returns whether anything was run.
+func (m *Migrator) step(verb string, next func(current int) (Migration, string, bool), track func(*sql.Tx, Migration) error) (bool, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1);`, migrationLockKey); err != nil {
+		return false, err
+	}
+
+	if err := ensureMigrationsTable(tx); err != nil {
+		return false, err
+	}
+
+	current, err := schemaVersion(tx)
+	if err != nil {
+		return false, err
+	}
+
+	mig, stmt, ok := next(current)
+	if !ok {
+		return false, tx.Commit()
+	}
+
+	logger := logger.WithField("version", mig.Version)
+	logger.Infof("%v migration %q", verb, mig.Name)
+
+	if stmt != "" {
+		if _, err := tx.Exec(stmt); err != nil {
+			logger.WithField("error", err).Debugf("%v migration failed", verb)
+			return false, fmt.Errorf("%v migration %v: %v", verb, mig.Version, err)
+		}
+	}
+
+	if err := track(tx, mig); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// LatestVersion returns the schema version the server expects.
+func LatestVersion() int {
+	if len(Migrations) == 0 {
+		return 0
+	}
+
+	return Migrations[len(Migrations)-1].Version
+}
+
+// ensureMigrationsTable creates the table that keeps track of applied
+// migrations, if it isn't there yet.
+func ensureMigrationsTable(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		name varchar(255) NOT NULL,
+		applied_at timestamp with time zone NOT NULL DEFAULT now()
+	);
+	`)
+
+	return err
+}
+
+// hasMigrationsTable returns whether the table that keeps track of applied
+// migrations exists, without creating it.
+func hasMigrationsTable(q querier) (bool, error) {
+	var exists bool
+	err := q.QueryRow(`SELECT to_regclass('schema_migrations') IS NOT NULL;`).
+		Scan(&exists)
+
+	return exists, err
+}
+
+// schemaVersion returns the version of the latest migration applied to db,
+// or 0 if none have been. It only reads from the database, so a database
+// that has never been migrated is at version 0.
+func schemaVersion(q querier) (int, error) {
+	exists, err := hasMigrationsTable(q)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	var version int
+	err = q.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations;`).
+		Scan(&version)
+
+	return version, err
+}
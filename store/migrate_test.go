@@ -0,0 +1,25 @@
+package store
+
+import "testing"
+
+func TestMigrationsOrdered(t *testing.T) {
+	prev := 0
+	for _, mig := range Migrations {
+		if mig.Version <= prev {
+			t.Fatalf("expected migration %v to come after %v", mig.Version, prev)
+		}
+		prev = mig.Version
+
+		if mig.Name == "" {
+			t.Fatalf("expected migration %v to have a name", mig.Version)
+		}
+
+		if mig.Rewrite == nil && (mig.Up == "" || mig.Down == "") {
+			t.Fatalf("expected migration %v to have up and down statements", mig.Version)
+		}
+	}
+
+	if LatestVersion() != prev {
+		t.Fatalf("expected latest version %v, got %v", prev, LatestVersion())
+	}
+}
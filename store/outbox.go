@@ -0,0 +1,33 @@
+package store
+
+import "time"
+
+// Message is an outbound queue message waiting in the outbox. Messages are
+// saved in the same transaction as the change they describe, so that the
+// change and the message can't get out of step, and a relay publishes them
+// afterwards.
+type Message struct {
+	ID      int
+	Subject string
+	Payload []byte
+
+	CreatedAt     time.Time
+	Attempts      int
+	LastError     string
+	NextAttemptAt time.Time
+}
+
+// MessageFunc builds the outbox messages for a change to a project, from
+// the project as it was before the change and as it is after it. It's
+// called in the same transaction as the change, so the messages describe
+// what was actually saved even if the project changed since the caller
+// last read it. Either project is nil if there isn't one, like before a
+// project is created or after it's deleted.
+type MessageFunc func(old, new *Project) []Message
+
+// Messages returns a MessageFunc saving `msgs` whatever the change was.
+func Messages(msgs ...Message) MessageFunc {
+	return func(old, new *Project) []Message {
+		return msgs
+	}
+}
@@ -1,9 +1,13 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"time"
 
-	_ "github.com/lib/pq" // load the postgres driver
+	"github.com/lib/pq"
+	"github.com/run-ci/run-server/branches"
+	"github.com/sirupsen/logrus"
 )
 
 // Postgres is a RepoStore backed by PostgreSQL.
@@ -24,49 +28,92 @@ func NewPostgres(connstr string) (Repo, error) {
 		return nil, err
 	}
 
+	logger.Debug("checking schema version")
+	version, err := schemaVersion(db)
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to check schema version")
+		db.Close()
+		return nil, err
+	}
+
+	if version < LatestVersion() {
+		logger.WithFields(logrus.Fields{
+			"version": version,
+			"latest":  LatestVersion(),
+		}).Debug("schema is behind")
+		db.Close()
+		return nil, ErrSchemaBehind
+	}
+
 	return &Postgres{
 		db: db,
 	}, nil
 }
 
-// CreateGitRepo saves the Git repository in Postgres.
-func (pg *Postgres) CreateGitRepo(repo GitRepo) error {
-	logger.Debugf("creating git repo for %v", repo.Remote)
+// DB returns the database connection pool, for things that keep their own
+// tables in the same database.
+func (pg *Postgres) DB() *sql.DB {
+	return pg.db
+}
 
-	sqlinsert := `
-	INSERT INTO git_repos (remote, branch)
-	VALUES
-		($1, $2);
-	`
+// pingTimeout is how long Ping waits for the database to answer.
+const pingTimeout = 2 * time.Second
+
+// Ping checks that the database can be reached.
+func (pg *Postgres) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+
+	return pg.db.PingContext(ctx)
+}
+
+// Close closes the database connection pool.
+func (pg *Postgres) Close() error {
+	logger.Debug("closing database connection")
+
+	return pg.db.Close()
+}
+
+// CreateGitRepo saves the Git repository in Postgres, along with `msgs`.
+// The branch is added to the project for the remote, which is created if
+// there isn't one yet.
+func (pg *Postgres) CreateGitRepo(repo GitRepo, msgs ...MessageFunc) error {
+	logger.Debugf("creating git repo for %v", repo.Remote)
 
-	_, err := pg.db.Exec(sqlinsert, repo.Remote, repo.Branch)
+	project := projectByRemote(repo.Remote)
+	err := pg.withMessages(msgs, project, project, func(tx *sql.Tx) error {
+		return insertGitRepo(tx, repo)
+	})
 	if err != nil {
 		logger.WithField("error", err).
 			Debugf("unable to create git repo for %v#%v", repo.Remote, repo.Branch)
 	}
-	return err
+	return translateErr(err)
 }
 
-// GetGitRepo returns the git repo with the given remote and branch.
+// GetGitRepo returns the git repo with the given remote and branch. It
+// returns ErrNotFound if there is no such repo.
 func (pg *Postgres) GetGitRepo(remote, branch string) (GitRepo, error) {
 	logger := logger.WithField("remote", remote)
 	logger.Debug("getting git repo from postgres")
 
 	sqlq := `
-	SELECT * FROM git_repos
+	SELECT remote, branch, url FROM git_repos
 	WHERE remote = $1 AND branch = $2;
 	`
 
 	var repo GitRepo
-	return repo, pg.db.QueryRow(sqlq, remote).Scan(&repo.Remote, &repo.Branch)
+	err := pg.db.QueryRow(sqlq, remote, branch).Scan(&repo.Remote, &repo.Branch, &repo.URL)
+	return repo, translateErr(err)
 }
 
-// GetGitRepos returns all repos.
+// GetGitRepos returns all repos, ordered by remote and branch.
 func (pg *Postgres) GetGitRepos() ([]GitRepo, error) {
 	logger.Debug("getting git repos from postgres")
 
 	sqlq := `
-	SELECT * FROM git_repos;
+	SELECT remote, branch, url FROM git_repos
+	ORDER BY remote, branch;
 	`
 
 	rows, err := pg.db.Query(sqlq)
@@ -78,7 +125,7 @@ func (pg *Postgres) GetGitRepos() ([]GitRepo, error) {
 	repos := []GitRepo{}
 	for rows.Next() {
 		repo := GitRepo{}
-		err := rows.Scan(&repo.Remote, &repo.Branch)
+		err := rows.Scan(&repo.Remote, &repo.Branch, &repo.URL)
 		if err != nil {
 			logger.WithField("error", err).Debug("unable to scan row")
 			return repos, err
@@ -88,3 +135,176 @@ func (pg *Postgres) GetGitRepos() ([]GitRepo, error) {
 
 	return repos, nil
 }
+
+// QueryGitRepos returns the repos matching `q`, in the order it asks for.
+// The filtering, ordering and limiting are all done by the database.
+func (pg *Postgres) QueryGitRepos(q GitRepoQuery) ([]GitRepo, error) {
+	logger.Debugf("querying git repos from postgres: %+v", q)
+
+	order, cmp := "ASC", ">"
+	if q.Desc {
+		order, cmp = "DESC", "<"
+	}
+
+	after := q.After != nil
+	var afterRemote, afterBranch string
+	if after {
+		afterRemote, afterBranch = q.After.Remote, q.After.Branch
+	}
+
+	var limit interface{}
+	if q.Limit > 0 {
+		limit = q.Limit
+	}
+
+	sqlq := `
+	SELECT remote, branch, url FROM git_repos
+	WHERE left(remote, length($1)) = $1
+	AND ($2 = '' OR branch ~ $2)
+	AND (NOT $3 OR (remote, branch) ` + cmp + ` ($4, $5))
+	ORDER BY remote ` + order + `, branch ` + order + `
+	LIMIT $6;
+	`
+
+	var branch string
+	if q.BranchGlob != "" {
+		branch = branches.GlobRegexp(q.BranchGlob)
+	}
+
+	rows, err := pg.db.Query(sqlq, q.RemotePrefix, branch,
+		after, afterRemote, afterBranch, limit)
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to query database")
+		return nil, err
+	}
+	defer rows.Close()
+
+	repos := []GitRepo{}
+	for rows.Next() {
+		repo := GitRepo{}
+		err := rows.Scan(&repo.Remote, &repo.Branch, &repo.URL)
+		if err != nil {
+			logger.WithField("error", err).Debug("unable to scan row")
+			return repos, err
+		}
+		repos = append(repos, repo)
+	}
+
+	return repos, rows.Err()
+}
+
+// UpdateGitRepo replaces the git repo with the given remote and branch
+// with `repo`, and saves `msgs`. It returns ErrNotFound if there is no such
+// repo and ErrConflict if `repo` already exists.
+func (pg *Postgres) UpdateGitRepo(remote, branch string, repo GitRepo, msgs ...MessageFunc) error {
+	logger := logger.WithField("remote", remote)
+	logger.Debugf("updating git repo %v#%v", remote, branch)
+
+	before, after := projectByRemote(remote), projectByRemote(repo.Remote)
+	err := pg.withMessages(msgs, before, after, func(tx *sql.Tx) error {
+		if err := deleteGitRepo(tx, remote, branch); err != nil {
+			return err
+		}
+
+		return insertGitRepo(tx, repo)
+	})
+	if err != nil {
+		logger.WithField("error", err).
+			Debugf("unable to update git repo %v#%v", remote, branch)
+	}
+	return translateErr(err)
+}
+
+// DeleteGitRepo deletes the git repo with the given remote and branch, and
+// saves `msgs`. It returns ErrNotFound if there is no such repo. The
+// project for the remote is left alone.
+func (pg *Postgres) DeleteGitRepo(remote, branch string, msgs ...MessageFunc) error {
+	logger := logger.WithField("remote", remote)
+	logger.Debugf("deleting git repo %v#%v", remote, branch)
+
+	project := projectByRemote(remote)
+	err := pg.withMessages(msgs, project, project, func(tx *sql.Tx) error {
+		return deleteGitRepo(tx, remote, branch)
+	})
+	if err != nil {
+		logger.WithField("error", err).
+			Debugf("unable to delete git repo %v#%v", remote, branch)
+	}
+	return translateErr(err)
+}
+
+// insertGitRepo starts tracking the repo's branch in the project for its
+// remote, creating the project if there isn't one yet.
+func insertGitRepo(tx *sql.Tx, repo GitRepo) error {
+	p := newGitRepoProject(repo)
+
+	sqlupsert := `
+	INSERT INTO projects (name, remote, url, default_branch, config_path, enabled)
+	VALUES
+		($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (remote) DO UPDATE
+	SET url = CASE WHEN EXCLUDED.url = '' THEN projects.url ELSE EXCLUDED.url END
+	RETURNING id;
+	`
+
+	var id int
+	err := tx.QueryRow(sqlupsert, p.Name, p.Remote, p.URL, p.DefaultBranch,
+		p.ConfigPath, p.Enabled).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO project_branches (project_id, branch) VALUES ($1, $2);`,
+		id, repo.Branch)
+	return err
+}
+
+// deleteGitRepo stops tracking the branch in the project for the remote.
+func deleteGitRepo(tx *sql.Tx, remote, branch string) error {
+	sqldelete := `
+	DELETE FROM project_branches b
+	USING projects p
+	WHERE b.project_id = p.id AND p.remote = $1 AND b.branch = $2;
+	`
+
+	res, err := tx.Exec(sqldelete, remote, branch)
+	if err != nil {
+		return err
+	}
+
+	return checkAffected(res)
+}
+
+// checkAffected returns ErrNotFound if the statement that produced `res`
+// didn't touch any rows.
+func checkAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// translateErr turns database errors callers need to tell apart into the
+// store's own errors, so that they don't need to know about Postgres.
+func translateErr(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+
+	if pqerr, ok := err.(*pq.Error); ok {
+		switch pqerr.Code.Name() {
+		case "unique_violation":
+			return ErrConflict
+		case "foreign_key_violation":
+			return ErrNotFound
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,360 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// sqlAgentColumns selects an agent along with the run it holds the lease
+// of, if any.
+const sqlAgentColumns = `
+	a.id, a.name, a.labels, a.registered_at, a.last_heartbeat,
+	COALESCE((
+		SELECT r.id FROM runs r
+		WHERE r.agent_id = a.id AND r.status IN ('running', 'cancelling')
+		ORDER BY r.id
+		LIMIT 1
+	), 0)`
+
+// RegisterAgent saves `agent`, replacing the name and labels of the agent
+// with the same ID if it has registered before. Registering counts as a
+// heartbeat.
+func (pg *Postgres) RegisterAgent(agent Agent) (Agent, error) {
+	logger := logger.WithField("agent_id", agent.ID)
+	logger.Debug("registering agent")
+
+	labels := agent.Labels
+	if labels == nil {
+		labels = []string{}
+	}
+
+	now := time.Now()
+
+	sqlupsert := `
+	INSERT INTO agents (id, name, labels, registered_at, last_heartbeat)
+	VALUES
+		($1, $2, $3, $4, $4)
+	ON CONFLICT (id) DO UPDATE
+	SET name = EXCLUDED.name, labels = EXCLUDED.labels, last_heartbeat = EXCLUDED.last_heartbeat;
+	`
+
+	_, err := pg.db.Exec(sqlupsert, agent.ID, agent.Name, pq.Array(labels), now)
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to register agent")
+		return agent, translateErr(err)
+	}
+
+	return pg.GetAgent(agent.ID)
+}
+
+// GetAgent returns the agent with the given ID. It returns ErrNotFound if
+// there is no such agent.
+func (pg *Postgres) GetAgent(id string) (Agent, error) {
+	return getAgent(pg.db, id)
+}
+
+// GetAgents returns every agent that has ever registered, by ID.
+func (pg *Postgres) GetAgents() ([]Agent, error) {
+	logger.Debug("getting agents from postgres")
+
+	sqlq := `
+	SELECT ` + sqlAgentColumns + ` FROM agents a
+	ORDER BY a.id;
+	`
+
+	rows, err := pg.db.Query(sqlq)
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to query database")
+		return nil, err
+	}
+	defer rows.Close()
+
+	agents := []Agent{}
+	for rows.Next() {
+		agent, err := scanAgent(rows)
+		if err != nil {
+			logger.WithField("error", err).Debug("unable to scan row")
+			return agents, err
+		}
+		agents = append(agents, agent)
+	}
+
+	return agents, rows.Err()
+}
+
+// HeartbeatAgent records that the agent with the given ID is still around
+// and extends the lease of the run it holds, if any, to `lease` from now.
+// It returns ErrNotFound if there is no such agent.
+func (pg *Postgres) HeartbeatAgent(id string, lease time.Duration) (Agent, error) {
+	logger := logger.WithField("agent_id", id)
+	logger.Debug("recording heartbeat")
+
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return Agent{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	res, err := tx.Exec(`UPDATE agents SET last_heartbeat = $2 WHERE id = $1;`, id, now)
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to update agent")
+		return Agent{}, err
+	}
+
+	if err := checkAffected(res); err != nil {
+		return Agent{}, err
+	}
+
+	sqlupdate := `
+	UPDATE runs
+	SET lease_expires = $2
+	WHERE agent_id = $1 AND status IN ('running', 'cancelling');
+	`
+
+	if _, err := tx.Exec(sqlupdate, id, now.Add(lease)); err != nil {
+		logger.WithField("error", err).Debug("unable to extend lease")
+		return Agent{}, err
+	}
+
+	agent, err := getAgent(tx, id)
+	if err != nil {
+		return agent, err
+	}
+
+	return agent, tx.Commit()
+}
+
+// LeaseRun leases the oldest queued run the agent with the given ID has
+// the labels for to it until `lease` from now, and moves it to running. If
+// the agent already holds a lease, that run is returned instead. It
+// returns ErrNotFound if there is no such agent or nothing for it to run.
+func (pg *Postgres) LeaseRun(agentID string, lease time.Duration) (Run, error) {
+	logger := logger.WithField("agent_id", agentID)
+	logger.Debug("leasing run")
+
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return Run{}, err
+	}
+	defer tx.Rollback()
+
+	// Locking the agent keeps two heartbeats from the same agent from
+	// each leasing it a run.
+	var labels []string
+	err = tx.QueryRow(`SELECT labels FROM agents WHERE id = $1 FOR UPDATE;`, agentID).
+		Scan(pq.Array(&labels))
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to get agent")
+		return Run{}, translateErr(err)
+	}
+	if labels == nil {
+		labels = []string{}
+	}
+
+	sqlheld := `
+	SELECT ` + sqlRunColumns + ` FROM runs
+	WHERE agent_id = $1 AND status IN ('running', 'cancelling')
+	ORDER BY id
+	LIMIT 1;
+	`
+
+	run, err := scanRun(tx.QueryRow(sqlheld, agentID))
+	if err == nil {
+		run.Steps, err = getSteps(tx, run.ID)
+		if err != nil {
+			return run, err
+		}
+
+		return run, tx.Commit()
+	}
+	if err != sql.ErrNoRows {
+		logger.WithField("error", err).Debug("unable to get held run")
+		return run, err
+	}
+
+	// Skipping locked runs lets other agents lease at the same time
+	// without waiting on each other or being handed the same run.
+	sqlq := `
+	SELECT ` + sqlRunColumns + ` FROM runs
+	WHERE status = 'queued' AND labels <@ $1
+	ORDER BY id
+	LIMIT 1
+	FOR UPDATE SKIP LOCKED;
+	`
+
+	run, err = scanRun(tx.QueryRow(sqlq, pq.Array(labels)))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logger.WithField("error", err).Debug("unable to get queued run")
+		}
+		return run, translateErr(err)
+	}
+
+	now := time.Now()
+	if err := run.Transition(RunRunning, now); err != nil {
+		return run, err
+	}
+	run.AgentID = agentID
+	run.LeaseExpires = now.Add(lease)
+
+	if err := updateRun(tx, run); err != nil {
+		logger.WithField("error", err).Debug("unable to lease run")
+		return run, err
+	}
+
+	run.Steps, err = getSteps(tx, run.ID)
+	if err != nil {
+		return run, err
+	}
+
+	return run, tx.Commit()
+}
+
+// ExpireLeases puts every running run whose lease has run out back in the
+// queue and returns them.
+func (pg *Postgres) ExpireLeases() ([]Run, error) {
+	logger.Debug("expiring leases")
+
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	sqlq := `
+	SELECT ` + sqlRunColumns + ` FROM runs
+	WHERE status = 'running' AND lease_expires < $1
+	ORDER BY id
+	FOR UPDATE SKIP LOCKED;
+	`
+
+	runs, err := queryRuns(tx, sqlq, now)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range runs {
+		if err := runs[i].Transition(RunQueued, now); err != nil {
+			return nil, err
+		}
+
+		if err := updateRun(tx, runs[i]); err != nil {
+			logger.WithField("error", err).Debug("unable to requeue run")
+			return nil, err
+		}
+	}
+
+	return runs, tx.Commit()
+}
+
+// TimeoutRuns fails every running run that has gone on for longer than
+// its timeout, or `timeout` if it doesn't have one, and cancels every run
+// that has been cancelling for longer than `cancelTimeout`. It returns
+// the runs it stopped. With a zero `timeout`, runs without a timeout of
+// their own can go on forever.
+func (pg *Postgres) TimeoutRuns(timeout, cancelTimeout time.Duration) ([]Run, error) {
+	logger.Debug("timing out runs")
+
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	sqlq := `
+	SELECT ` + sqlRunColumns + ` FROM runs
+	WHERE (
+		status = 'running' AND COALESCE(NULLIF(timeout_ms, 0), $2::bigint) > 0 AND
+		started_at + COALESCE(NULLIF(timeout_ms, 0), $2::bigint) * interval '1 millisecond' < $1
+	) OR (
+		status = 'cancelling' AND
+		cancel_requested_at + $3::bigint * interval '1 millisecond' < $1
+	)
+	ORDER BY id
+	FOR UPDATE SKIP LOCKED;
+	`
+
+	runs, err := queryRuns(tx, sqlq, now, durationMS(timeout), durationMS(cancelTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range runs {
+		to := RunFailed
+		if runs[i].Status == RunCancelling {
+			to = RunCancelled
+		}
+
+		if err := runs[i].Transition(to, now); err != nil {
+			return nil, err
+		}
+
+		if err := updateRun(tx, runs[i]); err != nil {
+			logger.WithField("error", err).Debug("unable to stop run")
+			return nil, err
+		}
+	}
+
+	return runs, tx.Commit()
+}
+
+// queryRuns returns the runs selected by `sqlq`, without their steps.
+func queryRuns(q querier, sqlq string, args ...interface{}) ([]Run, error) {
+	rows, err := q.Query(sqlq, args...)
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to query database")
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []Run{}
+	for rows.Next() {
+		run, err := scanRun(rows)
+		if err != nil {
+			logger.WithField("error", err).Debug("unable to scan row")
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
+
+// querier is either an *sql.DB or *sql.Tx.
+type querier interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+	QueryRow(string, ...interface{}) *sql.Row
+}
+
+func getAgent(q querier, id string) (Agent, error) {
+	sqlq := `
+	SELECT ` + sqlAgentColumns + ` FROM agents a
+	WHERE a.id = $1;
+	`
+
+	agent, err := scanAgent(q.QueryRow(sqlq, id))
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to get agent")
+	}
+	return agent, translateErr(err)
+}
+
+func scanAgent(row scanner) (Agent, error) {
+	var agent Agent
+
+	err := row.Scan(&agent.ID, &agent.Name, pq.Array(&agent.Labels),
+		&agent.RegisteredAt, &agent.LastHeartbeat, &agent.RunID)
+	if len(agent.Labels) == 0 {
+		agent.Labels = nil
+	}
+
+	return agent, err
+}
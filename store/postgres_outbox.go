@@ -0,0 +1,185 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// withMessages runs `f` in a transaction and saves the messages `fns`
+// build to the outbox as part of the same transaction. They're built from
+// the project `before` finds before `f` runs and the one `after` finds
+// once it's done. Either can be nil for changes with no project on that
+// side of them.
+func (pg *Postgres) withMessages(fns []MessageFunc, before, after projectFinder, f func(*sql.Tx) error) error {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var old *Project
+	if len(fns) > 0 && before != nil {
+		if old, err = before(tx); err != nil {
+			return err
+		}
+	}
+
+	if err := f(tx); err != nil {
+		return err
+	}
+
+	msgs := []Message{}
+	if len(fns) > 0 {
+		var new *Project
+		if after != nil {
+			if new, err = after(tx); err != nil {
+				return err
+			}
+		}
+
+		for _, fn := range fns {
+			msgs = append(msgs, fn(old, new)...)
+		}
+	}
+
+	sqlinsert := `
+	INSERT INTO outbox (subject, payload)
+	VALUES
+		($1, $2);
+	`
+
+	for _, msg := range msgs {
+		if _, err := tx.Exec(sqlinsert, msg.Subject, msg.Payload); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// projectFinder finds the project a change is about within its
+// transaction, or returns nil if there isn't one.
+type projectFinder func(*sql.Tx) (*Project, error)
+
+// lockProject returns a projectFinder for the project matching `where`,
+// which is locked until the transaction ends so that nothing else can
+// change it in between the change and the messages about it being built.
+func lockProject(where string, arg func() interface{}) projectFinder {
+	return func(tx *sql.Tx) (*Project, error) {
+		var id int
+		err := tx.QueryRow(`SELECT id FROM projects p WHERE `+where+` FOR UPDATE;`, arg()).
+			Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := scanProject(tx.QueryRow(sqlProjectSelect+`WHERE p.id = $1`+sqlProjectGroup, id))
+		if err != nil {
+			return nil, err
+		}
+
+		return &p, nil
+	}
+}
+
+// projectByRemote finds the project for `remote`.
+func projectByRemote(remote string) projectFinder {
+	return lockProject(`p.remote = $1`, func() interface{} {
+		return remote
+	})
+}
+
+// projectByID finds the project with the ID `id` points to, which may
+// only be known once the change has been made.
+func projectByID(id *int) projectFinder {
+	return lockProject(`p.id = $1`, func() interface{} {
+		return *id
+	})
+}
+
+// GetPendingMessages returns up to `limit` undelivered messages that are
+// due to be sent, oldest first.
+func (pg *Postgres) GetPendingMessages(limit int) ([]Message, error) {
+	logger.Debug("getting pending messages from postgres")
+
+	sqlq := `
+	SELECT id, subject, payload, created_at, attempts, last_error, next_attempt_at
+	FROM outbox
+	WHERE delivered_at IS NULL AND next_attempt_at <= now()
+	ORDER BY id
+	LIMIT $1;
+	`
+
+	rows, err := pg.db.Query(sqlq, limit)
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to query database")
+		return nil, err
+	}
+	defer rows.Close()
+
+	msgs := []Message{}
+	for rows.Next() {
+		var msg Message
+		err := rows.Scan(&msg.ID, &msg.Subject, &msg.Payload, &msg.CreatedAt,
+			&msg.Attempts, &msg.LastError, &msg.NextAttemptAt)
+		if err != nil {
+			logger.WithField("error", err).Debug("unable to scan row")
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, rows.Err()
+}
+
+// CountPendingMessages returns how many messages haven't been delivered
+// yet, whether or not they're due.
+func (pg *Postgres) CountPendingMessages() (int, error) {
+	sqlq := `
+	SELECT count(*) FROM outbox
+	WHERE delivered_at IS NULL;
+	`
+
+	var n int
+	return n, pg.db.QueryRow(sqlq).Scan(&n)
+}
+
+// MarkMessageDelivered records that the message with the given ID has
+// been published. It returns ErrNotFound if there is no such message.
+func (pg *Postgres) MarkMessageDelivered(id int) error {
+	sqlupdate := `
+	UPDATE outbox
+	SET delivered_at = now()
+	WHERE id = $1;
+	`
+
+	res, err := pg.db.Exec(sqlupdate, id)
+	if err != nil {
+		logger.WithField("error", err).Debugf("unable to mark message %v delivered", id)
+		return err
+	}
+
+	return checkAffected(res)
+}
+
+// MarkMessageFailed records a failed attempt at publishing the message
+// with the given ID, and when to try again. It returns ErrNotFound if there
+// is no such message.
+func (pg *Postgres) MarkMessageFailed(id int, reason string, next time.Time) error {
+	sqlupdate := `
+	UPDATE outbox
+	SET attempts = attempts + 1, last_error = $2, next_attempt_at = $3
+	WHERE id = $1;
+	`
+
+	res, err := pg.db.Exec(sqlupdate, id, reason, next)
+	if err != nil {
+		logger.WithField("error", err).Debugf("unable to mark message %v failed", id)
+		return err
+	}
+
+	return checkAffected(res)
+}
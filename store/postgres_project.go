@@ -0,0 +1,224 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// sqlProjectSelect selects projects along with their tracked branches.
+// It needs a WHERE clause, if any, followed by sqlProjectGroup.
+const sqlProjectSelect = `
+	SELECT p.id, p.name, p.remote, p.url, p.default_branch, p.credentials,
+		p.config_path, p.enabled, p.created_at,
+		COALESCE(array_agg(b.branch ORDER BY b.branch) FILTER (WHERE b.branch IS NOT NULL), '{}')
+	FROM projects p
+	LEFT JOIN project_branches b ON b.project_id = p.id
+`
+
+const sqlProjectGroup = `
+	GROUP BY p.id
+`
+
+// CreateProject saves a new project in Postgres, along with `msgs`, and
+// returns it with its ID set. It returns ErrConflict if there already is
+// a project for the remote.
+func (pg *Postgres) CreateProject(p Project, msgs ...MessageFunc) (Project, error) {
+	logger := logger.WithField("remote", p.Remote)
+	logger.Debug("creating project")
+
+	p.CreatedAt = time.Now()
+	p.Branches = sortedBranches(p.Branches)
+
+	sqlinsert := `
+	INSERT INTO projects (name, remote, url, default_branch, credentials,
+		config_path, enabled, created_at)
+	VALUES
+		($1, $2, $3, $4, $5, $6, $7, $8)
+	RETURNING id;
+	`
+
+	err := pg.withMessages(msgs, nil, projectByID(&p.ID), func(tx *sql.Tx) error {
+		err := tx.QueryRow(sqlinsert, p.Name, p.Remote, p.URL, p.DefaultBranch,
+			p.Credentials, p.ConfigPath, p.Enabled, p.CreatedAt).Scan(&p.ID)
+		if err != nil {
+			return err
+		}
+
+		return insertBranches(tx, p)
+	})
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to create project")
+	}
+	return p, translateErr(err)
+}
+
+// GetProject returns the project with the given ID. It returns ErrNotFound
+// if there is no such project.
+func (pg *Postgres) GetProject(id int) (Project, error) {
+	logger := logger.WithField("project_id", id)
+	logger.Debug("getting project from postgres")
+
+	sqlq := sqlProjectSelect + `WHERE p.id = $1` + sqlProjectGroup
+
+	p, err := scanProject(pg.db.QueryRow(sqlq, id))
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to get project")
+	}
+	return p, translateErr(err)
+}
+
+// GetProjectByRemote returns the project for the canonical `remote`. It
+// returns ErrNotFound if there is no such project.
+func (pg *Postgres) GetProjectByRemote(remote string) (Project, error) {
+	logger := logger.WithField("remote", remote)
+	logger.Debug("getting project from postgres")
+
+	sqlq := sqlProjectSelect + `WHERE p.remote = $1` + sqlProjectGroup
+
+	p, err := scanProject(pg.db.QueryRow(sqlq, remote))
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to get project")
+	}
+	return p, translateErr(err)
+}
+
+// GetProjects returns all projects, oldest first.
+func (pg *Postgres) GetProjects() ([]Project, error) {
+	logger.Debug("getting projects from postgres")
+
+	sqlq := sqlProjectSelect + sqlProjectGroup + `ORDER BY p.id`
+
+	rows, err := pg.db.Query(sqlq)
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to query database")
+		return nil, err
+	}
+	defer rows.Close()
+
+	projects := []Project{}
+	for rows.Next() {
+		p, err := scanProject(rows)
+		if err != nil {
+			logger.WithField("error", err).Debug("unable to scan row")
+			return projects, err
+		}
+		projects = append(projects, p)
+	}
+
+	return projects, rows.Err()
+}
+
+// UpdateProject replaces the project with the same ID as `p`, saves
+// `msgs`, and returns the updated project. Its branches are only replaced
+// if `p` has any, so branches tracked since `p` was read aren't lost. It
+// returns ErrNotFound if there is no such project and ErrConflict if
+// another project has its remote.
+func (pg *Postgres) UpdateProject(p Project, msgs ...MessageFunc) (Project, error) {
+	logger := logger.WithField("project_id", p.ID)
+	logger.Debug("updating project")
+
+	keepBranches := p.Branches == nil
+	p.Branches = sortedBranches(p.Branches)
+
+	sqlupdate := `
+	UPDATE projects
+	SET name = $2, remote = $3, url = $4, default_branch = $5,
+		credentials = $6, config_path = $7, enabled = $8
+	WHERE id = $1
+	RETURNING created_at;
+	`
+
+	project := projectByID(&p.ID)
+	err := pg.withMessages(msgs, project, project, func(tx *sql.Tx) error {
+		err := tx.QueryRow(sqlupdate, p.ID, p.Name, p.Remote, p.URL, p.DefaultBranch,
+			p.Credentials, p.ConfigPath, p.Enabled).Scan(&p.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		if keepBranches {
+			p.Branches, err = getBranches(tx, p.ID)
+			return err
+		}
+
+		_, err = tx.Exec(`DELETE FROM project_branches WHERE project_id = $1;`, p.ID)
+		if err != nil {
+			return err
+		}
+
+		return insertBranches(tx, p)
+	})
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to update project")
+	}
+	return p, translateErr(err)
+}
+
+// DeleteProject deletes the project with the given ID, along with its
+// tracked branches, and saves `msgs`. It returns ErrNotFound if there is
+// no such project.
+func (pg *Postgres) DeleteProject(id int, msgs ...MessageFunc) error {
+	logger := logger.WithField("project_id", id)
+	logger.Debug("deleting project")
+
+	err := pg.withMessages(msgs, projectByID(&id), nil, func(tx *sql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM projects WHERE id = $1;`, id)
+		if err != nil {
+			return err
+		}
+
+		return checkAffected(res)
+	})
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to delete project")
+	}
+	return translateErr(err)
+}
+
+func insertBranches(tx *sql.Tx, p Project) error {
+	for _, branch := range p.Branches {
+		_, err := tx.Exec(`INSERT INTO project_branches (project_id, branch) VALUES ($1, $2);`,
+			p.ID, branch)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getBranches(q querier, id int) ([]string, error) {
+	sqlq := `
+	SELECT branch FROM project_branches
+	WHERE project_id = $1
+	ORDER BY branch;
+	`
+
+	rows, err := q.Query(sqlq, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	branches := []string{}
+	for rows.Next() {
+		var branch string
+		if err := rows.Scan(&branch); err != nil {
+			return branches, err
+		}
+		branches = append(branches, branch)
+	}
+
+	return branches, rows.Err()
+}
+
+func scanProject(row scanner) (Project, error) {
+	p := Project{}
+	err := row.Scan(&p.ID, &p.Name, &p.Remote, &p.URL, &p.DefaultBranch,
+		&p.Credentials, &p.ConfigPath, &p.Enabled, &p.CreatedAt,
+		pq.Array(&p.Branches))
+
+	return p, err
+}
@@ -0,0 +1,313 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const sqlRunColumns = `id, remote, branch, commit, trigger, task, args, labels, status, agent_id, lease_expires, timeout_ms, cancel_requested_at, created_at, started_at, finished_at`
+
+// CreateRun saves a new queued run in Postgres and returns it with its
+// ID set.
+func (pg *Postgres) CreateRun(run Run) (Run, error) {
+	logger := logger.WithField("remote", run.Remote)
+	logger.Debugf("creating run for %v#%v", run.Remote, run.Branch)
+
+	run.Status = RunQueued
+	run.CreatedAt = time.Now()
+
+	args := []byte("{}")
+	if len(run.Args) > 0 {
+		var err error
+		if args, err = json.Marshal(run.Args); err != nil {
+			return run, err
+		}
+	}
+
+	// A nil slice would go in as NULL, which the column doesn't allow.
+	labels := run.Labels
+	if labels == nil {
+		labels = []string{}
+	}
+
+	sqlinsert := `
+	INSERT INTO runs (remote, branch, commit, trigger, task, args, labels, status, timeout_ms, created_at)
+	VALUES
+		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	RETURNING id;
+	`
+
+	err := pg.db.QueryRow(sqlinsert, run.Remote, run.Branch, run.Commit,
+		run.Trigger, run.Task, string(args), pq.Array(labels), run.Status,
+		durationMS(run.Timeout), run.CreatedAt).Scan(&run.ID)
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to create run")
+	}
+	return run, translateErr(err)
+}
+
+// GetRun returns the run with the given ID, along with its steps. It
+// returns ErrNotFound if there is no such run.
+func (pg *Postgres) GetRun(id int) (Run, error) {
+	logger := logger.WithField("run_id", id)
+	logger.Debug("getting run from postgres")
+
+	sqlq := `
+	SELECT ` + sqlRunColumns + ` FROM runs
+	WHERE id = $1;
+	`
+
+	run, err := scanRun(pg.db.QueryRow(sqlq, id))
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to get run")
+		return run, translateErr(err)
+	}
+
+	run.Steps, err = getSteps(pg.db, id)
+	return run, err
+}
+
+// GetRuns returns all the runs for the repo with the given remote, newest
+// first. If `branch` isn't empty, only runs for that branch are returned.
+func (pg *Postgres) GetRuns(remote, branch string) ([]Run, error) {
+	logger := logger.WithField("remote", remote)
+	logger.Debug("getting runs from postgres")
+
+	sqlq := `
+	SELECT ` + sqlRunColumns + ` FROM runs
+	WHERE remote = $1 AND ($2 = '' OR branch = $2)
+	ORDER BY id DESC;
+	`
+
+	rows, err := pg.db.Query(sqlq, remote, branch)
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to query database")
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []Run{}
+	for rows.Next() {
+		run, err := scanRun(rows)
+		if err != nil {
+			logger.WithField("error", err).Debug("unable to scan row")
+			return runs, err
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
+
+// UpdateRunStatus moves the run with the given ID to `status` and returns
+// the updated run. It returns ErrIllegalTransition if the run can't move
+// to `status` from the one it's in.
+func (pg *Postgres) UpdateRunStatus(id int, status RunStatus) (Run, error) {
+	logger := logger.WithField("run_id", id)
+	logger.Debugf("moving run to %v", status)
+
+	return pg.changeRun(id, func(run *Run) error {
+		return run.Transition(status, time.Now())
+	})
+}
+
+// CancelRun cancels the run with the given ID as far as Run.Cancel can
+// take it and returns the updated run.
+func (pg *Postgres) CancelRun(id int) (Run, error) {
+	logger.WithField("run_id", id).Debug("cancelling run")
+
+	return pg.changeRun(id, func(run *Run) error {
+		return run.Cancel(time.Now())
+	})
+}
+
+// changeRun applies `change` to the run with the given ID while holding a
+// lock on it, and saves the result if `change` doesn't return an error.
+func (pg *Postgres) changeRun(id int, change func(*Run) error) (Run, error) {
+	logger := logger.WithField("run_id", id)
+
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return Run{}, err
+	}
+	defer tx.Rollback()
+
+	sqlq := `
+	SELECT ` + sqlRunColumns + ` FROM runs
+	WHERE id = $1
+	FOR UPDATE;
+	`
+
+	run, err := scanRun(tx.QueryRow(sqlq, id))
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to get run")
+		return run, translateErr(err)
+	}
+
+	if err := change(&run); err != nil {
+		logger.WithField("error", err).Debugf("unable to change run from %v", run.Status)
+		return run, err
+	}
+
+	if err := updateRun(tx, run); err != nil {
+		logger.WithField("error", err).Debug("unable to update run")
+		return run, err
+	}
+
+	return run, tx.Commit()
+}
+
+// CreateStep saves a new step and returns it with its ID set. If the run
+// already has a step for the task, that one is returned instead, so
+// servers racing to create the same step all end up with the same one.
+// It returns ErrNotFound if the step's run doesn't exist.
+func (pg *Postgres) CreateStep(step Step) (Step, error) {
+	logger := logger.WithField("run_id", step.RunID)
+	logger.Debugf("creating step for task %v", step.Task)
+
+	// Updating the task to itself on conflict is what gets the existing
+	// step returned, since DO NOTHING returns no rows.
+	sqlinsert := `
+	INSERT INTO steps (run_id, task, exit_code, started_at, finished_at)
+	VALUES
+		($1, $2, $3, $4, $5)
+	ON CONFLICT (run_id, task) DO UPDATE SET task = EXCLUDED.task
+	RETURNING id, exit_code, started_at, finished_at;
+	`
+
+	var started, finished pq.NullTime
+	err := pg.db.QueryRow(sqlinsert, step.RunID, step.Task, step.ExitCode,
+		nullTime(step.StartedAt), nullTime(step.FinishedAt)).
+		Scan(&step.ID, &step.ExitCode, &started, &finished)
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to create step")
+		return step, translateErr(err)
+	}
+
+	step.StartedAt = started.Time
+	step.FinishedAt = finished.Time
+	return step, nil
+}
+
+// UpdateStep saves the exit code and timings of `step`. It returns
+// ErrNotFound if there is no such step.
+func (pg *Postgres) UpdateStep(step Step) error {
+	logger := logger.WithField("step_id", step.ID)
+	logger.Debug("updating step")
+
+	sqlupdate := `
+	UPDATE steps
+	SET exit_code = $2, started_at = $3, finished_at = $4
+	WHERE id = $1;
+	`
+
+	res, err := pg.db.Exec(sqlupdate, step.ID, step.ExitCode,
+		nullTime(step.StartedAt), nullTime(step.FinishedAt))
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to update step")
+		return err
+	}
+
+	return checkAffected(res)
+}
+
+func getSteps(q querier, runID int) ([]Step, error) {
+	sqlq := `
+	SELECT id, run_id, task, exit_code, started_at, finished_at FROM steps
+	WHERE run_id = $1
+	ORDER BY id;
+	`
+
+	rows, err := q.Query(sqlq, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	steps := []Step{}
+	for rows.Next() {
+		var step Step
+		var started, finished pq.NullTime
+
+		err := rows.Scan(&step.ID, &step.RunID, &step.Task, &step.ExitCode,
+			&started, &finished)
+		if err != nil {
+			return steps, err
+		}
+
+		step.StartedAt = started.Time
+		step.FinishedAt = finished.Time
+		steps = append(steps, step)
+	}
+
+	return steps, rows.Err()
+}
+
+// updateRun saves everything about `run` that changes as it moves between
+// statuses.
+func updateRun(tx *sql.Tx, run Run) error {
+	sqlupdate := `
+	UPDATE runs
+	SET status = $2, agent_id = $3, lease_expires = $4, cancel_requested_at = $5,
+		started_at = $6, finished_at = $7
+	WHERE id = $1;
+	`
+
+	_, err := tx.Exec(sqlupdate, run.ID, run.Status, run.AgentID, nullTime(run.LeaseExpires),
+		nullTime(run.CancelRequestedAt), nullTime(run.StartedAt), nullTime(run.FinishedAt))
+	return err
+}
+
+// scanner is either an *sql.Row or *sql.Rows.
+type scanner interface {
+	Scan(...interface{}) error
+}
+
+func scanRun(row scanner) (Run, error) {
+	var run Run
+	var args []byte
+	var timeout int64
+	var lease, cancelRequested, started, finished pq.NullTime
+
+	err := row.Scan(&run.ID, &run.Remote, &run.Branch, &run.Commit, &run.Trigger,
+		&run.Task, &args, pq.Array(&run.Labels), &run.Status, &run.AgentID, &lease,
+		&timeout, &cancelRequested, &run.CreatedAt, &started, &finished)
+	if err != nil {
+		return run, err
+	}
+
+	// Runs without arguments come back without any, like they went in.
+	if string(args) != "{}" {
+		if err := json.Unmarshal(args, &run.Args); err != nil {
+			return run, err
+		}
+	}
+
+	if len(run.Labels) == 0 {
+		run.Labels = nil
+	}
+
+	run.Timeout = time.Duration(timeout) * time.Millisecond
+	run.LeaseExpires = lease.Time
+	run.CancelRequestedAt = cancelRequested.Time
+	run.StartedAt = started.Time
+	run.FinishedAt = finished.Time
+	return run, err
+}
+
+// durationMS turns `d` into whole milliseconds, the way durations are
+// stored.
+func durationMS(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// nullTime turns zero times into NULLs.
+func nullTime(t time.Time) pq.NullTime {
+	return pq.NullTime{
+		Time:  t,
+		Valid: !t.IsZero(),
+	}
+}
@@ -0,0 +1,226 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const sqlScheduleColumns = `id, project_id, branch, cron, timezone, task, args, labels, enabled, next_fire_at, last_fired_at, created_at`
+
+// CreateSchedule saves a new schedule and returns it with its ID set. It
+// returns ErrNotFound if its project doesn't exist.
+func (pg *Postgres) CreateSchedule(sched Schedule) (Schedule, error) {
+	logger := logger.WithField("project_id", sched.ProjectID)
+	logger.Debug("creating schedule")
+
+	sched.CreatedAt = time.Now()
+	sched.LastFiredAt = time.Time{}
+
+	args, labels, err := scheduleParams(sched)
+	if err != nil {
+		return sched, err
+	}
+
+	sqlinsert := `
+	INSERT INTO schedules (project_id, branch, cron, timezone, task, args, labels, enabled, next_fire_at, created_at)
+	VALUES
+		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	RETURNING id;
+	`
+
+	err = pg.db.QueryRow(sqlinsert, sched.ProjectID, sched.Branch, sched.Cron,
+		sched.Timezone, sched.Task, args, labels, sched.Enabled,
+		nullTime(sched.NextFireAt), sched.CreatedAt).Scan(&sched.ID)
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to create schedule")
+	}
+	return sched, translateErr(err)
+}
+
+// GetSchedule returns the schedule with the given ID. It returns
+// ErrNotFound if there is no such schedule.
+func (pg *Postgres) GetSchedule(id int) (Schedule, error) {
+	sqlq := `
+	SELECT ` + sqlScheduleColumns + ` FROM schedules
+	WHERE id = $1;
+	`
+
+	sched, err := scanSchedule(pg.db.QueryRow(sqlq, id))
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to get schedule")
+	}
+	return sched, translateErr(err)
+}
+
+// GetSchedules returns the schedules of the project with the given ID,
+// oldest first. A zero ID returns every project's schedules.
+func (pg *Postgres) GetSchedules(projectID int) ([]Schedule, error) {
+	logger.Debug("getting schedules from postgres")
+
+	sqlq := `
+	SELECT ` + sqlScheduleColumns + ` FROM schedules
+	WHERE $1 = 0 OR project_id = $1
+	ORDER BY id;
+	`
+
+	return pg.querySchedules(sqlq, projectID)
+}
+
+// UpdateSchedule replaces the schedule with the same ID as `sched` and
+// returns it. Its project, creation time and last firing are kept. It
+// returns ErrNotFound if there is no such schedule.
+func (pg *Postgres) UpdateSchedule(sched Schedule) (Schedule, error) {
+	logger := logger.WithField("schedule_id", sched.ID)
+	logger.Debug("updating schedule")
+
+	args, labels, err := scheduleParams(sched)
+	if err != nil {
+		return sched, err
+	}
+
+	sqlupdate := `
+	UPDATE schedules
+	SET branch = $2, cron = $3, timezone = $4, task = $5, args = $6, labels = $7,
+		enabled = $8, next_fire_at = $9
+	WHERE id = $1
+	RETURNING ` + sqlScheduleColumns + `;
+	`
+
+	sched, err = scanSchedule(pg.db.QueryRow(sqlupdate, sched.ID, sched.Branch,
+		sched.Cron, sched.Timezone, sched.Task, args, labels, sched.Enabled,
+		nullTime(sched.NextFireAt)))
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to update schedule")
+	}
+	return sched, translateErr(err)
+}
+
+// DeleteSchedule deletes the schedule with the given ID. It returns
+// ErrNotFound if there is no such schedule.
+func (pg *Postgres) DeleteSchedule(id int) error {
+	logger := logger.WithField("schedule_id", id)
+	logger.Debug("deleting schedule")
+
+	res, err := pg.db.Exec(`DELETE FROM schedules WHERE id = $1;`, id)
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to delete schedule")
+		return err
+	}
+
+	return checkAffected(res)
+}
+
+// GetDueSchedules returns the enabled schedules due to fire at or before
+// `now`, the ones that have been due the longest first.
+func (pg *Postgres) GetDueSchedules(now time.Time) ([]Schedule, error) {
+	sqlq := `
+	SELECT ` + sqlScheduleColumns + ` FROM schedules
+	WHERE enabled AND next_fire_at <= $1
+	ORDER BY next_fire_at, id;
+	`
+
+	return pg.querySchedules(sqlq, now)
+}
+
+// FireSchedule records the schedule with the given ID as fired at `at`,
+// moves it on to fire next at `next` and returns it. It returns
+// ErrConflict unless the schedule is enabled and still due to fire at
+// `at`, which it isn't once someone else has fired it, and ErrNotFound
+// if there is no such schedule.
+func (pg *Postgres) FireSchedule(id int, at, next time.Time) (Schedule, error) {
+	logger := logger.WithField("schedule_id", id)
+
+	// Only one of any number of servers firing the same schedule at
+	// once finds it still due at `at`.
+	sqlupdate := `
+	UPDATE schedules
+	SET last_fired_at = $2, next_fire_at = $3
+	WHERE id = $1 AND enabled AND next_fire_at = $2
+	RETURNING ` + sqlScheduleColumns + `;
+	`
+
+	sched, err := scanSchedule(pg.db.QueryRow(sqlupdate, id, at, nullTime(next)))
+	if err != sql.ErrNoRows {
+		if err != nil {
+			logger.WithField("error", err).Debug("unable to fire schedule")
+		}
+		return sched, err
+	}
+
+	if sched, err = pg.GetSchedule(id); err != nil {
+		return sched, err
+	}
+
+	return sched, ErrConflict
+}
+
+func (pg *Postgres) querySchedules(sqlq string, args ...interface{}) ([]Schedule, error) {
+	rows, err := pg.db.Query(sqlq, args...)
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to query database")
+		return nil, err
+	}
+	defer rows.Close()
+
+	scheds := []Schedule{}
+	for rows.Next() {
+		sched, err := scanSchedule(rows)
+		if err != nil {
+			logger.WithField("error", err).Debug("unable to scan row")
+			return scheds, err
+		}
+		scheds = append(scheds, sched)
+	}
+
+	return scheds, rows.Err()
+}
+
+// scheduleParams returns the arguments and labels of `sched` the way
+// they're stored.
+func scheduleParams(sched Schedule) (string, interface{}, error) {
+	args := []byte("{}")
+	if len(sched.Args) > 0 {
+		var err error
+		if args, err = json.Marshal(sched.Args); err != nil {
+			return "", nil, err
+		}
+	}
+
+	// A nil slice would go in as NULL, which the column doesn't allow.
+	labels := sched.Labels
+	if labels == nil {
+		labels = []string{}
+	}
+
+	return string(args), pq.Array(labels), nil
+}
+
+func scanSchedule(row scanner) (Schedule, error) {
+	var sched Schedule
+	var args []byte
+	var next, last pq.NullTime
+
+	err := row.Scan(&sched.ID, &sched.ProjectID, &sched.Branch, &sched.Cron,
+		&sched.Timezone, &sched.Task, &args, pq.Array(&sched.Labels),
+		&sched.Enabled, &next, &last, &sched.CreatedAt)
+	if err != nil {
+		return sched, err
+	}
+
+	if string(args) != "{}" {
+		if err := json.Unmarshal(args, &sched.Args); err != nil {
+			return sched, err
+		}
+	}
+
+	if len(sched.Labels) == 0 {
+		sched.Labels = nil
+	}
+
+	sched.NextFireAt = next.Time
+	sched.LastFiredAt = last.Time
+	return sched, nil
+}
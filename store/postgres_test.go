@@ -0,0 +1,189 @@
+package store_test
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/run-ci/run-server/store"
+	"github.com/run-ci/run-server/storetest"
+)
+
+// TestPostgres needs a database it's allowed to wipe, given as a connection
+// string in RUN_TEST_POSTGRES_URL.
+func TestPostgres(t *testing.T) {
+	connstr := os.Getenv("RUN_TEST_POSTGRES_URL")
+	if connstr == "" {
+		t.Skip("RUN_TEST_POSTGRES_URL not set")
+	}
+
+	m, err := store.NewMigrator(connstr)
+	if err != nil {
+		t.Fatalf("got error connecting to postgres: %v", err)
+	}
+	defer m.Close()
+
+	if err := m.Up(); err != nil {
+		t.Fatalf("got error migrating database: %v", err)
+	}
+
+	db, err := sql.Open("postgres", connstr)
+	if err != nil {
+		t.Fatalf("got error connecting to postgres: %v", err)
+	}
+	defer db.Close()
+
+	storetest.Run(t, func(t *testing.T) store.Repo {
+		_, err := db.Exec(`TRUNCATE projects, project_branches, schedules, runs, steps, outbox, tokens, agents RESTART IDENTITY CASCADE;`)
+		if err != nil {
+			t.Fatalf("got error truncating tables: %v", err)
+		}
+
+		st, err := store.NewPostgres(connstr)
+		if err != nil {
+			t.Fatalf("got error connecting to postgres: %v", err)
+		}
+
+		return st
+	})
+}
+
+// TestMigratorConcurrent runs migrations from two migrators at once, which
+// must take turns rather than apply anything twice.
+func TestMigratorConcurrent(t *testing.T) {
+	connstr := os.Getenv("RUN_TEST_POSTGRES_URL")
+	if connstr == "" {
+		t.Skip("RUN_TEST_POSTGRES_URL not set")
+	}
+
+	migrators := make([]*store.Migrator, 2)
+	for i := range migrators {
+		m, err := store.NewMigrator(connstr)
+		if err != nil {
+			t.Fatalf("got error connecting to postgres: %v", err)
+		}
+		defer m.Close()
+
+		migrators[i] = m
+	}
+
+	if err := migrators[0].Up(); err != nil {
+		t.Fatalf("got error migrating database: %v", err)
+	}
+	if err := migrators[0].Down(); err != nil {
+		t.Fatalf("got error reverting migration: %v", err)
+	}
+
+	errs := make(chan error, len(migrators))
+	for _, m := range migrators {
+		go func(m *store.Migrator) {
+			errs <- m.Up()
+		}(m)
+	}
+
+	for range migrators {
+		if err := <-errs; err != nil {
+			t.Fatalf("got error migrating database: %v", err)
+		}
+	}
+
+	if _, err := store.NewPostgres(connstr); err != nil {
+		t.Fatalf("got error connecting to migrated database: %v", err)
+	}
+}
+
+// TestMigrateCanonicalRemotes saves projects and runs the way they were
+// before remotes were canonicalized, and checks that migrating brings them
+// over to canonical remotes.
+func TestMigrateCanonicalRemotes(t *testing.T) {
+	connstr := os.Getenv("RUN_TEST_POSTGRES_URL")
+	if connstr == "" {
+		t.Skip("RUN_TEST_POSTGRES_URL not set")
+	}
+
+	m, err := store.NewMigrator(connstr)
+	if err != nil {
+		t.Fatalf("got error connecting to postgres: %v", err)
+	}
+	defer m.Close()
+
+	if err := m.Up(); err != nil {
+		t.Fatalf("got error migrating database: %v", err)
+	}
+	if err := m.Down(); err != nil {
+		t.Fatalf("got error reverting migration: %v", err)
+	}
+
+	db, err := sql.Open("postgres", connstr)
+	if err != nil {
+		t.Fatalf("got error connecting to postgres: %v", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`
+	TRUNCATE projects, project_branches, schedules, runs, steps RESTART IDENTITY CASCADE;
+
+	INSERT INTO projects (name, remote, default_branch)
+	VALUES
+		('y', 'https://github.com/x/y.git', 'master'),
+		('y', 'git@GitHub.com:x/y.git', 'master');
+
+	INSERT INTO project_branches (project_id, branch)
+	VALUES (1, 'master'), (2, 'master'), (2, 'develop');
+
+	INSERT INTO schedules (project_id, cron, task, created_at)
+	VALUES (2, '@daily', 'nightly', now());
+
+	INSERT INTO runs (remote, branch, commit, trigger, status, created_at)
+	VALUES ('https://github.com/x/y.git', 'master', 'abc', 'poll', 'queued', now());
+	`)
+	if err != nil {
+		t.Fatalf("got error saving old remotes: %v", err)
+	}
+
+	if err := m.Up(); err != nil {
+		t.Fatalf("got error migrating database: %v", err)
+	}
+
+	st, err := store.NewPostgres(connstr)
+	if err != nil {
+		t.Fatalf("got error connecting to migrated database: %v", err)
+	}
+	defer st.Close()
+
+	projects, err := st.GetProjects()
+	if err != nil {
+		t.Fatalf("got error getting projects: %v", err)
+	}
+
+	if len(projects) != 1 {
+		t.Fatalf("expected projects for the same remote to be merged, got %+v", projects)
+	}
+
+	p := projects[0]
+	if p.ID != 1 || p.Remote != "github.com/x/y" || p.URL != "https://github.com/x/y.git" {
+		t.Fatalf("expected project 1 with canonical remote and original URL, got %+v", p)
+	}
+
+	for _, branch := range []string{"master", "develop"} {
+		if _, err := st.GetGitRepo("github.com/x/y", branch); err != nil {
+			t.Fatalf("got error getting %v by canonical remote: %v", branch, err)
+		}
+	}
+
+	scheds, err := st.GetSchedules(1)
+	if err != nil {
+		t.Fatalf("got error getting schedules: %v", err)
+	}
+	if len(scheds) != 1 {
+		t.Fatalf("expected the merged project's schedule to move, got %v", scheds)
+	}
+
+	runs, err := st.GetRuns("github.com/x/y", "")
+	if err != nil {
+		t.Fatalf("got error getting runs: %v", err)
+	}
+	if len(runs) != 1 {
+		t.Fatalf("expected run to be found by canonical remote, got %v", runs)
+	}
+}
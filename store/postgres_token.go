@@ -0,0 +1,99 @@
+package store
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const sqlTokenColumns = `id, name, hash, scopes, created_at`
+
+// CreateToken saves a new API token and returns it with its ID set. It
+// returns ErrConflict if a token with the same hash already exists.
+func (pg *Postgres) CreateToken(token Token) (Token, error) {
+	logger := logger.WithField("token", token.Name)
+	logger.Debug("creating token")
+
+	token.CreatedAt = time.Now()
+
+	sqlinsert := `
+	INSERT INTO tokens (name, hash, scopes, created_at)
+	VALUES
+		($1, $2, $3, $4)
+	RETURNING id;
+	`
+
+	err := pg.db.QueryRow(sqlinsert, token.Name, token.Hash,
+		pq.Array(token.Scopes), token.CreatedAt).Scan(&token.ID)
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to create token")
+	}
+	return token, translateErr(err)
+}
+
+// GetTokenByHash returns the token with the given hash. It returns
+// ErrNotFound if there is no such token.
+func (pg *Postgres) GetTokenByHash(hash string) (Token, error) {
+	sqlq := `
+	SELECT ` + sqlTokenColumns + ` FROM tokens
+	WHERE hash = $1;
+	`
+
+	token, err := scanToken(pg.db.QueryRow(sqlq, hash))
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to get token")
+	}
+	return token, translateErr(err)
+}
+
+// GetTokens returns all tokens, oldest first.
+func (pg *Postgres) GetTokens() ([]Token, error) {
+	logger.Debug("getting tokens from postgres")
+
+	sqlq := `
+	SELECT ` + sqlTokenColumns + ` FROM tokens
+	ORDER BY id;
+	`
+
+	rows, err := pg.db.Query(sqlq)
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to query database")
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []Token{}
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			logger.WithField("error", err).Debug("unable to scan row")
+			return tokens, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+// DeleteToken revokes the token with the given ID. It returns ErrNotFound
+// if there is no such token.
+func (pg *Postgres) DeleteToken(id int) error {
+	logger := logger.WithField("token_id", id)
+	logger.Debug("deleting token")
+
+	res, err := pg.db.Exec(`DELETE FROM tokens WHERE id = $1;`, id)
+	if err != nil {
+		logger.WithField("error", err).Debug("unable to delete token")
+		return err
+	}
+
+	return checkAffected(res)
+}
+
+func scanToken(row scanner) (Token, error) {
+	token := Token{}
+	err := row.Scan(&token.ID, &token.Name, &token.Hash,
+		pq.Array(&token.Scopes), &token.CreatedAt)
+
+	return token, err
+}
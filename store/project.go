@@ -0,0 +1,194 @@
+package store
+
+import (
+	"sort"
+	"time"
+
+	"github.com/run-ci/run-server/branches"
+	"github.com/run-ci/run-server/remote"
+)
+
+// DefaultConfigPath is where a project's task definitions are looked for
+// unless it says otherwise.
+const DefaultConfigPath = "tasks"
+
+// Project is a remote along with the branches of it that are built and
+// the settings that apply to all of them.
+type Project struct {
+	ID   int
+	Name string
+
+	// Remote and URL are the canonical and registered forms of the
+	// remote, like they are for GitRepo. No two projects share a remote.
+	Remote string
+	URL    string
+
+	DefaultBranch string
+
+	// Branches are the branches or branch patterns that are tracked,
+	// including exclusions, in the syntax of the branches package.
+	Branches []string
+
+	// Credentials names the credentials used to clone the remote. The
+	// secrets themselves are kept by whatever does the cloning.
+	Credentials string
+
+	// ConfigPath is the directory in the repo that holds task definitions.
+	ConfigPath string
+
+	// Enabled projects are polled and built. Disabled ones are kept
+	// around, but nothing happens to them.
+	Enabled bool
+
+	CreatedAt time.Time
+}
+
+// CloneURL returns the URL the project's remote should be cloned from.
+func (p Project) CloneURL() string {
+	return GitRepo{Remote: p.Remote, URL: p.URL}.CloneURL()
+}
+
+// GitRepos returns the project's tracked branches as git repos.
+func (p Project) GitRepos() []GitRepo {
+	repos := []GitRepo{}
+	for _, branch := range p.Branches {
+		repos = append(repos, GitRepo{
+			Remote: p.Remote,
+			Branch: branch,
+			URL:    p.URL,
+		})
+	}
+
+	return repos
+}
+
+// HasBranch returns whether `branch` is one of the project's tracked
+// branches.
+func (p Project) HasBranch(branch string) bool {
+	for _, b := range p.Branches {
+		if b == branch {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Tracks returns whether commits to `branch` get built, which they do if
+// the project is enabled and the branch matches its patterns.
+func (p Project) Tracks(branch string) bool {
+	if !p.Enabled {
+		return false
+	}
+
+	set, err := branches.Parse(p.Branches)
+	if err != nil {
+		// Branches saved before patterns were validated might not parse,
+		// but they can still be matched literally.
+		return p.HasBranch(branch)
+	}
+
+	return set.Match(branch)
+}
+
+// newGitRepoProject returns the project a git repo gets when it's created
+// through the git repo API and there isn't a project for its remote yet.
+func newGitRepoProject(repo GitRepo) Project {
+	return Project{
+		Name:          repo.Remote,
+		Remote:        repo.Remote,
+		URL:           repo.URL,
+		DefaultBranch: repo.Branch,
+		Branches:      []string{repo.Branch},
+		ConfigPath:    DefaultConfigPath,
+		Enabled:       true,
+	}
+}
+
+// sortedBranches returns a sorted copy of `branches` with duplicates
+// removed, which is the order backends keep them in.
+func sortedBranches(branches []string) []string {
+	seen := map[string]bool{}
+	sorted := []string{}
+	for _, branch := range branches {
+		if !seen[branch] {
+			seen[branch] = true
+			sorted = append(sorted, branch)
+		}
+	}
+
+	sort.Strings(sorted)
+	return sorted
+}
+
+// canonicalRemote returns the canonical form of `raw`, or `raw` itself if
+// it can't be parsed, which remotes saved before they were validated might
+// not be.
+func canonicalRemote(raw string) string {
+	canonical, err := remote.Canonical(raw)
+	if err != nil {
+		return raw
+	}
+
+	return canonical
+}
+
+// remoteMerge is what bringing one project over to its canonical remote
+// does to it. Projects whose remotes are other spellings of the same one
+// are merged into it.
+type remoteMerge struct {
+	ID     int
+	Remote string
+	URL    string
+	Merged []int
+
+	changed bool
+}
+
+// mergeRemotes works out how to bring `projects`, which must be in ID
+// order, over to canonical remotes. Projects saved before remotes were
+// canonicalized have theirs the way they were spelled and an empty URL,
+// so they get the canonical remote and keep their spelling as their URL.
+// Projects for the same remote are merged into the oldest of them. Only
+// projects that change are returned.
+func mergeRemotes(projects []Project) []remoteMerge {
+	merges := []*remoteMerge{}
+	byRemote := map[string]*remoteMerge{}
+	for _, p := range projects {
+		canonical := canonicalRemote(p.Remote)
+
+		url := p.URL
+		if url == "" && p.Remote != canonical {
+			url = p.Remote
+		}
+
+		merge, ok := byRemote[canonical]
+		if !ok {
+			merge = &remoteMerge{
+				ID:      p.ID,
+				Remote:  canonical,
+				URL:     url,
+				changed: p.Remote != canonical || p.URL != url,
+			}
+
+			byRemote[canonical] = merge
+			merges = append(merges, merge)
+			continue
+		}
+
+		merge.Merged = append(merge.Merged, p.ID)
+		merge.changed = true
+		if merge.URL == "" {
+			merge.URL = url
+		}
+	}
+
+	changed := []remoteMerge{}
+	for _, merge := range merges {
+		if merge.changed {
+			changed = append(changed, *merge)
+		}
+	}
+
+	return changed
+}
@@ -0,0 +1,37 @@
+package store
+
+import "testing"
+
+func TestProjectTracks(t *testing.T) {
+	p := Project{
+		Enabled:  true,
+		Branches: []string{"master", "release/*", "!release/old"},
+	}
+
+	tests := []struct {
+		branch string
+		want   bool
+	}{
+		{"master", true},
+		{"release/1.0", true},
+		{"release/old", false},
+		{"develop", false},
+	}
+
+	for _, test := range tests {
+		if got := p.Tracks(test.branch); got != test.want {
+			t.Fatalf("expected %v to be tracked: %v, got %v", test.branch, test.want, got)
+		}
+	}
+
+	p.Enabled = false
+	if p.Tracks("master") {
+		t.Fatal("expected disabled project not to track anything")
+	}
+
+	// Branches that aren't valid patterns still match literally.
+	legacy := Project{Enabled: true, Branches: []string{"a b"}}
+	if !legacy.Tracks("a b") {
+		t.Fatal("expected unparseable branch to match literally")
+	}
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/run-ci/run-server/branches"
+)
+
+// GitRepoQuery narrows down and orders a listing of git repos. The zero
+// value matches every repo, in ascending order.
+type GitRepoQuery struct {
+	// RemotePrefix only matches repos whose remote starts with it.
+	RemotePrefix string
+
+	// BranchGlob only matches repos whose branch matches it. It's read
+	// the same way as the patterns projects track branches with: a `*`
+	// matches any run of characters but a slash, `**` matches any run of
+	// characters at all and a `?` matches a single character other than a
+	// slash.
+	BranchGlob string
+
+	// Desc orders repos by descending remote and branch instead of
+	// ascending.
+	Desc bool
+
+	// After only matches repos that come after it in the chosen order.
+	// It's how listings are paged through.
+	After *GitRepo
+
+	// Limit is the most repos to return, or 0 for no limit.
+	Limit int
+}
+
+// matcher returns a function reporting whether a repo passes the query's
+// filters, for backends that can't filter natively.
+func (q GitRepoQuery) matcher() func(GitRepo) bool {
+	var branch *regexp.Regexp
+	if q.BranchGlob != "" {
+		branch = regexp.MustCompile(branches.GlobRegexp(q.BranchGlob))
+	}
+
+	return func(repo GitRepo) bool {
+		if !strings.HasPrefix(repo.Remote, q.RemotePrefix) {
+			return false
+		}
+
+		if branch != nil && !branch.MatchString(repo.Branch) {
+			return false
+		}
+
+		if q.After != nil {
+			if q.Desc {
+				return gitRepoLess(repo, *q.After)
+			}
+
+			return gitRepoLess(*q.After, repo)
+		}
+
+		return true
+	}
+}
+
+// gitRepoLess orders git repos by remote, then branch.
+func gitRepoLess(a, b GitRepo) bool {
+	if a.Remote != b.Remote {
+		return a.Remote < b.Remote
+	}
+
+	return a.Branch < b.Branch
+}
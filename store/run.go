@@ -0,0 +1,156 @@
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrIllegalTransition is returned when trying to move a run to a status
+// it can't reach from the status it's in.
+var ErrIllegalTransition = errors.New("illegal run status transition")
+
+// RunStatus is the state a Run is in.
+type RunStatus string
+
+// Statuses a Run can be in. Runs start out queued and end up in one of
+// the terminal statuses. Running runs that are cancelled stay cancelling
+// until their agent stops them.
+const (
+	RunQueued     RunStatus = "queued"
+	RunRunning    RunStatus = "running"
+	RunCancelling RunStatus = "cancelling"
+	RunSucceeded  RunStatus = "succeeded"
+	RunFailed     RunStatus = "failed"
+	RunCancelled  RunStatus = "cancelled"
+	RunErrored    RunStatus = "errored"
+)
+
+// runTransitions maps each status to the statuses that can follow it.
+// Terminal statuses have no way out. Running runs go back to the queue
+// when the agent running them goes away. Cancelling runs can still end
+// any way they like, since they may finish before the agent gets to
+// stop them.
+var runTransitions = map[RunStatus][]RunStatus{
+	RunQueued:     {RunRunning, RunCancelled, RunErrored},
+	RunRunning:    {RunQueued, RunCancelling, RunSucceeded, RunFailed, RunCancelled, RunErrored},
+	RunCancelling: {RunSucceeded, RunFailed, RunCancelled, RunErrored},
+}
+
+// CanTransitionTo returns whether a run can go from `s` to `to`.
+func (s RunStatus) CanTransitionTo(to RunStatus) bool {
+	for _, next := range runTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Done returns whether `s` is a terminal status.
+func (s RunStatus) Done() bool {
+	switch s {
+	case RunSucceeded, RunFailed, RunCancelled, RunErrored:
+		return true
+	}
+
+	return false
+}
+
+// Active returns whether a run in status `s` is held by an agent.
+func (s RunStatus) Active() bool {
+	return s == RunRunning || s == RunCancelling
+}
+
+// Run is a single execution of a pipeline for a commit of a GitRepo.
+type Run struct {
+	ID      int
+	Remote  string
+	Branch  string
+	Commit  string
+	Trigger string
+	Status  RunStatus
+
+	// Task and Args are set for runs of a single task, like the ones
+	// started by hand. Args are the task's resolved arguments, defaults
+	// included.
+	Task string
+	Args map[string]string
+
+	// Labels are the labels an agent needs to have to run the run.
+	Labels []string
+
+	// AgentID is the agent that was last leased the run. The lease runs
+	// out at LeaseExpires unless the agent keeps sending heartbeats.
+	AgentID      string
+	LeaseExpires time.Time
+
+	// Timeout is how long the run can go on for once it's started before
+	// it's failed. Runs without one get the server's default.
+	Timeout time.Duration
+
+	// CancelRequestedAt is when the run was asked to stop, if it was
+	// cancelled while running.
+	CancelRequestedAt time.Time
+
+	CreatedAt  time.Time
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	Steps []Step
+}
+
+// Transition moves the run to status `to`, setting its timestamps along
+// the way. It returns ErrIllegalTransition if the run can't go there.
+func (r *Run) Transition(to RunStatus, now time.Time) error {
+	if !r.Status.CanTransitionTo(to) {
+		return ErrIllegalTransition
+	}
+
+	r.Status = to
+	if to == RunRunning {
+		r.StartedAt = now
+	}
+	if to == RunCancelling {
+		r.CancelRequestedAt = now
+	}
+	if to == RunQueued {
+		r.StartedAt = time.Time{}
+		r.AgentID = ""
+		r.LeaseExpires = time.Time{}
+	}
+	if to.Done() {
+		r.FinishedAt = now
+		r.LeaseExpires = time.Time{}
+	}
+
+	return nil
+}
+
+// Cancel moves the run as far towards cancelled as it can go on its own.
+// Queued runs are cancelled straight away, while running ones are left
+// cancelling for their agent to stop. Runs that are already cancelling
+// are left alone. It returns ErrIllegalTransition for runs that are done.
+func (r *Run) Cancel(now time.Time) error {
+	switch r.Status {
+	case RunQueued:
+		return r.Transition(RunCancelled, now)
+	case RunRunning:
+		return r.Transition(RunCancelling, now)
+	case RunCancelling:
+		return nil
+	}
+
+	return ErrIllegalTransition
+}
+
+// Step is a single task executed as part of a Run.
+type Step struct {
+	ID       int
+	RunID    int
+	Task     string
+	ExitCode int
+
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
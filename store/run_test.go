@@ -0,0 +1,86 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRunTransition(t *testing.T) {
+	tests := []struct {
+		from RunStatus
+		to   RunStatus
+		ok   bool
+	}{
+		{RunQueued, RunRunning, true},
+		{RunQueued, RunCancelled, true},
+		{RunQueued, RunSucceeded, false},
+		{RunRunning, RunSucceeded, true},
+		{RunRunning, RunFailed, true},
+		{RunRunning, RunQueued, true},
+		{RunRunning, RunCancelling, true},
+		{RunCancelling, RunCancelled, true},
+		{RunCancelling, RunSucceeded, true},
+		{RunCancelling, RunQueued, false},
+		{RunQueued, RunCancelling, false},
+		{RunSucceeded, RunRunning, false},
+		{RunCancelled, RunErrored, false},
+	}
+
+	for _, test := range tests {
+		run := Run{Status: test.from}
+		now := time.Now()
+
+		err := run.Transition(test.to, now)
+		if test.ok && err != nil {
+			t.Fatalf("expected %v -> %v to be allowed, got %v", test.from, test.to, err)
+		}
+		if !test.ok {
+			if err != ErrIllegalTransition {
+				t.Fatalf("expected %v -> %v to be illegal, got %v", test.from, test.to, err)
+			}
+			continue
+		}
+
+		if run.Status != test.to {
+			t.Fatalf("expected status %v, got %v", test.to, run.Status)
+		}
+
+		if test.to == RunRunning && !run.StartedAt.Equal(now) {
+			t.Fatalf("expected started at to be set")
+		}
+
+		if test.to == RunCancelling && !run.CancelRequestedAt.Equal(now) {
+			t.Fatalf("expected cancel requested at to be set")
+		}
+
+		if test.to.Done() && !run.FinishedAt.Equal(now) {
+			t.Fatalf("expected finished at to be set")
+		}
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	tests := []struct {
+		from RunStatus
+		to   RunStatus
+		err  error
+	}{
+		{RunQueued, RunCancelled, nil},
+		{RunRunning, RunCancelling, nil},
+		{RunCancelling, RunCancelling, nil},
+		{RunSucceeded, RunSucceeded, ErrIllegalTransition},
+		{RunCancelled, RunCancelled, ErrIllegalTransition},
+	}
+
+	for _, test := range tests {
+		run := Run{Status: test.from}
+
+		if err := run.Cancel(time.Now()); err != test.err {
+			t.Fatalf("expected %v cancelling %v run, got %v", test.err, test.from, err)
+		}
+
+		if run.Status != test.to {
+			t.Fatalf("expected cancelling %v run to leave it %v, got %v", test.from, test.to, run.Status)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package store
+
+import "time"
+
+// Schedule starts runs of a project's task on a cron schedule, whether or
+// not anything has changed.
+type Schedule struct {
+	ID        int
+	ProjectID int
+
+	// Branch is the branch runs are started on. Empty means the
+	// project's default branch.
+	Branch string
+
+	// Cron is the cron expression the schedule fires on, in Timezone.
+	// An empty timezone is UTC.
+	Cron     string
+	Timezone string
+
+	Task   string
+	Args   map[string]string
+	Labels []string
+
+	Enabled bool
+
+	// NextFireAt is when the schedule fires next. It's only ever moved
+	// on by whoever fires the schedule, which is how a schedule is only
+	// fired once no matter how many servers are watching it.
+	NextFireAt  time.Time
+	LastFiredAt time.Time
+
+	CreatedAt time.Time
+}
@@ -1,22 +1,113 @@
 package store
 
-import "github.com/sirupsen/logrus"
+import (
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
 
 var logger *logrus.Entry
 
+var (
+	// ErrNotFound is returned when the thing being looked up, changed or
+	// deleted doesn't exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrConflict is returned when creating or changing something would
+	// clash with something that already exists.
+	ErrConflict = errors.New("already exists")
+)
+
 func init() {
 	logger = logrus.WithField("package", "store")
 }
 
 // Repo is anything that can hold data about source repositories.
 type Repo interface {
-	CreateGitRepo(GitRepo) error
+	// Changes to git repos can carry outbox messages that are built and
+	// saved along with the change.
+	CreateGitRepo(GitRepo, ...MessageFunc) error
 	GetGitRepo(string, string) (GitRepo, error)
 	GetGitRepos() ([]GitRepo, error)
+	QueryGitRepos(GitRepoQuery) ([]GitRepo, error)
+	UpdateGitRepo(string, string, GitRepo, ...MessageFunc) error
+	DeleteGitRepo(string, string, ...MessageFunc) error
+
+	// Git repos are a view over projects and their tracked branches.
+	// Changes to projects can carry outbox messages too.
+	CreateProject(Project, ...MessageFunc) (Project, error)
+	GetProject(int) (Project, error)
+	GetProjectByRemote(string) (Project, error)
+	GetProjects() ([]Project, error)
+
+	// Updating a project with nil Branches leaves its branches alone.
+	UpdateProject(Project, ...MessageFunc) (Project, error)
+	DeleteProject(int, ...MessageFunc) error
+
+	CreateRun(Run) (Run, error)
+	GetRun(int) (Run, error)
+	GetRuns(string, string) ([]Run, error)
+	UpdateRunStatus(int, RunStatus) (Run, error)
+	CancelRun(int) (Run, error)
+
+	// Creating a step the run already has a step for returns that one,
+	// so every server recording the run's logs agrees on its steps.
+	CreateStep(Step) (Step, error)
+	UpdateStep(Step) error
+
+	// Schedules are fired by moving them on to their next firing, which
+	// only works for whoever gets there first.
+	CreateSchedule(Schedule) (Schedule, error)
+	GetSchedule(int) (Schedule, error)
+	GetSchedules(int) ([]Schedule, error)
+	UpdateSchedule(Schedule) (Schedule, error)
+	DeleteSchedule(int) error
+	GetDueSchedules(time.Time) ([]Schedule, error)
+	FireSchedule(int, time.Time, time.Time) (Schedule, error)
+
+	// Agents lease queued runs, and keep their leases by sending
+	// heartbeats. Runs whose leases run out go back to the queue, and
+	// runs that go on for too long are stopped.
+	RegisterAgent(Agent) (Agent, error)
+	GetAgent(string) (Agent, error)
+	GetAgents() ([]Agent, error)
+	HeartbeatAgent(string, time.Duration) (Agent, error)
+	LeaseRun(string, time.Duration) (Run, error)
+	ExpireLeases() ([]Run, error)
+	TimeoutRuns(time.Duration, time.Duration) ([]Run, error)
+
+	GetPendingMessages(int) ([]Message, error)
+	CountPendingMessages() (int, error)
+	MarkMessageDelivered(int) error
+	MarkMessageFailed(int, string, time.Time) error
+
+	CreateToken(Token) (Token, error)
+	GetTokenByHash(string) (Token, error)
+	GetTokens() ([]Token, error)
+	DeleteToken(int) error
+
+	Ping() error
+	Close() error
 }
 
 // GitRepo is a Git repository.
 type GitRepo struct {
+	// Remote is the canonical form of the remote, as returned by
+	// remote.Canonical. Together with Branch it identifies the repo.
 	Remote string
 	Branch string
+
+	// URL is the remote as it was registered, which is what gets cloned.
+	URL string
+}
+
+// CloneURL returns the URL the repo should be cloned from. Repos
+// registered before URLs were kept only have their remote.
+func (repo GitRepo) CloneURL() string {
+	if repo.URL == "" {
+		return repo.Remote
+	}
+
+	return repo.URL
 }
@@ -0,0 +1,48 @@
+package store
+
+import "time"
+
+// Scopes an API token can carry. Each one grants access to a group of
+// endpoints, and ScopeAdmin grants access to everything.
+const (
+	ScopeReposRead   = "repos:read"
+	ScopeReposWrite  = "repos:write"
+	ScopeRunsTrigger = "runs:trigger"
+	ScopeAgentsRun   = "agents:run"
+	ScopeAdmin       = "admin"
+)
+
+// Scopes are all the scopes a token can be given.
+var Scopes = []string{ScopeReposRead, ScopeReposWrite, ScopeRunsTrigger, ScopeAgentsRun, ScopeAdmin}
+
+// ValidScope returns whether `scope` is one of Scopes.
+func ValidScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Token is an API token. Only a hash of the token is ever stored, so a
+// token can't be recovered from the store once it's been handed out.
+type Token struct {
+	ID        int
+	Name      string
+	Hash      string
+	Scopes    []string
+	CreatedAt time.Time
+}
+
+// HasScope returns whether the token grants `scope`.
+func (t Token) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
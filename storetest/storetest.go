@@ -0,0 +1,1635 @@
+// Package storetest checks that implementations of store.Repo behave the
+// way the rest of the server expects them to.
+package storetest
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/run-ci/run-server/store"
+)
+
+var seedRepos = []store.GitRepo{
+	{Remote: "b.git", Branch: "master", URL: "https://b.git"},
+	{Remote: "a.git", Branch: "master", URL: "https://a.git"},
+	{Remote: "a.git", Branch: "feature", URL: "https://a.git"},
+}
+
+var tests = []struct {
+	name string
+	test func(*testing.T, store.Repo)
+}{
+	{"Ping", testPing},
+	{"GetGitRepo", testGetGitRepo},
+	{"GetGitRepoBranches", testGetGitRepoBranches},
+	{"GetGitRepoNotFound", testGetGitRepoNotFound},
+	{"CreateGitRepoConflict", testCreateGitRepoConflict},
+	{"GetGitReposOrdered", testGetGitReposOrdered},
+	{"QueryGitRepos", testQueryGitRepos},
+	{"QueryGitReposPaged", testQueryGitReposPaged},
+	{"UpdateGitRepo", testUpdateGitRepo},
+	{"UpdateGitRepoNotFound", testUpdateGitRepoNotFound},
+	{"UpdateGitRepoConflict", testUpdateGitRepoConflict},
+	{"DeleteGitRepo", testDeleteGitRepo},
+	{"DeleteGitRepoNotFound", testDeleteGitRepoNotFound},
+	{"Projects", testProjects},
+	{"ProjectConflict", testProjectConflict},
+	{"UpdateProjectKeepsBranches", testUpdateProjectKeepsBranches},
+	{"ProjectNotFound", testProjectNotFound},
+	{"GitReposAreProjectBranches", testGitReposAreProjectBranches},
+	{"CreateRun", testCreateRun},
+	{"CreateRunWithTask", testCreateRunWithTask},
+	{"GetRunNotFound", testGetRunNotFound},
+	{"GetRunsOrdered", testGetRunsOrdered},
+	{"UpdateRunStatus", testUpdateRunStatus},
+	{"UpdateRunStatusIllegal", testUpdateRunStatusIllegal},
+	{"UpdateRunStatusNotFound", testUpdateRunStatusNotFound},
+	{"Steps", testSteps},
+	{"CreateStepNotFound", testCreateStepNotFound},
+	{"CreateStepExisting", testCreateStepExisting},
+	{"UpdateStepNotFound", testUpdateStepNotFound},
+	{"Agents", testAgents},
+	{"AgentNotFound", testAgentNotFound},
+	{"LeaseRun", testLeaseRun},
+	{"LeaseRunLabels", testLeaseRunLabels},
+	{"ExpireLeases", testExpireLeases},
+	{"CancelRun", testCancelRun},
+	{"TimeoutRuns", testTimeoutRuns},
+	{"Schedules", testSchedules},
+	{"ScheduleNotFound", testScheduleNotFound},
+	{"GetDueSchedules", testGetDueSchedules},
+	{"FireSchedule", testFireSchedule},
+	{"OutboxMessagesSaved", testOutboxMessagesSaved},
+	{"OutboxMessagesRolledBack", testOutboxMessagesRolledBack},
+	{"OutboxMessagesSeeChange", testOutboxMessagesSeeChange},
+	{"OutboxDelivered", testOutboxDelivered},
+	{"OutboxFailed", testOutboxFailed},
+	{"OutboxNotFound", testOutboxNotFound},
+	{"Tokens", testTokens},
+	{"CreateTokenConflict", testCreateTokenConflict},
+	{"TokenNotFound", testTokenNotFound},
+}
+
+// Run runs every behavioral test against the Repos returned by `newRepo`.
+// Each call to `newRepo` must return an empty Repo.
+func Run(t *testing.T, newRepo func(*testing.T) store.Repo) {
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, newRepo(t))
+		})
+	}
+}
+
+func seed(t *testing.T, st store.Repo) {
+	for _, repo := range seedRepos {
+		if err := st.CreateGitRepo(repo); err != nil {
+			t.Fatalf("got error creating %v: %v", repo, err)
+		}
+	}
+}
+
+func seedRuns(t *testing.T, st store.Repo, branches ...string) []store.Run {
+	runs := []store.Run{}
+	for _, branch := range branches {
+		run, err := st.CreateRun(store.Run{
+			Remote:  "a.git",
+			Branch:  branch,
+			Commit:  "abc123",
+			Trigger: "push",
+		})
+		if err != nil {
+			t.Fatalf("got error creating run: %v", err)
+		}
+
+		runs = append(runs, run)
+	}
+
+	return runs
+}
+
+func testPing(t *testing.T, st store.Repo) {
+	if err := st.Ping(); err != nil {
+		t.Fatalf("got error pinging store: %v", err)
+	}
+}
+
+func testGetGitRepo(t *testing.T, st store.Repo) {
+	seed(t, st)
+
+	repo, err := st.GetGitRepo("a.git", "feature")
+	if err != nil {
+		t.Fatalf("got error getting repo: %v", err)
+	}
+
+	if repo != seedRepos[2] {
+		t.Fatalf("expected %v, got %v", seedRepos[2], repo)
+	}
+}
+
+// Branches of the same remote are told apart by the branch, not just by
+// which one comes first.
+func testGetGitRepoBranches(t *testing.T, st store.Repo) {
+	seed(t, st)
+
+	for _, want := range seedRepos {
+		repo, err := st.GetGitRepo(want.Remote, want.Branch)
+		if err != nil {
+			t.Fatalf("got error getting %v#%v: %v", want.Remote, want.Branch, err)
+		}
+
+		if repo != want {
+			t.Fatalf("expected %v, got %v", want, repo)
+		}
+	}
+}
+
+func testGetGitRepoNotFound(t *testing.T, st store.Repo) {
+	seed(t, st)
+
+	if _, err := st.GetGitRepo("a.git", "missing"); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+}
+
+func testCreateGitRepoConflict(t *testing.T, st store.Repo) {
+	seed(t, st)
+
+	if err := st.CreateGitRepo(seedRepos[0]); err != store.ErrConflict {
+		t.Fatalf("expected %v, got %v", store.ErrConflict, err)
+	}
+}
+
+func testGetGitReposOrdered(t *testing.T, st store.Repo) {
+	repos, err := st.GetGitRepos()
+	if err != nil {
+		t.Fatalf("got error listing repos: %v", err)
+	}
+	if repos == nil || len(repos) != 0 {
+		t.Fatalf("expected an empty list of repos, got %#v", repos)
+	}
+
+	seed(t, st)
+
+	repos, err = st.GetGitRepos()
+	if err != nil {
+		t.Fatalf("got error listing repos: %v", err)
+	}
+
+	want := []store.GitRepo{seedRepos[2], seedRepos[1], seedRepos[0]}
+	if len(repos) != len(want) {
+		t.Fatalf("expected %v repos, got %v", len(want), len(repos))
+	}
+
+	for i := range want {
+		if repos[i] != want[i] {
+			t.Fatalf("expected repo %v to be %v, got %v", i, want[i], repos[i])
+		}
+	}
+}
+
+func testQueryGitRepos(t *testing.T, st store.Repo) {
+	repos := []store.GitRepo{
+		{Remote: "https://github.com/run-ci/run.git", Branch: "master"},
+		{Remote: "https://github.com/run-ci/run.git", Branch: "feature/logs"},
+		{Remote: "https://github.com/run-ci/run.git", Branch: "feature/auth/tokens"},
+		{Remote: "https://github.com/run-ci/run-server.git", Branch: "feature_x"},
+		{Remote: "https://gitlab.com/run-ci/run.git", Branch: "master"},
+	}
+	for _, repo := range repos {
+		if err := st.CreateGitRepo(repo); err != nil {
+			t.Fatalf("got error seeding repo %v: %v", repo, err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query store.GitRepoQuery
+		want  []store.GitRepo
+	}{
+		{
+			name:  "RemotePrefix",
+			query: store.GitRepoQuery{RemotePrefix: "https://gitlab.com/"},
+			want:  []store.GitRepo{repos[4]},
+		},
+		{
+			// A single star stops at slashes, like in branch patterns.
+			name:  "BranchGlob",
+			query: store.GitRepoQuery{BranchGlob: "feature/*"},
+			want:  []store.GitRepo{repos[1]},
+		},
+		{
+			name:  "BranchGlobDoubleStar",
+			query: store.GitRepoQuery{BranchGlob: "feature/**"},
+			want:  []store.GitRepo{repos[2], repos[1]},
+		},
+		{
+			// SQL and regular expression wildcards in globs are matched
+			// literally.
+			name:  "BranchGlobEscaped",
+			query: store.GitRepoQuery{BranchGlob: "feature_?"},
+			want:  []store.GitRepo{repos[3]},
+		},
+		{
+			name:  "Desc",
+			query: store.GitRepoQuery{RemotePrefix: "https://github.com/run-ci/run.git", Desc: true},
+			want:  []store.GitRepo{repos[0], repos[1], repos[2]},
+		},
+		{
+			name:  "Limit",
+			query: store.GitRepoQuery{Limit: 2},
+			want:  []store.GitRepo{repos[3], repos[2]},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := st.QueryGitRepos(test.query)
+		if err != nil {
+			t.Fatalf("%v: got error querying repos: %v", test.name, err)
+		}
+
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%v: expected %v, got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func testQueryGitReposPaged(t *testing.T, st store.Repo) {
+	seed(t, st)
+
+	for _, desc := range []bool{false, true} {
+		want, err := st.QueryGitRepos(store.GitRepoQuery{Desc: desc})
+		if err != nil {
+			t.Fatalf("got error querying repos: %v", err)
+		}
+
+		got := []store.GitRepo{}
+		q := store.GitRepoQuery{Desc: desc, Limit: 2}
+		for {
+			page, err := st.QueryGitRepos(q)
+			if err != nil {
+				t.Fatalf("got error querying repos: %v", err)
+			}
+
+			got = append(got, page...)
+			if len(page) < q.Limit {
+				break
+			}
+
+			q.After = &page[len(page)-1]
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected paging (desc %v) to visit %v, got %v", desc, want, got)
+		}
+	}
+}
+
+func testUpdateGitRepo(t *testing.T, st store.Repo) {
+	seed(t, st)
+
+	updated := store.GitRepo{Remote: "a.git", Branch: "develop"}
+	if err := st.UpdateGitRepo("a.git", "feature", updated); err != nil {
+		t.Fatalf("got error updating repo: %v", err)
+	}
+
+	if _, err := st.GetGitRepo("a.git", "feature"); err != store.ErrNotFound {
+		t.Fatalf("expected old repo to be gone, got %v", err)
+	}
+
+	if _, err := st.GetGitRepo("a.git", "develop"); err != nil {
+		t.Fatalf("got error getting updated repo: %v", err)
+	}
+}
+
+func testUpdateGitRepoNotFound(t *testing.T, st store.Repo) {
+	seed(t, st)
+
+	updated := store.GitRepo{Remote: "a.git", Branch: "develop"}
+	if err := st.UpdateGitRepo("a.git", "missing", updated); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+}
+
+func testUpdateGitRepoConflict(t *testing.T, st store.Repo) {
+	seed(t, st)
+
+	if err := st.UpdateGitRepo("a.git", "feature", seedRepos[1]); err != store.ErrConflict {
+		t.Fatalf("expected %v, got %v", store.ErrConflict, err)
+	}
+}
+
+func testDeleteGitRepo(t *testing.T, st store.Repo) {
+	seed(t, st)
+
+	if err := st.DeleteGitRepo("b.git", "master"); err != nil {
+		t.Fatalf("got error deleting repo: %v", err)
+	}
+
+	if _, err := st.GetGitRepo("b.git", "master"); err != store.ErrNotFound {
+		t.Fatalf("expected deleted repo to be gone, got %v", err)
+	}
+}
+
+func testDeleteGitRepoNotFound(t *testing.T, st store.Repo) {
+	if err := st.DeleteGitRepo("b.git", "master"); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+}
+
+func testProjects(t *testing.T, st store.Repo) {
+	created, err := st.CreateProject(store.Project{
+		Name:          "run",
+		Remote:        "example.com/run",
+		URL:           "https://example.com/run.git",
+		DefaultBranch: "master",
+		Branches:      []string{"master", "develop", "master"},
+		Credentials:   "deploy-key",
+		ConfigPath:    "ci",
+		Enabled:       true,
+	}, message("create"))
+	if err != nil {
+		t.Fatalf("got error creating project: %v", err)
+	}
+
+	if created.ID == 0 || created.CreatedAt.IsZero() {
+		t.Fatalf("expected project to have an ID and creation time, got %+v", created)
+	}
+
+	if want := []string{"develop", "master"}; !reflect.DeepEqual(created.Branches, want) {
+		t.Fatalf("expected branches %v, got %v", want, created.Branches)
+	}
+
+	got, err := st.GetProject(created.ID)
+	if err != nil {
+		t.Fatalf("got error getting project: %v", err)
+	}
+
+	if got.Name != "run" || got.Credentials != "deploy-key" || got.ConfigPath != "ci" ||
+		!got.Enabled || !reflect.DeepEqual(got.Branches, created.Branches) {
+		t.Fatalf("expected %+v, got %+v", created, got)
+	}
+
+	byRemote, err := st.GetProjectByRemote("example.com/run")
+	if err != nil {
+		t.Fatalf("got error getting project by remote: %v", err)
+	}
+
+	if byRemote.ID != created.ID {
+		t.Fatalf("expected project %v, got %+v", created.ID, byRemote)
+	}
+
+	repo, err := st.GetGitRepo("example.com/run", "develop")
+	if err != nil {
+		t.Fatalf("got error getting tracked branch as a repo: %v", err)
+	}
+
+	if repo.URL != created.URL {
+		t.Fatalf("expected repo to have the project's URL, got %v", repo.URL)
+	}
+
+	got.Branches = []string{"master"}
+	got.Enabled = false
+	updated, err := st.UpdateProject(got, message("update"))
+	if err != nil {
+		t.Fatalf("got error updating project: %v", err)
+	}
+
+	if updated.Enabled || !updated.CreatedAt.Equal(got.CreatedAt) {
+		t.Fatalf("expected disabled project created at %v, got %+v", got.CreatedAt, updated)
+	}
+
+	if _, err := st.GetGitRepo("example.com/run", "develop"); err != store.ErrNotFound {
+		t.Fatalf("expected untracked branch to be gone, got %v", err)
+	}
+
+	projects, err := st.GetProjects()
+	if err != nil {
+		t.Fatalf("got error listing projects: %v", err)
+	}
+
+	if len(projects) != 1 || projects[0].ID != created.ID {
+		t.Fatalf("expected only project %v, got %+v", created.ID, projects)
+	}
+
+	if err := st.DeleteProject(created.ID, message("delete")); err != nil {
+		t.Fatalf("got error deleting project: %v", err)
+	}
+
+	if _, err := st.GetGitRepo("example.com/run", "master"); err != store.ErrNotFound {
+		t.Fatalf("expected deleted project's branches to be gone, got %v", err)
+	}
+
+	if msgs := pending(t, st); len(msgs) != 3 {
+		t.Fatalf("expected 3 pending messages, got %v", len(msgs))
+	}
+}
+
+func testProjectConflict(t *testing.T, st store.Repo) {
+	seed(t, st)
+
+	_, err := st.CreateProject(store.Project{Name: "a", Remote: "a.git", DefaultBranch: "master"})
+	if err != store.ErrConflict {
+		t.Fatalf("expected %v creating project for a seeded remote, got %v", store.ErrConflict, err)
+	}
+
+	p, err := st.CreateProject(store.Project{Name: "c", Remote: "c.git", DefaultBranch: "master"})
+	if err != nil {
+		t.Fatalf("got error creating project: %v", err)
+	}
+
+	p.Remote = "b.git"
+	if _, err := st.UpdateProject(p); err != store.ErrConflict {
+		t.Fatalf("expected %v moving project to a taken remote, got %v", store.ErrConflict, err)
+	}
+}
+
+func testUpdateProjectKeepsBranches(t *testing.T, st store.Repo) {
+	p, err := st.CreateProject(store.Project{
+		Name:          "run",
+		Remote:        "example.com/run",
+		DefaultBranch: "master",
+		Branches:      []string{"master"},
+	})
+	if err != nil {
+		t.Fatalf("got error creating project: %v", err)
+	}
+
+	// A branch is tracked between reading the project and writing it
+	// back.
+	if err := st.CreateGitRepo(store.GitRepo{Remote: "example.com/run", Branch: "develop"}); err != nil {
+		t.Fatalf("got error tracking branch: %v", err)
+	}
+
+	p.Name = "renamed"
+	p.Branches = nil
+	updated, err := st.UpdateProject(p)
+	if err != nil {
+		t.Fatalf("got error updating project: %v", err)
+	}
+
+	want := []string{"develop", "master"}
+	if updated.Name != "renamed" || !reflect.DeepEqual(updated.Branches, want) {
+		t.Fatalf("expected renamed project tracking %v, got %+v", want, updated)
+	}
+
+	got, err := st.GetProject(p.ID)
+	if err != nil {
+		t.Fatalf("got error getting project: %v", err)
+	}
+
+	if !reflect.DeepEqual(got.Branches, want) {
+		t.Fatalf("expected %v to still be tracked, got %v", want, got.Branches)
+	}
+}
+
+func testProjectNotFound(t *testing.T, st store.Repo) {
+	if _, err := st.GetProject(42); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+
+	if _, err := st.GetProjectByRemote("example.com/missing"); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+
+	if _, err := st.UpdateProject(store.Project{ID: 42, Remote: "a.git"}); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+
+	if err := st.DeleteProject(42); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+}
+
+func testGitReposAreProjectBranches(t *testing.T, st store.Repo) {
+	seed(t, st)
+
+	projects, err := st.GetProjects()
+	if err != nil {
+		t.Fatalf("got error listing projects: %v", err)
+	}
+
+	if len(projects) != 2 {
+		t.Fatalf("expected a project per remote, got %+v", projects)
+	}
+
+	var a store.Project
+	for _, p := range projects {
+		if p.Remote == "a.git" {
+			a = p
+		}
+	}
+
+	if want := []string{"feature", "master"}; !reflect.DeepEqual(a.Branches, want) {
+		t.Fatalf("expected a.git to track %v, got %+v", want, a)
+	}
+
+	if !a.Enabled || a.ConfigPath != store.DefaultConfigPath || a.DefaultBranch == "" {
+		t.Fatalf("expected a.git to get default settings, got %+v", a)
+	}
+
+	// Deleting every branch leaves the project behind.
+	for _, branch := range a.Branches {
+		if err := st.DeleteGitRepo("a.git", branch); err != nil {
+			t.Fatalf("got error deleting repo: %v", err)
+		}
+	}
+
+	a, err = st.GetProject(a.ID)
+	if err != nil {
+		t.Fatalf("got error getting project: %v", err)
+	}
+
+	if len(a.Branches) != 0 {
+		t.Fatalf("expected no tracked branches, got %v", a.Branches)
+	}
+}
+
+func testCreateRun(t *testing.T, st store.Repo) {
+	run := seedRuns(t, st, "master")[0]
+
+	if run.ID == 0 {
+		t.Fatal("expected new run to have an ID")
+	}
+
+	if run.Status != store.RunQueued {
+		t.Fatalf("expected new run to be %v, got %v", store.RunQueued, run.Status)
+	}
+
+	if run.CreatedAt.IsZero() {
+		t.Fatal("expected new run to have a creation time")
+	}
+
+	got, err := st.GetRun(run.ID)
+	if err != nil {
+		t.Fatalf("got error getting run: %v", err)
+	}
+
+	if got.Remote != run.Remote || got.Branch != run.Branch || got.Commit != run.Commit {
+		t.Fatalf("expected %v, got %v", run, got)
+	}
+
+	if got.Task != "" || got.Args != nil {
+		t.Fatalf("expected run without a task or arguments, got %+v", got)
+	}
+}
+
+func testCreateRunWithTask(t *testing.T, st store.Repo) {
+	run, err := st.CreateRun(store.Run{
+		Remote:  "a.git",
+		Branch:  "master",
+		Commit:  "abc123",
+		Trigger: "manual",
+		Task:    "build",
+		Args:    map[string]string{"GOOS": "darwin"},
+		Timeout: 90 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("got error creating run: %v", err)
+	}
+
+	got, err := st.GetRun(run.ID)
+	if err != nil {
+		t.Fatalf("got error getting run: %v", err)
+	}
+
+	if got.Task != "build" || !reflect.DeepEqual(got.Args, run.Args) || got.Timeout != run.Timeout {
+		t.Fatalf("expected build task with %v and a timeout of %v, got %+v", run.Args, run.Timeout, got)
+	}
+}
+
+func testGetRunNotFound(t *testing.T, st store.Repo) {
+	run := seedRuns(t, st, "master")[0]
+
+	if _, err := st.GetRun(run.ID + 100); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+}
+
+func testGetRunsOrdered(t *testing.T, st store.Repo) {
+	seeded := seedRuns(t, st, "master", "feature", "master")
+
+	runs, err := st.GetRuns("a.git", "master")
+	if err != nil {
+		t.Fatalf("got error listing runs: %v", err)
+	}
+
+	if len(runs) != 2 || runs[0].ID != seeded[2].ID || runs[1].ID != seeded[0].ID {
+		t.Fatalf("expected runs %v and %v newest first, got %v",
+			seeded[2].ID, seeded[0].ID, runs)
+	}
+
+	runs, err = st.GetRuns("a.git", "")
+	if err != nil {
+		t.Fatalf("got error listing runs: %v", err)
+	}
+
+	if len(runs) != 3 {
+		t.Fatalf("expected 3 runs across branches, got %v", len(runs))
+	}
+
+	runs, err = st.GetRuns("missing.git", "")
+	if err != nil {
+		t.Fatalf("got error listing runs: %v", err)
+	}
+
+	if runs == nil || len(runs) != 0 {
+		t.Fatalf("expected an empty list of runs, got %#v", runs)
+	}
+}
+
+func testUpdateRunStatus(t *testing.T, st store.Repo) {
+	run := seedRuns(t, st, "master")[0]
+
+	run, err := st.UpdateRunStatus(run.ID, store.RunRunning)
+	if err != nil {
+		t.Fatalf("got error starting run: %v", err)
+	}
+
+	if run.Status != store.RunRunning || run.StartedAt.IsZero() {
+		t.Fatalf("expected run to be started, got %v", run)
+	}
+
+	if _, err := st.UpdateRunStatus(run.ID, store.RunSucceeded); err != nil {
+		t.Fatalf("got error finishing run: %v", err)
+	}
+
+	run, err = st.GetRun(run.ID)
+	if err != nil {
+		t.Fatalf("got error getting run: %v", err)
+	}
+
+	if run.Status != store.RunSucceeded || run.StartedAt.IsZero() || run.FinishedAt.IsZero() {
+		t.Fatalf("expected run to have succeeded, got %v", run)
+	}
+}
+
+func testUpdateRunStatusIllegal(t *testing.T, st store.Repo) {
+	run := seedRuns(t, st, "master")[0]
+
+	if _, err := st.UpdateRunStatus(run.ID, store.RunSucceeded); err != store.ErrIllegalTransition {
+		t.Fatalf("expected %v, got %v", store.ErrIllegalTransition, err)
+	}
+
+	run, err := st.GetRun(run.ID)
+	if err != nil {
+		t.Fatalf("got error getting run: %v", err)
+	}
+
+	if run.Status != store.RunQueued {
+		t.Fatalf("expected run to still be %v, got %v", store.RunQueued, run.Status)
+	}
+}
+
+func testUpdateRunStatusNotFound(t *testing.T, st store.Repo) {
+	if _, err := st.UpdateRunStatus(42, store.RunRunning); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+}
+
+func testSteps(t *testing.T, st store.Repo) {
+	run := seedRuns(t, st, "master")[0]
+
+	for _, task := range []string{"build", "test"} {
+		step, err := st.CreateStep(store.Step{RunID: run.ID, Task: task})
+		if err != nil {
+			t.Fatalf("got error creating step: %v", err)
+		}
+
+		step.ExitCode = 2
+		if err := st.UpdateStep(step); err != nil {
+			t.Fatalf("got error updating step: %v", err)
+		}
+	}
+
+	run, err := st.GetRun(run.ID)
+	if err != nil {
+		t.Fatalf("got error getting run: %v", err)
+	}
+
+	if len(run.Steps) != 2 || run.Steps[0].Task != "build" || run.Steps[1].Task != "test" {
+		t.Fatalf("expected build and test steps in order, got %v", run.Steps)
+	}
+
+	if run.Steps[0].ExitCode != 2 {
+		t.Fatalf("expected updated exit code 2, got %v", run.Steps[0].ExitCode)
+	}
+}
+
+func testCreateStepNotFound(t *testing.T, st store.Repo) {
+	if _, err := st.CreateStep(store.Step{RunID: 42, Task: "build"}); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+}
+
+func testCreateStepExisting(t *testing.T, st store.Repo) {
+	run := seedRuns(t, st, "master")[0]
+
+	first, err := st.CreateStep(store.Step{RunID: run.ID, Task: "build"})
+	if err != nil {
+		t.Fatalf("got error creating step: %v", err)
+	}
+
+	second, err := st.CreateStep(store.Step{RunID: run.ID, Task: "build"})
+	if err != nil {
+		t.Fatalf("got error creating step again: %v", err)
+	}
+
+	if second.ID != first.ID {
+		t.Fatalf("expected existing step %v, got %v", first.ID, second.ID)
+	}
+
+	run, err = st.GetRun(run.ID)
+	if err != nil {
+		t.Fatalf("got error getting run: %v", err)
+	}
+
+	if len(run.Steps) != 1 {
+		t.Fatalf("expected a single step, got %v", run.Steps)
+	}
+}
+
+func testUpdateStepNotFound(t *testing.T, st store.Repo) {
+	if err := st.UpdateStep(store.Step{ID: 42}); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+}
+
+func testAgents(t *testing.T, st store.Repo) {
+	for _, id := range []string{"b", "a"} {
+		_, err := st.RegisterAgent(store.Agent{ID: id, Labels: []string{"os=linux"}})
+		if err != nil {
+			t.Fatalf("got error registering agent %v: %v", id, err)
+		}
+	}
+
+	first, err := st.GetAgent("a")
+	if err != nil {
+		t.Fatalf("got error getting agent: %v", err)
+	}
+
+	// Registering again replaces the labels but keeps when the agent
+	// first showed up.
+	again, err := st.RegisterAgent(store.Agent{ID: "a", Name: "builder", Labels: []string{"os=darwin"}})
+	if err != nil {
+		t.Fatalf("got error registering agent again: %v", err)
+	}
+
+	if again.Name != "builder" || !reflect.DeepEqual(again.Labels, []string{"os=darwin"}) {
+		t.Fatalf("expected updated agent, got %+v", again)
+	}
+
+	if !again.RegisteredAt.Equal(first.RegisteredAt) {
+		t.Fatalf("expected registration time %v to be kept, got %v", first.RegisteredAt, again.RegisteredAt)
+	}
+
+	agents, err := st.GetAgents()
+	if err != nil {
+		t.Fatalf("got error listing agents: %v", err)
+	}
+
+	if len(agents) != 2 || agents[0].ID != "a" || agents[1].ID != "b" {
+		t.Fatalf("expected agents a and b, got %+v", agents)
+	}
+
+	beat, err := st.HeartbeatAgent("b", time.Minute)
+	if err != nil {
+		t.Fatalf("got error sending heartbeat: %v", err)
+	}
+
+	if beat.LastHeartbeat.Before(agents[1].LastHeartbeat) {
+		t.Fatalf("expected heartbeat to move forward from %v, got %v", agents[1].LastHeartbeat, beat.LastHeartbeat)
+	}
+}
+
+func testAgentNotFound(t *testing.T, st store.Repo) {
+	if _, err := st.GetAgent("nope"); err != store.ErrNotFound {
+		t.Fatalf("expected %v getting agent, got %v", store.ErrNotFound, err)
+	}
+
+	if _, err := st.HeartbeatAgent("nope", time.Minute); err != store.ErrNotFound {
+		t.Fatalf("expected %v sending heartbeat, got %v", store.ErrNotFound, err)
+	}
+
+	if _, err := st.LeaseRun("nope", time.Minute); err != store.ErrNotFound {
+		t.Fatalf("expected %v leasing run, got %v", store.ErrNotFound, err)
+	}
+}
+
+func testLeaseRun(t *testing.T, st store.Repo) {
+	seeded := seedRuns(t, st, "master", "feature")
+
+	if _, err := st.RegisterAgent(store.Agent{ID: "a"}); err != nil {
+		t.Fatalf("got error registering agent: %v", err)
+	}
+
+	run, err := st.LeaseRun("a", time.Minute)
+	if err != nil {
+		t.Fatalf("got error leasing run: %v", err)
+	}
+
+	if run.ID != seeded[0].ID || run.Status != store.RunRunning || run.AgentID != "a" {
+		t.Fatalf("expected oldest run leased to a, got %+v", run)
+	}
+
+	if run.StartedAt.IsZero() || !run.LeaseExpires.After(run.StartedAt) {
+		t.Fatalf("expected run started with a lease, got %+v", run)
+	}
+
+	if _, err := st.CreateStep(store.Step{RunID: run.ID, Task: "build"}); err != nil {
+		t.Fatalf("got error creating step: %v", err)
+	}
+
+	// Agents get the run they hold until they're done with it, steps
+	// and all.
+	held, err := st.LeaseRun("a", time.Minute)
+	if err != nil {
+		t.Fatalf("got error leasing run again: %v", err)
+	}
+
+	if held.ID != run.ID {
+		t.Fatalf("expected held run %v, got %v", run.ID, held.ID)
+	}
+
+	if len(held.Steps) != 1 || held.Steps[0].Task != "build" {
+		t.Fatalf("expected held run with its build step, got %v", held.Steps)
+	}
+
+	agent, err := st.GetAgent("a")
+	if err != nil {
+		t.Fatalf("got error getting agent: %v", err)
+	}
+
+	if agent.RunID != run.ID {
+		t.Fatalf("expected agent to hold run %v, got %v", run.ID, agent.RunID)
+	}
+
+	if _, err := st.UpdateRunStatus(run.ID, store.RunSucceeded); err != nil {
+		t.Fatalf("got error finishing run: %v", err)
+	}
+
+	next, err := st.LeaseRun("a", time.Minute)
+	if err != nil {
+		t.Fatalf("got error leasing next run: %v", err)
+	}
+
+	if next.ID != seeded[1].ID {
+		t.Fatalf("expected run %v, got %v", seeded[1].ID, next.ID)
+	}
+
+	if _, err := st.UpdateRunStatus(next.ID, store.RunFailed); err != nil {
+		t.Fatalf("got error finishing run: %v", err)
+	}
+
+	if _, err := st.LeaseRun("a", time.Minute); err != store.ErrNotFound {
+		t.Fatalf("expected %v with nothing queued, got %v", store.ErrNotFound, err)
+	}
+}
+
+func testLeaseRunLabels(t *testing.T, st store.Repo) {
+	run, err := st.CreateRun(store.Run{
+		Remote:  "a.git",
+		Branch:  "master",
+		Trigger: "manual",
+		Labels:  []string{"os=linux", "docker"},
+	})
+	if err != nil {
+		t.Fatalf("got error creating run: %v", err)
+	}
+
+	agents := []store.Agent{
+		{ID: "darwin", Labels: []string{"os=darwin", "docker"}},
+		{ID: "linux", Labels: []string{"arch=amd64", "docker", "os=linux"}},
+	}
+	for _, agent := range agents {
+		if _, err := st.RegisterAgent(agent); err != nil {
+			t.Fatalf("got error registering agent %v: %v", agent.ID, err)
+		}
+	}
+
+	if _, err := st.LeaseRun("darwin", time.Minute); err != store.ErrNotFound {
+		t.Fatalf("expected %v for agent without labels, got %v", store.ErrNotFound, err)
+	}
+
+	leased, err := st.LeaseRun("linux", time.Minute)
+	if err != nil {
+		t.Fatalf("got error leasing run: %v", err)
+	}
+
+	if leased.ID != run.ID || !reflect.DeepEqual(leased.Labels, run.Labels) {
+		t.Fatalf("expected run %+v, got %+v", run, leased)
+	}
+}
+
+func testExpireLeases(t *testing.T, st store.Repo) {
+	seeded := seedRuns(t, st, "master", "feature")
+
+	for _, id := range []string{"a", "b"} {
+		if _, err := st.RegisterAgent(store.Agent{ID: id}); err != nil {
+			t.Fatalf("got error registering agent %v: %v", id, err)
+		}
+	}
+
+	// a's lease is out as soon as it's taken, b's isn't.
+	if _, err := st.LeaseRun("a", -time.Second); err != nil {
+		t.Fatalf("got error leasing run to a: %v", err)
+	}
+	if _, err := st.LeaseRun("b", time.Minute); err != nil {
+		t.Fatalf("got error leasing run to b: %v", err)
+	}
+
+	expired, err := st.ExpireLeases()
+	if err != nil {
+		t.Fatalf("got error expiring leases: %v", err)
+	}
+
+	if len(expired) != 1 || expired[0].ID != seeded[0].ID {
+		t.Fatalf("expected run %v to expire, got %+v", seeded[0].ID, expired)
+	}
+
+	run, err := st.GetRun(seeded[0].ID)
+	if err != nil {
+		t.Fatalf("got error getting run: %v", err)
+	}
+
+	if run.Status != store.RunQueued || run.AgentID != "" || !run.StartedAt.IsZero() || !run.LeaseExpires.IsZero() {
+		t.Fatalf("expected run back in the queue, got %+v", run)
+	}
+
+	// A heartbeat keeps the lease going.
+	if _, err := st.LeaseRun("a", -time.Second); err != nil {
+		t.Fatalf("got error leasing run to a again: %v", err)
+	}
+	if _, err := st.HeartbeatAgent("a", time.Minute); err != nil {
+		t.Fatalf("got error sending heartbeat: %v", err)
+	}
+
+	expired, err = st.ExpireLeases()
+	if err != nil {
+		t.Fatalf("got error expiring leases: %v", err)
+	}
+
+	if len(expired) != 0 {
+		t.Fatalf("expected no leases to expire, got %+v", expired)
+	}
+}
+
+func testCancelRun(t *testing.T, st store.Repo) {
+	seeded := seedRuns(t, st, "master", "feature")
+
+	if _, err := st.RegisterAgent(store.Agent{ID: "a"}); err != nil {
+		t.Fatalf("got error registering agent: %v", err)
+	}
+	if _, err := st.LeaseRun("a", time.Minute); err != nil {
+		t.Fatalf("got error leasing run: %v", err)
+	}
+
+	// Running runs wait for their agent, which keeps holding them.
+	for i := 0; i < 2; i++ {
+		run, err := st.CancelRun(seeded[0].ID)
+		if err != nil {
+			t.Fatalf("got error cancelling running run: %v", err)
+		}
+
+		if run.Status != store.RunCancelling || run.CancelRequestedAt.IsZero() || !run.FinishedAt.IsZero() {
+			t.Fatalf("expected run to be cancelling, got %+v", run)
+		}
+	}
+
+	agent, err := st.GetAgent("a")
+	if err != nil {
+		t.Fatalf("got error getting agent: %v", err)
+	}
+
+	if agent.RunID != seeded[0].ID {
+		t.Fatalf("expected agent to still hold run %v, got %v", seeded[0].ID, agent.RunID)
+	}
+
+	if held, err := st.LeaseRun("a", time.Minute); err != nil || held.ID != seeded[0].ID {
+		t.Fatalf("expected agent to be handed run %v again, got %+v and %v", seeded[0].ID, held, err)
+	}
+
+	// Queued runs have nobody to wait for.
+	run, err := st.CancelRun(seeded[1].ID)
+	if err != nil {
+		t.Fatalf("got error cancelling queued run: %v", err)
+	}
+
+	if run.Status != store.RunCancelled || run.FinishedAt.IsZero() {
+		t.Fatalf("expected run to be cancelled, got %+v", run)
+	}
+
+	if _, err := st.CancelRun(seeded[1].ID); err != store.ErrIllegalTransition {
+		t.Fatalf("expected %v cancelling a finished run, got %v", store.ErrIllegalTransition, err)
+	}
+
+	if _, err := st.CancelRun(seeded[1].ID + 100); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+}
+
+func testTimeoutRuns(t *testing.T, st store.Repo) {
+	short, err := st.CreateRun(store.Run{
+		Remote:  "a.git",
+		Branch:  "master",
+		Trigger: "manual",
+		Timeout: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("got error creating run: %v", err)
+	}
+	seeded := seedRuns(t, st, "master", "feature")
+
+	for _, id := range []string{"a", "b", "c"} {
+		if _, err := st.RegisterAgent(store.Agent{ID: id}); err != nil {
+			t.Fatalf("got error registering agent %v: %v", id, err)
+		}
+		if _, err := st.LeaseRun(id, time.Minute); err != nil {
+			t.Fatalf("got error leasing run to %v: %v", id, err)
+		}
+	}
+
+	if _, err := st.CancelRun(seeded[1].ID); err != nil {
+		t.Fatalf("got error cancelling run: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	tests := []struct {
+		timeout, cancelTimeout time.Duration
+
+		id     int
+		status store.RunStatus
+		agent  string
+	}{
+		// Only the run with a timeout of its own runs out without a
+		// default.
+		{0, time.Hour, short.ID, store.RunFailed, "a"},
+		{time.Hour, -time.Second, seeded[1].ID, store.RunCancelled, "c"},
+		{time.Millisecond, time.Hour, seeded[0].ID, store.RunFailed, "b"},
+	}
+
+	for _, test := range tests {
+		stopped, err := st.TimeoutRuns(test.timeout, test.cancelTimeout)
+		if err != nil {
+			t.Fatalf("got error timing out runs: %v", err)
+		}
+
+		if len(stopped) != 1 || stopped[0].ID != test.id || stopped[0].Status != test.status ||
+			stopped[0].AgentID != test.agent {
+			t.Fatalf("expected run %v of %v to be %v, got %+v", test.id, test.agent, test.status, stopped)
+		}
+
+		agent, err := st.GetAgent(test.agent)
+		if err != nil {
+			t.Fatalf("got error getting agent: %v", err)
+		}
+
+		if agent.RunID != 0 {
+			t.Fatalf("expected %v to be let go of its run, got %v", test.agent, agent.RunID)
+		}
+	}
+
+	stopped, err := st.TimeoutRuns(time.Millisecond, -time.Second)
+	if err != nil {
+		t.Fatalf("got error timing out runs: %v", err)
+	}
+
+	if len(stopped) != 0 {
+		t.Fatalf("expected nothing left to time out, got %+v", stopped)
+	}
+}
+
+func message(payload string) store.MessageFunc {
+	return store.Messages(store.Message{
+		Subject: "pollers",
+		Payload: []byte(payload),
+	})
+}
+
+func pending(t *testing.T, st store.Repo) []store.Message {
+	msgs, err := st.GetPendingMessages(100)
+	if err != nil {
+		t.Fatalf("got error getting pending messages: %v", err)
+	}
+
+	return msgs
+}
+
+func createProject(t *testing.T, st store.Repo, remote string) store.Project {
+	p, err := st.CreateProject(store.Project{
+		Name:          remote,
+		Remote:        remote,
+		DefaultBranch: "master",
+		Branches:      []string{"master"},
+		Enabled:       true,
+	})
+	if err != nil {
+		t.Fatalf("got error creating project: %v", err)
+	}
+
+	return p
+}
+
+func testSchedules(t *testing.T, st store.Repo) {
+	p := createProject(t, st, "a.git")
+	other := createProject(t, st, "b.git")
+	next := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	created, err := st.CreateSchedule(store.Schedule{
+		ProjectID:  p.ID,
+		Branch:     "release",
+		Cron:       "0 2 * * *",
+		Timezone:   "Europe/Amsterdam",
+		Task:       "nightly",
+		Args:       map[string]string{"suite": "full"},
+		Labels:     []string{"linux"},
+		Enabled:    true,
+		NextFireAt: next,
+	})
+	if err != nil {
+		t.Fatalf("got error creating schedule: %v", err)
+	}
+
+	if created.ID == 0 || created.CreatedAt.IsZero() {
+		t.Fatalf("expected schedule to have an ID and creation time, got %+v", created)
+	}
+
+	if _, err := st.CreateSchedule(store.Schedule{ProjectID: other.ID, Cron: "@hourly", Task: "test"}); err != nil {
+		t.Fatalf("got error creating schedule: %v", err)
+	}
+
+	got, err := st.GetSchedule(created.ID)
+	if err != nil {
+		t.Fatalf("got error getting schedule: %v", err)
+	}
+
+	if got.ProjectID != p.ID || got.Branch != "release" || got.Cron != "0 2 * * *" ||
+		got.Timezone != "Europe/Amsterdam" || got.Task != "nightly" || !got.Enabled {
+		t.Fatalf("expected %+v, got %+v", created, got)
+	}
+
+	if want := map[string]string{"suite": "full"}; !reflect.DeepEqual(got.Args, want) {
+		t.Fatalf("expected arguments %v, got %v", want, got.Args)
+	}
+
+	if want := []string{"linux"}; !reflect.DeepEqual(got.Labels, want) {
+		t.Fatalf("expected labels %v, got %v", want, got.Labels)
+	}
+
+	if !got.NextFireAt.Equal(next) || !got.LastFiredAt.IsZero() {
+		t.Fatalf("expected schedule to fire next at %v and never to have fired, got %+v", next, got)
+	}
+
+	all, err := st.GetSchedules(0)
+	if err != nil {
+		t.Fatalf("got error getting schedules: %v", err)
+	}
+
+	if len(all) != 2 || all[0].ID != created.ID {
+		t.Fatalf("expected 2 schedules starting with %v, got %+v", created.ID, all)
+	}
+
+	scheds, err := st.GetSchedules(other.ID)
+	if err != nil {
+		t.Fatalf("got error getting schedules: %v", err)
+	}
+
+	if len(scheds) != 1 || scheds[0].ProjectID != other.ID {
+		t.Fatalf("expected 1 schedule of project %v, got %+v", other.ID, scheds)
+	}
+
+	got.ProjectID = other.ID
+	got.Cron = "30 3 * * *"
+	got.Args = nil
+	got.Labels = nil
+	got.Enabled = false
+	got.NextFireAt = time.Time{}
+
+	updated, err := st.UpdateSchedule(got)
+	if err != nil {
+		t.Fatalf("got error updating schedule: %v", err)
+	}
+
+	if updated.ProjectID != p.ID || !updated.CreatedAt.Equal(created.CreatedAt) {
+		t.Fatalf("expected project and creation time to be kept, got %+v", updated)
+	}
+
+	if updated.Cron != "30 3 * * *" || updated.Enabled || updated.Args != nil ||
+		updated.Labels != nil || !updated.NextFireAt.IsZero() {
+		t.Fatalf("expected schedule to be updated, got %+v", updated)
+	}
+
+	if err := st.DeleteSchedule(created.ID); err != nil {
+		t.Fatalf("got error deleting schedule: %v", err)
+	}
+
+	if _, err := st.GetSchedule(created.ID); err != store.ErrNotFound {
+		t.Fatalf("expected %v after deleting schedule, got %v", store.ErrNotFound, err)
+	}
+
+	// Deleting a project deletes its schedules.
+	if err := st.DeleteProject(other.ID); err != nil {
+		t.Fatalf("got error deleting project: %v", err)
+	}
+
+	if all, err := st.GetSchedules(0); err != nil || len(all) != 0 {
+		t.Fatalf("expected no schedules left, got %+v, %v", all, err)
+	}
+}
+
+func testScheduleNotFound(t *testing.T, st store.Repo) {
+	if _, err := st.CreateSchedule(store.Schedule{ProjectID: 1, Cron: "@daily", Task: "test"}); err != store.ErrNotFound {
+		t.Fatalf("expected %v creating schedule for missing project, got %v", store.ErrNotFound, err)
+	}
+
+	if _, err := st.GetSchedule(1); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+
+	if _, err := st.UpdateSchedule(store.Schedule{ID: 1}); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+
+	if err := st.DeleteSchedule(1); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+
+	if _, err := st.FireSchedule(1, time.Now(), time.Now()); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+}
+
+func testGetDueSchedules(t *testing.T, st store.Repo) {
+	p := createProject(t, st, "a.git")
+	now := time.Now().Truncate(time.Second)
+
+	scheds := []store.Schedule{
+		{NextFireAt: now.Add(-time.Minute), Enabled: true},
+		{NextFireAt: now.Add(-time.Hour), Enabled: true},
+		{NextFireAt: now, Enabled: true},
+		{NextFireAt: now.Add(time.Minute), Enabled: true},
+		{NextFireAt: now.Add(-time.Hour), Enabled: false},
+		{Enabled: true},
+	}
+
+	ids := []int{}
+	for _, sched := range scheds {
+		sched.ProjectID = p.ID
+		sched.Cron = "* * * * *"
+		sched.Task = "test"
+
+		created, err := st.CreateSchedule(sched)
+		if err != nil {
+			t.Fatalf("got error creating schedule: %v", err)
+		}
+		ids = append(ids, created.ID)
+	}
+
+	due, err := st.GetDueSchedules(now)
+	if err != nil {
+		t.Fatalf("got error getting due schedules: %v", err)
+	}
+
+	got := []int{}
+	for _, sched := range due {
+		got = append(got, sched.ID)
+	}
+
+	if want := []int{ids[1], ids[0], ids[2]}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected due schedules %v, got %v", want, got)
+	}
+}
+
+func testFireSchedule(t *testing.T, st store.Repo) {
+	p := createProject(t, st, "a.git")
+	at := time.Now().Add(-time.Minute).Truncate(time.Second)
+	next := at.Add(time.Hour)
+
+	created, err := st.CreateSchedule(store.Schedule{
+		ProjectID:  p.ID,
+		Cron:       "@hourly",
+		Task:       "test",
+		Enabled:    true,
+		NextFireAt: at,
+	})
+	if err != nil {
+		t.Fatalf("got error creating schedule: %v", err)
+	}
+
+	fired, err := st.FireSchedule(created.ID, at, next)
+	if err != nil {
+		t.Fatalf("got error firing schedule: %v", err)
+	}
+
+	if !fired.LastFiredAt.Equal(at) || !fired.NextFireAt.Equal(next) {
+		t.Fatalf("expected schedule fired at %v to fire next at %v, got %+v", at, next, fired)
+	}
+
+	// Whoever comes second finds it already fired.
+	if _, err := st.FireSchedule(created.ID, at, next); err != store.ErrConflict {
+		t.Fatalf("expected %v firing schedule twice, got %v", store.ErrConflict, err)
+	}
+
+	got, err := st.GetSchedule(created.ID)
+	if err != nil {
+		t.Fatalf("got error getting schedule: %v", err)
+	}
+
+	if !got.LastFiredAt.Equal(at) || !got.NextFireAt.Equal(next) {
+		t.Fatalf("expected firing to be saved, got %+v", got)
+	}
+
+	// Disabled schedules don't fire, and schedules that never fire again
+	// aren't due.
+	got.Enabled = false
+	if _, err := st.UpdateSchedule(got); err != nil {
+		t.Fatalf("got error updating schedule: %v", err)
+	}
+
+	if _, err := st.FireSchedule(created.ID, next, next.Add(time.Hour)); err != store.ErrConflict {
+		t.Fatalf("expected %v firing disabled schedule, got %v", store.ErrConflict, err)
+	}
+
+	got.Enabled = true
+	if _, err := st.UpdateSchedule(got); err != nil {
+		t.Fatalf("got error updating schedule: %v", err)
+	}
+
+	if _, err := st.FireSchedule(created.ID, next, time.Time{}); err != nil {
+		t.Fatalf("got error firing schedule for the last time: %v", err)
+	}
+
+	if due, err := st.GetDueSchedules(next.Add(24 * time.Hour)); err != nil || len(due) != 0 {
+		t.Fatalf("expected no due schedules, got %+v, %v", due, err)
+	}
+}
+
+func testOutboxMessagesSaved(t *testing.T, st store.Repo) {
+	repo := store.GitRepo{Remote: "a.git", Branch: "master"}
+	if err := st.CreateGitRepo(repo, message("create")); err != nil {
+		t.Fatalf("got error creating repo: %v", err)
+	}
+
+	updated := store.GitRepo{Remote: "a.git", Branch: "develop"}
+	if err := st.UpdateGitRepo(repo.Remote, repo.Branch, updated, message("update")); err != nil {
+		t.Fatalf("got error updating repo: %v", err)
+	}
+
+	if err := st.DeleteGitRepo(updated.Remote, updated.Branch, message("delete")); err != nil {
+		t.Fatalf("got error deleting repo: %v", err)
+	}
+
+	msgs := pending(t, st)
+	want := []string{"create", "update", "delete"}
+	if len(msgs) != len(want) {
+		t.Fatalf("expected %v pending messages, got %v", len(want), len(msgs))
+	}
+
+	for i, msg := range msgs {
+		if string(msg.Payload) != want[i] || msg.Subject != "pollers" {
+			t.Fatalf("expected message %v to be %v on pollers, got %s on %v",
+				i, want[i], msg.Payload, msg.Subject)
+		}
+
+		if msg.ID == 0 || msg.CreatedAt.IsZero() {
+			t.Fatalf("expected message %v to have an ID and creation time, got %v", i, msg)
+		}
+	}
+}
+
+func testOutboxMessagesRolledBack(t *testing.T, st store.Repo) {
+	seed(t, st)
+
+	if err := st.CreateGitRepo(seedRepos[0], message("create")); err != store.ErrConflict {
+		t.Fatalf("expected %v, got %v", store.ErrConflict, err)
+	}
+
+	missing := store.GitRepo{Remote: "a.git", Branch: "missing"}
+	if err := st.UpdateGitRepo(missing.Remote, missing.Branch, missing, message("update")); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+
+	if err := st.DeleteGitRepo(missing.Remote, missing.Branch, message("delete")); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+
+	n, err := st.CountPendingMessages()
+	if err != nil {
+		t.Fatalf("got error counting pending messages: %v", err)
+	}
+
+	if n != 0 {
+		t.Fatalf("expected failed changes to leave no messages, got %v", n)
+	}
+}
+
+// Messages are built from the project as the change found it and left it,
+// rather than whatever the caller last read.
+func testOutboxMessagesSeeChange(t *testing.T, st store.Repo) {
+	describe := func(p *store.Project) string {
+		if p == nil {
+			return "none"
+		}
+
+		return strings.Join(p.Branches, ",")
+	}
+
+	var got string
+	record := func(old, new *store.Project) []store.Message {
+		got = describe(old) + " -> " + describe(new)
+		return nil
+	}
+
+	expect := func(want string) {
+		t.Helper()
+
+		if got != want {
+			t.Fatalf("expected messages to be built for %q, got %q", want, got)
+		}
+		got = ""
+	}
+
+	if err := st.CreateGitRepo(store.GitRepo{Remote: "a.git", Branch: "master"}, record); err != nil {
+		t.Fatalf("got error creating repo: %v", err)
+	}
+	expect("none -> master")
+
+	if err := st.CreateGitRepo(store.GitRepo{Remote: "a.git", Branch: "develop"}, record); err != nil {
+		t.Fatalf("got error creating repo: %v", err)
+	}
+	expect("master -> develop,master")
+
+	updated := store.GitRepo{Remote: "a.git", Branch: "feature"}
+	if err := st.UpdateGitRepo("a.git", "develop", updated, record); err != nil {
+		t.Fatalf("got error updating repo: %v", err)
+	}
+	expect("develop,master -> feature,master")
+
+	if err := st.DeleteGitRepo("a.git", "feature", record); err != nil {
+		t.Fatalf("got error deleting repo: %v", err)
+	}
+	expect("feature,master -> master")
+
+	p, err := st.GetProjectByRemote("a.git")
+	if err != nil {
+		t.Fatalf("got error getting project: %v", err)
+	}
+
+	p.Branches = []string{"release/*", "master"}
+	if _, err := st.UpdateProject(p, record); err != nil {
+		t.Fatalf("got error updating project: %v", err)
+	}
+	expect("master -> master,release/*")
+
+	if err := st.DeleteProject(p.ID, record); err != nil {
+		t.Fatalf("got error deleting project: %v", err)
+	}
+	expect("master,release/* -> none")
+
+	_, err = st.CreateProject(store.Project{
+		Name:          "b",
+		Remote:        "b.git",
+		DefaultBranch: "master",
+		Branches:      []string{"master"},
+	}, record)
+	if err != nil {
+		t.Fatalf("got error creating project: %v", err)
+	}
+	expect("none -> master")
+}
+
+func testOutboxDelivered(t *testing.T, st store.Repo) {
+	repo := store.GitRepo{Remote: "a.git", Branch: "master"}
+	if err := st.CreateGitRepo(repo, message("create")); err != nil {
+		t.Fatalf("got error creating repo: %v", err)
+	}
+
+	msgs := pending(t, st)
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 pending message, got %v", len(msgs))
+	}
+
+	if err := st.MarkMessageDelivered(msgs[0].ID); err != nil {
+		t.Fatalf("got error marking message delivered: %v", err)
+	}
+
+	if msgs := pending(t, st); len(msgs) != 0 {
+		t.Fatalf("expected no pending messages, got %v", len(msgs))
+	}
+}
+
+func testOutboxFailed(t *testing.T, st store.Repo) {
+	repo := store.GitRepo{Remote: "a.git", Branch: "master"}
+	if err := st.CreateGitRepo(repo, message("create")); err != nil {
+		t.Fatalf("got error creating repo: %v", err)
+	}
+
+	id := pending(t, st)[0].ID
+	if err := st.MarkMessageFailed(id, "bus is down", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("got error marking message failed: %v", err)
+	}
+
+	if msgs := pending(t, st); len(msgs) != 0 {
+		t.Fatalf("expected failed message not to be due, got %v", len(msgs))
+	}
+
+	n, err := st.CountPendingMessages()
+	if err != nil {
+		t.Fatalf("got error counting pending messages: %v", err)
+	}
+
+	if n != 1 {
+		t.Fatalf("expected failed message to still be pending, got %v", n)
+	}
+
+	if err := st.MarkMessageFailed(id, "still down", time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("got error marking message failed: %v", err)
+	}
+
+	msgs := pending(t, st)
+	if len(msgs) != 1 {
+		t.Fatalf("expected rescheduled message to be due, got %v", len(msgs))
+	}
+
+	if msgs[0].Attempts != 2 || msgs[0].LastError != "still down" {
+		t.Fatalf("expected 2 attempts and the last error, got %v", msgs[0])
+	}
+}
+
+func testOutboxNotFound(t *testing.T, st store.Repo) {
+	if err := st.MarkMessageDelivered(42); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+
+	if err := st.MarkMessageFailed(42, "", time.Now()); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+}
+
+func testTokens(t *testing.T, st store.Repo) {
+	created, err := st.CreateToken(store.Token{
+		Name:   "ci",
+		Hash:   strings.Repeat("a", 64),
+		Scopes: []string{store.ScopeReposRead, store.ScopeRunsTrigger},
+	})
+	if err != nil {
+		t.Fatalf("got error creating token: %v", err)
+	}
+
+	if created.ID == 0 || created.CreatedAt.IsZero() {
+		t.Fatalf("expected token to have an ID and creation time, got %+v", created)
+	}
+
+	if _, err := st.CreateToken(store.Token{Name: "other", Hash: strings.Repeat("b", 64)}); err != nil {
+		t.Fatalf("got error creating token: %v", err)
+	}
+
+	got, err := st.GetTokenByHash(created.Hash)
+	if err != nil {
+		t.Fatalf("got error getting token: %v", err)
+	}
+
+	if got.ID != created.ID || got.Name != "ci" || !reflect.DeepEqual(got.Scopes, created.Scopes) {
+		t.Fatalf("expected %+v, got %+v", created, got)
+	}
+
+	tokens, err := st.GetTokens()
+	if err != nil {
+		t.Fatalf("got error getting tokens: %v", err)
+	}
+
+	if len(tokens) != 2 || tokens[0].ID != created.ID {
+		t.Fatalf("expected 2 tokens starting with %v, got %+v", created.ID, tokens)
+	}
+
+	if err := st.DeleteToken(created.ID); err != nil {
+		t.Fatalf("got error deleting token: %v", err)
+	}
+
+	if _, err := st.GetTokenByHash(created.Hash); err != store.ErrNotFound {
+		t.Fatalf("expected %v after deleting token, got %v", store.ErrNotFound, err)
+	}
+}
+
+func testCreateTokenConflict(t *testing.T, st store.Repo) {
+	token := store.Token{Name: "ci", Hash: strings.Repeat("a", 64)}
+	if _, err := st.CreateToken(token); err != nil {
+		t.Fatalf("got error creating token: %v", err)
+	}
+
+	if _, err := st.CreateToken(token); err != store.ErrConflict {
+		t.Fatalf("expected %v, got %v", store.ErrConflict, err)
+	}
+}
+
+func testTokenNotFound(t *testing.T, st store.Repo) {
+	if _, err := st.GetTokenByHash(strings.Repeat("a", 64)); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+
+	if err := st.DeleteToken(1); err != store.ErrNotFound {
+		t.Fatalf("expected %v, got %v", store.ErrNotFound, err)
+	}
+}
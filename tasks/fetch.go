@@ -0,0 +1,113 @@
+package tasks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ErrNoTask is returned when a repo doesn't have the task file asked for.
+var ErrNoTask = errors.New("task file not found")
+
+// Fetcher gets task files out of repos.
+type Fetcher interface {
+	// Fetch returns the contents of `file` at `ref` of the repo at `url`,
+	// along with the commit `ref` points to. The ref can be a branch, a
+	// tag or a full commit hash.
+	Fetch(url, ref, file string) ([]byte, string, error)
+}
+
+// Git fetches task files with the git command line, getting as little of
+// the repo as it can. It has no credentials of its own, so it only works
+// for repos the server can clone anonymously or with whatever git is
+// already configured to use.
+type Git struct {
+	// Timeout bounds each fetch. Zero means no timeout.
+	Timeout time.Duration
+
+	// AllowFile lets it fetch from file:// URLs and local paths. They're
+	// refused unless it's set, since they read from the server's own
+	// filesystem.
+	AllowFile bool
+}
+
+// protocols returns the protocols git is allowed to fetch over. Anything
+// else, like the ext:: and fd:: remote helpers, is refused by git itself.
+func (g Git) protocols() string {
+	protocols := "https:http:ssh:git"
+	if g.AllowFile {
+		protocols += ":file"
+	}
+
+	return protocols
+}
+
+// Fetch implements Fetcher.
+func (g Git) Fetch(url, ref, file string) ([]byte, string, error) {
+	// Neither can be allowed to pass for an option.
+	if strings.HasPrefix(url, "-") || strings.HasPrefix(ref, "-") {
+		return nil, "", fmt.Errorf("invalid url %q or ref %q", url, ref)
+	}
+
+	ctx := context.Background()
+	if g.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.Timeout)
+		defer cancel()
+	}
+
+	dir, err := ioutil.TempDir("", "run-server-tasks")
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.RemoveAll(dir)
+
+	git := func(args ...string) ([]byte, error) {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_ALLOW_PROTOCOL="+g.protocols(),
+			"GIT_TERMINAL_PROMPT=0",
+		)
+
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("git %v: %v: %v", args[0], err, strings.TrimSpace(stderr.String()))
+		}
+
+		return out, nil
+	}
+
+	if _, err := git("init", "-q"); err != nil {
+		return nil, "", err
+	}
+
+	if _, err := git("fetch", "-q", "--depth", "1", url, ref); err != nil {
+		return nil, "", err
+	}
+
+	commit, err := git("rev-parse", "FETCH_HEAD")
+	if err != nil {
+		return nil, "", err
+	}
+
+	if _, err := git("cat-file", "-e", "FETCH_HEAD:"+file); err != nil {
+		return nil, "", ErrNoTask
+	}
+
+	buf, err := git("cat-file", "blob", "FETCH_HEAD:"+file)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return buf, strings.TrimSpace(string(commit)), nil
+}
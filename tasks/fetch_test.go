@@ -0,0 +1,105 @@
+package tasks
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newRepo returns the path to a git repo with `files` committed on master,
+// along with the commit.
+func newRepo(t *testing.T, files map[string]string) (string, string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "tasks-repo")
+	if err != nil {
+		t.Fatalf("got error creating temp dir: %v", err)
+	}
+
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("got error running git %v: %v: %s", args, err, out)
+		}
+
+		return strings.TrimSpace(string(out))
+	}
+
+	git("init", "-q")
+	git("symbolic-ref", "HEAD", "refs/heads/master")
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("got error creating %v: %v", filepath.Dir(path), err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("got error writing %v: %v", name, err)
+		}
+	}
+
+	git("add", "-A")
+	git("commit", "-q", "-m", "tasks")
+
+	return dir, git("rev-parse", "HEAD")
+}
+
+func TestGitFetch(t *testing.T) {
+	dir, commit := newRepo(t, map[string]string{
+		"tasks/build.yaml": "image: a\ncommand: b\n",
+	})
+	defer os.RemoveAll(dir)
+
+	g := Git{Timeout: 10 * time.Second, AllowFile: true}
+
+	buf, got, err := g.Fetch("file://"+dir, "master", "tasks/build.yaml")
+	if err != nil {
+		t.Fatalf("got error fetching task: %v", err)
+	}
+
+	if string(buf) != "image: a\ncommand: b\n" {
+		t.Fatalf("unexpected task file %q", buf)
+	}
+
+	if got != commit {
+		t.Fatalf("expected commit %v, got %v", commit, got)
+	}
+
+	if _, _, err := g.Fetch("file://"+dir, "master", "tasks/test.yaml"); err != ErrNoTask {
+		t.Fatalf("expected %v, got %v", ErrNoTask, err)
+	}
+
+	if _, _, err := g.Fetch("file://"+dir, "nope", "tasks/build.yaml"); err == nil {
+		t.Fatal("expected an error fetching a missing branch")
+	}
+}
+
+func TestGitFetchFileRefused(t *testing.T) {
+	dir, _ := newRepo(t, map[string]string{
+		"tasks/build.yaml": "image: a\ncommand: b\n",
+	})
+	defer os.RemoveAll(dir)
+
+	g := Git{Timeout: 10 * time.Second}
+
+	for _, url := range []string{"file://" + dir, dir, "ext::sh -c touch% " + filepath.Join(dir, "pwned")} {
+		_, _, err := g.Fetch(url, "master", "tasks/build.yaml")
+		if err == nil || err == ErrNoTask {
+			t.Fatalf("expected %q to be refused, got %v", url, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "pwned")); !os.IsNotExist(err) {
+		t.Fatalf("expected ext:: remote not to run anything, got %v", err)
+	}
+}
@@ -0,0 +1,402 @@
+// Package tasks parses the task definitions projects keep in their repos,
+// in the same format the `run` tool reads them in. Each task lives in its
+// own YAML file and is named after it, so `tasks/build.yaml` defines the
+// `build` task.
+package tasks
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Ext is the extension task files have.
+const Ext = ".yaml"
+
+// Task is a single task definition.
+type Task struct {
+	Name        string
+	Summary     string
+	Description string
+	Image       string
+	Mount       string
+	Command     string
+	Shell       string
+
+	// Timeout is how long a run of the task can take before it's failed,
+	// or 0 if it doesn't say.
+	Timeout time.Duration
+
+	// Arguments are passed to the task's command as environment
+	// variables, keyed by their names.
+	Arguments map[string]Argument
+}
+
+// Argument is a value a task can be given when it's run.
+type Argument struct {
+	Description string
+
+	// Default is used when the argument isn't given. Arguments without
+	// one have to be given every time the task is run.
+	Default    string
+	HasDefault bool
+}
+
+// Error is a problem with a task file, along with where in the file it is.
+// Line and Column are 1-based, and are 0 if the problem isn't anywhere in
+// particular.
+type Error struct {
+	Line    int
+	Column  int
+	Field   string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+
+	return fmt.Sprintf("line %v: %v", e.Line, e.Message)
+}
+
+// Errors is every problem found with a task file.
+type Errors []*Error
+
+func (errs Errors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+var (
+	argNameRE   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	taskNameRE  = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	syntaxErrRE = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+)
+
+// ValidName returns whether `name` can be the name of a task.
+func ValidName(name string) bool {
+	return taskNameRE.MatchString(name)
+}
+
+// Parse parses the task `name` from the contents of its file. It returns
+// Errors listing everything wrong with the file if it isn't valid.
+func Parse(name string, buf []byte) (Task, error) {
+	task := Task{
+		Name:      name,
+		Arguments: map[string]Argument{},
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(buf, &doc); err != nil {
+		return task, Errors{syntaxError(err)}
+	}
+
+	p := parser{}
+
+	if !ValidName(name) {
+		p.errorf(nil, "", "invalid task name %q", name)
+	}
+
+	if doc.Kind == 0 || len(doc.Content) == 0 {
+		p.errorf(nil, "", "task file is empty")
+		return task, p.errs
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		p.errorf(root, "", "expected a mapping of task fields")
+		return task, p.errs
+	}
+
+	fields := map[string]*string{
+		"summary":     &task.Summary,
+		"description": &task.Description,
+		"image":       &task.Image,
+		"mount":       &task.Mount,
+		"command":     &task.Command,
+		"shell":       &task.Shell,
+	}
+
+	present := map[string]bool{}
+	p.mapping(root, "", func(key string, keyNode, val *yaml.Node) {
+		present[key] = true
+
+		if key == "arguments" {
+			task.Arguments = p.arguments(val)
+			return
+		}
+
+		if key == "timeout" {
+			task.Timeout = p.duration(val, key)
+			return
+		}
+
+		field, ok := fields[key]
+		if !ok {
+			p.errorf(keyNode, key, "unknown field %q", key)
+			return
+		}
+
+		*field = p.str(val, key)
+	})
+
+	for _, required := range []string{"image", "command"} {
+		if !present[required] {
+			p.errorf(root, required, "missing %v", required)
+			continue
+		}
+
+		if v := p.find(root, required); v.Kind == yaml.ScalarNode && strings.TrimSpace(v.Value) == "" {
+			p.errorf(v, required, "%v is empty", required)
+		}
+	}
+
+	if task.Mount != "" && !path.IsAbs(task.Mount) {
+		p.errorf(p.find(root, "mount"), "mount", "mount must be an absolute path")
+	}
+
+	if len(p.errs) > 0 {
+		return task, p.errs
+	}
+
+	return task, nil
+}
+
+// LoadDir parses every task file in `dir`. Tasks that can't be read or
+// aren't valid are reported in the returned map of errors, keyed by file
+// name, and left out of the returned tasks.
+func LoadDir(dir string) ([]Task, map[string]error, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+Ext))
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(files)
+
+	tasks := []Task{}
+	errs := map[string]error{}
+	for _, file := range files {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			errs[filepath.Base(file)] = err
+			continue
+		}
+
+		task, err := Parse(NameOf(file), buf)
+		if err != nil {
+			errs[filepath.Base(file)] = err
+			continue
+		}
+
+		tasks = append(tasks, task)
+	}
+
+	return tasks, errs, nil
+}
+
+// NameOf returns the name of the task defined in `file`.
+func NameOf(file string) string {
+	return strings.TrimSuffix(filepath.Base(file), Ext)
+}
+
+// syntaxError turns an error from the YAML parser into an Error, pulling
+// the line number out of its message if it has one.
+func syntaxError(err error) *Error {
+	msg := err.Error()
+
+	if m := syntaxErrRE.FindStringSubmatch(msg); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return &Error{Line: line, Message: m[2]}
+	}
+
+	return &Error{Message: strings.TrimPrefix(msg, "yaml: ")}
+}
+
+// parser collects every error found while walking a task file, so they
+// can all be reported at once.
+type parser struct {
+	errs Errors
+}
+
+func (p *parser) errorf(n *yaml.Node, field, format string, args ...interface{}) {
+	err := &Error{Field: field, Message: fmt.Sprintf(format, args...)}
+	if n != nil {
+		err.Line, err.Column = n.Line, n.Column
+	}
+
+	p.errs = append(p.errs, err)
+}
+
+// mapping calls `f` with every key and value in the mapping `n`, which is
+// the value of `field`. Keys that aren't strings or are repeated are
+// reported rather than passed on.
+func (p *parser) mapping(n *yaml.Node, field string, f func(key string, keyNode, val *yaml.Node)) {
+	if n.Kind != yaml.MappingNode {
+		p.errorf(n, field, "%v must be a mapping", field)
+		return
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		keyNode, val := n.Content[i], n.Content[i+1]
+
+		if keyNode.Kind != yaml.ScalarNode {
+			p.errorf(keyNode, field, "keys must be strings")
+			continue
+		}
+
+		key := keyNode.Value
+		if seen[key] {
+			p.errorf(keyNode, join(field, key), "%q is repeated", key)
+			continue
+		}
+		seen[key] = true
+
+		f(key, keyNode, val)
+	}
+}
+
+// str returns the value of the scalar `n`, which is the value of `field`.
+func (p *parser) str(n *yaml.Node, field string) string {
+	if n.Kind != yaml.ScalarNode {
+		p.errorf(n, field, "%v must be a string", field)
+		return ""
+	}
+
+	return n.Value
+}
+
+// duration returns the value of the scalar `n`, which is the value of
+// `field`, as a positive duration like "90s" or "1h30m".
+func (p *parser) duration(n *yaml.Node, field string) time.Duration {
+	raw := p.str(n, field)
+	if raw == "" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		p.errorf(n, field, "%v must be a positive duration like 90s or 1h30m", field)
+		return 0
+	}
+
+	return d
+}
+
+func (p *parser) arguments(n *yaml.Node) map[string]Argument {
+	args := map[string]Argument{}
+
+	// An `arguments:` with nothing after it is just a task without any.
+	if n.Kind == yaml.ScalarNode && n.ShortTag() == "!!null" {
+		return args
+	}
+
+	p.mapping(n, "arguments", func(name string, nameNode, val *yaml.Node) {
+		field := join("arguments", name)
+
+		if !argNameRE.MatchString(name) {
+			p.errorf(nameNode, field, "argument name %q isn't a valid environment variable name", name)
+			return
+		}
+
+		arg := Argument{}
+		if val.Kind == yaml.ScalarNode && val.ShortTag() == "!!null" {
+			args[name] = arg
+			return
+		}
+
+		p.mapping(val, field, func(key string, keyNode, val *yaml.Node) {
+			switch key {
+			case "description":
+				arg.Description = p.str(val, join(field, key))
+			case "default":
+				arg.Default = p.str(val, join(field, key))
+				arg.HasDefault = true
+			default:
+				p.errorf(keyNode, join(field, key), "unknown argument field %q", key)
+			}
+		})
+
+		args[name] = arg
+	})
+
+	return args
+}
+
+// find returns the value of `key` in the mapping `n`, or `n` itself if it
+// doesn't have one.
+func (p *parser) find(n *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+
+	return n
+}
+
+func join(field, key string) string {
+	if field == "" {
+		return key
+	}
+
+	return field + "." + key
+}
+
+// Resolve checks `args` against the task's arguments and returns the
+// values the task should be run with, which includes the defaults of the
+// arguments that weren't given. It returns Errors for arguments the task
+// doesn't take and for required ones that are missing.
+func (t Task) Resolve(args map[string]string) (map[string]string, error) {
+	resolved := map[string]string{}
+	errs := Errors{}
+
+	for name, value := range args {
+		if _, ok := t.Arguments[name]; !ok {
+			errs = append(errs, &Error{
+				Field:   join("arguments", name),
+				Message: fmt.Sprintf("task %v doesn't take argument %v", t.Name, name),
+			})
+			continue
+		}
+
+		resolved[name] = value
+	}
+
+	for name, arg := range t.Arguments {
+		if _, ok := resolved[name]; ok {
+			continue
+		}
+
+		if !arg.HasDefault {
+			errs = append(errs, &Error{
+				Field:   join("arguments", name),
+				Message: fmt.Sprintf("task %v needs argument %v", t.Name, name),
+			})
+			continue
+		}
+
+		resolved[name] = arg.Default
+	}
+
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool {
+			return errs[i].Field < errs[j].Field
+		})
+		return nil, errs
+	}
+
+	return resolved, nil
+}
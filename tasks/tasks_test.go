@@ -0,0 +1,141 @@
+package tasks
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseBuildTask(t *testing.T) {
+	// The repo's own build task is the canonical example of the format.
+	buf, err := ioutil.ReadFile("build.yaml")
+	if err != nil {
+		t.Fatalf("got error reading build task: %v", err)
+	}
+
+	task, err := Parse("build", buf)
+	if err != nil {
+		t.Fatalf("got error parsing build task: %v", err)
+	}
+
+	if task.Image != "golang:1.11-stretch" || task.Command != "go build -v" ||
+		task.Mount != "/go/src/github.com/run-ci/run-server" {
+		t.Fatalf("unexpected task %+v", task)
+	}
+
+	goos, ok := task.Arguments["GOOS"]
+	if !ok || !goos.HasDefault || goos.Default != "linux" {
+		t.Fatalf("expected GOOS to default to linux, got %+v", task.Arguments)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		line  int
+		field string
+	}{
+		{"syntax", "image: a\n  command: [b\n", 2, ""},
+		{"empty", "", 0, ""},
+		{"not a mapping", "- image: a\n", 1, ""},
+		{"unknown field", "image: a\ncommand: b\nimgae: c\n", 3, "imgae"},
+		{"missing command", "image: a\n", 1, "command"},
+		{"repeated field", "image: a\ncommand: b\nimage: c\n", 3, "image"},
+		{"not a string", "image: a\ncommand:\n  - b\n", 3, "command"},
+		{"relative mount", "image: a\ncommand: b\nmount: src\n", 3, "mount"},
+		{"bad timeout", "image: a\ncommand: b\ntimeout: soon\n", 3, "timeout"},
+		{"negative timeout", "image: a\ncommand: b\ntimeout: -1m\n", 3, "timeout"},
+		{"bad argument name", "image: a\ncommand: b\narguments:\n  GO-OS:\n    default: linux\n", 4, "arguments.GO-OS"},
+		{"unknown argument field", "image: a\ncommand: b\narguments:\n  GOOS:\n    defualt: linux\n", 5, "arguments.GOOS.defualt"},
+	}
+
+	for _, test := range tests {
+		_, err := Parse("test", []byte(test.doc))
+		errs, ok := err.(Errors)
+		if !ok || len(errs) == 0 {
+			t.Fatalf("%v: expected Errors, got %v", test.name, err)
+		}
+
+		if errs[0].Line != test.line || errs[0].Field != test.field {
+			t.Fatalf("%v: expected error on line %v for %q, got %+v", test.name, test.line, test.field, errs[0])
+		}
+	}
+}
+
+func TestParseReportsEveryError(t *testing.T) {
+	_, err := Parse("test", []byte("summary: a\nimgae: b\ncommand: [c]\n"))
+
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("expected Errors, got %v", err)
+	}
+
+	// The misspelled field, the command that isn't a string and the
+	// missing image are all reported.
+	if len(errs) != 3 {
+		t.Fatalf("expected 3 errors, got %v", errs)
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tasks")
+	if err != nil {
+		t.Fatalf("got error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"build.yaml": "image: a\ncommand: b\n",
+		"test.yaml":  "image: a\n",
+		"notes.txt":  "not a task",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("got error writing %v: %v", name, err)
+		}
+	}
+
+	tasks, errs, err := LoadDir(dir)
+	if err != nil {
+		t.Fatalf("got error loading tasks: %v", err)
+	}
+
+	if len(tasks) != 1 || tasks[0].Name != "build" {
+		t.Fatalf("expected only the build task, got %+v", tasks)
+	}
+
+	if len(errs) != 1 || errs["test.yaml"] == nil {
+		t.Fatalf("expected an error for test.yaml, got %v", errs)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	task := Task{
+		Name: "build",
+		Arguments: map[string]Argument{
+			"GOOS":    {Default: "linux", HasDefault: true},
+			"VERSION": {},
+		},
+	}
+
+	args, err := task.Resolve(map[string]string{"VERSION": "1.0"})
+	if err != nil {
+		t.Fatalf("got error resolving arguments: %v", err)
+	}
+
+	if args["GOOS"] != "linux" || args["VERSION"] != "1.0" || len(args) != 2 {
+		t.Fatalf("expected defaults filled in, got %v", args)
+	}
+
+	_, err = task.Resolve(map[string]string{"GOARCH": "arm"})
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", err)
+	}
+
+	if errs[0].Field != "arguments.GOARCH" || errs[1].Field != "arguments.VERSION" {
+		t.Fatalf("expected unknown GOARCH and missing VERSION, got %v", errs)
+	}
+}
@@ -0,0 +1,146 @@
+// Package triggers turns the build triggers published by pollers and
+// webhooks into queued runs.
+package triggers
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/remote"
+	"github.com/run-ci/run-server/store"
+	"github.com/sirupsen/logrus"
+)
+
+var logger *logrus.Entry
+
+func init() {
+	logger = logrus.WithField("package", "triggers")
+}
+
+// ErrNotTracked is returned for triggers of commits that aren't built,
+// either because nothing tracks their branch or because their project is
+// disabled.
+var ErrNotTracked = errors.New("ref isn't tracked")
+
+// Group is the queue group servers consume triggers in, so that each
+// trigger is only recorded once no matter how many servers are running.
+const Group = "run-server"
+
+// Trigger is a request to build a commit, as published on
+// queue.SubjectTriggers.
+type Trigger struct {
+	// Remote can be any spelling of the remote. Parse replaces it with its
+	// canonical form, which is what runs are recorded against.
+	Remote string `json:"remote"`
+	Branch string `json:"branch"`
+	Tag    string `json:"tag"`
+	Commit string `json:"commit"`
+
+	// Trigger is what caused the build, for example "push" or "tag". It
+	// defaults to "poll" since pollers are the main source of triggers.
+	Trigger string `json:"trigger"`
+}
+
+// Parse unmarshals and validates a trigger message.
+func Parse(msg []byte) (Trigger, error) {
+	var trig Trigger
+	if err := json.Unmarshal(msg, &trig); err != nil {
+		return trig, err
+	}
+
+	if trig.Remote == "" {
+		return trig, errors.New("missing remote")
+	}
+
+	canonical, err := remote.Canonical(trig.Remote)
+	if err != nil {
+		return trig, err
+	}
+	trig.Remote = canonical
+
+	if trig.Commit == "" {
+		return trig, errors.New("missing commit")
+	}
+
+	if trig.Branch == "" && trig.Tag == "" {
+		return trig, errors.New("need either a branch or a tag")
+	}
+
+	if trig.Trigger == "" {
+		trig.Trigger = "poll"
+	}
+
+	return trig, nil
+}
+
+// Consume records every trigger received on `recv` as a queued run in
+// `st`. It returns when `recv` is closed.
+func Consume(recv <-chan queue.Message, st store.Repo) {
+	logger.Info("consuming build triggers")
+
+	for msg := range recv {
+		Record(msg.Data, st)
+	}
+
+	logger.Info("trigger channel closed, done consuming")
+}
+
+// Record saves the trigger in `msg` as a queued run. Invalid triggers, and
+// triggers for branches their project doesn't track, are logged and
+// dropped since sending them again won't fix them.
+func Record(msg []byte, st store.Repo) (store.Run, error) {
+	trig, err := Parse(msg)
+	if err != nil {
+		logger.WithField("error", err).
+			Errorf("dropping invalid trigger: %s", msg)
+		return store.Run{}, err
+	}
+
+	// Tags aren't on any branch, so runs for tags are recorded against
+	// the tag name instead.
+	ref := trig.Branch
+	if ref == "" {
+		ref = trig.Tag
+	}
+
+	logger := logger.WithFields(logrus.Fields{
+		"remote":  trig.Remote,
+		"ref":     ref,
+		"commit":  trig.Commit,
+		"trigger": trig.Trigger,
+	})
+
+	// Pollers only watch tracked branches and webhooks are matched before
+	// they're turned into triggers, but the patterns may have changed
+	// since either of them looked.
+	p, err := st.GetProjectByRemote(trig.Remote)
+	if err != nil && err != store.ErrNotFound {
+		logger.WithField("error", err).Error("unable to get project")
+		return store.Run{}, err
+	}
+
+	tracked := p.Enabled
+	if trig.Branch != "" {
+		tracked = p.Tracks(trig.Branch)
+	}
+
+	if !tracked {
+		logger.Warn("dropping trigger for untracked ref")
+		return store.Run{}, ErrNotTracked
+	}
+
+	run, err := st.CreateRun(store.Run{
+		Remote:  trig.Remote,
+		Branch:  ref,
+		Commit:  trig.Commit,
+		Trigger: trig.Trigger,
+	})
+	if err != nil {
+		logger.WithField("error", err).Error("unable to save run")
+		return run, err
+	}
+
+	logger.WithField("run_id", run.ID).Info("queued run")
+	return run, nil
+}
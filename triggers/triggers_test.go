@@ -0,0 +1,94 @@
+package triggers
+
+import (
+	"testing"
+
+	"github.com/run-ci/run-server/queue"
+	"github.com/run-ci/run-server/store"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		msg     string
+		ok      bool
+		trigger string
+	}{
+		{`{"remote": "https://example.com/a.git", "branch": "master", "commit": "abc"}`, true, "poll"},
+		{`{"remote": "git@example.com:a.git", "tag": "v1", "commit": "abc", "trigger": "tag"}`, true, "tag"},
+		{`{"remote": "a.git", "commit": "abc"}`, false, ""},
+		{`{"remote": "a.git", "branch": "master", "commit": "abc"}`, false, ""},
+		{`{"branch": "master", "commit": "abc"}`, false, ""},
+		{`{"remote": "a.git", "branch": "master"}`, false, ""},
+		{`not json`, false, ""},
+	}
+
+	for _, test := range tests {
+		trig, err := Parse([]byte(test.msg))
+		if test.ok && err != nil {
+			t.Fatalf("expected %s to parse, got %v", test.msg, err)
+		}
+		if !test.ok && err == nil {
+			t.Fatalf("expected error parsing %s", test.msg)
+		}
+
+		if test.ok && trig.Trigger != test.trigger {
+			t.Fatalf("expected trigger %v, got %v", test.trigger, trig.Trigger)
+		}
+	}
+}
+
+func TestConsume(t *testing.T) {
+	bus := queue.NewMemory()
+	st := store.NewMemory()
+
+	_, err := st.CreateProject(store.Project{
+		Name:     "a",
+		Remote:   "example.com/a",
+		Branches: []string{"master", "!release/*"},
+		Enabled:  true,
+	})
+	if err != nil {
+		t.Fatalf("got error creating project: %v", err)
+	}
+
+	recv, err := bus.QueueSubscribe(queue.SubjectTriggers, Group)
+	if err != nil {
+		t.Fatalf("got error subscribing: %v", err)
+	}
+
+	msgs := []string{
+		`{"remote": "https://example.com/a.git", "branch": "master", "commit": "abc"}`,
+		`invalid`,
+		`{"remote": "https://example.com/a.git", "branch": "develop", "commit": "ghi"}`,
+		`{"remote": "https://example.com/b.git", "branch": "master", "commit": "jkl"}`,
+		`{"remote": "git@example.com:a.git", "tag": "v1.0.0", "commit": "def", "trigger": "tag"}`,
+	}
+	for _, msg := range msgs {
+		if err := bus.Publish(queue.SubjectTriggers, []byte(msg)); err != nil {
+			t.Fatalf("got error publishing: %v", err)
+		}
+	}
+
+	// Closing the bus closes `recv`, which lets Consume return once it's
+	// gone through everything already published.
+	bus.Close()
+	Consume(recv, st)
+
+	// Both spellings of the remote are recorded against its canonical form.
+	runs, err := st.GetRuns("example.com/a", "")
+	if err != nil {
+		t.Fatalf("got error listing runs: %v", err)
+	}
+
+	if len(runs) != 2 {
+		t.Fatalf("expected 2 runs, got %v", len(runs))
+	}
+
+	if runs[0].Branch != "v1.0.0" || runs[0].Trigger != "tag" {
+		t.Fatalf("expected tag run for v1.0.0, got %v", runs[0])
+	}
+
+	if runs[1].Branch != "master" || runs[1].Commit != "abc" || runs[1].Trigger != "poll" {
+		t.Fatalf("expected polled run for master, got %v", runs[1])
+	}
+}